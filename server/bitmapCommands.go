@@ -0,0 +1,658 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Bitmap command handlers. Bitmaps are plain string values addressed bit by bit:
+// bit 0 is the most significant bit of the first byte, as in Redis.
+// Writes keep the expiration of an existing key.
+
+var (
+	ErrBitOffset = errors.New("bit offset is not an integer or out of range")
+	ErrBitValue  = errors.New("bit is not an integer or out of range")
+)
+
+// BITMAP_MAX_BITS bounds bit offsets so a bitmap never exceeds STRING_MAX_SIZE.
+const BITMAP_MAX_BITS = STRING_MAX_SIZE * 8
+
+// parseBitOffset parses a bit offset. When hashAllowed is set, the "#N" form
+// (BITFIELD) is accepted and multiplied by width.
+func parseBitOffset(s string, hashAllowed bool, width int) (uint64, error) {
+	mul := uint64(1)
+	if hashAllowed && strings.HasPrefix(s, "#") {
+		s = s[1:]
+		mul = uint64(width)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > BITMAP_MAX_BITS || uint64(n)*mul+uint64(width) > BITMAP_MAX_BITS {
+		return 0, ErrBitOffset
+	}
+	return uint64(n) * mul, nil
+}
+
+// getBit returns the bit at offset, treating bytes past the end as zero.
+// It reads strings in place, so that single-bit reads do not copy the value.
+func getBit[T ~string | ~[]byte](buf T, offset uint64) byte {
+	byteIdx := offset >> 3
+	if byteIdx >= uint64(len(buf)) {
+		return 0
+	}
+	return (buf[byteIdx] >> (7 - offset&7)) & 1
+}
+
+// growBitmap extends buf with zero bytes so that bit (offset+width-1) is addressable.
+func growBitmap(buf []byte, offset uint64, width int) []byte {
+	need := int((offset + uint64(width) + 7) >> 3)
+	if need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	return buf
+}
+
+// setBit writes bit at offset; buf must already be large enough.
+func setBit(buf []byte, offset uint64, bit byte) {
+	byteIdx := offset >> 3
+	mask := byte(1) << (7 - offset&7)
+	if bit != 0 {
+		buf[byteIdx] |= mask
+	} else {
+		buf[byteIdx] &^= mask
+	}
+}
+
+// setBitString returns str with the bit at offset set to bit, padded with
+// zero bytes when str is too short. str is copied once, into the result.
+func setBitString(str string, offset uint64, bit byte) string {
+	byteIdx := int(offset >> 3)
+	var b strings.Builder
+	b.Grow(max(len(str), byteIdx+1))
+
+	cur := byte(0)
+	if byteIdx < len(str) {
+		b.WriteString(str[:byteIdx])
+		cur = str[byteIdx]
+	} else {
+		b.WriteString(str)
+		var zeros [512]byte
+		for pad := byteIdx - len(str); pad > 0; pad -= min(pad, len(zeros)) {
+			b.Write(zeros[:min(pad, len(zeros))])
+		}
+	}
+	mask := byte(1) << (7 - offset&7)
+	if bit != 0 {
+		cur |= mask
+	} else {
+		cur &^= mask
+	}
+	b.WriteByte(cur)
+	if byteIdx < len(str) {
+		b.WriteString(str[byteIdx+1:])
+	}
+	return b.String()
+}
+
+// onesCount returns the number of set bits in s.
+func onesCount(s string) int {
+	count := 0
+	for i := 0; i < len(s); i++ {
+		count += bits.OnesCount8(s[i])
+	}
+	return count
+}
+
+// SETBIT key offset value
+func SETBIT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("setbit")
+	}
+	key := argv[0]
+	offset, err := parseBitOffset(argv[1], false, 1)
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if argv[2] != "0" && argv[2] != "1" {
+		return "NOT_OK", ErrBitValue
+	}
+	bit := argv[2][0] - '0'
+
+	var old byte
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		old = getBit(str, offset)
+		if old == bit && offset>>3 < uint64(len(str)) {
+			// Nothing changes: do not copy the value.
+			return nil
+		}
+		storeStringLocked(data, key, setBitString(str, offset, bit))
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(old)), nil
+}
+
+// GETBIT key offset
+func GETBIT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("getbit")
+	}
+	offset, err := parseBitOffset(argv[1], false, 1)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var bit byte
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, argv[0])
+		bit = getBit(str, offset)
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(bit)), nil
+}
+
+// normalizeBitRange resolves negative start/end offsets against length and
+// clamps them. ok is false when the resulting range is empty.
+func normalizeBitRange(start, end, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return start, end, length > 0 && start <= end
+}
+
+// parseBitRangeUnit parses the optional BYTE|BIT argument.
+func parseBitRangeUnit(argv []string, i int) (bool, error) {
+	if i >= len(argv) {
+		return false, nil
+	}
+	if i != len(argv)-1 {
+		return false, ErrSyntax
+	}
+	switch strings.ToUpper(argv[i]) {
+	case "BYTE":
+		return false, nil
+	case "BIT":
+		return true, nil
+	}
+	return false, ErrSyntax
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func BITCOUNT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 3 && len(argv) != 4 {
+		if len(argv) == 2 {
+			return "NOT_OK", ErrSyntax
+		}
+		return "NOT_OK", errWrongArgs("bitcount")
+	}
+
+	var start, end int64
+	isBit := false
+	if len(argv) > 1 {
+		if start, err = parseIntArg(argv[1]); err != nil {
+			return "NOT_OK", err
+		}
+		if end, err = parseIntArg(argv[2]); err != nil {
+			return "NOT_OK", err
+		}
+		if isBit, err = parseBitRangeUnit(argv, 3); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var count int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if len(argv) == 1 {
+			count = onesCount(str)
+			return nil
+		}
+
+		length := int64(len(str))
+		if isBit {
+			length *= 8
+		}
+		s, e, ok := normalizeBitRange(start, end, length)
+		if !ok {
+			return nil
+		}
+		if isBit {
+			for off := s; off <= e; off++ {
+				count += int(getBit(str, uint64(off)))
+			}
+			return nil
+		}
+		count = onesCount(str[s : e+1])
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(count)), nil
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+// When searching for a clear bit without an explicit end, the string is
+// considered padded with zeros on the right.
+func BITPOS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 || len(argv) > 5 {
+		return "NOT_OK", errWrongArgs("bitpos")
+	}
+	if argv[1] != "0" && argv[1] != "1" {
+		return "NOT_OK", errors.New("The bit argument must be 1 or 0.")
+	}
+	bit := argv[1][0] - '0'
+
+	var start int64
+	end := int64(-1)
+	endGiven, isBit := len(argv) > 3, false
+	if len(argv) > 2 {
+		if start, err = parseIntArg(argv[2]); err != nil {
+			return "NOT_OK", err
+		}
+	}
+	if endGiven {
+		if end, err = parseIntArg(argv[3]); err != nil {
+			return "NOT_OK", err
+		}
+		if isBit, err = parseBitRangeUnit(argv, 4); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var pos int64 = -1
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if !found {
+			if bit == 0 {
+				pos = 0
+			}
+			return nil
+		}
+		length := int64(len(str))
+		if isBit {
+			length *= 8
+		}
+		s, e, ok := normalizeBitRange(start, end, length)
+		if !ok {
+			return nil
+		}
+		// Work in bits from here on.
+		if !isBit {
+			s, e = s*8, e*8+7
+		}
+
+		// Skip whole bytes that cannot contain the bit we look for.
+		skip := byte(0x00)
+		if bit == 0 {
+			skip = 0xff
+		}
+		for off := s; off <= e; {
+			if off&7 == 0 && off+7 <= e && str[off>>3] == skip {
+				off += 8
+				continue
+			}
+			if getBit(str, uint64(off)) == bit {
+				pos = off
+				return nil
+			}
+			off++
+		}
+
+		if bit == 0 && !endGiven {
+			pos = e + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(pos), nil
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+// Missing keys are treated as zero-filled strings; the result is as long as the
+// longest input and replaces destkey (dropping any expiration).
+func BITOP(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("bitop")
+	}
+	op, dest, keys := strings.ToUpper(argv[0]), argv[1], argv[2:]
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return "NOT_OK", errors.New("BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return "NOT_OK", ErrSyntax
+	}
+
+	var length int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		srcs := make([]string, len(keys))
+		for i, key := range keys {
+			str, _, err := lookupString(data, key)
+			if err != nil {
+				return err
+			}
+			srcs[i] = str
+			length = max(length, len(str))
+		}
+
+		res := make([]byte, length)
+		for i := range res {
+			// byteAt pads shorter inputs with zeros.
+			byteAt := func(s string) byte {
+				if i < len(s) {
+					return s[i]
+				}
+				return 0
+			}
+			acc := byteAt(srcs[0])
+			for _, src := range srcs[1:] {
+				switch op {
+				case "AND":
+					acc &= byteAt(src)
+				case "OR":
+					acc |= byteAt(src)
+				case "XOR":
+					acc ^= byteAt(src)
+				}
+			}
+			if op == "NOT" {
+				acc = ^acc
+			}
+			res[i] = acc
+		}
+
+		deleteKeyLocked(data, dest)
+		if length > 0 {
+			storeStringLocked(data, dest, string(res))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(length)), nil
+}
+
+// bitfieldType is a BITFIELD integer type such as i8 or u16.
+type bitfieldType struct {
+	signed bool
+	width  int
+}
+
+func parseBitfieldType(s string) (bitfieldType, error) {
+	errType := errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return bitfieldType{}, errType
+	}
+	t := bitfieldType{signed: s[0] == 'i' || s[0] == 'I'}
+	width, err := strconv.Atoi(s[1:])
+	if err != nil || width < 1 || (t.signed && width > 64) || (!t.signed && width > 63) {
+		return bitfieldType{}, errType
+	}
+	t.width = width
+	return t, nil
+}
+
+// bounds returns the smallest and greatest value representable by t.
+func (t bitfieldType) bounds() (int64, int64) {
+	if t.signed {
+		if t.width == 64 {
+			return math.MinInt64, math.MaxInt64
+		}
+		return -(int64(1) << (t.width - 1)), int64(1)<<(t.width-1) - 1
+	}
+	return 0, int64(1)<<t.width - 1
+}
+
+// wrap truncates v to the width of t, sign-extending for signed types.
+func (t bitfieldType) wrap(v uint64) int64 {
+	if t.width == 64 {
+		return int64(v)
+	}
+	v &= uint64(1)<<t.width - 1
+	if t.signed && v&(uint64(1)<<(t.width-1)) != 0 {
+		v |= ^uint64(0) << t.width
+	}
+	return int64(v)
+}
+
+func getBitfield(buf []byte, offset uint64, t bitfieldType) int64 {
+	var v uint64
+	for i := 0; i < t.width; i++ {
+		v = v<<1 | uint64(getBit(buf, offset+uint64(i)))
+	}
+	return t.wrap(v)
+}
+
+// setBitfield writes v (already in range); buf must be large enough.
+func setBitfield(buf []byte, offset uint64, t bitfieldType, v int64) {
+	u := uint64(v)
+	for i := 0; i < t.width; i++ {
+		setBit(buf, offset+uint64(i), byte(u>>(t.width-1-i))&1)
+	}
+}
+
+// applyOverflow computes old+incr (or just incr when set is true) for t using
+// the given overflow policy. ok is false when the policy is FAIL and the
+// operation overflows.
+func (t bitfieldType) applyOverflow(old, incr int64, set bool, policy string) (int64, bool) {
+	minV, maxV := t.bounds()
+
+	var overflow, underflow bool
+	if set {
+		overflow, underflow = incr > maxV, incr < minV
+	} else {
+		overflow = incr > 0 && old > maxV-incr
+		// minV-incr cannot be computed for unsigned types when incr is MinInt64,
+		// but such an increment always underflows them.
+		underflow = incr < 0 && ((!t.signed && incr == math.MinInt64) || old < minV-incr)
+	}
+	if !overflow && !underflow {
+		if set {
+			return incr, true
+		}
+		return old + incr, true
+	}
+
+	switch policy {
+	case "SAT":
+		if overflow {
+			return maxV, true
+		}
+		return minV, true
+	case "FAIL":
+		return 0, false
+	default: // WRAP: arithmetic modulo 2^width
+		if set {
+			return t.wrap(uint64(incr)), true
+		}
+		return t.wrap(uint64(old) + uint64(incr)), true
+	}
+}
+
+// bitfieldOp is one GET/SET/INCRBY operation of a BITFIELD call.
+type bitfieldOp struct {
+	kind     string // GET, SET or INCRBY
+	t        bitfieldType
+	offset   uint64
+	value    int64
+	overflow string // policy in force for this operation
+}
+
+// parseBitfieldOps parses the operations of BITFIELD; readOnly only allows GET.
+func parseBitfieldOps(argv []string, readOnly bool) ([]bitfieldOp, error) {
+	var ops []bitfieldOp
+	overflow := "WRAP"
+	for i := 0; i < len(argv); i++ {
+		kind := strings.ToUpper(argv[i])
+		switch {
+		case kind == "OVERFLOW" && !readOnly && i+1 < len(argv):
+			overflow = strings.ToUpper(argv[i+1])
+			if overflow != "WRAP" && overflow != "SAT" && overflow != "FAIL" {
+				return nil, errors.New("Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		case kind == "GET" && i+2 < len(argv):
+		case (kind == "SET" || kind == "INCRBY") && !readOnly && i+3 < len(argv):
+		default:
+			if readOnly && (kind == "SET" || kind == "INCRBY" || kind == "OVERFLOW") {
+				return nil, errors.New("BITFIELD_RO only supports the GET subcommand")
+			}
+			return nil, ErrSyntax
+		}
+
+		op := bitfieldOp{kind: kind, overflow: overflow}
+		var err error
+		if op.t, err = parseBitfieldType(argv[i+1]); err != nil {
+			return nil, err
+		}
+		if op.offset, err = parseBitOffset(argv[i+2], true, op.t.width); err != nil {
+			return nil, err
+		}
+		i += 2
+		if kind != "GET" {
+			if op.value, err = parseIntArg(argv[i+1]); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// runBitfieldOps executes ops against buf and returns the reply items and the
+// (possibly grown) buffer.
+func runBitfieldOps(buf []byte, ops []bitfieldOp) ([]string, []byte) {
+	items := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if op.kind == "GET" {
+			items = append(items, intReply(getBitfield(buf, op.offset, op.t)))
+			continue
+		}
+
+		buf = growBitmap(buf, op.offset, op.t.width)
+		old := getBitfield(buf, op.offset, op.t)
+		newV, ok := op.t.applyOverflow(old, op.value, op.kind == "SET", op.overflow)
+		if !ok {
+			items = append(items, NIL_REPLY)
+			continue
+		}
+		setBitfield(buf, op.offset, op.t, newV)
+		if op.kind == "SET" {
+			items = append(items, intReply(old))
+		} else {
+			items = append(items, intReply(newV))
+		}
+	}
+	return items, buf
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment]
+// [OVERFLOW WRAP|SAT|FAIL] ...
+func BITFIELD(args string) (string, error) {
+	return bitfieldGeneric(args, "bitfield", false)
+}
+
+// BITFIELD_RO key [GET type offset ...]
+func BITFIELD_RO(args string) (string, error) {
+	return bitfieldGeneric(args, "bitfield_ro", true)
+}
+
+func bitfieldGeneric(args string, cmd string, readOnly bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	key := argv[0]
+	ops, err := parseBitfieldOps(argv[1:], readOnly)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	writes := false
+	for _, op := range ops {
+		writes = writes || op.kind != "GET"
+	}
+
+	var items []string
+	run := func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		var buf []byte
+		items, buf = runBitfieldOps([]byte(str), ops)
+		if writes && len(buf) > 0 {
+			storeStringLocked(data, key, string(buf))
+		}
+		return nil
+	}
+	if writes {
+		err = keyDataSpace.Update(run)
+	} else {
+		err = keyDataSpace.View(run)
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KeyReadyNotifier lets blocking commands (e.g. BZPOPMIN) sleep until one of
+// the keys they are waiting on receives new data, instead of polling the keyspace.
+//
+// A waiter subscribes a channel on a set of keys, re-checks the keyspace and then
+// waits on the channel. Writers call Signal after releasing the keyspace lock.
+// The channel is buffered, so a signal sent between the check and the wait is not lost.
+type KeyReadyNotifier struct {
+	waiters map[string]map[chan struct{}]struct{} // key -> set of waiting channels
+	mu      sync.Mutex
+}
+
+var keyReadyNotifier = NewKeyReadyNotifier()
+
+// NewKeyReadyNotifier creates an empty notifier.
+func NewKeyReadyNotifier() *KeyReadyNotifier {
+	return &KeyReadyNotifier{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// Subscribe registers a new channel on all the given keys and returns it.
+func (n *KeyReadyNotifier) Subscribe(keys []string) chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		set, ok := n.waiters[key]
+		if !ok {
+			set = make(map[chan struct{}]struct{})
+			n.waiters[key] = set
+		}
+		set[ch] = struct{}{}
+	}
+	return ch
+}
+
+// Unsubscribe removes a channel previously returned by Subscribe.
+func (n *KeyReadyNotifier) Unsubscribe(keys []string, ch chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, key := range keys {
+		if set, ok := n.waiters[key]; ok {
+			delete(set, ch)
+			if len(set) == 0 {
+				delete(n.waiters, key)
+			}
+		}
+	}
+}
+
+// Signal wakes up every waiter subscribed on key. It never blocks.
+func (n *KeyReadyNotifier) Signal(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A wake-up is already pending for this waiter.
+		}
+	}
+}
+
+// blockUntilReady repeatedly calls try until it reports done, sleeping on the
+// notifier between attempts. A zero timeout blocks forever.
+// Returns ok=false when the timeout elapses before try succeeds.
+func blockUntilReady(keys []string, timeout time.Duration, try func() (string, bool, error)) (string, bool, error) {
+	ch := keyReadyNotifier.Subscribe(keys)
+	defer keyReadyNotifier.Unsubscribe(keys, ch)
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		res, done, err := try()
+		if err != nil || done {
+			return res, done, err
+		}
+		select {
+		case <-ch:
+			// Some key changed: try again.
+		case <-deadline:
+			return "", false, nil
+		}
+	}
+}
+
+// parseTimeoutArg parses the timeout of a blocking command, expressed in
+// (possibly fractional) seconds. Zero means "block forever".
+func parseTimeoutArg(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, errors.New("timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, errors.New("timeout is negative")
+	}
+	// Larger timeouts do not fit a time.Duration.
+	if secs >= math.MaxInt64/float64(time.Second) {
+		return 0, errors.New("timeout is out of range")
+	}
+	timeout := time.Duration(secs * float64(time.Second))
+	if timeout == 0 && secs > 0 {
+		// Below one nanosecond: still a timeout, not "block forever".
+		timeout = 1
+	}
+	return timeout, nil
+}
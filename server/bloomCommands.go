@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bloom filter command handlers. Filters are *BloomFilter values (see bloomFilter.go).
+
+// lookupBloom returns the filter stored at key, nil if the key does not exist,
+// or ErrWrongType if the key holds another kind of value.
+func lookupBloom(data map[string]DataValue, key string) (*BloomFilter, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	bf, ok := value.(*BloomFilter)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return bf, nil
+}
+
+// BF.RESERVE key error_rate capacity [EXPANSION expansion] [NONSCALING]
+func BF_RESERVE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("bf.reserve")
+	}
+	key := argv[0]
+
+	errorRate, err := parseFloatArg(argv[1])
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return "NOT_OK", errors.New("(0 < error rate range < 1)")
+	}
+	capacity, err := parseIntArg(argv[2])
+	if err != nil || capacity <= 0 {
+		return "NOT_OK", errors.New("(capacity should be larger than 0)")
+	}
+
+	expansion := int64(BF_DEFAULT_EXPANSION)
+	nonScaling := false
+	for i := 3; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "EXPANSION":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			if expansion, err = parseIntArg(argv[i+1]); err != nil || expansion < 1 || expansion > 1<<16 {
+				return "NOT_OK", errors.New("bad expansion")
+			}
+			i++
+		case "NONSCALING":
+			nonScaling = true
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := data[key]; exists {
+			return errors.New("item exists")
+		}
+		bf, err := NewBloomFilter(errorRate, uint64(capacity), uint32(expansion), nonScaling)
+		if err != nil {
+			return err
+		}
+		data[key] = bf
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// bfAddLocked adds items to the filter at key, creating it with the default
+// parameters when missing. For each item it reports whether it was added, or
+// why it could not be.
+func bfAddLocked(data map[string]DataValue, key string, items []string) ([]bool, []error, error) {
+	bf, err := lookupBloom(data, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bf == nil {
+		if bf, err = NewBloomFilter(BF_DEFAULT_ERROR_RATE, BF_DEFAULT_CAPACITY, BF_DEFAULT_EXPANSION, false); err != nil {
+			return nil, nil, err
+		}
+		data[key] = bf
+	}
+	added := make([]bool, len(items))
+	errs := make([]error, len(items))
+	for i, item := range items {
+		added[i], errs[i] = bf.Add(item)
+	}
+	return added, errs, nil
+}
+
+// BF.ADD key item
+// Returns 1 if the item was added, 0 if it may already exist.
+func BF_ADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("bf.add")
+	}
+
+	var added []bool
+	var errs []error
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		added, errs, err = bfAddLocked(data, argv[0], argv[1:])
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if errs[0] != nil {
+		return "NOT_OK", errs[0]
+	}
+	if added[0] {
+		return "1", nil
+	}
+	return "0", nil
+}
+
+// BF.MADD key item [item ...]
+// Items that do not fit in a full NONSCALING filter are reported as errors
+// inside the reply array.
+func BF_MADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("bf.madd")
+	}
+
+	var added []bool
+	var errs []error
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		added, errs, err = bfAddLocked(data, argv[0], argv[1:])
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	items := make([]string, len(added))
+	for i := range added {
+		switch {
+		case errs[i] != nil:
+			items[i] = "ERR: " + errs[i].Error()
+		case added[i]:
+			items[i] = "1"
+		default:
+			items[i] = "0"
+		}
+	}
+	return arrayReply(items), nil
+}
+
+// bfExistsGeneric returns 1/0 for each item; a missing key contains nothing.
+func bfExistsGeneric(key string, items []string) ([]string, error) {
+	results := make([]string, len(items))
+	err := keyDataSpace.View(func(data map[string]DataValue) error {
+		bf, err := lookupBloom(data, key)
+		if err != nil {
+			return err
+		}
+		for i, item := range items {
+			results[i] = "0"
+			if bf != nil && bf.Exists(item) {
+				results[i] = "1"
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// BF.EXISTS key item
+func BF_EXISTS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("bf.exists")
+	}
+	results, err := bfExistsGeneric(argv[0], argv[1:])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return results[0], nil
+}
+
+// BF.MEXISTS key item [item ...]
+func BF_MEXISTS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("bf.mexists")
+	}
+	results, err := bfExistsGeneric(argv[0], argv[1:])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(results), nil
+}
+
+// BF.INFO key [CAPACITY|SIZE|FILTERS|ITEMS|EXPANSION]
+func BF_INFO(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("bf.info")
+	}
+
+	var result string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		bf, err := lookupBloom(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if bf == nil {
+			return errors.New("not found")
+		}
+
+		expansion := intReply(int64(bf.expansion))
+		if bf.nonScaling {
+			expansion = NIL_REPLY
+		}
+		fields := []struct {
+			option, name, value string
+		}{
+			{"CAPACITY", "Capacity", intReply(int64(bf.Capacity()))},
+			{"SIZE", "Size", intReply(int64(bf.Size()))},
+			{"FILTERS", "Number of filters", intReply(int64(len(bf.links)))},
+			{"ITEMS", "Number of items inserted", intReply(int64(bf.Items()))},
+			{"EXPANSION", "Expansion rate", expansion},
+		}
+
+		if len(argv) == 2 {
+			for _, f := range fields {
+				if strings.ToUpper(argv[1]) == f.option {
+					result = f.value
+					return nil
+				}
+			}
+			return errors.New("invalid information value")
+		}
+		items := make([]string, 0, 2*len(fields))
+		for _, f := range fields {
+			items = append(items, f.name, f.value)
+		}
+		result = arrayReply(items)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
@@ -0,0 +1,209 @@
+// File: bloomFilter.go
+//
+// Purpose:
+//   Scalable Bloom filter value type for the BF.* commands, modelled after
+//   RedisBloom.
+//
+//   A filter is a chain of sub-filters. Items are always added to the last
+//   one; when it reaches its capacity a new sub-filter is appended, with a
+//   capacity EXPANSION times larger and an error rate halved (tightening
+//   ratio 0.5), so that the compound error rate stays below the requested one.
+//   A NONSCALING filter refuses new items once full instead.
+//
+//   Each sub-filter sizes itself for its capacity n and error rate p:
+//     bits   m = n * -ln(p) / ln(2)^2
+//     hashes k = ceil(ln(2) * m / n)
+//   Bit positions come from double hashing of two 64-bit MurmurHash64A
+//   values: h_i = h1 + i*h2 (mod m).
+//   A sub-filter may not exceed BF_MAX_BITS: creating or scaling a filter
+//   past it fails with ErrBloomTooLarge instead of allocating.
+//
+// Asymptotic costs:
+//   - Add / Exists: O(k * number of sub-filters)
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; filters live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	BF_DEFAULT_ERROR_RATE = 0.01
+	BF_DEFAULT_CAPACITY   = 100
+	BF_DEFAULT_EXPANSION  = 2
+	BF_TIGHTENING_RATIO   = 0.5
+	BF_HASH_SEED          = 0xc6a4a7935bd1e995
+	BF_MAX_BITS           = 1 << 32 // per sub-filter: 512 MiB
+)
+
+var (
+	ErrBloomFull     = errors.New("non scaling filter is full")
+	ErrBloomTooLarge = errors.New("filter too large: reduce the capacity or increase the error rate")
+)
+
+// bloomMaxHashes is the number of hashes of a sub-filter with the smallest
+// positive error rate, an upper bound for valid filters.
+var bloomMaxHashes = uint32(math.Ceil(-math.Log(math.SmallestNonzeroFloat64) / math.Ln2))
+
+// bloomLink is a single, fixed size sub-filter.
+type bloomLink struct {
+	capacity  uint64
+	errorRate float64
+	hashes    uint32
+	items     uint64
+	bits      []byte
+}
+
+// newBloomLink sizes a sub-filter, failing with ErrBloomTooLarge when it
+// would need more than BF_MAX_BITS.
+func newBloomLink(capacity uint64, errorRate float64) (*bloomLink, error) {
+	bpe := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	// Computed in floating point: capacity * bpe may overflow uint64.
+	bits := math.Ceil(float64(capacity) * bpe)
+	if !(bits <= BF_MAX_BITS) {
+		return nil, ErrBloomTooLarge
+	}
+	nbits := max(uint64(bits), 8)
+	return &bloomLink{
+		capacity:  capacity,
+		errorRate: errorRate,
+		hashes:    uint32(math.Ceil(math.Ln2 * bpe)),
+		bits:      make([]byte, (nbits+7)/8),
+	}, nil
+}
+
+// validBloomLink reports whether a decoded sub-filter is consistent enough
+// to be used: its bits and hashes are bounded like those of newBloomLink.
+func validBloomLink(l *bloomLink) bool {
+	return l.capacity > 0 && l.errorRate > 0 && l.errorRate < 1 &&
+		l.hashes > 0 && l.hashes <= bloomMaxHashes &&
+		len(l.bits) > 0 && uint64(len(l.bits)) <= BF_MAX_BITS/8
+}
+
+// bloomHashes returns the two base hashes of item.
+func bloomHashes(item string) (uint64, uint64) {
+	h1 := murmurHash64A([]byte(item), BF_HASH_SEED)
+	h2 := murmurHash64A([]byte(item), h1)
+	return h1, h2
+}
+
+func (l *bloomLink) has(h1, h2 uint64) bool {
+	nbits := uint64(len(l.bits)) * 8
+	for i := uint64(0); i < uint64(l.hashes); i++ {
+		pos := (h1 + i*h2) % nbits
+		if l.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLink) add(h1, h2 uint64) {
+	nbits := uint64(len(l.bits)) * 8
+	for i := uint64(0); i < uint64(l.hashes); i++ {
+		pos := (h1 + i*h2) % nbits
+		l.bits[pos/8] |= 1 << (pos % 8)
+	}
+	l.items++
+}
+
+// BloomFilter is the scalable Bloom filter value type.
+type BloomFilter struct {
+	expansion  uint32
+	nonScaling bool
+	links      []*bloomLink
+}
+
+// NewBloomFilter creates a filter with a single sub-filter.
+func NewBloomFilter(errorRate float64, capacity uint64, expansion uint32, nonScaling bool) (*BloomFilter, error) {
+	link, err := newBloomLink(capacity, errorRate)
+	if err != nil {
+		return nil, err
+	}
+	return &BloomFilter{
+		expansion:  expansion,
+		nonScaling: nonScaling,
+		links:      []*bloomLink{link},
+	}, nil
+}
+
+func (bf *BloomFilter) Type() ValueType { return BLOOM_VALUE }
+
+func (bf *BloomFilter) DeepCopy() DataValue {
+	clone := &BloomFilter{expansion: bf.expansion, nonScaling: bf.nonScaling}
+	for _, l := range bf.links {
+		cp := *l
+		cp.bits = append([]byte(nil), l.bits...)
+		clone.links = append(clone.links, &cp)
+	}
+	return clone
+}
+
+// Exists reports whether item may have been added.
+func (bf *BloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHashes(item)
+	// Newer sub-filters hold the most items: check them first.
+	for i := len(bf.links) - 1; i >= 0; i-- {
+		if bf.links[i].has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add inserts item. Returns false if it may already be present.
+func (bf *BloomFilter) Add(item string) (bool, error) {
+	if bf.Exists(item) {
+		return false, nil
+	}
+	last := bf.links[len(bf.links)-1]
+	if last.items >= last.capacity {
+		if bf.nonScaling {
+			return false, ErrBloomFull
+		}
+		if last.capacity > math.MaxUint64/uint64(bf.expansion) {
+			return false, ErrBloomTooLarge
+		}
+		next, err := newBloomLink(last.capacity*uint64(bf.expansion), last.errorRate*BF_TIGHTENING_RATIO)
+		if err != nil {
+			return false, err
+		}
+		bf.links = append(bf.links, next)
+		last = next
+	}
+	h1, h2 := bloomHashes(item)
+	last.add(h1, h2)
+	return true, nil
+}
+
+// Capacity returns the total capacity of the sub-filters.
+func (bf *BloomFilter) Capacity() uint64 {
+	var total uint64
+	for _, l := range bf.links {
+		total += l.capacity
+	}
+	return total
+}
+
+// Items returns the number of items added.
+func (bf *BloomFilter) Items() uint64 {
+	var total uint64
+	for _, l := range bf.links {
+		total += l.items
+	}
+	return total
+}
+
+// Size returns the bytes used by the bit arrays.
+func (bf *BloomFilter) Size() uint64 {
+	var total uint64
+	for _, l := range bf.links {
+		total += uint64(len(l.bits))
+	}
+	return total
+}
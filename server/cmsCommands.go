@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Count-min sketch command handlers. Sketches are *CountMinSketch values
+// (see countMinSketch.go).
+
+// lookupCMS returns the sketch stored at key, nil if the key does not exist,
+// or ErrWrongType if the key holds another kind of value.
+func lookupCMS(data map[string]DataValue, key string) (*CountMinSketch, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	cms, ok := value.(*CountMinSketch)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return cms, nil
+}
+
+// cmsCreate stores a new sketch at key, failing if the key exists.
+func cmsCreate(key string, width, depth uint32) (string, error) {
+	err := keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := data[key]; exists {
+			return errors.New("CMS: key already exists")
+		}
+		data[key] = NewCountMinSketch(width, depth)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// CMS.INITBYDIM key width depth
+func CMS_INITBYDIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("cms.initbydim")
+	}
+	width, err := parseIntArg(argv[1])
+	if err != nil || width < 1 || width > CMS_MAX_COUNTERS {
+		return "NOT_OK", errors.New("CMS: invalid width")
+	}
+	depth, err := parseIntArg(argv[2])
+	if err != nil || !cmsValidDims(uint64(width), uint64(max(depth, 0))) {
+		return "NOT_OK", errors.New("CMS: invalid depth")
+	}
+	return cmsCreate(argv[0], uint32(width), uint32(depth))
+}
+
+// CMS.INITBYPROB key error probability
+// error is the overestimate as a fraction of the total count, probability
+// the chance of exceeding it.
+func CMS_INITBYPROB(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("cms.initbyprob")
+	}
+	errorRate, err := parseFloatArg(argv[1])
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return "NOT_OK", errors.New("CMS: invalid overestimation value")
+	}
+	probability, err := parseFloatArg(argv[2])
+	if err != nil || probability <= 0 || probability >= 1 {
+		return "NOT_OK", errors.New("CMS: invalid prob value")
+	}
+	width, depth := cmsDimsByProb(errorRate, probability)
+	if !cmsValidDims(width, depth) {
+		return "NOT_OK", errors.New("CMS: invalid overestimation value")
+	}
+	return cmsCreate(argv[0], uint32(width), uint32(depth))
+}
+
+// CMS.INCRBY key item increment [item increment ...]
+// Returns the new estimated count of each item.
+func CMS_INCRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 || len(argv)%2 != 1 {
+		return "NOT_OK", errWrongArgs("cms.incrby")
+	}
+	key := argv[0]
+	pairs := argv[1:]
+
+	incrs := make([]uint32, len(pairs)/2)
+	for i := range incrs {
+		n, err := parseIntArg(pairs[2*i+1])
+		if err != nil || n < 0 || n > math.MaxUint32 {
+			return "NOT_OK", errors.New("CMS: Cannot parse number")
+		}
+		incrs[i] = uint32(n)
+	}
+
+	items := make([]string, len(incrs))
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		cms, err := lookupCMS(data, key)
+		if err != nil {
+			return err
+		}
+		if cms == nil {
+			return errors.New("CMS: key does not exist")
+		}
+		for i, incr := range incrs {
+			count, err := cms.IncrBy(pairs[2*i], incr)
+			if err != nil {
+				return err
+			}
+			items[i] = intReply(int64(count))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// CMS.QUERY key item [item ...]
+func CMS_QUERY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("cms.query")
+	}
+
+	items := make([]string, len(argv)-1)
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		cms, err := lookupCMS(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if cms == nil {
+			return errors.New("CMS: key does not exist")
+		}
+		for i, item := range argv[1:] {
+			items[i] = intReply(int64(cms.Query(item)))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// CMS.MERGE destination numkeys source [source ...] [WEIGHTS weight [weight ...]]
+// Overwrites destination, which must already exist with the same dimensions
+// as the sources, with their weighted sum.
+func CMS_MERGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("cms.merge")
+	}
+	dest := argv[0]
+	numKeys, err := parseIntArg(argv[1])
+	if err != nil || numKeys < 1 {
+		return "NOT_OK", errors.New("CMS: invalid numkeys")
+	}
+	if numKeys > int64(len(argv)-2) {
+		return "NOT_OK", errWrongArgs("cms.merge")
+	}
+	keys := argv[2 : 2+numKeys]
+
+	weights := make([]int64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if rest := argv[2+numKeys:]; len(rest) > 0 {
+		if strings.ToUpper(rest[0]) != "WEIGHTS" || len(rest)-1 != int(numKeys) {
+			return "NOT_OK", ErrSyntax
+		}
+		for i := range weights {
+			if weights[i], err = parseIntArg(rest[1+i]); err != nil {
+				return "NOT_OK", errors.New("CMS: invalid weight value")
+			}
+		}
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		target, err := lookupCMS(data, dest)
+		if err != nil {
+			return err
+		}
+		if target == nil {
+			return errors.New("CMS: key does not exist")
+		}
+		sources := make([]*CountMinSketch, len(keys))
+		for i, key := range keys {
+			if sources[i], err = lookupCMS(data, key); err != nil {
+				return err
+			}
+			if sources[i] == nil {
+				return errors.New("CMS: key does not exist")
+			}
+		}
+		return target.Merge(sources, weights)
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
@@ -10,6 +10,17 @@ import (
 
 type Handler func(args string) (string, error)
 
+var (
+	ErrSyntax     = errors.New("syntax error")
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrNotFloat   = errors.New("value is not a valid float")
+)
+
+// errWrongArgs is returned when a command receives the wrong number of arguments.
+func errWrongArgs(cmd string) error {
+	return errors.New("wrong number of arguments for '" + cmd + "' command")
+}
+
 var cmdHandlers = map[string]Handler{
 	"GET":    GET,
 	"SET":    SET,
@@ -18,6 +29,178 @@ var cmdHandlers = map[string]Handler{
 	"ESC":    ESC,
 	"PING":   PING,
 	"HELP":   HELP,
+
+	// Keyspace (see keyspaceCommands.go)
+	"KEYS":      KEYS,
+	"SCAN":      SCAN,
+	"ZSCAN":     ZSCAN,
+	"HSCAN":     HSCAN,
+	"SSCAN":     SSCAN,
+	"EXISTS":    EXISTS,
+	"TYPE":      TYPE,
+	"RENAME":    RENAME,
+	"RENAMENX":  RENAMENX,
+	"COPY":      COPY,
+	"TOUCH":     TOUCH,
+	"UNLINK":    UNLINK,
+	"DBSIZE":    DBSIZE,
+	"FLUSHDB":   FLUSHDB,
+	"FLUSHALL":  FLUSHALL,
+	"RANDOMKEY": RANDOMKEY,
+	"DUMP":      DUMP,
+	"RESTORE":   RESTORE,
+	"OBJECT":    OBJECT,
+
+	// Server (see config.go and memoryCommands.go)
+	"CONFIG": CONFIG,
+	"MEMORY": MEMORY,
+
+	// Sorting (see sortCommands.go)
+	"SORT":    SORT,
+	"SORT_RO": SORT_RO,
+
+	// Expiration (see expireCommands.go)
+	"EXPIRE":      EXPIRE,
+	"PEXPIRE":     PEXPIRE,
+	"EXPIREAT":    EXPIREAT,
+	"PEXPIREAT":   PEXPIREAT,
+	"TTL":         TTL,
+	"PTTL":        PTTL,
+	"EXPIRETIME":  EXPIRETIME,
+	"PEXPIRETIME": PEXPIRETIME,
+	"PERSIST":     PERSIST,
+
+	// Counters and string manipulation (see stringCommands.go)
+	"INCR":        INCR,
+	"DECR":        DECR,
+	"INCRBY":      INCRBY,
+	"DECRBY":      DECRBY,
+	"INCRBYFLOAT": INCRBYFLOAT,
+	"APPEND":      APPEND,
+	"STRLEN":      STRLEN,
+	"GETRANGE":    GETRANGE,
+	"SETRANGE":    SETRANGE,
+	"GETDEL":      GETDEL,
+	"GETSET":      GETSET,
+	"GETEX":       GETEX,
+	"LCS":         LCS,
+	"MGET":        MGET,
+	"MSET":        MSET,
+	"MSETNX":      MSETNX,
+
+	// Bitmaps (see bitmapCommands.go)
+	"SETBIT":      SETBIT,
+	"GETBIT":      GETBIT,
+	"BITCOUNT":    BITCOUNT,
+	"BITPOS":      BITPOS,
+	"BITOP":       BITOP,
+	"BITFIELD":    BITFIELD,
+	"BITFIELD_RO": BITFIELD_RO,
+
+	// HyperLogLog (see hllCommands.go)
+	"PFADD":   PFADD,
+	"PFCOUNT": PFCOUNT,
+	"PFMERGE": PFMERGE,
+
+	// Sorted sets (see zsetCommands.go)
+	"ZADD":        ZADD,
+	"ZREM":        ZREM,
+	"ZCARD":       ZCARD,
+	"ZSCORE":      ZSCORE,
+	"ZINCRBY":     ZINCRBY,
+	"ZRANK":       ZRANK,
+	"ZREVRANK":    ZREVRANK,
+	"ZRANGE":      ZRANGE,
+	"ZCOUNT":      ZCOUNT,
+	"ZPOPMIN":     ZPOPMIN,
+	"ZPOPMAX":     ZPOPMAX,
+	"BZPOPMIN":    BZPOPMIN,
+	"BZPOPMAX":    BZPOPMAX,
+	"ZUNIONSTORE": ZUNIONSTORE,
+	"ZINTERSTORE": ZINTERSTORE,
+
+	// Geospatial indexes (see geoCommands.go)
+	"GEOADD":         GEOADD,
+	"GEOPOS":         GEOPOS,
+	"GEODIST":        GEODIST,
+	"GEOHASH":        GEOHASH,
+	"GEOSEARCH":      GEOSEARCH,
+	"GEOSEARCHSTORE": GEOSEARCHSTORE,
+
+	// JSON documents (see jsonCommands.go)
+	"JSON.SET":       JSON_SET,
+	"JSON.GET":       JSON_GET,
+	"JSON.MGET":      JSON_MGET,
+	"JSON.DEL":       JSON_DEL,
+	"JSON.TYPE":      JSON_TYPE,
+	"JSON.NUMINCRBY": JSON_NUMINCRBY,
+	"JSON.ARRAPPEND": JSON_ARRAPPEND,
+	"JSON.ARRLEN":    JSON_ARRLEN,
+	"JSON.OBJKEYS":   JSON_OBJKEYS,
+
+	// Search indexes (see searchCommands.go)
+	"FT.CREATE":    FT_CREATE,
+	"FT.SEARCH":    FT_SEARCH,
+	"FT.DROPINDEX": FT_DROPINDEX,
+
+	// Bloom filters (see bloomCommands.go)
+	"BF.RESERVE": BF_RESERVE,
+	"BF.ADD":     BF_ADD,
+	"BF.MADD":    BF_MADD,
+	"BF.EXISTS":  BF_EXISTS,
+	"BF.MEXISTS": BF_MEXISTS,
+	"BF.INFO":    BF_INFO,
+
+	// Count-min sketches (see cmsCommands.go)
+	"CMS.INITBYDIM":  CMS_INITBYDIM,
+	"CMS.INITBYPROB": CMS_INITBYPROB,
+	"CMS.INCRBY":     CMS_INCRBY,
+	"CMS.QUERY":      CMS_QUERY,
+	"CMS.MERGE":      CMS_MERGE,
+
+	// Top-K (see topkCommands.go)
+	"TOPK.RESERVE": TOPK_RESERVE,
+	"TOPK.ADD":     TOPK_ADD,
+	"TOPK.INCRBY":  TOPK_INCRBY,
+	"TOPK.QUERY":   TOPK_QUERY,
+	"TOPK.LIST":    TOPK_LIST,
+
+	// Time series (see tsCommands.go)
+	"TS.CREATE":     TS_CREATE,
+	"TS.ADD":        TS_ADD,
+	"TS.MADD":       TS_MADD,
+	"TS.RANGE":      TS_RANGE,
+	"TS.REVRANGE":   TS_REVRANGE,
+	"TS.MRANGE":     TS_MRANGE,
+	"TS.CREATERULE": TS_CREATERULE,
+	"TS.DELETERULE": TS_DELETERULE,
+
+	// Vector sets (see vectorCommands.go)
+	"VADD":  VADD,
+	"VREM":  VREM,
+	"VSIM":  VSIM,
+	"VCARD": VCARD,
+	"VDIM":  VDIM,
+	"VEMB":  VEMB,
+
+	// Graphs (see graphCommands.go)
+	"GRAPH.QUERY":    GRAPH_QUERY,
+	"GRAPH.RO_QUERY": GRAPH_RO_QUERY,
+	"GRAPH.DELETE":   GRAPH_DELETE,
+
+	// Streams (see streamCommands.go)
+	"XADD":       XADD,
+	"XTRIM":      XTRIM,
+	"XLEN":       XLEN,
+	"XRANGE":     XRANGE,
+	"XREVRANGE":  XREVRANGE,
+	"XREAD":      XREAD,
+	"XGROUP":     XGROUP,
+	"XREADGROUP": XREADGROUP,
+	"XACK":       XACK,
+	"XPENDING":   XPENDING,
+	"XCLAIM":     XCLAIM,
+	"XAUTOCLAIM": XAUTOCLAIM,
 }
 
 func getConstantCommandsArray() []string {
@@ -43,11 +226,196 @@ func tryParseExecuteCommand(command_raw string) (string, error) {
 // Returns execution result (string) and error (=nil if no error)
 func executeCommand(cmd string, args string) (string, error) {
 
-	handler, ok := cmdHandlers[strings.ToUpper(cmd)]
+	name := strings.ToUpper(cmd)
+	handler, ok := cmdHandlers[name]
 	if !ok || handler == nil {
 		return "NOT_OK", errors.New("unknown command: " + cmd)
 	}
-	return handler(args)
+	if cmdDenyOOM[name] {
+		if err := performEvictions(); err != nil {
+			return "NOT_OK", err
+		}
+	}
+	res, err := handler(args)
+	trackCommandKeys(name, args)
+	return res, err
+}
+
+// cmdDenyOOM lists the commands that may grow the dataset: they make room
+// first when maxmemory is exceeded, and fail if they cannot (see evict.go).
+var cmdDenyOOM = map[string]bool{
+	"SET": true, "MSET": true, "MSETNX": true, "APPEND": true, "SETRANGE": true,
+	"INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
+	"GETSET": true, "COPY": true, "RESTORE": true, "SORT": true,
+	"SETBIT": true, "BITOP": true, "BITFIELD": true, "PFADD": true, "PFMERGE": true,
+	"ZADD": true, "ZINCRBY": true, "ZUNIONSTORE": true, "ZINTERSTORE": true,
+	"GEOADD": true, "GEOSEARCHSTORE": true,
+	"JSON.SET": true, "JSON.NUMINCRBY": true, "JSON.ARRAPPEND": true, "FT.CREATE": true,
+	"BF.RESERVE": true, "BF.ADD": true, "BF.MADD": true,
+	"CMS.INITBYDIM": true, "CMS.INITBYPROB": true, "CMS.INCRBY": true, "CMS.MERGE": true,
+	"TOPK.RESERVE": true, "TOPK.ADD": true, "TOPK.INCRBY": true,
+	"TS.CREATE": true, "TS.ADD": true, "TS.MADD": true, "TS.CREATERULE": true,
+	"VADD": true, "GRAPH.QUERY": true,
+	"XADD": true, "XGROUP": true,
+}
+
+// keySpec tells which arguments of a command are keys, for access tracking:
+// argv[first], argv[first+step], ... up to argv[last], where a negative last
+// counts from the end (-1 is the last argument). A step of 0 means the
+// command reads no key, or records the access itself. find, when set,
+// replaces the positional rule.
+type keySpec struct {
+	first, last, step int
+	find              func(argv []string) []string
+}
+
+// cmdKeySpecs lists the commands whose keys are not just their first argument.
+var cmdKeySpecs = map[string]keySpec{
+	// No keys, or metadata lookups that must not count as accesses
+	"ESC":          {},
+	"PING":         {},
+	"HELP":         {},
+	"KEYS":         {},
+	"SCAN":         {},
+	"DBSIZE":       {},
+	"FLUSHDB":      {},
+	"FLUSHALL":     {},
+	"RANDOMKEY":    {},
+	"EXISTS":       {},
+	"TYPE":         {},
+	"OBJECT":       {},
+	"CONFIG":       {},
+	"MEMORY":       {},
+	"RESTORE":      {},
+	"TTL":          {},
+	"PTTL":         {},
+	"EXPIRETIME":   {},
+	"PEXPIRETIME":  {},
+	"FT.CREATE":    {},
+	"FT.SEARCH":    {},
+	"FT.DROPINDEX": {},
+	"TS.MRANGE":    {},
+
+	// Every argument
+	"DEL":     {0, -1, 1, nil},
+	"UNLINK":  {0, -1, 1, nil},
+	"TOUCH":   {0, -1, 1, nil},
+	"MGET":    {0, -1, 1, nil},
+	"PFCOUNT": {0, -1, 1, nil},
+	"PFMERGE": {0, -1, 1, nil},
+
+	// Every argument but the last one
+	"JSON.MGET": {0, -2, 1, nil},
+	"BZPOPMIN":  {0, -2, 1, nil},
+	"BZPOPMAX":  {0, -2, 1, nil},
+
+	// The first two arguments
+	"RENAME":         {0, 1, 1, nil},
+	"RENAMENX":       {0, 1, 1, nil},
+	"COPY":           {0, 1, 1, nil},
+	"LCS":            {0, 1, 1, nil},
+	"GEOSEARCHSTORE": {0, 1, 1, nil},
+	"TS.CREATERULE":  {0, 1, 1, nil},
+	"TS.DELETERULE":  {0, 1, 1, nil},
+
+	"MSET":    {0, -1, 2, nil},
+	"MSETNX":  {0, -1, 2, nil},
+	"TS.MADD": {0, -1, 3, nil},
+	"BITOP":   {1, -1, 1, nil},
+	"XGROUP":  {1, 1, 1, nil},
+
+	"ZUNIONSTORE": {find: numkeysCommandKeys},
+	"ZINTERSTORE": {find: numkeysCommandKeys},
+	"CMS.MERGE":   {find: numkeysCommandKeys},
+	"XREAD":       {find: streamsCommandKeys},
+	"XREADGROUP":  {find: streamsCommandKeys},
+	"SORT":        {find: sortCommandKeys},
+}
+
+// numkeysCommandKeys finds the keys of "destination numkeys key [key ...] ...".
+func numkeysCommandKeys(argv []string) []string {
+	if len(argv) < 2 {
+		return argv
+	}
+	n, err := strconv.Atoi(argv[1])
+	if err != nil || n < 0 || n > len(argv)-2 {
+		return argv[:1]
+	}
+	return append([]string{argv[0]}, argv[2:2+n]...)
+}
+
+// streamsCommandKeys finds the keys of "... STREAMS key [key ...] id [id ...]".
+func streamsCommandKeys(argv []string) []string {
+	for i, arg := range argv {
+		if strings.EqualFold(arg, "STREAMS") {
+			rest := argv[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// sortCommandKeys finds the keys of "key ... [STORE destination]". Keys
+// read through BY and GET patterns are not counted as accessed.
+func sortCommandKeys(argv []string) []string {
+	keys := argv[:min(len(argv), 1)]
+	for i := 1; i+1 < len(argv); i++ {
+		if strings.EqualFold(argv[i], "STORE") {
+			return append([]string{argv[0]}, argv[i+1])
+		}
+	}
+	return keys
+}
+
+// commandKeys returns the keys named by a command, according to cmdKeySpecs.
+// Commands that are not listed read or write their first argument only.
+func commandKeys(name, args string) []string {
+	spec, ok := cmdKeySpecs[name]
+	if !ok {
+		spec = keySpec{0, 0, 1, nil}
+	}
+	if spec.step == 0 && spec.find == nil {
+		return nil
+	}
+	argv, err := splitArgs(args)
+	if err != nil {
+		return nil
+	}
+	if spec.find != nil {
+		return spec.find(argv)
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(argv)
+	}
+	var keys []string
+	for i := spec.first; i <= last && i < len(argv); i += spec.step {
+		keys = append(keys, argv[i])
+	}
+	return keys
+}
+
+// trackCommandKeys records an access to every key named by a command that
+// still exists once it ran, and forgets the statistics of the others. It
+// also refreshes the recorded size of the keys, which the command may have
+// changed.
+func trackCommandKeys(name, args string) {
+	keys := commandKeys(name, args)
+	if len(keys) == 0 {
+		return
+	}
+	nowMs := time.Now().UnixMilli()
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for _, key := range keys {
+			if _, ok := data[key]; ok {
+				keyAccess.Touch(key, nowMs)
+			} else {
+				keyAccess.Remove(key)
+			}
+			keyDataSpace.trackSizeLocked(key)
+		}
+		return nil
+	})
 }
 
 func GET(args string) (string, error) {
@@ -57,14 +425,26 @@ func GET(args string) (string, error) {
 		return "NOT_OK", errors.New("command parsing error: " + err.Error())
 	}
 
-	value, exists := keyDataSpace.Get(key)
+	value, exists := keyDataSpace.GetValue(key)
 	if !exists {
 		return "NOT_OK", errors.New("No such KEY is present: " + key)
 	}
+	str, ok := value.(StringValue)
+	if !ok {
+		return "NOT_OK", ErrWrongType
+	}
 
-	return value, nil
+	return stringReply(string(str)), nil
 }
 
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-seconds|PXAT unix-milliseconds|KEEPTTL]
+// SET key value [expire_after]
+// Stores a string value, replacing any value of any type. NX only sets the
+// key if it does not exist, XX only if it exists; KEEPTTL keeps the current
+// expiration, which is otherwise replaced by the given one or removed. The
+// legacy form takes the expiration in seconds, -1 meaning none.
+// Replies OK, or (nil) when NX/XX prevented the write; with GET it replies
+// the previous value instead (or (nil)) and fails if it is not a string.
 func SET(args string) (string, error) {
 
 	var err error
@@ -78,67 +458,140 @@ func SET(args string) (string, error) {
 		return "NOT_OK", errors.New("command parsing error: " + err.Error())
 	}
 
-	var expiration_sec int64 = -1
-	if args != "" {
-		exp, _, err := cutFirstTokenSpaceTab(args)
-		if err != nil {
-			return "NOT_OK", errors.New("command parsing error: " + err.Error())
-		}
+	opts, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
 
-		expiration_sec, err = strconv.ParseInt(exp, 10, 64)
-		if err != nil {
-			return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	nowMs := time.Now().UnixMilli()
+	nx, xx, get, keepTTL := false, false, false, false
+	expireAt := NO_EXP_TS
+	hasExpire := false
+
+	if len(opts) == 1 {
+		// Legacy form: SET key value expire_after.
+		if seconds, err := strconv.ParseInt(opts[0], 10, 64); err == nil {
+			if seconds != -1 {
+				if seconds > (math.MaxInt64-nowMs)/1000 || seconds < math.MinInt64/1000 {
+					return "NOT_OK", errors.New("invalid expire time in 'set' command")
+				}
+				expireAt, hasExpire = nowMs+seconds*1000, true
+			}
+			opts = nil
 		}
 	}
 
-	var expire_at_ts int64 = math.MaxInt64
-	if expiration_sec == -1 {
-		expire_at_ts = math.MaxInt64
-	} else {
-		expire_at_ts = time.Now().UnixMilli() + expiration_sec*1000
+	for i := 0; i < len(opts); i++ {
+		switch opt := strings.ToUpper(opts[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || i+1 >= len(opts) {
+				return "NOT_OK", ErrSyntax
+			}
+			if expireAt, err = parseExpireOption(opt, opts[i+1], nowMs, "set"); err != nil {
+				return "NOT_OK", err
+			}
+			hasExpire = true
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+	if (nx && xx) || (keepTTL && hasExpire) {
+		return "NOT_OK", ErrSyntax
 	}
 
-	keyDataSpace.Add(key, data)
-	keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: expire_at_ts})
+	res := ""
+	err = keyDataSpace.Update(func(kv map[string]DataValue) error {
+		exists := keyAliveLocked(kv, key, nowMs)
+		if !exists {
+			// Drop a value whose expiration passed but was not removed yet.
+			if _, stale := kv[key]; stale {
+				deleteKeyLocked(kv, key)
+			}
+		}
+		if get {
+			res = NIL_REPLY
+			if exists {
+				old, ok := kv[key].(StringValue)
+				if !ok {
+					return ErrWrongType
+				}
+				res = stringReply(string(old))
+			}
+		}
+		if (nx && exists) || (xx && !exists) {
+			if !get {
+				res = NIL_REPLY
+			}
+			return nil
+		}
 
-	return "", nil
+		kv[key] = StringValue(data)
+		ftReindexLocked(kv, key)
+		switch {
+		case hasExpire && expireAt <= nowMs:
+			deleteKeyLocked(kv, key)
+		case hasExpire:
+			keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: expireAt})
+		case !keepTTL:
+			keyExpirations.Remove(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
 }
 
+// DEL key [key ...]
+// Deletes the keys and returns how many of them existed.
 func DEL(args string) (string, error) {
-	key, _, err := cutFirstTokenSpaceTab(args)
+	argv, err := splitArgs(args)
 	if err != nil {
 		return "NOT_OK", errors.New("command parsing error: " + err.Error())
 	}
-	keyDataSpace.Remove(key)
-	keyExpirations.Remove(key)
-
-	return "OK", nil
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("del")
+	}
 
+	removed := removeKeys(argv)
+	return intReply(int64(len(removed))), nil
 }
 
+// SETEXP key seconds
+// Sets the expiration of an existing key of any type to seconds from now,
+// like EXPIRE but failing on missing keys.
 func SETEXP(args string) (string, error) {
-	var expiration_sec int64
-
-	key, remaining, err := cutFirstTokenSpaceTab(args)
+	argv, err := splitArgs(args)
 	if err != nil {
 		return "NOT_OK", errors.New("command parsing error: " + err.Error())
 	}
-
-	if remaining != "" {
-		exp, _, err := cutFirstTokenSpaceTab(remaining)
-		if err != nil {
-			return "NOT_OK", errors.New("command parsing error: " + err.Error())
-		}
-
-		expiration_sec, err = strconv.ParseInt(exp, 10, 64)
-		if err != nil {
-			return "NOT_OK", errors.New("command parsing error: " + err.Error())
-		}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("setexp")
+	}
+	seconds, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
 	}
 
-	expire_at_ts := time.Now().UnixMilli() + expiration_sec*1000
-	exists := keyExpirations.UpdateExpiration(key, expire_at_ts)
-
+	nowMs := time.Now().UnixMilli()
+	if seconds > (math.MaxInt64-nowMs)/1000 || seconds < math.MinInt64/1000 {
+		return "NOT_OK", errors.New("invalid expire time in 'setexp' command")
+	}
+	exists := false
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		exists = setExpireLocked(data, argv[0], nowMs+seconds*1000, 0, nowMs)
+		return nil
+	})
 	if !exists {
 		return "NOT_OK", errors.New("you tried to update expiration for a non existing key")
 	}
@@ -159,6 +612,25 @@ func HELP(args string) (string, error) {
 	return "See README.md on github repo: https://github.com/Cepeppe/redis-go-clone/", nil
 }
 
+// parseIntArg parses a signed 64-bit integer argument.
+func parseIntArg(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+// parseFloatArg parses a float argument, accepting "inf", "+inf" and "-inf"
+// but rejecting NaN.
+func parseFloatArg(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrNotFloat
+	}
+	return f, nil
+}
+
 func canonCmd(s string) string {
 	s = strings.ReplaceAll(s, "\r", "")
 	s = strings.ReplaceAll(s, "\n", "")
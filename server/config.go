@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Runtime configuration, read and changed with CONFIG GET / CONFIG SET.
+// Each parameter is backed by the variables of the feature it configures.
+
+// parseMemoryArg parses a memory amount: a number of bytes optionally
+// followed by k, kb, m, mb, g or gb (case-insensitive). As in Redis, k, m
+// and g are powers of 1000 and kb, mb and gb powers of 1024.
+func parseMemoryArg(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	}
+	lower := strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// configParam is a parameter of CONFIG GET / CONFIG SET.
+type configParam struct {
+	get func() string
+	set func(value string) error
+}
+
+var configParams = map[string]configParam{
+	"maxmemory": {
+		get: func() string {
+			limit, _, _ := evictionSettings()
+			return strconv.FormatInt(limit, 10)
+		},
+		set: func(value string) error {
+			limit, err := parseMemoryArg(value)
+			if err != nil {
+				return err
+			}
+			configMu.Lock()
+			maxMemory = limit
+			configMu.Unlock()
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func() string {
+			_, policy, _ := evictionSettings()
+			return evictionPolicyNames[policy]
+		},
+		set: func(value string) error {
+			for i, name := range evictionPolicyNames {
+				if strings.EqualFold(value, name) {
+					configMu.Lock()
+					maxMemoryPolicy = evictionPolicy(i)
+					configMu.Unlock()
+					// Scores of different policies are not comparable.
+					evictMu.Lock()
+					evictionPool = nil
+					evictMu.Unlock()
+					return nil
+				}
+			}
+			return errors.New("argument(s) must be one of the following: " + strings.Join(evictionPolicyNames, ", "))
+		},
+	},
+	"maxmemory-samples": {
+		get: func() string {
+			_, _, samples := evictionSettings()
+			return strconv.Itoa(samples)
+		},
+		set: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 64 {
+				return errors.New("argument must be between 1 and 64 inclusive")
+			}
+			configMu.Lock()
+			maxMemorySamples = n
+			configMu.Unlock()
+			return nil
+		},
+	},
+}
+
+// CONFIG GET pattern [pattern ...]
+// CONFIG SET parameter value [parameter value ...]
+// Reads or changes the runtime configuration: maxmemory, maxmemory-policy
+// and maxmemory-samples. GET replies a flat array of names and values
+// matching the glob patterns, sorted by name.
+func CONFIG(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("config")
+	}
+
+	switch strings.ToUpper(argv[0]) {
+	case "GET":
+		if len(argv) < 2 {
+			return "NOT_OK", errWrongArgs("config|get")
+		}
+		names := make([]string, 0, len(configParams))
+		for name := range configParams {
+			for _, pattern := range argv[1:] {
+				if globMatch(strings.ToLower(pattern), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+		items := make([]string, 0, 2*len(names))
+		for _, name := range names {
+			items = append(items, name, configParams[name].get())
+		}
+		return arrayReply(items), nil
+
+	case "SET":
+		if len(argv) < 3 || len(argv)%2 == 0 {
+			return "NOT_OK", errWrongArgs("config|set")
+		}
+		for i := 1; i < len(argv); i += 2 {
+			if _, ok := configParams[strings.ToLower(argv[i])]; !ok {
+				return "NOT_OK", errors.New("Unknown option or number of arguments for CONFIG SET - '" + argv[i] + "'")
+			}
+		}
+		for i := 1; i < len(argv); i += 2 {
+			name := strings.ToLower(argv[i])
+			if err := configParams[name].set(argv[i+1]); err != nil {
+				return "NOT_OK", errors.New("CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error())
+			}
+		}
+		return "", nil
+
+	default:
+		return "NOT_OK", errors.New("unknown subcommand '" + argv[0] + "'")
+	}
+}
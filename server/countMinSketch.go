@@ -0,0 +1,153 @@
+// File: countMinSketch.go
+//
+// Purpose:
+//   Count-min sketch value type for the CMS.* commands, modelled after
+//   RedisBloom.
+//
+//   The sketch is a depth x width matrix of 32-bit counters. Each row hashes
+//   the item (MurmurHash64A seeded with the row number) to one counter;
+//   increments add to one counter per row and the estimated count is the
+//   minimum among them, which never underestimates the real count.
+//
+//   Sizing from the desired guarantees (CMS.INITBYPROB):
+//     width = ceil(2 / error)                        overestimate <= error * total
+//     depth = ceil(log(probability) / log(0.5))      with probability 1 - probability
+//
+// Asymptotic costs:
+//   - IncrBy / Query: O(depth)
+//   - Merge:          O(width * depth * number of sources)
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; sketches live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+var ErrCMSOverflow = errors.New("CMS: INCRBY overflow")
+
+// CountMinSketch is the count-min sketch value type.
+type CountMinSketch struct {
+	width, depth uint32
+	count        uint64 // total of all increments
+	counters     []uint32
+}
+
+// NewCountMinSketch creates an empty sketch.
+func NewCountMinSketch(width, depth uint32) *CountMinSketch {
+	return &CountMinSketch{
+		width:    width,
+		depth:    depth,
+		counters: make([]uint32, uint64(width)*uint64(depth)),
+	}
+}
+
+// CMS_MAX_COUNTERS bounds width * depth: 256 MiB of counters.
+const CMS_MAX_COUNTERS = 1 << 26
+
+// cmsValidDims reports whether a width x depth sketch may be allocated.
+func cmsValidDims(width, depth uint64) bool {
+	return width >= 1 && depth >= 1 &&
+		width <= CMS_MAX_COUNTERS && depth <= CMS_MAX_COUNTERS && width*depth <= CMS_MAX_COUNTERS
+}
+
+// cmsDimsByProb returns the sketch size for the given error and probability.
+// Sizes too large for a sketch are clamped to CMS_MAX_COUNTERS+1, so that
+// cmsValidDims rejects them.
+func cmsDimsByProb(errorRate, probability float64) (uint64, uint64) {
+	width := math.Ceil(2 / errorRate)
+	depth := math.Ceil(math.Log(probability) / math.Log(0.5))
+	return uint64(min(width, CMS_MAX_COUNTERS+1)), uint64(min(depth, CMS_MAX_COUNTERS+1))
+}
+
+func (c *CountMinSketch) Type() ValueType { return CMS_VALUE }
+
+func (c *CountMinSketch) DeepCopy() DataValue {
+	clone := *c
+	clone.counters = append([]uint32(nil), c.counters...)
+	return &clone
+}
+
+// cell returns the index of the counter of item in the given row.
+func (c *CountMinSketch) cell(item string, row uint32) uint64 {
+	h := murmurHash64A([]byte(item), uint64(row))
+	return uint64(row)*uint64(c.width) + h%uint64(c.width)
+}
+
+// Query returns the estimated count of item.
+func (c *CountMinSketch) Query(item string) uint32 {
+	minCount := uint32(math.MaxUint32)
+	for row := uint32(0); row < c.depth; row++ {
+		minCount = min(minCount, c.counters[c.cell(item, row)])
+	}
+	return minCount
+}
+
+// IncrBy adds incr to the counters of item and returns its new estimate.
+// Nothing is changed if any counter would overflow.
+func (c *CountMinSketch) IncrBy(item string, incr uint32) (uint32, error) {
+	for row := uint32(0); row < c.depth; row++ {
+		if c.counters[c.cell(item, row)] > math.MaxUint32-incr {
+			return 0, ErrCMSOverflow
+		}
+	}
+	for row := uint32(0); row < c.depth; row++ {
+		c.counters[c.cell(item, row)] += incr
+	}
+	c.count += uint64(incr)
+	return c.Query(item), nil
+}
+
+// Merge overwrites c with the weighted sum of sources, which must all have
+// the dimensions of c.
+func (c *CountMinSketch) Merge(sources []*CountMinSketch, weights []int64) error {
+	counters := make([]uint32, len(c.counters))
+	var count int64
+	for i, src := range sources {
+		if src.width != c.width || src.depth != c.depth {
+			return errors.New("CMS: width/depth is not equal")
+		}
+		for j, v := range src.counters {
+			sum, ok := cmsMulAdd(int64(counters[j]), uint64(v), weights[i])
+			if !ok || sum < 0 || sum > math.MaxUint32 {
+				return ErrCMSOverflow
+			}
+			counters[j] = uint32(sum)
+		}
+		var ok bool
+		if count, ok = cmsMulAdd(count, src.count, weights[i]); !ok {
+			return ErrCMSOverflow
+		}
+	}
+	if count < 0 {
+		return ErrCMSOverflow
+	}
+	c.counters, c.count = counters, uint64(count)
+	return nil
+}
+
+// cmsMulAdd returns acc + n*w, or false when the result does not fit an int64.
+func cmsMulAdd(acc int64, n uint64, w int64) (int64, bool) {
+	abs := uint64(w)
+	if w < 0 {
+		abs = -abs
+	}
+	hi, lo := bits.Mul64(n, abs)
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, false
+	}
+	product := int64(lo)
+	if w < 0 {
+		product = -product
+	}
+	sum := acc + product
+	if (product > 0 && sum < acc) || (product < 0 && sum > acc) {
+		return 0, false
+	}
+	return sum, true
+}
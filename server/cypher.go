@@ -0,0 +1,2015 @@
+// File: cypher.go
+//
+// Purpose:
+//   Parser and executor for the Cypher subset accepted by GRAPH.QUERY.
+//
+//   A query is a sequence of clauses run as a pipeline over rows of variable
+//   bindings, starting from a single empty row:
+//     MATCH pattern [, pattern ...] [WHERE expr]   extends every row with the
+//                                                   matches of the patterns
+//     CREATE pattern [, pattern ...]                creates the unbound nodes
+//                                                   and every relationship
+//     [DETACH] DELETE expr [, expr ...]             deletes nodes / relationships
+//     RETURN [DISTINCT] expr [AS name] [, ...]      must be the last clause
+//       [ORDER BY expr [ASC|DESC] [, ...]] [SKIP n] [LIMIT n]
+//
+//   Patterns: (a:Label {key: value})-[r:TYPE|OTHER {key: value}]->(b),
+//   with <-, -> or - for the direction and *, *n, *min..max, *..max on a
+//   relationship for variable-length paths (its variable is then bound to the
+//   list of traversed relationships). Within a pattern a relationship is
+//   traversed at most once.
+//
+//   Expressions: literals (numbers, 'strings', true, false, null, [lists]),
+//   variables, properties (n.name), arithmetic (+ - * / %), comparisons
+//   (= <> < <= > >=), AND, OR, XOR, NOT, IN, STARTS WITH, ENDS WITH,
+//   CONTAINS, IS [NOT] NULL, and the functions id, labels, type, size,
+//   toLower, toUpper, toString, exists. RETURN items can also be the
+//   aggregations count, sum, avg, min, max and collect (optionally with
+//   DISTINCT), grouped by the other items.
+//
+//   Null follows Cypher's three-valued logic: comparisons with null are null
+//   and WHERE keeps only rows evaluating to true.
+//
+//   Write queries keep an undo log, so that a failing query leaves the graph
+//   unchanged.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+func errCypher(format string, args ...any) error {
+	return fmt.Errorf("Cypher error: "+format, args...)
+}
+
+// --- Lexer ---
+
+type cypherTokKind uint8
+
+const (
+	CYPHER_EOF cypherTokKind = iota
+	CYPHER_IDENT
+	CYPHER_INT
+	CYPHER_FLOAT
+	CYPHER_STRING
+	CYPHER_PUNCT
+)
+
+type cypherToken struct {
+	kind       cypherTokKind
+	text       string // identifier, punctuation, or decoded string
+	value      any    // int64 or float64 for numbers
+	start, end int    // byte offsets in the query
+}
+
+// cypherPuncts lists the multi-character punctuation first.
+var cypherPuncts = []string{"<>", "<=", ">=", "..", "(", ")", "[", "]", "{", "}", ":", ",", ".", "-", "<", ">", "=", "+", "*", "/", "%", "|"}
+
+func lexCypher(q string) ([]cypherToken, error) {
+	var toks []cypherToken
+	i := 0
+	for {
+		for i < len(q) && unicode.IsSpace(rune(q[i])) {
+			i++
+		}
+		if i >= len(q) {
+			toks = append(toks, cypherToken{kind: CYPHER_EOF, start: i, end: i})
+			return toks, nil
+		}
+		start := i
+		c := q[i]
+		switch {
+		case c == '_' || unicode.IsLetter(rune(c)):
+			for i < len(q) && (q[i] == '_' || unicode.IsLetter(rune(q[i])) || unicode.IsDigit(rune(q[i]))) {
+				i++
+			}
+			toks = append(toks, cypherToken{kind: CYPHER_IDENT, text: q[start:i]})
+
+		case c == '`':
+			j := strings.IndexByte(q[i+1:], '`')
+			if j < 0 {
+				return nil, errCypher("unterminated identifier")
+			}
+			i += j + 2
+			toks = append(toks, cypherToken{kind: CYPHER_IDENT, text: q[start+1 : i-1]})
+
+		case unicode.IsDigit(rune(c)):
+			for i < len(q) && unicode.IsDigit(rune(q[i])) {
+				i++
+			}
+			isFloat := false
+			if i+1 < len(q) && q[i] == '.' && unicode.IsDigit(rune(q[i+1])) {
+				isFloat = true
+				i++
+				for i < len(q) && unicode.IsDigit(rune(q[i])) {
+					i++
+				}
+			}
+			if i < len(q) && (q[i] == 'e' || q[i] == 'E') {
+				isFloat = true
+				i++
+				if i < len(q) && (q[i] == '+' || q[i] == '-') {
+					i++
+				}
+				for i < len(q) && unicode.IsDigit(rune(q[i])) {
+					i++
+				}
+			}
+			tok := cypherToken{kind: CYPHER_INT, text: q[start:i]}
+			if isFloat {
+				f, err := strconv.ParseFloat(tok.text, 64)
+				if err != nil {
+					return nil, errCypher("invalid number %s", tok.text)
+				}
+				tok.kind, tok.value = CYPHER_FLOAT, f
+			} else {
+				n, err := strconv.ParseInt(tok.text, 10, 64)
+				if err != nil {
+					return nil, errCypher("integer overflow %s", tok.text)
+				}
+				tok.value = n
+			}
+			toks = append(toks, tok)
+
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(q) {
+					return nil, errCypher("unterminated string")
+				}
+				if q[i] == c {
+					i++
+					break
+				}
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+					switch q[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(q[i])
+					}
+					i++
+					continue
+				}
+				b.WriteByte(q[i])
+				i++
+			}
+			toks = append(toks, cypherToken{kind: CYPHER_STRING, text: b.String()})
+
+		default:
+			matched := ""
+			for _, p := range cypherPuncts {
+				if strings.HasPrefix(q[i:], p) {
+					matched = p
+					break
+				}
+			}
+			if matched == "" {
+				return nil, errCypher("unexpected character '%c'", c)
+			}
+			i += len(matched)
+			toks = append(toks, cypherToken{kind: CYPHER_PUNCT, text: matched})
+		}
+		toks[len(toks)-1].start, toks[len(toks)-1].end = start, i
+	}
+}
+
+// --- AST ---
+
+const (
+	CYPHER_DIR_BOTH = iota
+	CYPHER_DIR_OUT
+	CYPHER_DIR_IN
+)
+
+type cypherNodePattern struct {
+	variable string
+	labels   []string
+	props    []cypherMapEntry
+}
+
+type cypherRelPattern struct {
+	variable  string
+	types     []string
+	props     []cypherMapEntry
+	dir       int
+	varLength bool
+	min, max  int // max < 0: unbounded
+}
+
+// cypherPath is node (rel node)*.
+type cypherPath struct {
+	nodes []*cypherNodePattern
+	rels  []*cypherRelPattern
+}
+
+type cypherMapEntry struct {
+	key   string
+	value cypherExpr
+}
+
+type cypherMatch struct {
+	patterns []*cypherPath
+	where    cypherExpr
+}
+
+type cypherCreate struct {
+	patterns []*cypherPath
+}
+
+type cypherDelete struct {
+	detach bool
+	exprs  []cypherExpr
+}
+
+type cypherReturnItem struct {
+	expr cypherExpr
+	name string
+}
+
+type cypherOrderItem struct {
+	expr cypherExpr
+	text string
+	desc bool
+}
+
+type cypherReturn struct {
+	distinct    bool
+	items       []cypherReturnItem
+	orderBy     []cypherOrderItem
+	skip, limit int64 // limit < 0: no limit
+}
+
+type cypherQuery struct {
+	clauses []any // *cypherMatch, *cypherCreate, *cypherDelete, *cypherReturn
+}
+
+// writes reports whether the query modifies the graph.
+func (q *cypherQuery) writes() bool {
+	for _, c := range q.clauses {
+		switch c.(type) {
+		case *cypherCreate, *cypherDelete:
+			return true
+		}
+	}
+	return false
+}
+
+// --- Expressions ---
+
+type cypherRow map[string]any
+
+type cypherExpr interface {
+	eval(row cypherRow) (any, error)
+}
+
+type (
+	cypherLiteral  struct{ value any }
+	cypherVariable struct{ name string }
+	cypherProperty struct {
+		subject cypherExpr
+		key     string
+	}
+	cypherList   struct{ items []cypherExpr }
+	cypherBinary struct {
+		op          string
+		left, right cypherExpr
+	}
+	cypherUnary struct {
+		op      string
+		operand cypherExpr
+	}
+	cypherIsNull struct {
+		operand cypherExpr
+		not     bool
+	}
+	cypherCall struct {
+		name     string // lowercase
+		args     []cypherExpr
+		star     bool // count(*)
+		distinct bool
+	}
+)
+
+var cypherAggregates = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true, "collect": true}
+
+func (e cypherLiteral) eval(cypherRow) (any, error) { return e.value, nil }
+
+func (e cypherVariable) eval(row cypherRow) (any, error) {
+	v, ok := row[e.name]
+	if !ok {
+		return nil, errCypher("%s not defined", e.name)
+	}
+	return v, nil
+}
+
+func (e cypherProperty) eval(row cypherRow) (any, error) {
+	subject, err := e.subject.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	switch s := subject.(type) {
+	case nil:
+		return nil, nil
+	case *graphNode:
+		v, _ := s.props.get(e.key)
+		return v, nil
+	case *graphEdge:
+		v, _ := s.props.get(e.key)
+		return v, nil
+	}
+	return nil, errCypher("type mismatch: expected a node or relationship for property %s", e.key)
+}
+
+func (e cypherList) eval(row cypherRow) (any, error) {
+	out := make([]any, len(e.items))
+	for i, item := range e.items {
+		v, err := item.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (e cypherIsNull) eval(row cypherRow) (any, error) {
+	v, err := e.operand.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != e.not, nil
+}
+
+func (e cypherUnary) eval(row cypherRow) (any, error) {
+	v, err := e.operand.eval(row)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	switch e.op {
+	case "NOT":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, errCypher("type mismatch: NOT expects a boolean")
+		}
+		return !b, nil
+	}
+	switch n := v.(type) {
+	case int64:
+		return -n, nil
+	case float64:
+		return -n, nil
+	}
+	return nil, errCypher("type mismatch: unary minus expects a number")
+}
+
+func (e cypherBinary) eval(row cypherRow) (any, error) {
+	switch e.op {
+	case "AND", "OR", "XOR":
+		return e.evalLogical(row)
+	}
+	l, err := e.left.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "IN":
+		list, ok := r.([]any)
+		if r == nil || l == nil {
+			return nil, nil
+		}
+		if !ok {
+			return nil, errCypher("type mismatch: IN expects a list")
+		}
+		for _, item := range list {
+			if item != nil && graphEquals(l, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch e.op {
+	case "=":
+		return graphEquals(l, r), nil
+	case "<>":
+		return !graphEquals(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, ok := graphCompare(l, r)
+		if !ok {
+			return nil, nil
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "STARTS WITH", "ENDS WITH", "CONTAINS":
+		ls, ok1 := l.(string)
+		rs, ok2 := r.(string)
+		if !ok1 || !ok2 {
+			return nil, nil
+		}
+		switch e.op {
+		case "STARTS WITH":
+			return strings.HasPrefix(ls, rs), nil
+		case "ENDS WITH":
+			return strings.HasSuffix(ls, rs), nil
+		}
+		return strings.Contains(ls, rs), nil
+	}
+	return cypherArithmetic(e.op, l, r)
+}
+
+func (e cypherBinary) evalLogical(row cypherRow) (any, error) {
+	l, err := e.left.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	lb, lok := l.(bool)
+	rb, rok := r.(bool)
+	if (l != nil && !lok) || (r != nil && !rok) {
+		return nil, errCypher("type mismatch: %s expects booleans", e.op)
+	}
+	switch e.op {
+	case "AND":
+		if (lok && !lb) || (rok && !rb) {
+			return false, nil
+		}
+	case "OR":
+		if (lok && lb) || (rok && rb) {
+			return true, nil
+		}
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch e.op {
+	case "AND":
+		return true, nil
+	case "OR":
+		return false, nil
+	}
+	return lb != rb, nil
+}
+
+func cypherArithmetic(op string, l, r any) (any, error) {
+	if op == "+" {
+		ll, lok := l.([]any)
+		rl, rok := r.([]any)
+		switch {
+		case lok && rok:
+			return append(append([]any(nil), ll...), rl...), nil
+		case lok:
+			return append(append([]any(nil), ll...), r), nil
+		}
+		_, ls := l.(string)
+		_, rs := r.(string)
+		if ls || rs {
+			return graphValueString(l) + graphValueString(r), nil
+		}
+	}
+
+	li, lint := l.(int64)
+	ri, rint := r.(int64)
+	if lint && rint {
+		switch op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/", "%":
+			if ri == 0 {
+				return nil, errCypher("division by zero")
+			}
+			if op == "/" {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+	lf, ok1 := graphNumber(l)
+	rf, ok2 := graphNumber(r)
+	if !ok1 || !ok2 {
+		return nil, errCypher("type mismatch: %s expects numbers", op)
+	}
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	}
+	return math.Mod(lf, rf), nil
+}
+
+func (e cypherCall) eval(row cypherRow) (any, error) {
+	if cypherAggregates[e.name] {
+		return nil, errCypher("aggregation function %s is only allowed in RETURN items", e.name)
+	}
+	if len(e.args) != 1 {
+		return nil, errCypher("%s expects one argument", e.name)
+	}
+	v, err := e.args[0].eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.name {
+	case "exists":
+		return v != nil, nil
+	case "tostring":
+		if v == nil {
+			return nil, nil
+		}
+		return graphValueString(v), nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch e.name {
+	case "id":
+		switch x := v.(type) {
+		case *graphNode:
+			return int64(x.id), nil
+		case *graphEdge:
+			return int64(x.id), nil
+		}
+	case "labels":
+		if n, ok := v.(*graphNode); ok {
+			out := make([]any, len(n.labels))
+			for i, l := range n.labels {
+				out[i] = l
+			}
+			return out, nil
+		}
+	case "type":
+		if r, ok := v.(*graphEdge); ok {
+			return r.relType, nil
+		}
+	case "size":
+		switch x := v.(type) {
+		case string:
+			return int64(len([]rune(x))), nil
+		case []any:
+			return int64(len(x)), nil
+		}
+	case "tolower", "toupper":
+		if s, ok := v.(string); ok {
+			if e.name == "tolower" {
+				return strings.ToLower(s), nil
+			}
+			return strings.ToUpper(s), nil
+		}
+	default:
+		return nil, errCypher("unknown function '%s'", e.name)
+	}
+	return nil, errCypher("type mismatch in %s()", e.name)
+}
+
+// cypherHasAggregate reports whether an aggregation appears anywhere in e.
+func cypherHasAggregate(e cypherExpr) bool {
+	switch x := e.(type) {
+	case cypherCall:
+		if cypherAggregates[x.name] {
+			return true
+		}
+		for _, a := range x.args {
+			if cypherHasAggregate(a) {
+				return true
+			}
+		}
+	case cypherProperty:
+		return cypherHasAggregate(x.subject)
+	case cypherList:
+		for _, item := range x.items {
+			if cypherHasAggregate(item) {
+				return true
+			}
+		}
+	case cypherBinary:
+		return cypherHasAggregate(x.left) || cypherHasAggregate(x.right)
+	case cypherUnary:
+		return cypherHasAggregate(x.operand)
+	case cypherIsNull:
+		return cypherHasAggregate(x.operand)
+	}
+	return false
+}
+
+// --- Parser ---
+
+type cypherParser struct {
+	query string
+	toks  []cypherToken
+	pos   int
+	depth int // nesting of the expression being parsed, see enter
+}
+
+// CYPHER_MAX_DEPTH bounds the nesting of parentheses, lists and unary
+// operators, so that a crafted query cannot exhaust the goroutine stack.
+const CYPHER_MAX_DEPTH = 128
+
+// enter accounts for one more level of recursion: callers defer p.leave().
+func (p *cypherParser) enter() error {
+	if p.depth++; p.depth > CYPHER_MAX_DEPTH {
+		return errCypher("query nested too deeply")
+	}
+	return nil
+}
+
+func (p *cypherParser) leave() {
+	p.depth--
+}
+
+func parseCypher(query string) (*cypherQuery, error) {
+	toks, err := lexCypher(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &cypherParser{query: query, toks: toks}
+	q := &cypherQuery{}
+	for p.peek().kind != CYPHER_EOF {
+		if len(q.clauses) > 0 {
+			if _, ok := q.clauses[len(q.clauses)-1].(*cypherReturn); ok {
+				return nil, errCypher("RETURN must be the last clause")
+			}
+		}
+		var clause any
+		switch {
+		case p.acceptKeyword("MATCH"):
+			clause, err = p.parseMatch()
+		case p.acceptKeyword("CREATE"):
+			var patterns []*cypherPath
+			patterns, err = p.parsePatterns()
+			clause = &cypherCreate{patterns}
+		case p.acceptKeyword("DETACH"):
+			if !p.acceptKeyword("DELETE") {
+				return nil, errCypher("expected DELETE after DETACH")
+			}
+			clause, err = p.parseDelete(true)
+		case p.acceptKeyword("DELETE"):
+			clause, err = p.parseDelete(false)
+		case p.acceptKeyword("RETURN"):
+			clause, err = p.parseReturn()
+		default:
+			return nil, p.unexpected()
+		}
+		if err != nil {
+			return nil, err
+		}
+		q.clauses = append(q.clauses, clause)
+	}
+	if len(q.clauses) == 0 {
+		return nil, errCypher("empty query")
+	}
+	return q, nil
+}
+
+func (p *cypherParser) peek() cypherToken { return p.toks[p.pos] }
+
+func (p *cypherParser) next() cypherToken {
+	tok := p.toks[p.pos]
+	if tok.kind != CYPHER_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *cypherParser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == CYPHER_EOF {
+		return errCypher("unexpected end of query")
+	}
+	return errCypher("unexpected '%s' at offset %d", p.query[tok.start:tok.end], tok.start)
+}
+
+func (p *cypherParser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == CYPHER_IDENT && strings.EqualFold(tok.text, kw)
+}
+
+func (p *cypherParser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cypherParser) isPunct(s string) bool {
+	tok := p.peek()
+	return tok.kind == CYPHER_PUNCT && tok.text == s
+}
+
+func (p *cypherParser) acceptPunct(s string) bool {
+	if p.isPunct(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cypherParser) expectPunct(s string) error {
+	if !p.acceptPunct(s) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *cypherParser) expectIdent() (string, error) {
+	if p.peek().kind != CYPHER_IDENT {
+		return "", p.unexpected()
+	}
+	return p.next().text, nil
+}
+
+func (p *cypherParser) expectInt() (int64, error) {
+	if p.peek().kind != CYPHER_INT {
+		return 0, p.unexpected()
+	}
+	return p.next().value.(int64), nil
+}
+
+func (p *cypherParser) parseMatch() (*cypherMatch, error) {
+	patterns, err := p.parsePatterns()
+	if err != nil {
+		return nil, err
+	}
+	m := &cypherMatch{patterns: patterns}
+	if p.acceptKeyword("WHERE") {
+		if m.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *cypherParser) parseDelete(detach bool) (*cypherDelete, error) {
+	d := &cypherDelete{detach: detach}
+	for {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		d.exprs = append(d.exprs, e)
+		if !p.acceptPunct(",") {
+			return d, nil
+		}
+	}
+}
+
+func (p *cypherParser) parseReturn() (*cypherReturn, error) {
+	r := &cypherReturn{limit: -1}
+	r.distinct = p.acceptKeyword("DISTINCT")
+	for {
+		start := p.peek().start
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		item := cypherReturnItem{expr: e, name: p.query[start:p.toks[p.pos-1].end]}
+		if p.acceptKeyword("AS") {
+			if item.name, err = p.expectIdent(); err != nil {
+				return nil, err
+			}
+		}
+		if cypherHasAggregate(e) {
+			if call, ok := e.(cypherCall); !ok || !cypherAggregates[call.name] {
+				return nil, errCypher("aggregations cannot be nested in expressions")
+			}
+		}
+		r.items = append(r.items, item)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if !p.acceptKeyword("BY") {
+			return nil, errCypher("expected BY after ORDER")
+		}
+		for {
+			start := p.peek().start
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			o := cypherOrderItem{expr: e, text: p.query[start:p.toks[p.pos-1].end]}
+			if p.acceptKeyword("DESC") || p.acceptKeyword("DESCENDING") {
+				o.desc = true
+			} else if !p.acceptKeyword("ASC") {
+				p.acceptKeyword("ASCENDING")
+			}
+			r.orderBy = append(r.orderBy, o)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	var err error
+	if p.acceptKeyword("SKIP") {
+		if r.skip, err = p.expectInt(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		if r.limit, err = p.expectInt(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (p *cypherParser) parsePatterns() ([]*cypherPath, error) {
+	var paths []*cypherPath
+	for {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if !p.acceptPunct(",") {
+			return paths, nil
+		}
+	}
+}
+
+func (p *cypherParser) parsePath() (*cypherPath, error) {
+	node, err := p.parseNodePattern()
+	if err != nil {
+		return nil, err
+	}
+	path := &cypherPath{nodes: []*cypherNodePattern{node}}
+	for p.isPunct("-") || p.isPunct("<") {
+		rel, err := p.parseRelPattern()
+		if err != nil {
+			return nil, err
+		}
+		node, err := p.parseNodePattern()
+		if err != nil {
+			return nil, err
+		}
+		path.rels = append(path.rels, rel)
+		path.nodes = append(path.nodes, node)
+	}
+	return path, nil
+}
+
+func (p *cypherParser) parseNodePattern() (*cypherNodePattern, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	n := &cypherNodePattern{}
+	if p.peek().kind == CYPHER_IDENT {
+		n.variable = p.next().text
+	}
+	for p.acceptPunct(":") {
+		label, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		n.labels = append(n.labels, label)
+	}
+	if p.isPunct("{") {
+		props, err := p.parseMap()
+		if err != nil {
+			return nil, err
+		}
+		n.props = props
+	}
+	return n, p.expectPunct(")")
+}
+
+func (p *cypherParser) parseRelPattern() (*cypherRelPattern, error) {
+	r := &cypherRelPattern{min: 1, max: 1}
+	left := p.acceptPunct("<")
+	if err := p.expectPunct("-"); err != nil {
+		return nil, err
+	}
+	if p.acceptPunct("[") {
+		if p.peek().kind == CYPHER_IDENT {
+			r.variable = p.next().text
+		}
+		if p.acceptPunct(":") {
+			for {
+				t, err := p.expectIdent()
+				if err != nil {
+					return nil, err
+				}
+				r.types = append(r.types, t)
+				if !p.acceptPunct("|") {
+					break
+				}
+				p.acceptPunct(":")
+			}
+		}
+		if p.acceptPunct("*") {
+			if err := p.parseVarLength(r); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("{") {
+			props, err := p.parseMap()
+			if err != nil {
+				return nil, err
+			}
+			r.props = props
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectPunct("-"); err != nil {
+		return nil, err
+	}
+	right := p.acceptPunct(">")
+	switch {
+	case left && right:
+		return nil, errCypher("a relationship cannot point both ways")
+	case left:
+		r.dir = CYPHER_DIR_IN
+	case right:
+		r.dir = CYPHER_DIR_OUT
+	}
+	return r, nil
+}
+
+// parseVarLength parses what follows '*': nothing, n, min..max, ..max or min..
+func (p *cypherParser) parseVarLength(r *cypherRelPattern) error {
+	r.varLength, r.min, r.max = true, 1, -1
+	if p.peek().kind == CYPHER_INT {
+		n, _ := p.expectInt()
+		r.min, r.max = int(n), int(n)
+	}
+	if p.acceptPunct("..") {
+		r.max = -1
+		if p.peek().kind == CYPHER_INT {
+			n, _ := p.expectInt()
+			r.max = int(n)
+		}
+	}
+	if r.min < 0 || (r.max >= 0 && r.max < r.min) {
+		return errCypher("invalid variable length range")
+	}
+	return nil
+}
+
+func (p *cypherParser) parseMap() ([]cypherMapEntry, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var entries []cypherMapEntry
+	if p.acceptPunct("}") {
+		return entries, nil
+	}
+	for {
+		key, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cypherMapEntry{key, value})
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	return entries, p.expectPunct("}")
+}
+
+// Expression precedence, lowest first: OR, XOR, AND, NOT, comparison,
+// additive, multiplicative, unary minus, property access.
+func (p *cypherParser) parseExpr() (cypherExpr, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	return p.parseBinaryLevel([]string{"OR"}, p.parseXor)
+}
+
+func (p *cypherParser) parseXor() (cypherExpr, error) {
+	return p.parseBinaryLevel([]string{"XOR"}, p.parseAnd)
+}
+
+func (p *cypherParser) parseAnd() (cypherExpr, error) {
+	return p.parseBinaryLevel([]string{"AND"}, p.parseNot)
+}
+
+// parseBinaryLevel parses a left-associative chain of keyword operators.
+func (p *cypherParser) parseBinaryLevel(ops []string, operand func() (cypherExpr, error)) (cypherExpr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		matched := ""
+		for _, op := range ops {
+			if p.acceptKeyword(op) {
+				matched = op
+				break
+			}
+		}
+		if matched == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = cypherBinary{matched, left, right}
+	}
+}
+
+func (p *cypherParser) parseNot() (cypherExpr, error) {
+	if p.acceptKeyword("NOT") {
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return cypherUnary{"NOT", operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *cypherParser) parseComparison() (cypherExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.acceptPunct("="):
+			op = "="
+		case p.acceptPunct("<>"):
+			op = "<>"
+		case p.acceptPunct("<="):
+			op = "<="
+		case p.acceptPunct(">="):
+			op = ">="
+		case p.acceptPunct("<"):
+			op = "<"
+		case p.acceptPunct(">"):
+			op = ">"
+		case p.acceptKeyword("IN"):
+			op = "IN"
+		case p.acceptKeyword("CONTAINS"):
+			op = "CONTAINS"
+		case p.acceptKeyword("STARTS"), p.acceptKeyword("ENDS"):
+			op = strings.ToUpper(p.toks[p.pos-1].text) + " WITH"
+			if !p.acceptKeyword("WITH") {
+				return nil, errCypher("expected WITH after %s", strings.ToUpper(p.toks[p.pos-1].text))
+			}
+		case p.acceptKeyword("IS"):
+			not := p.acceptKeyword("NOT")
+			if !p.acceptKeyword("NULL") {
+				return nil, errCypher("expected NULL after IS")
+			}
+			left = cypherIsNull{left, not}
+			continue
+		default:
+			return left, nil
+		}
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = cypherBinary{op, left, right}
+	}
+}
+
+func (p *cypherParser) parseAdditive() (cypherExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = cypherBinary{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *cypherParser) parseMultiplicative() (cypherExpr, error) {
+	left, err := p.parseUnaryMinus()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("*") || p.isPunct("/") || p.isPunct("%") {
+		op := p.next().text
+		right, err := p.parseUnaryMinus()
+		if err != nil {
+			return nil, err
+		}
+		left = cypherBinary{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *cypherParser) parseUnaryMinus() (cypherExpr, error) {
+	if p.acceptPunct("-") {
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnaryMinus()
+		if err != nil {
+			return nil, err
+		}
+		return cypherUnary{"-", operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *cypherParser) parsePostfix() (cypherExpr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct(".") {
+		key, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		e = cypherProperty{e, key}
+	}
+	return e, nil
+}
+
+func (p *cypherParser) parsePrimary() (cypherExpr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case CYPHER_INT, CYPHER_FLOAT:
+		p.next()
+		return cypherLiteral{tok.value}, nil
+	case CYPHER_STRING:
+		p.next()
+		return cypherLiteral{tok.text}, nil
+	case CYPHER_IDENT:
+		p.next()
+		switch strings.ToUpper(tok.text) {
+		case "TRUE":
+			return cypherLiteral{true}, nil
+		case "FALSE":
+			return cypherLiteral{false}, nil
+		case "NULL":
+			return cypherLiteral{nil}, nil
+		}
+		if p.acceptPunct("(") {
+			return p.parseCall(strings.ToLower(tok.text))
+		}
+		return cypherVariable{tok.text}, nil
+	}
+
+	switch {
+	case p.acceptPunct("("):
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectPunct(")")
+	case p.acceptPunct("["):
+		list := cypherList{}
+		if p.acceptPunct("]") {
+			return list, nil
+		}
+		for {
+			item, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+		return list, p.expectPunct("]")
+	}
+	return nil, p.unexpected()
+}
+
+func (p *cypherParser) parseCall(name string) (cypherExpr, error) {
+	call := cypherCall{name: name}
+	if name == "count" && p.acceptPunct("*") {
+		call.star = true
+		return call, p.expectPunct(")")
+	}
+	if cypherAggregates[name] {
+		call.distinct = p.acceptKeyword("DISTINCT")
+	}
+	if p.acceptPunct(")") {
+		return nil, errCypher("%s expects one argument", name)
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if cypherAggregates[name] && len(call.args) != 1 {
+		return nil, errCypher("%s expects one argument", name)
+	}
+	return call, p.expectPunct(")")
+}
+
+// --- Execution ---
+
+// cypherStats counts the changes made by a query.
+type cypherStats struct {
+	nodesCreated, nodesDeleted int
+	relsCreated, relsDeleted   int
+	propertiesSet              int
+}
+
+// cypherExec runs a query against a graph, recording an undo log of its changes.
+type cypherExec struct {
+	g     *Graph
+	stats cypherStats
+	undo  []func()
+}
+
+// rollback reverts every change made so far, newest first.
+func (ex *cypherExec) rollback() {
+	for i := len(ex.undo) - 1; i >= 0; i-- {
+		ex.undo[i]()
+	}
+	ex.undo = nil
+}
+
+// cypherResult is the output of RETURN.
+type cypherResult struct {
+	columns []string
+	rows    [][]any
+}
+
+// runCypher executes q on g. On error every change is rolled back.
+func runCypher(g *Graph, q *cypherQuery) (*cypherResult, cypherStats, error) {
+	ex := &cypherExec{g: g}
+	res, err := ex.run(q)
+	if err != nil {
+		ex.rollback()
+		return nil, cypherStats{}, err
+	}
+	return res, ex.stats, nil
+}
+
+func (ex *cypherExec) run(q *cypherQuery) (*cypherResult, error) {
+	rows := []cypherRow{{}}
+	var err error
+	for _, clause := range q.clauses {
+		switch c := clause.(type) {
+		case *cypherMatch:
+			rows, err = ex.match(c, rows)
+		case *cypherCreate:
+			err = ex.create(c, rows)
+		case *cypherDelete:
+			err = ex.delete(c, rows)
+		case *cypherReturn:
+			return ex.project(c, rows)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (row cypherRow) with(name string, v any) cypherRow {
+	out := make(cypherRow, len(row)+1)
+	for k, x := range row {
+		out[k] = x
+	}
+	if name != "" {
+		out[name] = v
+	}
+	return out
+}
+
+func cypherTruthy(v any) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+func (ex *cypherExec) match(m *cypherMatch, rows []cypherRow) ([]cypherRow, error) {
+	for _, path := range m.patterns {
+		var next []cypherRow
+		for _, row := range rows {
+			err := ex.matchPath(path, row, func(r cypherRow) {
+				next = append(next, r)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		rows = next
+	}
+	if m.where == nil {
+		return rows, nil
+	}
+	kept := rows[:0]
+	for _, row := range rows {
+		v, err := m.where.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if cypherTruthy(v) {
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// propsMatch checks the property map of a pattern against an entity.
+func propsMatch(entries []cypherMapEntry, props graphProps, row cypherRow) (bool, error) {
+	for _, entry := range entries {
+		want, err := entry.value.eval(row)
+		if err != nil {
+			return false, err
+		}
+		have, ok := props.get(entry.key)
+		if !ok || want == nil || !graphEquals(have, want) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// nodeMatches checks a node against a node pattern and the current bindings.
+func nodeMatches(np *cypherNodePattern, n *graphNode, row cypherRow) (bool, error) {
+	if np.variable != "" {
+		if bound, ok := row[np.variable]; ok {
+			if bn, isNode := bound.(*graphNode); !isNode || bn != n {
+				return false, nil
+			}
+		}
+	}
+	for _, l := range np.labels {
+		if !n.hasLabel(l) {
+			return false, nil
+		}
+	}
+	return propsMatch(np.props, n.props, row)
+}
+
+func relMatches(rp *cypherRelPattern, e *graphEdge, row cypherRow) (bool, error) {
+	if len(rp.types) > 0 {
+		ok := false
+		for _, t := range rp.types {
+			if e.relType == t {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return propsMatch(rp.props, e.props, row)
+}
+
+// cypherHop is an edge that can be followed from a node, with the node it leads to.
+type cypherHop struct {
+	edge *graphEdge
+	to   *graphNode
+}
+
+// hops returns the edges that can be followed from n in direction dir.
+func hops(n *graphNode, dir int) []cypherHop {
+	var out []cypherHop
+	if dir != CYPHER_DIR_IN {
+		for _, e := range n.out {
+			out = append(out, cypherHop{e, e.dst})
+		}
+	}
+	if dir != CYPHER_DIR_OUT {
+		for _, e := range n.in {
+			// An undirected self loop was already returned by the out list.
+			if dir == CYPHER_DIR_BOTH && e.src == n {
+				continue
+			}
+			out = append(out, cypherHop{e, e.src})
+		}
+	}
+	return out
+}
+
+// matchPath calls emit with row extended by every match of path.
+func (ex *cypherExec) matchPath(path *cypherPath, row cypherRow, emit func(cypherRow)) error {
+	first := path.nodes[0]
+	var candidates []*graphNode
+	if bound, ok := row[first.variable]; ok && first.variable != "" {
+		n, isNode := bound.(*graphNode)
+		if !isNode {
+			return errCypher("%s is not a node", first.variable)
+		}
+		candidates = []*graphNode{n}
+	} else {
+		candidates = ex.g.sortedNodes()
+	}
+
+	used := make(map[*graphEdge]bool)
+	var step func(i int, n *graphNode, row cypherRow) error
+	step = func(i int, n *graphNode, row cypherRow) error {
+		if i == len(path.rels) {
+			emit(row)
+			return nil
+		}
+		rp, np := path.rels[i], path.nodes[i+1]
+
+		// bindRel binds the relationship variable (if any) and continues from to.
+		bindRel := func(relValue any, to *graphNode) error {
+			r := row
+			if rp.variable != "" {
+				if bound, ok := row[rp.variable]; ok {
+					if !graphSameRel(bound, relValue) {
+						return nil
+					}
+				}
+				r = row.with(rp.variable, relValue)
+			}
+			ok, err := nodeMatches(np, to, r)
+			if err != nil || !ok {
+				return err
+			}
+			return step(i+1, to, r.with(np.variable, to))
+		}
+
+		if !rp.varLength {
+			for _, h := range hops(n, rp.dir) {
+				if used[h.edge] {
+					continue
+				}
+				ok, err := relMatches(rp, h.edge, row)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				used[h.edge] = true
+				err = bindRel(h.edge, h.to)
+				used[h.edge] = false
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		// Variable length: depth-first over the paths of min..max hops.
+		var trail []any
+		var walk func(at *graphNode) error
+		walk = func(at *graphNode) error {
+			if len(trail) >= rp.min {
+				if err := bindRel(append([]any(nil), trail...), at); err != nil {
+					return err
+				}
+			}
+			if rp.max >= 0 && len(trail) >= rp.max {
+				return nil
+			}
+			for _, h := range hops(at, rp.dir) {
+				if used[h.edge] {
+					continue
+				}
+				ok, err := relMatches(rp, h.edge, row)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				used[h.edge] = true
+				trail = append(trail, h.edge)
+				err = walk(h.to)
+				trail = trail[:len(trail)-1]
+				used[h.edge] = false
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return walk(n)
+	}
+
+	for _, n := range candidates {
+		ok, err := nodeMatches(first, n, row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := step(0, n, row.with(first.variable, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// graphSameRel compares relationship bindings: single edges or edge lists.
+func graphSameRel(a, b any) bool {
+	la, aList := a.([]any)
+	lb, bList := b.([]any)
+	if aList != bList {
+		return false
+	}
+	if !aList {
+		return a == b
+	}
+	if len(la) != len(lb) {
+		return false
+	}
+	for i := range la {
+		if la[i] != lb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// evalProps evaluates the property map of a CREATE pattern; null values are skipped.
+func (ex *cypherExec) evalProps(entries []cypherMapEntry, row cypherRow) (graphProps, error) {
+	var props graphProps
+	for _, entry := range entries {
+		v, err := entry.value.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPropertyValue(v); err != nil {
+			return nil, err
+		}
+		if v != nil {
+			props.set(entry.key, v)
+			ex.stats.propertiesSet++
+		}
+	}
+	return props, nil
+}
+
+// checkPropertyValue rejects values that cannot be stored as properties.
+func checkPropertyValue(v any) error {
+	switch x := v.(type) {
+	case nil, bool, int64, float64, string:
+		return nil
+	case []any:
+		for _, item := range x {
+			if item == nil {
+				return errCypher("property lists cannot contain null")
+			}
+			if err := checkPropertyValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errCypher("nodes and relationships cannot be stored as properties")
+}
+
+func (ex *cypherExec) create(c *cypherCreate, rows []cypherRow) error {
+	for i, row := range rows {
+		for _, path := range c.patterns {
+			nodes := make([]*graphNode, len(path.nodes))
+			for j, np := range path.nodes {
+				if bound, ok := row[np.variable]; ok && np.variable != "" {
+					n, isNode := bound.(*graphNode)
+					if !isNode {
+						return errCypher("%s is not a node", np.variable)
+					}
+					nodes[j] = n
+					continue
+				}
+				props, err := ex.evalProps(np.props, row)
+				if err != nil {
+					return err
+				}
+				n := ex.g.AddNode(append([]string(nil), np.labels...), props)
+				ex.undo = append(ex.undo, func() { ex.g.DeleteNode(n) })
+				ex.stats.nodesCreated++
+				nodes[j] = n
+				row = row.with(np.variable, n)
+			}
+			for j, rp := range path.rels {
+				if len(rp.types) != 1 || rp.varLength || rp.dir == CYPHER_DIR_BOTH {
+					return errCypher("relationships must be created with exactly one type and a direction")
+				}
+				if _, ok := row[rp.variable]; ok && rp.variable != "" {
+					return errCypher("variable %s already declared", rp.variable)
+				}
+				props, err := ex.evalProps(rp.props, row)
+				if err != nil {
+					return err
+				}
+				src, dst := nodes[j], nodes[j+1]
+				if rp.dir == CYPHER_DIR_IN {
+					src, dst = dst, src
+				}
+				e := ex.g.AddEdge(src, dst, rp.types[0], props)
+				ex.undo = append(ex.undo, func() { ex.g.DeleteEdge(e) })
+				ex.stats.relsCreated++
+				row = row.with(rp.variable, e)
+			}
+		}
+		rows[i] = row
+	}
+	return nil
+}
+
+func (ex *cypherExec) delete(d *cypherDelete, rows []cypherRow) error {
+	nodes := make(map[*graphNode]bool)
+	edges := make(map[*graphEdge]bool)
+	var nodeOrder []*graphNode
+	var edgeOrder []*graphEdge
+	addEdge := func(e *graphEdge) {
+		if !edges[e] {
+			edges[e] = true
+			edgeOrder = append(edgeOrder, e)
+		}
+	}
+	for _, row := range rows {
+		for _, expr := range d.exprs {
+			v, err := expr.eval(row)
+			if err != nil {
+				return err
+			}
+			switch x := v.(type) {
+			case nil:
+			case *graphNode:
+				if !nodes[x] {
+					nodes[x] = true
+					nodeOrder = append(nodeOrder, x)
+				}
+			case *graphEdge:
+				addEdge(x)
+			case []any:
+				for _, item := range x {
+					if e, ok := item.(*graphEdge); ok {
+						addEdge(e)
+					}
+				}
+			default:
+				return errCypher("DELETE expects nodes or relationships")
+			}
+		}
+	}
+
+	for _, n := range nodeOrder {
+		for _, h := range hops(n, CYPHER_DIR_BOTH) {
+			if edges[h.edge] {
+				continue
+			}
+			if !d.detach {
+				return errCypher("cannot delete a node that still has relationships, use DETACH DELETE")
+			}
+			addEdge(h.edge)
+		}
+	}
+
+	for _, e := range edgeOrder {
+		if _, alive := ex.g.edges[e.id]; !alive {
+			continue
+		}
+		ex.g.DeleteEdge(e)
+		ex.undo = append(ex.undo, func() { ex.g.linkEdge(e) })
+		ex.stats.relsDeleted++
+	}
+	for _, n := range nodeOrder {
+		if _, alive := ex.g.nodes[n.id]; !alive {
+			continue
+		}
+		ex.g.DeleteNode(n)
+		ex.undo = append(ex.undo, func() { ex.g.restoreNode(n) })
+		ex.stats.nodesDeleted++
+	}
+	return nil
+}
+
+// cypherAggState accumulates one aggregation of one group.
+type cypherAggState struct {
+	count int64
+	sum   any
+	best  any
+	items []any
+	seen  map[string]bool
+}
+
+func (s *cypherAggState) add(call cypherCall, v any) error {
+	if call.star {
+		s.count++
+		return nil
+	}
+	if v == nil {
+		return nil
+	}
+	if call.distinct {
+		key := graphValueString(v)
+		if s.seen == nil {
+			s.seen = make(map[string]bool)
+		}
+		if s.seen[key] {
+			return nil
+		}
+		s.seen[key] = true
+	}
+	s.count++
+	switch call.name {
+	case "sum", "avg":
+		if _, ok := graphNumber(v); !ok {
+			return errCypher("%s expects numbers", call.name)
+		}
+		if s.sum == nil {
+			s.sum = v
+			return nil
+		}
+		sum, err := cypherArithmetic("+", s.sum, v)
+		if err != nil {
+			return err
+		}
+		s.sum = sum
+	case "min", "max":
+		if s.best == nil {
+			s.best = v
+			return nil
+		}
+		c := graphSortOrder(v, s.best)
+		if (call.name == "min" && c < 0) || (call.name == "max" && c > 0) {
+			s.best = v
+		}
+	case "collect":
+		s.items = append(s.items, v)
+	}
+	return nil
+}
+
+func (s *cypherAggState) result(call cypherCall) any {
+	switch call.name {
+	case "count":
+		return s.count
+	case "sum":
+		if s.sum == nil {
+			return int64(0)
+		}
+		return s.sum
+	case "avg":
+		if s.count == 0 {
+			return nil
+		}
+		f, _ := graphNumber(s.sum)
+		return f / float64(s.count)
+	case "min", "max":
+		return s.best
+	}
+	if s.items == nil {
+		return []any{}
+	}
+	return s.items
+}
+
+// project evaluates RETURN: grouping and aggregation, DISTINCT, ORDER BY,
+// SKIP and LIMIT.
+func (ex *cypherExec) project(r *cypherReturn, rows []cypherRow) (*cypherResult, error) {
+	res := &cypherResult{}
+	aggregated := false
+	for _, item := range r.items {
+		res.columns = append(res.columns, item.name)
+		if _, ok := item.expr.(cypherCall); ok && cypherHasAggregate(item.expr) {
+			aggregated = true
+		}
+	}
+
+	// envs keeps, for every output row, the bindings ORDER BY can refer to.
+	var envs []cypherRow
+	if !aggregated {
+		for _, row := range rows {
+			out := make([]any, len(r.items))
+			env := row.with("", nil)
+			for i, item := range r.items {
+				v, err := item.expr.eval(row)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = v
+				env[item.name] = v
+			}
+			res.rows = append(res.rows, out)
+			envs = append(envs, env)
+		}
+	} else {
+		type group struct {
+			row    cypherRow
+			keys   []any
+			states []*cypherAggState
+		}
+		var groups []*group
+		byKey := make(map[string]*group)
+		for _, row := range rows {
+			keys := make([]any, len(r.items))
+			var keyText strings.Builder
+			for i, item := range r.items {
+				if call, ok := item.expr.(cypherCall); ok && cypherAggregates[call.name] {
+					continue
+				}
+				v, err := item.expr.eval(row)
+				if err != nil {
+					return nil, err
+				}
+				keys[i] = v
+				fmt.Fprintf(&keyText, "%T:%s\x00", v, graphValueString(v))
+			}
+			g, ok := byKey[keyText.String()]
+			if !ok {
+				g = &group{row: row, keys: keys, states: make([]*cypherAggState, len(r.items))}
+				byKey[keyText.String()] = g
+				groups = append(groups, g)
+			}
+			for i, item := range r.items {
+				call, ok := item.expr.(cypherCall)
+				if !ok || !cypherAggregates[call.name] {
+					continue
+				}
+				if g.states[i] == nil {
+					g.states[i] = &cypherAggState{}
+				}
+				var v any
+				if !call.star {
+					var err error
+					if v, err = call.args[0].eval(row); err != nil {
+						return nil, err
+					}
+				}
+				if err := g.states[i].add(call, v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// Aggregating nothing without grouping keys still returns one row.
+		if len(groups) == 0 {
+			onlyAggregates := true
+			for _, item := range r.items {
+				if call, ok := item.expr.(cypherCall); !ok || !cypherAggregates[call.name] {
+					onlyAggregates = false
+				}
+			}
+			if onlyAggregates {
+				groups = append(groups, &group{row: cypherRow{}, keys: make([]any, len(r.items)), states: make([]*cypherAggState, len(r.items))})
+			}
+		}
+		for _, g := range groups {
+			out := make([]any, len(r.items))
+			env := cypherRow{}
+			for i, item := range r.items {
+				if call, ok := item.expr.(cypherCall); ok && cypherAggregates[call.name] {
+					if g.states[i] == nil {
+						g.states[i] = &cypherAggState{}
+					}
+					out[i] = g.states[i].result(call)
+				} else {
+					out[i] = g.keys[i]
+				}
+				env[item.name] = out[i]
+			}
+			res.rows = append(res.rows, out)
+			envs = append(envs, env)
+		}
+	}
+
+	if r.distinct {
+		seen := make(map[string]bool)
+		var rowsOut [][]any
+		var envsOut []cypherRow
+		for i, row := range res.rows {
+			var key strings.Builder
+			for _, v := range row {
+				fmt.Fprintf(&key, "%T:%s\x00", v, graphValueString(v))
+			}
+			if seen[key.String()] {
+				continue
+			}
+			seen[key.String()] = true
+			rowsOut = append(rowsOut, row)
+			envsOut = append(envsOut, envs[i])
+		}
+		res.rows, envs = rowsOut, envsOut
+	}
+
+	if len(r.orderBy) > 0 {
+		sortKeys := make([][]any, len(res.rows))
+		for i := range res.rows {
+			sortKeys[i] = make([]any, len(r.orderBy))
+			for j, o := range r.orderBy {
+				if v, ok := envs[i][o.text]; ok {
+					sortKeys[i][j] = v
+					continue
+				}
+				v, err := o.expr.eval(envs[i])
+				if err != nil {
+					return nil, err
+				}
+				sortKeys[i][j] = v
+			}
+		}
+		order := make([]int, len(res.rows))
+		for i := range order {
+			order[i] = i
+		}
+		sortStable(order, func(a, b int) bool {
+			for j, o := range r.orderBy {
+				c := graphSortOrder(sortKeys[a][j], sortKeys[b][j])
+				if c != 0 {
+					return (c < 0) != o.desc
+				}
+			}
+			return false
+		})
+		sorted := make([][]any, len(order))
+		for i, k := range order {
+			sorted[i] = res.rows[k]
+		}
+		res.rows = sorted
+	}
+
+	if r.skip > 0 {
+		res.rows = res.rows[min(r.skip, int64(len(res.rows))):]
+	}
+	if r.limit >= 0 && r.limit < int64(len(res.rows)) {
+		res.rows = res.rows[:r.limit]
+	}
+	return res, nil
+}
+
+// sortStable sorts indexes with less, keeping equal elements in order.
+func sortStable(idx []int, less func(a, b int) bool) {
+	// Insertion sort is enough for small results; switch to merge sort for large ones.
+	if len(idx) < 64 {
+		for i := 1; i < len(idx); i++ {
+			for j := i; j > 0 && less(idx[j], idx[j-1]); j-- {
+				idx[j], idx[j-1] = idx[j-1], idx[j]
+			}
+		}
+		return
+	}
+	mid := len(idx) / 2
+	left := append([]int(nil), idx[:mid]...)
+	right := append([]int(nil), idx[mid:]...)
+	sortStable(left, less)
+	sortStable(right, less)
+	i, j := 0, 0
+	for k := range idx {
+		if j >= len(right) || (i < len(left) && !less(right[j], left[i])) {
+			idx[k] = left[i]
+			i++
+		} else {
+			idx[k] = right[j]
+			j++
+		}
+	}
+}
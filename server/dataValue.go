@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+)
+
+// ValueType identifies the kind of value stored under a key.
+// Its numeric value is also the type tag written in the rdb file, so
+// existing constants must never be renumbered.
+type ValueType uint8
+
+const (
+	STRING_VALUE ValueType = iota
+	ZSET_VALUE
+	STREAM_VALUE
+	JSON_VALUE
+	BLOOM_VALUE
+	CMS_VALUE
+	TOPK_VALUE
+	TS_VALUE
+	VSET_VALUE
+	GRAPH_VALUE
+)
+
+// ErrWrongType is returned when a command is run against a key holding a
+// value of a different kind (e.g. ZADD on a string).
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// DataValue is implemented by every value type that can be stored in the KeyDataSpace.
+type DataValue interface {
+	// Type returns the kind of the value.
+	Type() ValueType
+	// DeepCopy returns an independent clone, used by rdb snapshots.
+	DeepCopy() DataValue
+}
+
+// valueTypeName returns the name used by Redis for the given value type.
+func valueTypeName(t ValueType) string {
+	switch t {
+	case STRING_VALUE:
+		return "string"
+	case ZSET_VALUE:
+		return "zset"
+	case STREAM_VALUE:
+		return "stream"
+	case JSON_VALUE:
+		return "ReJSON-RL"
+	case BLOOM_VALUE:
+		return "MBbloom--"
+	case CMS_VALUE:
+		return "CMSk-TYPE"
+	case TOPK_VALUE:
+		return "TopK-TYPE"
+	case TS_VALUE:
+		return "TSDB-TYPE"
+	case VSET_VALUE:
+		return "vectorset"
+	case GRAPH_VALUE:
+		return "graphdata"
+	default:
+		return "unknown"
+	}
+}
+
+// StringValue is the plain string value created by SET.
+type StringValue string
+
+func (v StringValue) Type() ValueType { return STRING_VALUE }
+
+func (v StringValue) DeepCopy() DataValue { return v }
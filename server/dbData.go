@@ -38,6 +38,16 @@ func initKeyDataSpace(dst **KeyDataSpace) {
 	}
 }
 
+// initKeyAccessSpace initializes a *KeyAccessSpace pointer if it is currently nil.
+func initKeyAccessSpace(dst **KeyAccessSpace) {
+	if dst == nil {
+		panic("KeyAccessSpace: nil destination pointer")
+	}
+	if *dst == nil {
+		*dst = NewKeyAccessSpace()
+	}
+}
+
 // printMemoryStatus builds a human-readable snapshot of in-memory structures,
 // prints it to stdout, and returns the same string.
 // Arguments:
@@ -89,7 +99,7 @@ func printMemoryStatus() {
 	}
 
 	// --- Map section ---
-	b.WriteString("KeyDataSpace (map[string]string):\n")
+	b.WriteString("KeyDataSpace (map[string]DataValue):\n")
 	if !keyDataSpace.IsInitialized() {
 		b.WriteString("  state: nil\n")
 	} else {
@@ -111,8 +121,8 @@ func printMemoryStatus() {
 			b.WriteString("  entries (sorted by key):\n")
 			for i := 0; i < limit; i++ {
 				k := keys[i]
-				v, _ := keyDataSpace.Get(k)
-				b.WriteString(fmt.Sprintf("    - %q: %q\n", k, v))
+				v, _ := keyDataSpace.GetValue(k)
+				b.WriteString(fmt.Sprintf("    - %q: %s\n", k, describeValue(v)))
 			}
 			if len(keys) > limit {
 				b.WriteString(fmt.Sprintf("    ... (%d more)\n", len(keys)-limit))
@@ -124,3 +134,32 @@ func printMemoryStatus() {
 	out := b.String()
 	fmt.Println(out)
 }
+
+// describeValue returns a short printable form of a value for printMemoryStatus:
+// strings are shown quoted, collections by type and size.
+func describeValue(v DataValue) string {
+	switch val := v.(type) {
+	case StringValue:
+		return fmt.Sprintf("%q", string(val))
+	case *SortedSet:
+		return fmt.Sprintf("<zset, %d members>", val.Len())
+	case *Stream:
+		return fmt.Sprintf("<stream, %d entries, %d groups>", val.Len(), len(val.groups))
+	case *JSONValue:
+		return fmt.Sprintf("<json, %s>", jsonTypeName(val.root))
+	case *BloomFilter:
+		return fmt.Sprintf("<bloom, %d items, %d filters>", val.Items(), len(val.links))
+	case *CountMinSketch:
+		return fmt.Sprintf("<cms, %dx%d, count %d>", val.width, val.depth, val.count)
+	case *TopK:
+		return fmt.Sprintf("<topk, %d/%d items>", val.heap.Len(), val.k)
+	case *TimeSeries:
+		return fmt.Sprintf("<timeseries, %d samples, %d rules>", len(val.samples), len(val.rules))
+	case *VectorSet:
+		return fmt.Sprintf("<vectorset, %d elements, dim %d>", val.Len(), val.dim)
+	case *Graph:
+		return fmt.Sprintf("<graph, %d nodes, %d edges>", len(val.nodes), len(val.edges))
+	default:
+		return "<" + valueTypeName(v.Type()) + ">"
+	}
+}
@@ -0,0 +1,230 @@
+// File: evict.go
+//
+// Purpose:
+//   The maxmemory limit. Before a command that may grow the dataset runs
+//   (see cmdDenyOOM), performEvictions compares maxmemoryUsed, the tracked
+//   size of the dataset and of its expiration and access bookkeeping, with
+//   maxmemory and, if it is exceeded, deletes keys chosen by maxmemory-policy
+//   until it drops under the limit:
+//     noeviction        reject the command with an OOM error
+//     allkeys-lru       the least recently used key
+//     allkeys-lfu       the least frequently used key
+//     allkeys-random    any key
+//     volatile-lru      like allkeys-lru, among keys with an expiration
+//     volatile-lfu      like allkeys-lfu, among keys with an expiration
+//     volatile-random   any key with an expiration
+//     volatile-ttl      the key with the nearest expiration
+//   When nothing can be evicted the command fails with the OOM error too.
+//
+//   As in Redis the policies are approximated: each round samples
+//   maxmemory-samples keys and merges them into a pool of the best
+//   EVPOOL_SIZE candidates seen so far, and the best one is evicted.
+//
+//   The limit does not apply to the whole Go heap: garbage not collected yet
+//   and the copies taken by the snapshot routine would make every write evict
+//   keys that are not using memory at all.
+//
+// Asymptotic costs:
+//   - performEvictions: O(1) when under the limit, O(samples) per evicted key
+//
+// Concurrency:
+//   - Evictions are serialized by evictMu and run inside KeyDataSpace.Update.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type evictionPolicy uint8
+
+const (
+	EVICT_NOEVICTION evictionPolicy = iota
+	EVICT_ALLKEYS_LRU
+	EVICT_ALLKEYS_LFU
+	EVICT_ALLKEYS_RANDOM
+	EVICT_VOLATILE_LRU
+	EVICT_VOLATILE_LFU
+	EVICT_VOLATILE_RANDOM
+	EVICT_VOLATILE_TTL
+)
+
+var evictionPolicyNames = []string{
+	"noeviction",
+	"allkeys-lru",
+	"allkeys-lfu",
+	"allkeys-random",
+	"volatile-lru",
+	"volatile-lfu",
+	"volatile-random",
+	"volatile-ttl",
+}
+
+// volatile reports whether the policy only evicts keys with an expiration.
+func (p evictionPolicy) volatile() bool {
+	return p >= EVICT_VOLATILE_LRU
+}
+
+// EVPOOL_SIZE is the number of candidates kept between eviction rounds.
+const EVPOOL_SIZE = 16
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+var (
+	configMu         sync.RWMutex
+	maxMemory        int64 // bytes, 0 for no limit
+	maxMemoryPolicy  = EVICT_NOEVICTION
+	maxMemorySamples = 5
+)
+
+// evictionSettings returns maxmemory, maxmemory-policy and maxmemory-samples.
+func evictionSettings() (int64, evictionPolicy, int) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return maxMemory, maxMemoryPolicy, maxMemorySamples
+}
+
+// maxmemoryUsed returns the bytes counted against maxmemory.
+func maxmemoryUsed() int64 {
+	return keyDataSpace.DatasetBytes() + keyExpirations.MemoryUsage() + keyAccess.MemoryUsage()
+}
+
+// evictionCandidate is a key of the eviction pool: the higher the score,
+// the better the candidate.
+type evictionCandidate struct {
+	key   string
+	score int64
+}
+
+var (
+	evictMu sync.Mutex
+	// evictionPool is sorted by ascending score; it is only touched
+	// while holding evictMu.
+	evictionPool []evictionCandidate
+)
+
+// performEvictions makes room for a command that may grow the dataset.
+// It returns errOOM if the memory is over the limit and cannot be freed.
+func performEvictions() error {
+	limit, policy, samples := evictionSettings()
+	if limit == 0 {
+		return nil
+	}
+
+	evictMu.Lock()
+	defer evictMu.Unlock()
+
+	if maxmemoryUsed() <= limit {
+		return nil
+	}
+	if policy == EVICT_NOEVICTION {
+		return errOOM
+	}
+
+	nowMs := time.Now().UnixMilli()
+	return keyDataSpace.Update(func(data map[string]DataValue) error {
+		// deleteKeyLocked updates the tracked sizes, so the usage is read
+		// again after each eviction.
+		for maxmemoryUsed() > limit {
+			key, ok := evictionCandidateLocked(data, policy, samples, nowMs)
+			if !ok {
+				return errOOM
+			}
+			deleteKeyLocked(data, key)
+		}
+		return nil
+	})
+}
+
+// evictionCandidateLocked picks the next key to evict.
+func evictionCandidateLocked(data map[string]DataValue, policy evictionPolicy, samples int, nowMs int64) (string, bool) {
+	switch policy {
+	case EVICT_ALLKEYS_RANDOM:
+		// Map iteration starts at a random position.
+		for key := range data {
+			return key, true
+		}
+		return "", false
+	case EVICT_VOLATILE_RANDOM:
+		for _, item := range keyExpirations.Sample(1) {
+			return item.key, true
+		}
+		return "", false
+	}
+
+	if policy.volatile() {
+		for _, item := range keyExpirations.Sample(samples) {
+			evictionPoolInsert(item.key, evictionScore(policy, item.key, item.expire_timestamp, nowMs))
+		}
+	} else {
+		n := 0
+		for key := range data {
+			if n == samples {
+				break
+			}
+			evictionPoolInsert(key, evictionScore(policy, key, NO_EXP_TS, nowMs))
+			n++
+		}
+	}
+
+	// Take the best candidate that still qualifies: the pool may hold keys
+	// deleted or persisted since they were sampled.
+	for len(evictionPool) > 0 {
+		c := evictionPool[len(evictionPool)-1]
+		evictionPool = evictionPool[:len(evictionPool)-1]
+		if _, ok := data[c.key]; !ok {
+			continue
+		}
+		if policy.volatile() && keyExpireAt(c.key) == NO_EXP_TS {
+			continue
+		}
+		return c.key, true
+	}
+	return "", false
+}
+
+// evictionScore rates a key for the LRU, LFU and TTL policies.
+func evictionScore(policy evictionPolicy, key string, expireAt, nowMs int64) int64 {
+	switch policy {
+	case EVICT_VOLATILE_TTL:
+		return math.MaxInt64 - expireAt
+	case EVICT_ALLKEYS_LFU, EVICT_VOLATILE_LFU:
+		a, ok := keyAccess.Get(key)
+		if !ok {
+			return 255 - LFU_INIT_VAL
+		}
+		return 255 - int64(a.freq(nowMs))
+	default:
+		a, ok := keyAccess.Get(key)
+		if !ok {
+			return 0
+		}
+		return nowMs - a.lastAccessMs
+	}
+}
+
+// evictionPoolInsert adds a candidate to the pool, dropping the worst one
+// when the pool is full.
+func evictionPoolInsert(key string, score int64) {
+	for i, c := range evictionPool {
+		if c.key == key {
+			evictionPool = append(evictionPool[:i], evictionPool[i+1:]...)
+			break
+		}
+	}
+	if len(evictionPool) == EVPOOL_SIZE {
+		if score <= evictionPool[0].score {
+			return
+		}
+		evictionPool = evictionPool[1:]
+	}
+	i := sort.Search(len(evictionPool), func(i int) bool { return evictionPool[i].score >= score })
+	evictionPool = append(evictionPool, evictionCandidate{})
+	copy(evictionPool[i+1:], evictionPool[i:])
+	evictionPool[i] = evictionCandidate{key: key, score: score}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Expiration command handlers. Expirations are unix timestamps in
+// milliseconds kept in keyExpirations; a key without an entry never expires.
+// Entries holding math.MaxInt64 were written by older versions to mean
+// "no expiration" and are read as such.
+
+// keyExpireAt returns the expiration of key, or NO_EXP_TS if it has none.
+func keyExpireAt(key string) int64 {
+	ts, ok := keyExpirations.FindExpiration(key)
+	if !ok || ts == math.MaxInt64 {
+		return NO_EXP_TS
+	}
+	return ts
+}
+
+// keyAliveLocked reports whether key exists and its expiration, if any, has
+// not passed yet (the expiration routine may not have removed it yet).
+func keyAliveLocked(data map[string]DataValue, key string, nowMs int64) bool {
+	if _, ok := data[key]; !ok {
+		return false
+	}
+	ts := keyExpireAt(key)
+	return ts == NO_EXP_TS || ts > nowMs
+}
+
+// Flags of the EXPIRE family.
+const (
+	EXPIRE_NX = 1 << iota // only if the key has no expiration
+	EXPIRE_XX             // only if the key has an expiration
+	EXPIRE_GT             // only if the new expiration is later (none counts as infinite)
+	EXPIRE_LT             // only if the new expiration is earlier
+)
+
+// parseExpireFlags parses the optional NX, XX, GT and LT flags.
+func parseExpireFlags(argv []string) (int, error) {
+	flags := 0
+	for _, arg := range argv {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			flags |= EXPIRE_NX
+		case "XX":
+			flags |= EXPIRE_XX
+		case "GT":
+			flags |= EXPIRE_GT
+		case "LT":
+			flags |= EXPIRE_LT
+		default:
+			return 0, errors.New("Unsupported option " + arg)
+		}
+	}
+	if flags&EXPIRE_NX != 0 && flags&^EXPIRE_NX != 0 {
+		return 0, errors.New("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flags&EXPIRE_GT != 0 && flags&EXPIRE_LT != 0 {
+		return 0, errors.New("GT and LT options at the same time are not compatible")
+	}
+	return flags, nil
+}
+
+// setExpireLocked applies an expiration if the flags allow it and reports
+// whether it was applied. A time not in the future deletes the key.
+// Must be called inside KeyDataSpace.Update.
+func setExpireLocked(data map[string]DataValue, key string, expireAt int64, flags int, nowMs int64) bool {
+	if !keyAliveLocked(data, key, nowMs) {
+		return false
+	}
+	current := keyExpireAt(key)
+	hasExpiration := current != NO_EXP_TS
+	switch {
+	case flags&EXPIRE_NX != 0 && hasExpiration,
+		flags&EXPIRE_XX != 0 && !hasExpiration,
+		flags&EXPIRE_GT != 0 && (!hasExpiration || expireAt <= current),
+		flags&EXPIRE_LT != 0 && hasExpiration && expireAt >= current:
+		return false
+	}
+
+	if expireAt <= nowMs {
+		deleteKeyLocked(data, key)
+	} else {
+		keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: expireAt})
+	}
+	return true
+}
+
+// expireGeneric implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT: unitMs is
+// 1000 for seconds, 1 for milliseconds; absolute tells whether the time is a
+// unix timestamp rather than relative to now.
+func expireGeneric(args, cmd string, unitMs int64, absolute bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	n, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	flags, err := parseExpireFlags(argv[2:])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	nowMs := time.Now().UnixMilli()
+	base := nowMs
+	if absolute {
+		base = 0
+	}
+	errInvalid := errors.New("invalid expire time in '" + cmd + "' command")
+	if n > (math.MaxInt64-base)/unitMs || n < math.MinInt64/unitMs {
+		return "NOT_OK", errInvalid
+	}
+	expireAt := base + n*unitMs
+
+	applied := false
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		applied = setExpireLocked(data, argv[0], expireAt, flags, nowMs)
+		return nil
+	})
+	if applied {
+		return intReply(1), nil
+	}
+	return intReply(0), nil
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+// Sets a timeout on key. Returns 1 if set, 0 if the key does not exist or
+// the condition is not met. A non-positive timeout deletes the key.
+func EXPIRE(args string) (string, error) {
+	return expireGeneric(args, "expire", 1000, false)
+}
+
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+// Like EXPIRE, in milliseconds.
+func PEXPIRE(args string) (string, error) {
+	return expireGeneric(args, "pexpire", 1, false)
+}
+
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+// Like EXPIRE, with an absolute unix time; a time in the past deletes the key.
+func EXPIREAT(args string) (string, error) {
+	return expireGeneric(args, "expireat", 1000, true)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+// Like EXPIREAT, in milliseconds.
+func PEXPIREAT(args string) (string, error) {
+	return expireGeneric(args, "pexpireat", 1, true)
+}
+
+// ttlGeneric implements TTL, PTTL, EXPIRETIME and PEXPIRETIME. It returns
+// -2 if the key does not exist and -1 if it has no expiration.
+func ttlGeneric(args, cmd string, unitMs int64, absolute bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+
+	nowMs := time.Now().UnixMilli()
+	res := int64(-2)
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		if !keyAliveLocked(data, argv[0], nowMs) {
+			return nil
+		}
+		expireAt := keyExpireAt(argv[0])
+		switch {
+		case expireAt == NO_EXP_TS:
+			res = -1
+		case absolute:
+			res = expireAt / unitMs
+		default:
+			// Round to the nearest unit, as Redis does for TTL.
+			res = (expireAt - nowMs + unitMs/2) / unitMs
+		}
+		return nil
+	})
+	return intReply(res), nil
+}
+
+// TTL key
+// Returns the remaining time to live in seconds, -1 if the key has no
+// expiration, -2 if it does not exist.
+func TTL(args string) (string, error) {
+	return ttlGeneric(args, "ttl", 1000, false)
+}
+
+// PTTL key
+// Like TTL, in milliseconds.
+func PTTL(args string) (string, error) {
+	return ttlGeneric(args, "pttl", 1, false)
+}
+
+// EXPIRETIME key
+// Returns the absolute unix time in seconds at which key expires, -1 if it
+// has no expiration, -2 if it does not exist.
+func EXPIRETIME(args string) (string, error) {
+	return ttlGeneric(args, "expiretime", 1000, true)
+}
+
+// PEXPIRETIME key
+// Like EXPIRETIME, in milliseconds.
+func PEXPIRETIME(args string) (string, error) {
+	return ttlGeneric(args, "pexpiretime", 1, true)
+}
+
+// PERSIST key
+// Removes the expiration of key. Returns 1 if it had one, 0 otherwise.
+func PERSIST(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("persist")
+	}
+
+	nowMs := time.Now().UnixMilli()
+	removed := false
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		if keyAliveLocked(data, argv[0], nowMs) && keyExpireAt(argv[0]) != NO_EXP_TS {
+			keyExpirations.Remove(argv[0])
+			removed = true
+		}
+		return nil
+	})
+	if removed {
+		return intReply(1), nil
+	}
+	return intReply(0), nil
+}
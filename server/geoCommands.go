@@ -0,0 +1,540 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geospatial command handlers. A geo index is a plain sorted set whose scores
+// are 52-bit geohashes (see geohash.go), so ZRANGE, ZREM & co. work on it too.
+
+// geoUnitFactor returns how many meters make one unit.
+func geoUnitFactor(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errors.New("unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// parseGeoCoords parses a longitude/latitude pair and checks it can be indexed.
+func parseGeoCoords(longStr, latStr string) (float64, float64, error) {
+	long, err := parseFloatArg(longStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, err := parseFloatArg(latStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !geoValidCoords(long, lat) {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", long, lat)
+	}
+	return long, lat, nil
+}
+
+// geoDistReply renders a distance with 4 decimals, as Redis does.
+func geoDistReply(meters, unitFactor float64) string {
+	return strconv.FormatFloat(meters/unitFactor, 'f', 4, 64)
+}
+
+// geoCoordReply renders a [longitude latitude] pair.
+func geoCoordReply(long, lat float64) string {
+	return arrayReply([]string{floatReply(long), floatReply(lat)})
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func GEOADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 4 {
+		return "NOT_OK", errWrongArgs("geoadd")
+	}
+	key := argv[0]
+
+	var nx, xx, ch bool
+	i := 1
+flags:
+	for ; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break flags
+		}
+	}
+
+	triples := argv[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return "NOT_OK", ErrSyntax
+	}
+	if nx && xx {
+		return "NOT_OK", errors.New("XX and NX options at the same time are not compatible")
+	}
+
+	// Validate every position before touching the keyspace: GEOADD is all or nothing.
+	scores := make([]float64, len(triples)/3)
+	for j := range scores {
+		long, lat, err := parseGeoCoords(triples[3*j], triples[3*j+1])
+		if err != nil {
+			return "NOT_OK", err
+		}
+		scores[j] = float64(geohashEncodeWGS84(long, lat, GEO_STEP_MAX).bits)
+	}
+
+	var added, updated int64
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, key)
+		if err != nil {
+			return err
+		}
+		if zset == nil {
+			if xx {
+				return nil
+			}
+			zset = NewSortedSet()
+		}
+
+		for j, score := range scores {
+			member := triples[3*j+2]
+			cur, exists := zset.Score(member)
+			if (exists && nx) || (!exists && xx) {
+				continue
+			}
+			zset.Add(score, member)
+			if !exists {
+				added++
+			} else if cur != score {
+				updated++
+			}
+		}
+
+		if zset.Len() > 0 {
+			data[key] = zset
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if added > 0 || updated > 0 {
+		keyReadyNotifier.Signal(key)
+	}
+	if ch {
+		return intReply(added + updated), nil
+	}
+	return intReply(added), nil
+}
+
+// geoMembersGeneric runs render on the score of each member of a geo index,
+// replying (nil) for missing members.
+func geoMembersGeneric(args string, cmd string, render func(score float64) string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	key := argv[0]
+
+	items := make([]string, len(argv)-1)
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, key)
+		if err != nil {
+			return err
+		}
+		for i, member := range argv[1:] {
+			items[i] = NIL_REPLY
+			if zset == nil {
+				continue
+			}
+			if score, ok := zset.Score(member); ok {
+				items[i] = render(score)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// GEOPOS key [member ...]
+func GEOPOS(args string) (string, error) {
+	return geoMembersGeneric(args, "geopos", func(score float64) string {
+		return geoCoordReply(geoDecodeScore(score))
+	})
+}
+
+// GEOHASH key [member ...]
+// Replies with the standard 11 characters geohash strings.
+func GEOHASH(args string) (string, error) {
+	return geoMembersGeneric(args, "geohash", func(score float64) string {
+		return geohashString(geoDecodeScore(score))
+	})
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func GEODIST(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 && len(argv) != 4 {
+		return "NOT_OK", errWrongArgs("geodist")
+	}
+	unitFactor := 1.0
+	if len(argv) == 4 {
+		if unitFactor, err = geoUnitFactor(argv[3]); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var result string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil {
+			return err
+		}
+		result = NIL_REPLY
+		if zset == nil {
+			return nil
+		}
+		score1, ok1 := zset.Score(argv[1])
+		score2, ok2 := zset.Score(argv[2])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		long1, lat1 := geoDecodeScore(score1)
+		long2, lat2 := geoDecodeScore(score2)
+		result = geoDistReply(geoDistance(long1, lat1, long2, lat2), unitFactor)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// geoSearchSpec holds the parsed options of GEOSEARCH / GEOSEARCHSTORE.
+type geoSearchSpec struct {
+	fromMember string // empty when FROMLONLAT is used
+	shape      geoShape
+	unitFactor float64
+	sortOrder  int // 0 unsorted, 1 ASC, -1 DESC
+	count      int64
+	any        bool
+
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// geoPoint is a member found by a search.
+type geoPoint struct {
+	member    string
+	score     float64
+	dist      float64
+	long, lat float64
+}
+
+// parseGeoSearchArgs parses the options following the source key.
+func parseGeoSearchArgs(argv []string, cmd string, store bool) (*geoSearchSpec, error) {
+	spec := &geoSearchSpec{}
+	var fromMember, fromLonLat, byRadius, byBox bool
+
+	for i := 0; i < len(argv); i++ {
+		remaining := len(argv) - i - 1
+		switch strings.ToUpper(argv[i]) {
+		case "FROMMEMBER":
+			if remaining < 1 {
+				return nil, ErrSyntax
+			}
+			spec.fromMember = argv[i+1]
+			fromMember = true
+			i++
+		case "FROMLONLAT":
+			if remaining < 2 {
+				return nil, ErrSyntax
+			}
+			long, lat, err := parseGeoCoords(argv[i+1], argv[i+2])
+			if err != nil {
+				return nil, err
+			}
+			spec.shape.long, spec.shape.lat = long, lat
+			fromLonLat = true
+			i += 2
+		case "BYRADIUS":
+			if remaining < 2 {
+				return nil, ErrSyntax
+			}
+			radius, err := parseFloatArg(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if radius < 0 {
+				return nil, errors.New("radius cannot be negative")
+			}
+			if spec.unitFactor, err = geoUnitFactor(argv[i+2]); err != nil {
+				return nil, err
+			}
+			spec.shape.radius = radius * spec.unitFactor
+			byRadius = true
+			i += 2
+		case "BYBOX":
+			if remaining < 3 {
+				return nil, ErrSyntax
+			}
+			width, err := parseFloatArg(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			height, err := parseFloatArg(argv[i+2])
+			if err != nil {
+				return nil, err
+			}
+			if width < 0 || height < 0 {
+				return nil, errors.New("height or width cannot be negative")
+			}
+			if spec.unitFactor, err = geoUnitFactor(argv[i+3]); err != nil {
+				return nil, err
+			}
+			spec.shape.isBox = true
+			spec.shape.width = width * spec.unitFactor
+			spec.shape.height = height * spec.unitFactor
+			byBox = true
+			i += 3
+		case "ASC":
+			spec.sortOrder = 1
+		case "DESC":
+			spec.sortOrder = -1
+		case "COUNT":
+			if remaining < 1 {
+				return nil, ErrSyntax
+			}
+			count, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if count <= 0 {
+				return nil, errors.New("COUNT must be > 0")
+			}
+			spec.count = count
+			i++
+			if i+1 < len(argv) && strings.ToUpper(argv[i+1]) == "ANY" {
+				spec.any = true
+				i++
+			}
+		case "WITHCOORD":
+			spec.withCoord = true
+		case "WITHDIST":
+			spec.withDist = true
+		case "WITHHASH":
+			spec.withHash = true
+		case "STOREDIST":
+			if !store {
+				return nil, ErrSyntax
+			}
+			spec.storeDist = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if fromMember == fromLonLat {
+		return nil, errors.New("exactly one of FROMMEMBER or FROMLONLAT can be specified for '" + cmd + "'")
+	}
+	if byRadius == byBox {
+		return nil, errors.New("exactly one of BYRADIUS and BYBOX can be specified for '" + cmd + "'")
+	}
+	if store && (spec.withCoord || spec.withDist || spec.withHash) {
+		return nil, errors.New("STORE option in '" + cmd + "' is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+
+	// A COUNT without ordering returns the closest members.
+	if spec.count > 0 && !spec.any && spec.sortOrder == 0 {
+		spec.sortOrder = 1
+	}
+	return spec, nil
+}
+
+// geoSearchLocked returns the members of zset inside the shape of spec, ordered
+// and limited as requested. The center must already be resolved.
+func geoSearchLocked(zset *SortedSet, spec *geoSearchSpec) []geoPoint {
+	var points []geoPoint
+	limit := int(spec.count)
+
+	// Cells never overlap, so each member is found at most once.
+scan:
+	for _, cell := range spec.shape.searchAreas() {
+		r := cell.scoreRange()
+		for x := zset.zsl.FirstInScoreRange(r); x != nil && r.lteMax(x.score); x = x.level[0].forward {
+			long, lat := geoDecodeScore(x.score)
+			dist, ok := spec.shape.distanceIfInShape(long, lat)
+			if !ok {
+				continue
+			}
+			points = append(points, geoPoint{member: x.member, score: x.score, dist: dist, long: long, lat: lat})
+			// With ANY the search stops as soon as enough matches are found.
+			if spec.any && len(points) == limit {
+				break scan
+			}
+		}
+	}
+
+	switch spec.sortOrder {
+	case 1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case -1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if limit > 0 && len(points) > limit {
+		points = points[:limit]
+	}
+	return points
+}
+
+// resolveGeoCenter sets the center of the search from FROMMEMBER, if used.
+func resolveGeoCenter(zset *SortedSet, spec *geoSearchSpec) error {
+	if spec.fromMember == "" {
+		return nil
+	}
+	score, ok := zset.Score(spec.fromMember)
+	if !ok {
+		return errors.New("could not decode requested zset member")
+	}
+	spec.shape.long, spec.shape.lat = geoDecodeScore(score)
+	return nil
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+//
+//	BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI
+//	[ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func GEOSEARCH(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 5 {
+		return "NOT_OK", errWrongArgs("geosearch")
+	}
+	spec, err := parseGeoSearchArgs(argv[1:], "geosearch", false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var points []geoPoint
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		if err := resolveGeoCenter(zset, spec); err != nil {
+			return err
+		}
+		points = geoSearchLocked(zset, spec)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	items := make([]string, len(points))
+	for i, p := range points {
+		if !spec.withDist && !spec.withHash && !spec.withCoord {
+			items[i] = bulkReply(p.member)
+			continue
+		}
+		item := []string{bulkReply(p.member)}
+		if spec.withDist {
+			item = append(item, geoDistReply(p.dist, spec.unitFactor))
+		}
+		if spec.withHash {
+			item = append(item, intReply(int64(p.score)))
+		}
+		if spec.withCoord {
+			item = append(item, geoCoordReply(p.long, p.lat))
+		}
+		items[i] = arrayReply(item)
+	}
+	return arrayReply(items), nil
+}
+
+// GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude
+//
+//	BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI
+//	[ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+//
+// Stores the matches in destination as a geo index (or, with STOREDIST, as a
+// sorted set scored by distance) and returns how many were stored.
+func GEOSEARCHSTORE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 6 {
+		return "NOT_OK", errWrongArgs("geosearchstore")
+	}
+	dest := argv[0]
+	spec, err := parseGeoSearchArgs(argv[2:], "geosearchstore", true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var stored int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[1])
+		if err != nil {
+			return err
+		}
+		var points []geoPoint
+		if zset != nil {
+			if err := resolveGeoCenter(zset, spec); err != nil {
+				return err
+			}
+			points = geoSearchLocked(zset, spec)
+		}
+
+		// The destination is overwritten, losing any previous expiration.
+		deleteKeyLocked(data, dest)
+		if len(points) > 0 {
+			out := NewSortedSet()
+			for _, p := range points {
+				if spec.storeDist {
+					out.Add(p.dist/spec.unitFactor, p.member)
+				} else {
+					out.Add(p.score, p.member)
+				}
+			}
+			data[dest] = out
+		}
+		stored = len(points)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if stored > 0 {
+		keyReadyNotifier.Signal(dest)
+	}
+	return intReply(int64(stored)), nil
+}
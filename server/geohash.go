@@ -0,0 +1,320 @@
+// File: geohash.go
+//
+// Purpose:
+//   Geohash helpers for the GEO commands, following the Redis implementation.
+//
+//   A position is encoded as a 52-bit integer interleaving 26 bits of latitude
+//   (even bits) and 26 bits of longitude (odd bits). The integer is used as the
+//   score of a sorted set member, so members that are close on the map are
+//   close in the skiplist and an area can be scanned with a score range.
+//
+//   A search around a point picks the geohash precision (step) whose cells are
+//   about as large as the search radius, then scans the cell containing the
+//   center plus its 8 neighbours, filtering candidates by exact distance.
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	GEO_STEP_MAX = 26 // 26*2 = 52 bits
+
+	GEO_LAT_MIN  = -85.05112878
+	GEO_LAT_MAX  = 85.05112878
+	GEO_LONG_MIN = -180.0
+	GEO_LONG_MAX = 180.0
+
+	// Earth's quatratic mean radius for WGS-84, as used by Redis.
+	GEO_EARTH_RADIUS_IN_METERS = 6372797.560856
+	GEO_MERCATOR_MAX           = 20037726.37
+)
+
+// geoHashBits is a geohash of 2*step bits.
+type geoHashBits struct {
+	bits uint64
+	step uint8
+}
+
+// geoArea is the rectangle covered by a geohash cell.
+type geoArea struct {
+	hash             geoHashBits
+	latMin, latMax   float64
+	longMin, longMax float64
+}
+
+// interleave64 spreads the bits of xlo on the even positions and the bits of
+// ylo on the odd positions of the result.
+func interleave64(xlo, ylo uint32) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	S := [...]uint{1, 2, 4, 8, 16}
+
+	x, y := uint64(xlo), uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | (x << S[i])) & B[i]
+		y = (y | (y << S[i])) & B[i]
+	}
+	return x | (y << 1)
+}
+
+// deinterleave64 is the inverse of interleave64: even bits are returned in the
+// low 32 bits, odd bits in the high 32 bits.
+func deinterleave64(interleaved uint64) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	S := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x, y := interleaved, interleaved>>1
+	for i := 0; i < 6; i++ {
+		x = (x | (x >> S[i])) & B[i]
+		y = (y | (y >> S[i])) & B[i]
+	}
+	return x | (y << 32)
+}
+
+// geoValidCoords reports whether the pair can be indexed.
+func geoValidCoords(long, lat float64) bool {
+	return long >= GEO_LONG_MIN && long <= GEO_LONG_MAX && lat >= GEO_LAT_MIN && lat <= GEO_LAT_MAX
+}
+
+// geohashEncode encodes a position with the given precision, within the given
+// latitude range (the GEO index uses the Mercator range, GEOHASH the full one).
+func geohashEncode(long, lat float64, latMin, latMax float64, step uint8) geoHashBits {
+	latOffset := (lat - latMin) / (latMax - latMin)
+	longOffset := (long - GEO_LONG_MIN) / (GEO_LONG_MAX - GEO_LONG_MIN)
+	scale := float64(uint64(1) << step)
+	return geoHashBits{
+		bits: interleave64(uint32(latOffset*scale), uint32(longOffset*scale)),
+		step: step,
+	}
+}
+
+// geohashEncodeWGS84 encodes a position for the GEO index.
+func geohashEncodeWGS84(long, lat float64, step uint8) geoHashBits {
+	return geohashEncode(long, lat, GEO_LAT_MIN, GEO_LAT_MAX, step)
+}
+
+// geohashDecode returns the cell covered by hash.
+func geohashDecode(hash geoHashBits) geoArea {
+	separated := deinterleave64(hash.bits)
+	ilato := uint32(separated)
+	ilono := uint32(separated >> 32)
+
+	latScale := GEO_LAT_MAX - GEO_LAT_MIN
+	longScale := GEO_LONG_MAX - GEO_LONG_MIN
+	div := float64(uint64(1) << hash.step)
+
+	return geoArea{
+		hash:    hash,
+		latMin:  GEO_LAT_MIN + (float64(ilato)/div)*latScale,
+		latMax:  GEO_LAT_MIN + ((float64(ilato)+1)/div)*latScale,
+		longMin: GEO_LONG_MIN + (float64(ilono)/div)*longScale,
+		longMax: GEO_LONG_MIN + ((float64(ilono)+1)/div)*longScale,
+	}
+}
+
+// geoDecodeScore returns the position stored as a sorted set score.
+func geoDecodeScore(score float64) (float64, float64) {
+	area := geohashDecode(geoHashBits{bits: uint64(score), step: GEO_STEP_MAX})
+	long := math.Max(GEO_LONG_MIN, math.Min(GEO_LONG_MAX, (area.longMin+area.longMax)/2))
+	lat := math.Max(GEO_LAT_MIN, math.Min(GEO_LAT_MAX, (area.latMin+area.latMax)/2))
+	return long, lat
+}
+
+// geoMoveX moves hash by d cells along the longitude (odd bits).
+func geoMoveX(hash geoHashBits, d int) geoHashBits {
+	if d == 0 {
+		return hash
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+	return geoHashBits{bits: x | y, step: hash.step}
+}
+
+// geoMoveY moves hash by d cells along the latitude (even bits).
+func geoMoveY(hash geoHashBits, d int) geoHashBits {
+	if d == 0 {
+		return hash
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+	return geoHashBits{bits: x | y, step: hash.step}
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180.0) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180.0) }
+
+// geoLatDistance returns the distance in meters between two latitudes.
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return GEO_EARTH_RADIUS_IN_METERS * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the haversine distance in meters between two points.
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, long1r := degRad(lat1), degRad(long1)
+	lat2r, long2r := degRad(lat2), degRad(long2)
+	v := math.Sin((long2r - long1r) / 2)
+	// Same longitude: the distance is the latitude difference.
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * GEO_EARTH_RADIUS_IN_METERS * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area of a GEOSEARCH: a circle (radius) or a box (width/height),
+// all in meters, centered on (long, lat).
+type geoShape struct {
+	long, lat     float64
+	isBox         bool
+	radius        float64
+	width, height float64
+}
+
+// distanceIfInShape returns the distance from the center and whether the point
+// lies inside the shape.
+func (s *geoShape) distanceIfInShape(long, lat float64) (float64, bool) {
+	if !s.isBox {
+		d := geoDistance(s.long, s.lat, long, lat)
+		return d, d <= s.radius
+	}
+	if geoLatDistance(lat, s.lat) > s.height/2 {
+		return 0, false
+	}
+	if geoDistance(long, lat, s.long, lat) > s.width/2 {
+		return 0, false
+	}
+	return geoDistance(s.long, s.lat, long, lat), true
+}
+
+// boundingBox returns longMin, latMin, longMax, latMax of the shape.
+func (s *geoShape) boundingBox() (float64, float64, float64, float64) {
+	height, width := s.radius, s.radius
+	if s.isBox {
+		height, width = s.height/2, s.width/2
+	}
+	latDelta := radDeg(height / GEO_EARTH_RADIUS_IN_METERS)
+	longDeltaTop := radDeg(width / GEO_EARTH_RADIUS_IN_METERS / math.Cos(degRad(s.lat+latDelta)))
+	longDeltaBottom := radDeg(width / GEO_EARTH_RADIUS_IN_METERS / math.Cos(degRad(s.lat-latDelta)))
+
+	// The widest longitude delta is on the side closer to the pole.
+	longDelta := longDeltaTop
+	if s.lat < 0 {
+		longDelta = longDeltaBottom
+	}
+	return s.long - longDelta, s.lat - latDelta, s.long + longDelta, s.lat + latDelta
+}
+
+// geoEstimateStepsByRadius returns the precision whose cells are about as
+// large as rangeMeters at the given latitude.
+func geoEstimateStepsByRadius(rangeMeters float64, lat float64) uint8 {
+	if rangeMeters == 0 {
+		return GEO_STEP_MAX
+	}
+	step := 1
+	for rangeMeters < GEO_MERCATOR_MAX {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // Make sure range is included in most of the base cases.
+
+	// Cells get narrower towards the poles.
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint8(max(1, min(step, GEO_STEP_MAX)))
+}
+
+// searchAreas returns the cells to scan for the shape: the center cell and its
+// neighbours, minus the ones that cannot intersect the bounding box.
+func (s *geoShape) searchAreas() []geoHashBits {
+	longMin, latMin, longMax, latMax := s.boundingBox()
+	radius := s.radius
+	if s.isBox {
+		radius = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+
+	steps := geoEstimateStepsByRadius(radius, s.lat)
+	hash := geohashEncodeWGS84(s.long, s.lat, steps)
+
+	// If the neighbours do not cover the whole bounding box, use bigger cells.
+	if steps > 1 {
+		north := geohashDecode(geoMoveY(hash, 1))
+		south := geohashDecode(geoMoveY(hash, -1))
+		east := geohashDecode(geoMoveX(hash, 1))
+		west := geohashDecode(geoMoveX(hash, -1))
+		if north.latMax < latMax || south.latMin > latMin || east.longMax < longMax || west.longMin > longMin {
+			steps--
+			hash = geohashEncodeWGS84(s.long, s.lat, steps)
+		}
+	}
+	center := geohashDecode(hash)
+
+	var areas []geoHashBits
+	seen := make(map[uint64]bool)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			// Skip neighbours lying entirely outside the bounding box.
+			if steps >= 2 {
+				if (dy < 0 && center.latMin < latMin) || (dy > 0 && center.latMax > latMax) ||
+					(dx < 0 && center.longMin < longMin) || (dx > 0 && center.longMax > longMax) {
+					continue
+				}
+			}
+			cell := geoMoveY(geoMoveX(hash, dx), dy)
+			if !seen[cell.bits] {
+				seen[cell.bits] = true
+				areas = append(areas, cell)
+			}
+		}
+	}
+	return areas
+}
+
+// scoreRange returns the sorted set scores covered by a cell: [min, max).
+func (h geoHashBits) scoreRange() *scoreRange {
+	shift := uint(GEO_STEP_MAX-h.step) * 2
+	return &scoreRange{
+		min:   float64(h.bits << shift),
+		max:   float64((h.bits + 1) << shift),
+		maxex: true,
+	}
+}
+
+// geohashString returns the standard 11 characters geohash of a position,
+// computed over the full [-90, 90] latitude range like geohash.org.
+func geohashString(long, lat float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	hash := geohashEncode(long, lat, -90, 90, GEO_STEP_MAX)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := uint64(0)
+		// The 52 bits fill 10 characters plus 2 bits; the last character is padded.
+		if i < 10 {
+			idx = (hash.bits >> (52 - uint((i+1)*5))) & 0x1f
+		}
+		buf[i] = alphabet[idx]
+	}
+	return string(buf)
+}
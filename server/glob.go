@@ -0,0 +1,118 @@
+// File: glob.go
+//
+// Purpose:
+//   Glob-style pattern matching used by KEYS and the MATCH option of the
+//   SCAN family, with the same syntax as Redis:
+//     *        any sequence of bytes, including the empty one
+//     ?        exactly one byte
+//     [abc]    one byte of the set; [^abc] one byte not in the set;
+//              [a-z] a range (reversed ranges like [z-a] are accepted)
+//     \x       the byte x literally, also inside [...]
+//   Matching works on bytes, like Redis.
+//
+// Asymptotic costs:
+//   - globMatch: O(len(pattern) * len(s)) in the worst case. Only the last
+//     '*' is ever backtracked to, so patterns with many stars do not blow up
+//     exponentially.
+//
+// Concurrency:
+//   - Pure functions, safe for concurrent use.
+
+package main
+
+// globMatch reports whether s matches the glob pattern.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starI = p, i
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if next, ok := globMatchClass(pattern, p+1, s[i]); ok {
+					p = next
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					if pattern[p+1] == s[i] {
+						p += 2
+						i++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		// Mismatch: let the last '*' swallow one more byte, if there is one.
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchClass matches c against the set starting at pattern[p], just past
+// the '['. It returns the index following the closing ']' and whether c is
+// in the set. An unterminated set extends to the end of the pattern.
+func globMatchClass(pattern string, p int, c byte) (int, bool) {
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	match := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			if pattern[p+1] == c {
+				match = true
+			}
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				match = true
+			}
+			p += 3
+		default:
+			if pattern[p] == c {
+				match = true
+			}
+			p++
+		}
+	}
+	if p < len(pattern) {
+		p++ // the closing ']'
+	}
+	return p, match != negate
+}
@@ -0,0 +1,395 @@
+// File: graph.go
+//
+// Purpose:
+//   Property graph value type for the GRAPH.* commands, modelled after
+//   RedisGraph. Queries are written in a Cypher subset (see cypher.go).
+//
+//   A graph holds nodes and directed edges (relationships):
+//     - a node has an id, any number of labels and properties;
+//     - an edge has an id, exactly one type, a source and a destination node
+//       and properties.
+//   Property values are int64, float64, string, bool or lists of those.
+//   Ids are assigned incrementally and never reused.
+//
+//   Every node keeps its outgoing and incoming edges, so traversals cost
+//   O(degree) per hop.
+//
+// Asymptotic costs:
+//   - Add node / edge: O(1)
+//   - Delete edge: O(degree of its endpoints)
+//   - Label scan: O(n log n), nodes are visited in id order
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; graphs live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// graphProps is an ordered list of properties.
+type graphProps []graphProp
+
+type graphProp struct {
+	key   string
+	value any
+}
+
+func (p graphProps) get(key string) (any, bool) {
+	for _, prop := range p {
+		if prop.key == key {
+			return prop.value, true
+		}
+	}
+	return nil, false
+}
+
+// set adds or replaces a property; a nil value removes it.
+func (p *graphProps) set(key string, value any) {
+	for i, prop := range *p {
+		if prop.key == key {
+			if value == nil {
+				*p = append((*p)[:i], (*p)[i+1:]...)
+			} else {
+				(*p)[i].value = value
+			}
+			return
+		}
+	}
+	if value != nil {
+		*p = append(*p, graphProp{key, value})
+	}
+}
+
+type graphNode struct {
+	id      uint64
+	labels  []string
+	props   graphProps
+	out, in []*graphEdge
+}
+
+func (n *graphNode) hasLabel(label string) bool {
+	for _, l := range n.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+type graphEdge struct {
+	id       uint64
+	relType  string
+	src, dst *graphNode
+	props    graphProps
+}
+
+// Graph is the graph value type.
+type Graph struct {
+	nextNodeID uint64
+	nextEdgeID uint64
+	nodes      map[uint64]*graphNode
+	edges      map[uint64]*graphEdge
+}
+
+// NewGraph creates an empty graph.
+func NewGraph() *Graph {
+	return &Graph{
+		nodes: make(map[uint64]*graphNode),
+		edges: make(map[uint64]*graphEdge),
+	}
+}
+
+func (g *Graph) Type() ValueType { return GRAPH_VALUE }
+
+func (g *Graph) DeepCopy() DataValue {
+	clone := NewGraph()
+	clone.nextNodeID, clone.nextEdgeID = g.nextNodeID, g.nextEdgeID
+	for id, n := range g.nodes {
+		clone.nodes[id] = &graphNode{
+			id:     id,
+			labels: append([]string(nil), n.labels...),
+			props:  graphCopyProps(n.props),
+		}
+	}
+	for _, e := range g.sortedEdges() {
+		clone.linkEdge(&graphEdge{
+			id:      e.id,
+			relType: e.relType,
+			src:     clone.nodes[e.src.id],
+			dst:     clone.nodes[e.dst.id],
+			props:   graphCopyProps(e.props),
+		})
+	}
+	return clone
+}
+
+func graphCopyProps(p graphProps) graphProps {
+	out := make(graphProps, len(p))
+	for i, prop := range p {
+		out[i] = graphProp{prop.key, graphCopyValue(prop.value)}
+	}
+	return out
+}
+
+func graphCopyValue(v any) any {
+	if list, ok := v.([]any); ok {
+		out := make([]any, len(list))
+		for i, item := range list {
+			out[i] = graphCopyValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// AddNode creates a node.
+func (g *Graph) AddNode(labels []string, props graphProps) *graphNode {
+	n := &graphNode{id: g.nextNodeID, labels: labels, props: props}
+	g.nextNodeID++
+	g.nodes[n.id] = n
+	return n
+}
+
+// AddEdge creates an edge from src to dst.
+func (g *Graph) AddEdge(src, dst *graphNode, relType string, props graphProps) *graphEdge {
+	e := &graphEdge{id: g.nextEdgeID, relType: relType, src: src, dst: dst, props: props}
+	g.nextEdgeID++
+	g.linkEdge(e)
+	return e
+}
+
+// linkEdge registers an edge in the graph and in the adjacency of its endpoints.
+func (g *Graph) linkEdge(e *graphEdge) {
+	g.edges[e.id] = e
+	e.src.out = append(e.src.out, e)
+	e.dst.in = append(e.dst.in, e)
+}
+
+// DeleteEdge removes an edge.
+func (g *Graph) DeleteEdge(e *graphEdge) {
+	delete(g.edges, e.id)
+	e.src.out = graphWithoutEdge(e.src.out, e)
+	e.dst.in = graphWithoutEdge(e.dst.in, e)
+}
+
+func graphWithoutEdge(edges []*graphEdge, e *graphEdge) []*graphEdge {
+	for i, x := range edges {
+		if x == e {
+			return append(edges[:i], edges[i+1:]...)
+		}
+	}
+	return edges
+}
+
+// DeleteNode removes a node, which must not have edges left.
+func (g *Graph) DeleteNode(n *graphNode) {
+	delete(g.nodes, n.id)
+}
+
+// restoreNode puts back a node removed by DeleteNode.
+func (g *Graph) restoreNode(n *graphNode) {
+	g.nodes[n.id] = n
+}
+
+// sortedNodes returns the nodes in id order.
+func (g *Graph) sortedNodes() []*graphNode {
+	nodes := make([]*graphNode, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// sortedEdges returns the edges in id order.
+func (g *Graph) sortedEdges() []*graphEdge {
+	edges := make([]*graphEdge, 0, len(g.edges))
+	for _, e := range g.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].id < edges[j].id })
+	return edges
+}
+
+// --- Values ---
+//
+// Query values are nil, bool, int64, float64, string, []any, *graphNode and
+// *graphEdge.
+
+// graphNumber returns v as a float64 if it is a number.
+func graphNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// graphEquals compares two non-null values.
+func graphEquals(a, b any) bool {
+	if x, ok := graphNumber(a); ok {
+		y, ok := graphNumber(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i] == nil || y[i] == nil || !graphEquals(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// graphCompare orders two values of the same kind; ok is false when they
+// cannot be compared.
+func graphCompare(a, b any) (int, bool) {
+	if x, ok := graphNumber(a); ok {
+		y, ok := graphNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// graphSortOrder is a total order used by ORDER BY: values of different
+// kinds are ordered by kind, nulls last.
+func graphSortOrder(a, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case *graphNode:
+			return 0
+		case *graphEdge:
+			return 1
+		case []any:
+			return 2
+		case string:
+			return 3
+		case bool:
+			return 4
+		case int64, float64:
+			return 5
+		case nil:
+			return 7
+		}
+		return 6
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	if c, ok := graphCompare(a, b); ok {
+		return c
+	}
+	return strings.Compare(graphValueString(a), graphValueString(b))
+}
+
+// graphValueString renders a value as text, as used by string concatenation
+// and toString.
+func graphValueString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) || x != math.Trunc(x) {
+			return floatReply(x)
+		}
+		return strconv.FormatFloat(x, 'f', 1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case []any:
+		parts := make([]string, len(x))
+		for i, item := range x {
+			parts[i] = graphValueString(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *graphNode:
+		return fmt.Sprintf("(%d)", x.id)
+	case *graphEdge:
+		return fmt.Sprintf("[%d]", x.id)
+	}
+	return ""
+}
+
+// graphValueReply renders a value as a reply item. Nodes are rendered as
+// [id [labels...] [key value ...]], edges as [id type src dst [key value ...]].
+func graphValueReply(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return NIL_REPLY
+	case string:
+		return x
+	case []any:
+		items := make([]string, len(x))
+		for i, item := range x {
+			items[i] = graphValueReply(item)
+		}
+		return arrayReply(items)
+	case *graphNode:
+		return arrayReply([]string{
+			intReply(int64(x.id)),
+			arrayReply(x.labels),
+			graphPropsReply(x.props),
+		})
+	case *graphEdge:
+		return arrayReply([]string{
+			intReply(int64(x.id)),
+			x.relType,
+			intReply(int64(x.src.id)),
+			intReply(int64(x.dst.id)),
+			graphPropsReply(x.props),
+		})
+	}
+	return graphValueString(v)
+}
+
+func graphPropsReply(p graphProps) string {
+	items := make([]string, 0, 2*len(p))
+	for _, prop := range p {
+		items = append(items, prop.key, graphValueReply(prop.value))
+	}
+	return arrayReply(items)
+}
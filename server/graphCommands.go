@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Graph command handlers. Graphs are *Graph values (see graph.go) queried
+// with the Cypher subset implemented in cypher.go.
+
+// lookupGraph returns the graph stored at key, nil if the key does not exist,
+// or ErrWrongType if the key holds another kind of value.
+func lookupGraph(data map[string]DataValue, key string) (*Graph, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	g, ok := value.(*Graph)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return g, nil
+}
+
+// parseGraphQueryArgs parses "key query" and compiles the query, which must
+// be passed as a single (usually quoted) argument.
+func parseGraphQueryArgs(args, cmd string) (string, *cypherQuery, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "", nil, errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "", nil, errWrongArgs(cmd)
+	}
+	query := argv[1]
+	if strings.HasPrefix(query, `"`) {
+		if query, err = strconv.Unquote(query); err != nil {
+			return "", nil, ErrSyntax
+		}
+	}
+	q, err := parseCypher(query)
+	if err != nil {
+		return "", nil, err
+	}
+	return argv[0], q, nil
+}
+
+// GRAPH.QUERY key query
+// Runs a Cypher query against the graph at key, creating the graph when a
+// write query runs against a missing key. Queries with RETURN reply with
+// [[columns...] [[row values...] ...] [statistics...]], other queries with
+// [[statistics...]]. A query failing halfway leaves the graph unchanged.
+func GRAPH_QUERY(args string) (string, error) {
+	key, q, err := parseGraphQueryArgs(args, "graph.query")
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return runGraphQuery(key, q)
+}
+
+// GRAPH.RO_QUERY key query
+// Like GRAPH.QUERY, but rejects queries that modify the graph.
+func GRAPH_RO_QUERY(args string) (string, error) {
+	key, q, err := parseGraphQueryArgs(args, "graph.ro_query")
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if q.writes() {
+		return "NOT_OK", errors.New("graph.RO_QUERY is to be executed only on read-only queries")
+	}
+	return runGraphQuery(key, q)
+}
+
+func runGraphQuery(key string, q *cypherQuery) (string, error) {
+	start := time.Now()
+	var res *cypherResult
+	var stats cypherStats
+
+	run := func(g *Graph) error {
+		var err error
+		res, stats, err = runCypher(g, q)
+		return err
+	}
+
+	var err error
+	if q.writes() {
+		err = keyDataSpace.Update(func(data map[string]DataValue) error {
+			g, err := lookupGraph(data, key)
+			if err != nil {
+				return err
+			}
+			created := g == nil
+			if created {
+				g = NewGraph()
+			}
+			if err := run(g); err != nil {
+				return err
+			}
+			if created {
+				data[key] = g
+			}
+			return nil
+		})
+	} else {
+		err = keyDataSpace.View(func(data map[string]DataValue) error {
+			g, err := lookupGraph(data, key)
+			if err != nil {
+				return err
+			}
+			if g == nil {
+				g = NewGraph()
+			}
+			return run(g)
+		})
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	elapsed := float64(time.Since(start).Nanoseconds()) / 1e6
+	statsReply := arrayReply(graphStatsLines(stats, elapsed))
+	if res == nil {
+		return arrayReply([]string{statsReply}), nil
+	}
+	rows := make([]string, len(res.rows))
+	for i, row := range res.rows {
+		values := make([]string, len(row))
+		for j, v := range row {
+			values[j] = graphValueReply(v)
+		}
+		rows[i] = arrayReply(values)
+	}
+	return arrayReply([]string{arrayReply(res.columns), arrayReply(rows), statsReply}), nil
+}
+
+// graphStatsLines lists the non-zero change counters followed by the
+// execution time, as RedisGraph does.
+func graphStatsLines(stats cypherStats, elapsedMs float64) []string {
+	var lines []string
+	counters := []struct {
+		name  string
+		value int
+	}{
+		{"Nodes created", stats.nodesCreated},
+		{"Properties set", stats.propertiesSet},
+		{"Relationships created", stats.relsCreated},
+		{"Nodes deleted", stats.nodesDeleted},
+		{"Relationships deleted", stats.relsDeleted},
+	}
+	for _, c := range counters {
+		if c.value > 0 {
+			lines = append(lines, c.name+": "+strconv.Itoa(c.value))
+		}
+	}
+	return append(lines, "Query internal execution time: "+strconv.FormatFloat(elapsedMs, 'f', 6, 64)+" milliseconds")
+}
+
+// GRAPH.DELETE key
+// Deletes the graph at key.
+func GRAPH_DELETE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("graph.delete")
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		g, err := lookupGraph(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if g == nil {
+			return errors.New("Invalid graph operation on empty key")
+		}
+		deleteKeyLocked(data, argv[0])
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
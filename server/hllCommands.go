@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+)
+
+// HyperLogLog command handlers. HLLs are string values (see hyperLogLog.go),
+// so they keep the expiration semantics and persistence of strings.
+
+// lookupHLL returns the registers of the HLL stored at key, nil if the key does
+// not exist, or an error if the key does not hold a valid HLL.
+func lookupHLL(data map[string]DataValue, key string) (*hllRegisters, string, error) {
+	str, found, err := lookupString(data, key)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return nil, "", nil
+	}
+	regs, err := decodeHLL(str)
+	if err != nil {
+		return nil, "", err
+	}
+	return regs, str, nil
+}
+
+// PFADD key [element ...]
+// Returns 1 if the HLL was created or at least one register changed, 0 otherwise.
+func PFADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("pfadd")
+	}
+	key := argv[0]
+
+	updated := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		regs, _, err := lookupHLL(data, key)
+		if err != nil {
+			return err
+		}
+		if regs == nil {
+			regs = &hllRegisters{}
+			updated = true
+		}
+		for _, element := range argv[1:] {
+			if regs.Add(element) {
+				updated = true
+			}
+		}
+		if updated {
+			storeStringLocked(data, key, encodeHLL(regs, 0, false))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if updated {
+		return "1", nil
+	}
+	return "0", nil
+}
+
+// PFCOUNT key [key ...]
+// With a single key the estimate is cached in the HLL header; with several keys
+// the cardinality of their union is returned.
+func PFCOUNT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("pfcount")
+	}
+
+	var card uint64
+	if len(argv) == 1 {
+		key := argv[0]
+		err = keyDataSpace.Update(func(data map[string]DataValue) error {
+			regs, str, err := lookupHLL(data, key)
+			if err != nil || regs == nil {
+				return err
+			}
+			if cached, ok := hllCachedCount(str); ok {
+				card = cached
+				return nil
+			}
+			card = regs.Count()
+			storeStringLocked(data, key, encodeHLL(regs, card, true))
+			return nil
+		})
+	} else {
+		err = keyDataSpace.View(func(data map[string]DataValue) error {
+			union := &hllRegisters{}
+			for _, key := range argv {
+				regs, _, err := lookupHLL(data, key)
+				if err != nil {
+					return err
+				}
+				if regs != nil {
+					union.Merge(regs)
+				}
+			}
+			card = union.Count()
+			return nil
+		})
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(card)), nil
+}
+
+// PFMERGE destkey [sourcekey ...]
+// Stores in destkey the union of destkey (if it exists) and the source HLLs.
+func PFMERGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("pfmerge")
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		union := &hllRegisters{}
+		for _, key := range argv {
+			regs, _, err := lookupHLL(data, key)
+			if err != nil {
+				return err
+			}
+			if regs != nil {
+				union.Merge(regs)
+			}
+		}
+		storeStringLocked(data, argv[0], encodeHLL(union, 0, false))
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
@@ -0,0 +1,559 @@
+// File: json.go
+//
+// Purpose:
+//   Native JSON document type for the JSON.* commands, with the JSONPath
+//   subset used to address nested values.
+//
+//   Documents are parsed once into a tree of Go values, so commands read and
+//   mutate nested fields in place instead of re-parsing the whole text:
+//     null -> nil, true/false -> bool, numbers -> json.Number (the literal is
+//     kept, so integers never lose precision), strings -> string,
+//     arrays -> *jsonArray, objects -> *jsonObject (insertion ordered).
+//
+//   Paths:
+//     - JSONPath, starting with '$': $, .key, ['key'], [index] (negative counts
+//       from the end), .* and [*] wildcards, ..key / ..* recursive descent.
+//       Commands reply with one result per match.
+//     - legacy paths, as in RedisJSON v1: "." is the root and "a.b[0]" is read
+//       as "$.a.b[0]". Commands reply with the first match only, and fail when
+//       nothing matches.
+//
+// Asymptotic costs:
+//   - parsing / serialization: O(size of the document)
+//   - path evaluation: O(depth) for plain paths, O(size of the document) for
+//     wildcards and recursive descent
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; documents live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrJSONPathSyntax = errors.New("JSONPath syntax error")
+
+// jsonArray is a JSON array; a pointer so it can be mutated in place.
+type jsonArray struct {
+	items []any
+}
+
+// jsonObject is a JSON object that keeps the insertion order of its keys.
+type jsonObject struct {
+	keys []string
+	vals map[string]any
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{vals: make(map[string]any)}
+}
+
+// set adds or replaces key, appending new keys at the end.
+func (o *jsonObject) set(key string, v any) {
+	if _, ok := o.vals[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.vals[key] = v
+}
+
+// remove deletes key. Returns true if it was present.
+func (o *jsonObject) remove(key string) bool {
+	if _, ok := o.vals[key]; !ok {
+		return false
+	}
+	delete(o.vals, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// JSONValue is the JSON value type: the root of a document.
+type JSONValue struct {
+	root any
+}
+
+func (j *JSONValue) Type() ValueType { return JSON_VALUE }
+
+func (j *JSONValue) DeepCopy() DataValue {
+	return &JSONValue{root: jsonDeepCopy(j.root)}
+}
+
+func jsonDeepCopy(v any) any {
+	switch val := v.(type) {
+	case *jsonArray:
+		clone := &jsonArray{items: make([]any, len(val.items))}
+		for i, item := range val.items {
+			clone.items[i] = jsonDeepCopy(item)
+		}
+		return clone
+	case *jsonObject:
+		clone := newJSONObject()
+		for _, k := range val.keys {
+			clone.set(k, jsonDeepCopy(val.vals[k]))
+		}
+		return clone
+	default:
+		// Scalars are immutable.
+		return v
+	}
+}
+
+// parseJSON parses a complete JSON text.
+func parseJSON(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	v, err := parseJSONValue(dec)
+	if err != nil {
+		return nil, errors.New("invalid JSON: " + err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: trailing characters after value")
+	}
+	return v, nil
+}
+
+func parseJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '[':
+			arr := &jsonArray{}
+			for dec.More() {
+				item, err := parseJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr.items = append(arr.items, item)
+			}
+			_, err := dec.Token() // ']'
+			return arr, err
+		case '{':
+			obj := newJSONObject()
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := parseJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj.set(keyTok.(string), val)
+			}
+			_, err := dec.Token() // '}'
+			return obj, err
+		}
+		return nil, errors.New("unexpected delimiter " + t.String())
+	default:
+		// nil, bool, json.Number or string
+		return t, nil
+	}
+}
+
+// serializeJSON renders v as compact JSON text.
+func serializeJSON(v any) string {
+	var b strings.Builder
+	writeJSON(&b, v)
+	return b.String()
+}
+
+func writeJSON(b *strings.Builder, v any) {
+	switch val := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(val))
+	case json.Number:
+		b.WriteString(string(val))
+	case string:
+		writeJSONString(b, val)
+	case *jsonArray:
+		b.WriteByte('[')
+		for i, item := range val.items {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSON(b, item)
+		}
+		b.WriteByte(']')
+	case *jsonObject:
+		b.WriteByte('{')
+		for i, k := range val.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, k)
+			b.WriteByte(':')
+			writeJSON(b, val.vals[k])
+		}
+		b.WriteByte('}')
+	}
+}
+
+// writeJSONString writes s as a JSON string, escaping only what JSON requires.
+func writeJSONString(b *strings.Builder, s string) {
+	const hex = "0123456789abcdef"
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				b.WriteString(`\u00`)
+				b.WriteByte(hex[c>>4])
+				b.WriteByte(hex[c&0xf])
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// jsonTypeName returns the RedisJSON name of the type of v.
+func jsonTypeName(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if jsonIsInteger(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case *jsonArray:
+		return "array"
+	case *jsonObject:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonIsInteger reports whether a number literal has no fraction nor exponent.
+func jsonIsInteger(n json.Number) bool {
+	return !strings.ContainsAny(string(n), ".eE")
+}
+
+// jsonNumberAdd returns a + b, staying an integer when both are integers and
+// the sum does not overflow.
+func jsonNumberAdd(a, b json.Number) (json.Number, error) {
+	if jsonIsInteger(a) && jsonIsInteger(b) {
+		x, errX := strconv.ParseInt(string(a), 10, 64)
+		y, errY := strconv.ParseInt(string(b), 10, 64)
+		if errX == nil && errY == nil {
+			if sum := x + y; (sum > x) == (y > 0) {
+				return json.Number(strconv.FormatInt(sum, 10)), nil
+			}
+		}
+	}
+	x, err := strconv.ParseFloat(string(a), 64)
+	if err != nil {
+		return "", err
+	}
+	y, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return "", err
+	}
+	sum := x + y
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", errors.New("result is not a finite number")
+	}
+	s := strconv.FormatFloat(sum, 'g', -1, 64)
+	// Keep the result a float so its type does not change to integer.
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return json.Number(s), nil
+}
+
+// Path steps. A recursive step applies its selector to the current values and
+// to all of their descendants.
+const (
+	JSON_STEP_KEY = iota
+	JSON_STEP_INDEX
+	JSON_STEP_WILDCARD
+)
+
+type jsonPathStep struct {
+	kind      int
+	key       string
+	index     int
+	recursive bool
+}
+
+// jsonPath is a parsed path; legacy is set for paths not starting with '$'.
+type jsonPath struct {
+	raw    string
+	steps  []jsonPathStep
+	legacy bool
+}
+
+// parseJSONPath parses a JSONPath or a legacy path.
+func parseJSONPath(s string) (*jsonPath, error) {
+	p := &jsonPath{raw: s}
+	rest := s
+	switch {
+	case strings.HasPrefix(s, "$"):
+		rest = s[1:]
+	case s == ".":
+		p.legacy = true
+		return p, nil
+	default:
+		p.legacy = true
+		// "a.b" is read as ".a.b".
+		if !strings.HasPrefix(s, ".") && !strings.HasPrefix(s, "[") {
+			rest = "." + s
+		}
+	}
+
+	for rest != "" {
+		var step jsonPathStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				var err error
+				if step, rest, err = parseJSONPathBracket(rest); err != nil {
+					return nil, err
+				}
+				step.recursive = true
+				break
+			}
+			fallthrough
+		case strings.HasPrefix(rest, "."):
+			if !step.recursive {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, ErrJSONPathSyntax
+			case "*":
+				step.kind = JSON_STEP_WILDCARD
+			default:
+				step.kind, step.key = JSON_STEP_KEY, name
+			}
+		case strings.HasPrefix(rest, "["):
+			var err error
+			if step, rest, err = parseJSONPathBracket(rest); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrJSONPathSyntax
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+// parseJSONPathBracket parses a [index], [*] or ['key'] step.
+func parseJSONPathBracket(s string) (jsonPathStep, string, error) {
+	var step jsonPathStep
+	if len(s) > 1 && (s[1] == '\'' || s[1] == '"') {
+		quote := s[1]
+		end := strings.IndexByte(s[2:], quote)
+		if end < 0 || !strings.HasPrefix(s[2+end+1:], "]") {
+			return step, s, ErrJSONPathSyntax
+		}
+		step.kind, step.key = JSON_STEP_KEY, s[2:2+end]
+		return step, s[2+end+2:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return step, s, ErrJSONPathSyntax
+	}
+	inner := strings.TrimSpace(s[1:end])
+	if inner == "*" {
+		step.kind = JSON_STEP_WILDCARD
+		return step, s[end+1:], nil
+	}
+	idx, err := strconv.Atoi(inner)
+	if err != nil {
+		return step, s, ErrJSONPathSyntax
+	}
+	step.kind, step.index = JSON_STEP_INDEX, idx
+	return step, s[end+1:], nil
+}
+
+// jsonLoc is the position of a matched value: a key of an object, an index of
+// an array, or the root of the document (parent is the *JSONValue).
+type jsonLoc struct {
+	parent any
+	key    string
+	index  int
+}
+
+func (l jsonLoc) get() (any, bool) {
+	switch p := l.parent.(type) {
+	case *JSONValue:
+		return p.root, true
+	case *jsonObject:
+		v, ok := p.vals[l.key]
+		return v, ok
+	case *jsonArray:
+		return p.items[l.index], true
+	}
+	return nil, false
+}
+
+func (l jsonLoc) set(v any) {
+	switch p := l.parent.(type) {
+	case *JSONValue:
+		p.root = v
+	case *jsonObject:
+		p.set(l.key, v)
+	case *jsonArray:
+		p.items[l.index] = v
+	}
+}
+
+// children returns the locations of the direct children of v.
+func jsonChildren(v any) []jsonLoc {
+	switch val := v.(type) {
+	case *jsonArray:
+		locs := make([]jsonLoc, len(val.items))
+		for i := range val.items {
+			locs[i] = jsonLoc{parent: val, index: i}
+		}
+		return locs
+	case *jsonObject:
+		locs := make([]jsonLoc, len(val.keys))
+		for i, k := range val.keys {
+			locs[i] = jsonLoc{parent: val, key: k}
+		}
+		return locs
+	}
+	return nil
+}
+
+// selectStep applies a non-recursive step to v. When create is set, a key step
+// on an object also matches a missing key, so that JSON.SET can add it.
+func selectStep(v any, step jsonPathStep, create bool) []jsonLoc {
+	switch step.kind {
+	case JSON_STEP_WILDCARD:
+		return jsonChildren(v)
+	case JSON_STEP_KEY:
+		if obj, ok := v.(*jsonObject); ok {
+			if _, exists := obj.vals[step.key]; exists || create {
+				return []jsonLoc{{parent: obj, key: step.key}}
+			}
+		}
+	case JSON_STEP_INDEX:
+		if arr, ok := v.(*jsonArray); ok {
+			idx := step.index
+			if idx < 0 {
+				idx += len(arr.items)
+			}
+			if idx >= 0 && idx < len(arr.items) {
+				return []jsonLoc{{parent: arr, index: idx}}
+			}
+		}
+	}
+	return nil
+}
+
+// eval returns the locations matched by p in doc. With create set, the last
+// step may match a missing object key (see selectStep).
+func (p *jsonPath) eval(doc *JSONValue, create bool) []jsonLoc {
+	current := []jsonLoc{{parent: doc}}
+	for i, step := range p.steps {
+		last := create && i == len(p.steps)-1
+		var next []jsonLoc
+		// Overlapping recursive descents (e.g. $..a..[0]) reach the same
+		// location more than once: it must be matched, deleted or updated once.
+		var seen map[jsonLoc]bool
+		if step.recursive {
+			seen = make(map[jsonLoc]bool)
+		}
+		for _, loc := range current {
+			v, ok := loc.get()
+			if !ok {
+				continue
+			}
+			if !step.recursive {
+				next = append(next, selectStep(v, step, last)...)
+				continue
+			}
+			// Recursive descent: v itself and all of its descendants, in pre-order.
+			stack := []any{v}
+			for len(stack) > 0 {
+				node := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				for _, match := range selectStep(node, step, false) {
+					if !seen[match] {
+						seen[match] = true
+						next = append(next, match)
+					}
+				}
+				children := jsonChildren(node)
+				for j := len(children) - 1; j >= 0; j-- {
+					child, _ := children[j].get()
+					stack = append(stack, child)
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// jsonDelete removes the values at locs and returns how many were removed.
+// Array elements are removed from the highest index down so that the
+// remaining locations stay valid.
+func jsonDelete(locs []jsonLoc) int {
+	sort.SliceStable(locs, func(i, j int) bool { return locs[i].index > locs[j].index })
+	deleted := 0
+	for _, loc := range locs {
+		switch p := loc.parent.(type) {
+		case *jsonObject:
+			if p.remove(loc.key) {
+				deleted++
+			}
+		case *jsonArray:
+			if loc.index < len(p.items) {
+				p.items = append(p.items[:loc.index], p.items[loc.index+1:]...)
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
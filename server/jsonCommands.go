@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// JSON command handlers. Documents are *JSONValue values (see json.go).
+//
+// Commands taking a path reply in two shapes: with a JSONPath ($...) there is
+// one result per match, rendered as an array; with a legacy path the first
+// match is returned alone and a path matching nothing is an error.
+
+// lookupJSON returns the document stored at key, nil if the key does not
+// exist, or ErrWrongType if the key holds another kind of value.
+func lookupJSON(data map[string]DataValue, key string) (*JSONValue, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	doc, ok := value.(*JSONValue)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return doc, nil
+}
+
+// errJSONPathMissing is returned for legacy paths that match nothing.
+func errJSONPathMissing(path *jsonPath) error {
+	return errors.New("Path '" + path.raw + "' does not exist")
+}
+
+// errJSONWrongPathType is returned for legacy paths pointing to the wrong kind of value.
+func errJSONWrongPathType(expected string, v any) error {
+	return errors.New("WRONGTYPE wrong type of path value - expected " + expected + " but found " + jsonTypeName(v))
+}
+
+// jsonPathArg parses the optional path argument at argv[i], defaulting to the root.
+func jsonPathArg(argv []string, i int) (*jsonPath, error) {
+	if i >= len(argv) {
+		return parseJSONPath(".")
+	}
+	return parseJSONPath(argv[i])
+}
+
+// jsonPathReply runs fn on each value matched by path and builds the reply:
+// an array of results for JSONPath, the first result for legacy paths.
+// fn returns the rendered result, or an error which is reported as (nil) for
+// JSONPath and returned as is for legacy paths.
+func jsonPathReply(doc *JSONValue, path *jsonPath, fn func(loc jsonLoc, v any) (string, error)) (string, error) {
+	locs := path.eval(doc, false)
+	if path.legacy {
+		if len(locs) == 0 {
+			return "", errJSONPathMissing(path)
+		}
+		v, _ := locs[0].get()
+		return fn(locs[0], v)
+	}
+	items := make([]string, len(locs))
+	for i, loc := range locs {
+		v, _ := loc.get()
+		res, err := fn(loc, v)
+		if err != nil {
+			res = NIL_REPLY
+		}
+		items[i] = res
+	}
+	return arrayReply(items), nil
+}
+
+// jsonGetPath renders the values matched by path as JSON: the first value for
+// legacy paths, an array of all the values for JSONPath.
+func jsonGetPath(doc *JSONValue, path *jsonPath) (any, error) {
+	locs := path.eval(doc, false)
+	if path.legacy {
+		if len(locs) == 0 {
+			return nil, errJSONPathMissing(path)
+		}
+		v, _ := locs[0].get()
+		return v, nil
+	}
+	arr := &jsonArray{items: make([]any, len(locs))}
+	for i, loc := range locs {
+		arr.items[i], _ = loc.get()
+	}
+	return arr, nil
+}
+
+// JSON.SET key path value [NX|XX]
+// Sets the JSON value at path. A new key can only be created at the root; an
+// object key is added when its parent exists. NX/XX make the update
+// conditional on the path not existing/existing, replying (nil) when unmet.
+func JSON_SET(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 && len(argv) != 4 {
+		return "NOT_OK", errWrongArgs("json.set")
+	}
+	key := argv[0]
+	path, err := parseJSONPath(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	value, err := parseJSON(argv[2])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	var nx, xx bool
+	if len(argv) == 4 {
+		switch strings.ToUpper(argv[3]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	set := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			if len(path.steps) > 0 {
+				return errors.New("new objects must be created at the root")
+			}
+			if xx {
+				return nil
+			}
+			data[key] = &JSONValue{root: value}
+			set = true
+			ftReindexLocked(data, key)
+			return nil
+		}
+
+		locs := path.eval(doc, true)
+		if len(locs) == 0 && path.legacy {
+			return errJSONPathMissing(path)
+		}
+		for i, loc := range locs {
+			_, exists := loc.get()
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			// Each match gets its own copy of the value.
+			if i > 0 {
+				value = jsonDeepCopy(value)
+			}
+			loc.set(value)
+			set = true
+		}
+		if set {
+			ftReindexLocked(data, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !set {
+		return NIL_REPLY, nil
+	}
+	return "OK", nil
+}
+
+// JSON.GET key [path ...]
+// With a single path replies with the JSON of the matched value(s); with
+// several paths replies with an object mapping each path to its result.
+func JSON_GET(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("json.get")
+	}
+	key := argv[0]
+
+	paths := make([]*jsonPath, 0, len(argv)-1)
+	legacy := true
+	for _, raw := range argv[1:] {
+		path, err := parseJSONPath(raw)
+		if err != nil {
+			return "NOT_OK", err
+		}
+		paths = append(paths, path)
+		legacy = legacy && path.legacy
+	}
+	if len(paths) == 0 {
+		path, _ := parseJSONPath(".")
+		paths = append(paths, path)
+	}
+
+	var result string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			result = NIL_REPLY
+			return nil
+		}
+
+		if len(paths) == 1 {
+			v, err := jsonGetPath(doc, paths[0])
+			if err != nil {
+				return err
+			}
+			result = serializeJSON(v)
+			return nil
+		}
+
+		// With several paths, any JSONPath makes all of them reply as JSONPath.
+		obj := newJSONObject()
+		for _, path := range paths {
+			if !legacy {
+				path.legacy = false
+			}
+			v, err := jsonGetPath(doc, path)
+			if err != nil {
+				return err
+			}
+			obj.set(path.raw, v)
+		}
+		result = serializeJSON(obj)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// JSON.MGET key [key ...] path
+// Replies with the JSON at path for each key; missing keys, keys holding
+// other types and unmatched legacy paths give (nil).
+func JSON_MGET(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("json.mget")
+	}
+	keys := argv[:len(argv)-1]
+	path, err := parseJSONPath(argv[len(argv)-1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	items := make([]string, len(keys))
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for i, key := range keys {
+			items[i] = NIL_REPLY
+			doc, err := lookupJSON(data, key)
+			if err != nil || doc == nil {
+				continue
+			}
+			if v, err := jsonGetPath(doc, path); err == nil {
+				items[i] = serializeJSON(v)
+			}
+		}
+		return nil
+	})
+	return arrayReply(items), nil
+}
+
+// JSON.DEL key [path]
+// Deletes the values at path and returns how many were deleted. Deleting the
+// root deletes the key.
+func JSON_DEL(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("json.del")
+	}
+	key := argv[0]
+	path, err := jsonPathArg(argv, 1)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var deleted int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil || doc == nil {
+			return err
+		}
+		if len(path.steps) == 0 {
+			deleteKeyLocked(data, key)
+			deleted = 1
+			return nil
+		}
+		deleted = jsonDelete(path.eval(doc, false))
+		ftReindexLocked(data, key)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(deleted)), nil
+}
+
+// JSON.TYPE key [path]
+// Replies with the type of the value(s) at path: object, array, string,
+// integer, number, boolean or null.
+func JSON_TYPE(args string) (string, error) {
+	return jsonReadGeneric(args, "json.type", func(loc jsonLoc, v any) (string, error) {
+		return jsonTypeName(v), nil
+	})
+}
+
+// JSON.ARRLEN key [path]
+func JSON_ARRLEN(args string) (string, error) {
+	return jsonReadGeneric(args, "json.arrlen", func(loc jsonLoc, v any) (string, error) {
+		arr, ok := v.(*jsonArray)
+		if !ok {
+			return "", errJSONWrongPathType("array", v)
+		}
+		return intReply(int64(len(arr.items))), nil
+	})
+}
+
+// JSON.OBJKEYS key [path]
+func JSON_OBJKEYS(args string) (string, error) {
+	return jsonReadGeneric(args, "json.objkeys", func(loc jsonLoc, v any) (string, error) {
+		obj, ok := v.(*jsonObject)
+		if !ok {
+			return "", errJSONWrongPathType("object", v)
+		}
+		return arrayReply(obj.keys), nil
+	})
+}
+
+// jsonReadGeneric implements the read-only "key [path]" commands.
+func jsonReadGeneric(args string, cmd string, fn func(loc jsonLoc, v any) (string, error)) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	key := argv[0]
+	path, err := jsonPathArg(argv, 1)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var result string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			result = NIL_REPLY
+			return nil
+		}
+		result, err = jsonPathReply(doc, path, fn)
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// JSON.NUMINCRBY key path value
+// Adds value to the number(s) at path. Replies with the new value for legacy
+// paths, or a JSON array of the new values (null for non-numbers) for JSONPath.
+func JSON_NUMINCRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("json.numincrby")
+	}
+	key := argv[0]
+	path, err := parseJSONPath(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	incr, err := parseJSON(argv[2])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	incrNum, ok := incr.(json.Number)
+	if !ok {
+		return "NOT_OK", errors.New("expected a number but found " + jsonTypeName(incr))
+	}
+
+	var result string
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return errors.New("could not perform this operation on a key that doesn't exist")
+		}
+
+		locs := path.eval(doc, false)
+		if path.legacy && len(locs) == 0 {
+			return errJSONPathMissing(path)
+		}
+		// Compute every result first, so that a failure leaves the document untouched.
+		results := &jsonArray{items: make([]any, len(locs))}
+		for i, loc := range locs {
+			v, _ := loc.get()
+			num, ok := v.(json.Number)
+			if !ok {
+				if path.legacy {
+					return errJSONWrongPathType("number", v)
+				}
+				continue
+			}
+			if results.items[i], err = jsonNumberAdd(num, incrNum); err != nil {
+				return err
+			}
+		}
+		for i, loc := range locs {
+			if results.items[i] != nil {
+				loc.set(results.items[i])
+			}
+		}
+		ftReindexLocked(data, key)
+
+		if path.legacy {
+			result = serializeJSON(results.items[0])
+		} else {
+			result = serializeJSON(results)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// JSON.ARRAPPEND key path value [value ...]
+// Appends the values to the array(s) at path and replies with the new length(s).
+func JSON_ARRAPPEND(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("json.arrappend")
+	}
+	key := argv[0]
+	path, err := parseJSONPath(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	values := make([]any, len(argv)-2)
+	for i, raw := range argv[2:] {
+		if values[i], err = parseJSON(raw); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var result string
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		doc, err := lookupJSON(data, key)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return errors.New("could not perform this operation on a key that doesn't exist")
+		}
+		result, err = jsonPathReply(doc, path, func(loc jsonLoc, v any) (string, error) {
+			arr, ok := v.(*jsonArray)
+			if !ok {
+				return "", errJSONWrongPathType("array", v)
+			}
+			for _, value := range values {
+				arr.items = append(arr.items, jsonDeepCopy(value))
+			}
+			return strconv.Itoa(len(arr.items)), nil
+		})
+		ftReindexLocked(data, key)
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+// File: keyAccessSpace.go
+//
+// Purpose:
+//   Per-key access statistics used by OBJECT IDLETIME / OBJECT FREQ:
+//     - the time of the last read or write, in unix milliseconds
+//     - a logarithmic access-frequency counter (LFU), as in Redis: 8 bits
+//       that saturate at 255, incremented with probability
+//       1 / ((counter - LFU_INIT_VAL) * LFU_LOG_FACTOR + 1), so about a
+//       million accesses are needed to reach the maximum. The counter is
+//       decremented by one for every LFU_DECAY_TIME elapsed since it was
+//       last updated, so keys that stop being used cool down.
+//   New keys start at LFU_INIT_VAL, so that they are not evicted before
+//   having a chance to be accessed again.
+//
+//   Entries are updated by the command dispatcher (see trackCommandKeys) and
+//   removed together with their key by deleteKeyLocked.
+//
+// Asymptotic costs:
+//   - Touch / Get / Remove: O(1)
+//
+// Concurrency:
+//   This implementation is thread-safe. The lock order is KeyDataSpace
+//   first, then KeyAccessSpace.
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	LFU_INIT_VAL   = 5
+	LFU_LOG_FACTOR = 10
+	LFU_DECAY_TIME = time.Minute
+)
+
+// KeyAccess holds the access statistics of one key.
+type KeyAccess struct {
+	lastAccessMs int64
+	lfuUpdatedMs int64 // when lfu was last set, the origin of its decay
+	lfu          uint8
+}
+
+// newKeyAccess returns the statistics of a key created at nowMs.
+func newKeyAccess(nowMs int64) KeyAccess {
+	return KeyAccess{lastAccessMs: nowMs, lfuUpdatedMs: nowMs, lfu: LFU_INIT_VAL}
+}
+
+// freq returns the LFU counter decayed to nowMs.
+func (a KeyAccess) freq(nowMs int64) uint8 {
+	periods := (nowMs - a.lfuUpdatedMs) / LFU_DECAY_TIME.Milliseconds()
+	if periods <= 0 {
+		return a.lfu
+	}
+	if periods >= int64(a.lfu) {
+		return 0
+	}
+	return a.lfu - uint8(periods)
+}
+
+// lfuLogIncr increments counter with a probability that decreases as the
+// counter grows.
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - LFU_INIT_VAL
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*LFU_LOG_FACTOR+1) {
+		counter++
+	}
+	return counter
+}
+
+// KeyAccessSpace maps keys to their access statistics.
+type KeyAccessSpace struct {
+	entries map[string]KeyAccess
+	mu      sync.Mutex
+}
+
+// Access statistics of the keys in keyDataSpace
+var keyAccess *KeyAccessSpace
+
+// NewKeyAccessSpace creates an empty KeyAccessSpace.
+func NewKeyAccessSpace() *KeyAccessSpace {
+	return &KeyAccessSpace{entries: make(map[string]KeyAccess)}
+}
+
+// Touch records an access to key at nowMs. A key seen for the first time
+// starts with the LFU_INIT_VAL counter.
+func (s *KeyAccessSpace) Touch(key string, nowMs int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.entries[key]
+	if !ok {
+		s.entries[key] = newKeyAccess(nowMs)
+		return
+	}
+	s.entries[key] = KeyAccess{lastAccessMs: nowMs, lfuUpdatedMs: nowMs, lfu: lfuLogIncr(a.freq(nowMs))}
+}
+
+// Set replaces the statistics of key.
+func (s *KeyAccessSpace) Set(key string, a KeyAccess) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = a
+}
+
+// Get returns the statistics of key, if it has any.
+func (s *KeyAccessSpace) Get(key string) (KeyAccess, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.entries[key]
+	return a, ok
+}
+
+// Remove forgets key.
+func (s *KeyAccessSpace) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+}
+
+// MemoryUsage returns the approximate bytes used by the statistics.
+func (s *KeyAccessSpace) MemoryUsage() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const entrySize = MEM_STRING_HEADER + 24 // key + KeyAccess
+	return int64(len(s.entries)) * (MEM_MAP_ENTRY + entrySize)
+}
+
+// Clear forgets every key.
+func (s *KeyAccessSpace) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]KeyAccess)
+}
@@ -18,6 +18,7 @@
 //   - PopMin (extract min): 	O(log n) (with Lock)
 //   - Remove (by key):       O(log n) (with Lock)
 //   - Find (by key):         O(1) (via index, within a locked context)
+//   - Sample (n items):      O(n) (with RLock)
 //
 // Concurrency:
 //   This implementation is thread-safe.
@@ -31,6 +32,7 @@ package main
 
 import (
 	"container/heap"
+	"math/rand"
 	"sync"
 )
 
@@ -139,6 +141,23 @@ func (h *KeyExpirationMinHeap) Peek() (KeyExpiration, bool) {
 	return h.items[0], true
 }
 
+// Sample returns up to n items chosen at random (the same item may be
+// returned more than once). Used by the volatile eviction policies.
+// This method is thread-safe and runs in O(n) time.
+func (h *KeyExpirationMinHeap) Sample(n int) []KeyExpiration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.items) == 0 {
+		return nil
+	}
+	sample := make([]KeyExpiration, n)
+	for i := range sample {
+		sample[i] = h.items[rand.Intn(len(h.items))]
+	}
+	return sample
+}
+
 // PushItem adds an item or updates the timestamp of an existing item.
 // If the key already exists, its timestamp is updated, and the heap
 // is adjusted to maintain the heap property.
@@ -228,6 +247,27 @@ func (h *KeyExpirationMinHeap) FindExpiration(key string) (int64, bool) {
 	return NO_EXP_TS, false
 }
 
+// Clear removes every item from the heap.
+// This method is thread-safe.
+func (h *KeyExpirationMinHeap) Clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.items = nil
+	h.index = make(map[string]int)
+}
+
+// MemoryUsage returns the approximate bytes used by the heap slice and the
+// index map. The key strings are shared with the keyspace and not counted.
+// This method is thread-safe and runs in O(1) time.
+func (h *KeyExpirationMinHeap) MemoryUsage() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	const itemSize = MEM_STRING_HEADER + 8 // key + expire_timestamp
+	return MEM_SLICE_HEADER + int64(len(h.items))*itemSize + int64(len(h.index))*MEM_MAP_ENTRY
+}
+
 // DeepCopy creates a complete, independent clone of the KeyExpirationMinHeap.
 // It acquires a read lock on the original structures to ensure a consistent snapshot.
 func (h *KeyExpirationMinHeap) DeepCopy() *KeyExpirationMinHeap {
@@ -4,11 +4,19 @@ import (
 	"sync"
 )
 
-// KeyDataSpace is a thread-safe wrapper around a map[string]string.
+// KeyDataSpace is a thread-safe wrapper around a map[string]DataValue.
 // It uses a sync.RWMutex to manage concurrent access.
 type KeyDataSpace struct {
-	data map[string]string
+	data map[string]DataValue
 	mu   sync.RWMutex // Read-Write Mutex to protect the map
+
+	// Approximate cost in bytes of each entry (see entrySize), their total
+	// and the keys in SCAN order. They have their own mutex because commands
+	// that only hold the read lock refresh them too (see trackCommandKeys).
+	sizes     map[string]int64
+	sizeTotal int64
+	scan      *ScanIndex
+	trackMu   sync.Mutex
 }
 
 // Here we store db data
@@ -17,7 +25,9 @@ var keyDataSpace *KeyDataSpace
 // NewKeyDataSpace creates and returns a pointer to a new KeyDataSpace instance.
 func NewKeyDataSpace() *KeyDataSpace {
 	return &KeyDataSpace{
-		data: make(map[string]string),
+		data:  make(map[string]DataValue),
+		sizes: make(map[string]int64),
+		scan:  NewScanIndex(),
 	}
 }
 
@@ -28,7 +38,20 @@ func (s *KeyDataSpace) Add(key, value string) {
 	s.mu.Lock()
 	defer s.mu.Unlock() // Release the lock when the function returns.
 
+	s.data[key] = StringValue(value)
+	ftReindexLocked(s.data, key)
+	s.trackSizeLocked(key)
+}
+
+// SetValue inserts or replaces the value of any type stored for a key.
+// It requires an exclusive write lock.
+func (s *KeyDataSpace) SetValue(key string, value DataValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.data[key] = value
+	ftReindexLocked(s.data, key)
+	s.trackSizeLocked(key)
 }
 
 // Remove deletes a key from the map in a thread-safe manner.
@@ -39,6 +62,8 @@ func (s *KeyDataSpace) Remove(key string) {
 	defer s.mu.Unlock() // Release the lock when the function returns.
 
 	delete(s.data, key)
+	ftReindexLocked(s.data, key)
+	s.trackSizeLocked(key)
 }
 
 // Exists checks if a key is present in the map in a thread-safe manner.
@@ -54,17 +79,47 @@ func (s *KeyDataSpace) Exists(key string) bool {
 
 // --- Optional: A function to retrieve a value safely ---
 
-// Get retrieves the value for a key in a thread-safe manner.
+// Get retrieves the string value for a key in a thread-safe manner.
 // It returns the value and a boolean indicating if the key was found.
+// Keys holding a non-string value are reported as not found.
 func (s *KeyDataSpace) Get(key string) (string, bool) {
 	// Acquire a read lock.
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	value, found := s.data[key].(StringValue)
+	return string(value), found
+}
+
+// GetValue retrieves the value of any type stored for a key in a thread-safe manner.
+func (s *KeyDataSpace) GetValue(key string) (DataValue, bool) {
+	// Acquire a read lock.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	value, found := s.data[key]
 	return value, found
 }
 
+// Update runs fn while holding the exclusive write lock, so that a command can
+// read, modify and write one or more keys as a single atomic step.
+// fn must not retain the map after returning.
+func (s *KeyDataSpace) Update(fn func(data map[string]DataValue) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fn(s.data)
+}
+
+// View runs fn while holding the read lock. fn must not modify the map
+// nor any of the values stored in it.
+func (s *KeyDataSpace) View(fn func(data map[string]DataValue) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(s.data)
+}
+
 // IsInitialized checks if the internal map has been initialized (i.e., is not nil).
 func (s *KeyDataSpace) IsInitialized() bool {
 	// Acquire a read lock.
@@ -100,24 +155,112 @@ func (s *KeyDataSpace) Keys() []string {
 	return keys
 }
 
+// trackSizeLocked refreshes the recorded size and the SCAN order of key
+// after it was written or deleted. It must be called while holding the read
+// or the write lock.
+func (s *KeyDataSpace) trackSizeLocked(key string) {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+
+	oldSize, tracked := s.sizes[key]
+	s.sizeTotal -= oldSize
+	value, ok := s.data[key]
+	if !ok {
+		if tracked {
+			delete(s.sizes, key)
+			s.scan.Delete(key)
+		}
+		return
+	}
+	if !tracked {
+		s.scan.Insert(key)
+	}
+	size := entrySize(key, value, MEMORY_SAMPLES)
+	s.sizes[key] = size
+	s.sizeTotal += size
+}
+
+// ScanKeys returns the next keys of a SCAN iteration, see ScanIndex.Scan.
+// Keys written by the command in progress may not be reflected yet.
+func (s *KeyDataSpace) ScanKeys(cursor uint64, count int) ([]string, uint64) {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+
+	return s.scan.Scan(cursor, count)
+}
+
+// DatasetBytes returns the approximate bytes used by all the entries.
+func (s *KeyDataSpace) DatasetBytes() int64 {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+
+	return s.sizeTotal
+}
+
+// LargestEntry returns the key with the highest recorded size.
+// It runs in O(N): it is meant for diagnostics only.
+func (s *KeyDataSpace) LargestEntry() (string, int64) {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+
+	largest, largestSize := "", int64(0)
+	for key, size := range s.sizes {
+		if size > largestSize {
+			largest, largestSize = key, size
+		}
+	}
+	return largest, largestSize
+}
+
 // DeepCopy creates a complete, independent clone of the KeyDataSpace.
 // It acquires a read lock on the original map to ensure a consistent snapshot.
 func (s *KeyDataSpace) DeepCopy() *KeyDataSpace {
-    s.mu.RLock() // Acquire read lock on the original map
-    defer s.mu.RUnlock()
-
-    // 1. Create a new map with the same capacity
-    clonedData := make(map[string]string, len(s.data))
-
-    // 2. Copy every key-value pair from the original map
-    for key, value := range s.data {
-        clonedData[key] = value
-    }
-
-    // 3. Create the new KeyDataSpace instance with its own fresh RWMutex
-    return &KeyDataSpace{
-        data: clonedData,
-        // The mutex is zero-valued (fresh) and ready to use, ensuring
-        // the snapshot is completely independent.
-    }
-}
\ No newline at end of file
+	s.mu.RLock() // Acquire read lock on the original map
+	defer s.mu.RUnlock()
+
+	// 1. Create a new map with the same capacity
+	clonedData := make(map[string]DataValue, len(s.data))
+
+	// 2. Copy every key-value pair from the original map
+	// (collection values are cloned so later writes do not leak into the snapshot)
+	for key, value := range s.data {
+		clonedData[key] = value.DeepCopy()
+	}
+
+	// 3. Create the new KeyDataSpace instance with its own fresh RWMutex
+	return &KeyDataSpace{
+		data: clonedData,
+		// The mutex is zero-valued (fresh) and ready to use, ensuring
+		// the snapshot is completely independent.
+	}
+}
+
+// Flush removes every key together with all the expirations, the access
+// statistics and the search index entries, keeping the index definitions.
+// It returns the detached map so the caller decides how to release it.
+func (s *KeyDataSpace) Flush() map[string]DataValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.data
+	s.data = make(map[string]DataValue)
+	s.trackMu.Lock()
+	s.sizes, s.sizeTotal, s.scan = make(map[string]int64), 0, NewScanIndex()
+	s.trackMu.Unlock()
+	keyExpirations.Clear()
+	keyAccess.Clear()
+	ftFlushLocked()
+	return old
+}
+
+// deleteKeyLocked removes key together with its expiration entry, its access
+// statistics, its size and its search index entries.
+// It must be called from inside KeyDataSpace.Update; the lock order is always
+// KeyDataSpace first, then KeyExpirationMinHeap.
+func deleteKeyLocked(data map[string]DataValue, key string) {
+	delete(data, key)
+	keyExpirations.Remove(key)
+	keyAccess.Remove(key)
+	ftReindexLocked(data, key)
+	keyDataSpace.trackSizeLocked(key)
+}
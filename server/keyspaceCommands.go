@@ -0,0 +1,840 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keyspace command handlers: commands working on keys regardless of the
+// type of their value.
+//
+// SCAN cursors: the KeyDataSpace is a plain Go map, whose iteration order is
+// random and which cannot be resumed. The SCAN family therefore visits
+// elements in the order of a 64-bit hash of their name, and the cursor is the
+// hash to resume from. A call returns the COUNT elements with the smallest
+// hashes >= cursor, so an element present for the whole iteration is
+// returned exactly once however the map grows or shrinks in between; elements
+// added or removed meanwhile may or may not be returned. The names are kept
+// in hash order by a ScanIndex (see scanIndex.go), so each call costs
+// O(log N + COUNT) for N elements.
+
+const (
+	SCAN_HASH_SEED     = 0x5bd1e9955bd1e995
+	SCAN_DEFAULT_COUNT = 10
+)
+
+// KEYS pattern
+// Returns every key matching the glob pattern (see glob.go), sorted.
+// Takes O(N) for N keys: use SCAN on large keyspaces.
+func KEYS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("keys")
+	}
+	pattern, err := unquoteGlob(argv[0])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var keys []string
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for key := range data {
+			if globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return arrayReply(keys), nil
+}
+
+// unquoteGlob strips the quotes of a pattern given as a quoted token.
+func unquoteGlob(pattern string) (string, error) {
+	if !strings.HasPrefix(pattern, `"`) {
+		return pattern, nil
+	}
+	unquoted, err := strconv.Unquote(pattern)
+	if err != nil {
+		return "", ErrSyntax
+	}
+	return unquoted, nil
+}
+
+// scanOptions holds the options shared by the SCAN family.
+type scanOptions struct {
+	cursor    uint64
+	match     string // "" when every element matches
+	count     int
+	valueType string // SCAN only, "" for any type
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count] [TYPE type]";
+// TYPE is only accepted when allowType is set.
+func parseScanArgs(argv []string, allowType bool) (scanOptions, error) {
+	opts := scanOptions{count: SCAN_DEFAULT_COUNT}
+	cursor, err := strconv.ParseUint(argv[0], 10, 64)
+	if err != nil {
+		return opts, errors.New("invalid cursor")
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(argv); i += 2 {
+		if i+1 >= len(argv) {
+			return opts, ErrSyntax
+		}
+		switch strings.ToUpper(argv[i]) {
+		case "MATCH":
+			if opts.match, err = unquoteGlob(argv[i+1]); err != nil {
+				return opts, err
+			}
+			if opts.match == "*" {
+				opts.match = ""
+			}
+		case "COUNT":
+			n, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return opts, err
+			}
+			if n < 1 {
+				return opts, ErrSyntax
+			}
+			opts.count = int(min(n, math.MaxInt32))
+		case "TYPE":
+			if !allowType {
+				return opts, ErrSyntax
+			}
+			opts.valueType = argv[i+1]
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// scanReply renders [cursor [items...]].
+func scanReply(cursor uint64, items []string) string {
+	return arrayReply([]string{strconv.FormatUint(cursor, 10), arrayReply(items)})
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// Incrementally iterates the keyspace: start with cursor 0 and call again
+// with the returned cursor until it is 0. Each call examines COUNT (default
+// 10) keys and returns those matching the pattern and type, so a call can
+// return fewer keys, or none, before the iteration is over.
+func SCAN(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("scan")
+	}
+	opts, err := parseScanArgs(argv, true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var keys []string
+	var next uint64
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		batch, cursor := keyDataSpace.ScanKeys(opts.cursor, opts.count)
+		next = cursor
+		for _, key := range batch {
+			// The index is refreshed after each command: skip keys the
+			// running one has already deleted.
+			value, ok := data[key]
+			if !ok {
+				continue
+			}
+			if opts.match != "" && !globMatch(opts.match, key) {
+				continue
+			}
+			if opts.valueType != "" && !strings.EqualFold(valueTypeName(value.Type()), opts.valueType) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return scanReply(next, keys), nil
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+// Iterates the members of a sorted set like SCAN, replying with
+// [cursor [member score ...]]. A missing key is an empty sorted set.
+func ZSCAN(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("zscan")
+	}
+	opts, err := parseScanArgs(argv[1:], false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var items []string
+	var next uint64
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		batch, cursor := zset.scan.Scan(opts.cursor, opts.count)
+		next = cursor
+		for _, member := range batch {
+			if opts.match == "" || globMatch(opts.match, member) {
+				items = append(items, member, floatReply(zset.dict[member]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return scanReply(next, items), nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+// This server has no hash nor set type: a missing key is iterated as an
+// empty collection, any existing key holds the wrong type.
+func HSCAN(args string) (string, error) {
+	return scanMissingType(args, "hscan")
+}
+
+func SSCAN(args string) (string, error) {
+	return scanMissingType(args, "sscan")
+}
+
+func scanMissingType(args, cmd string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	if _, err := parseScanArgs(argv[1:], false); err != nil {
+		return "NOT_OK", err
+	}
+	if keyDataSpace.Exists(argv[0]) {
+		return "NOT_OK", ErrWrongType
+	}
+	return scanReply(0, nil), nil
+}
+
+// removeKeys deletes the given keys atomically and returns the values that
+// were removed (duplicate names are only removed once).
+func removeKeys(keys []string) []DataValue {
+	var removed []DataValue
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		for _, key := range keys {
+			if value, ok := data[key]; ok {
+				removed = append(removed, value)
+				deleteKeyLocked(data, key)
+			}
+		}
+		return nil
+	})
+	return removed
+}
+
+// EXISTS key [key ...]
+// Returns how many of the keys exist; a key repeated n times counts n times.
+func EXISTS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("exists")
+	}
+	return intReply(countExistingKeys(argv)), nil
+}
+
+func countExistingKeys(keys []string) int64 {
+	var count int64
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for _, key := range keys {
+			if _, ok := data[key]; ok {
+				count++
+			}
+		}
+		return nil
+	})
+	return count
+}
+
+// TYPE key
+// Returns the type name of the value at key, or "none" if it does not exist.
+func TYPE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("type")
+	}
+	value, ok := keyDataSpace.GetValue(argv[0])
+	if !ok {
+		return "none", nil
+	}
+	return valueTypeName(value.Type()), nil
+}
+
+var ErrNoSuchKey = errors.New("no such key")
+
+// moveKeyLocked moves the value and expiration of src to dst, replacing dst.
+// It must be called from inside KeyDataSpace.Update.
+func moveKeyLocked(data map[string]DataValue, src, dst string) {
+	value := data[src]
+	expireAt, hasExpiration := keyExpirations.FindExpiration(src)
+	deleteKeyLocked(data, dst)
+	deleteKeyLocked(data, src)
+	data[dst] = value
+	if hasExpiration {
+		keyExpirations.PushItem(KeyExpiration{key: dst, expire_timestamp: expireAt})
+	}
+	ftReindexLocked(data, dst)
+}
+
+// RENAME key newkey
+// Renames key, overwriting newkey. The expiration moves with the value.
+func RENAME(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("rename")
+	}
+	src, dst := argv[0], argv[1]
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, ok := data[src]; !ok {
+			return ErrNoSuchKey
+		}
+		if src != dst {
+			moveKeyLocked(data, src, dst)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	keyReadyNotifier.Signal(dst)
+	return "OK", nil
+}
+
+// RENAMENX key newkey
+// Renames key only if newkey does not exist. Returns 1 if renamed, 0 otherwise.
+func RENAMENX(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("renamenx")
+	}
+	src, dst := argv[0], argv[1]
+
+	renamed := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, ok := data[src]; !ok {
+			return ErrNoSuchKey
+		}
+		if _, exists := data[dst]; exists {
+			return nil
+		}
+		moveKeyLocked(data, src, dst)
+		renamed = true
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !renamed {
+		return intReply(0), nil
+	}
+	keyReadyNotifier.Signal(dst)
+	return intReply(1), nil
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+// Copies the value and expiration of source to destination. Returns 1 if
+// copied, 0 if source does not exist or destination exists without REPLACE.
+// There is a single database, so DB only accepts 0.
+func COPY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("copy")
+	}
+	src, dst := argv[0], argv[1]
+
+	replace := false
+	for i := 2; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			db, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return "NOT_OK", err
+			}
+			if db != 0 {
+				return "NOT_OK", errors.New("DB index is out of range")
+			}
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+	if src == dst {
+		return "NOT_OK", errors.New("source and destination objects are the same")
+	}
+
+	copied := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		value, ok := data[src]
+		if !ok {
+			return nil
+		}
+		if _, exists := data[dst]; exists {
+			if !replace {
+				return nil
+			}
+			deleteKeyLocked(data, dst)
+		}
+		data[dst] = value.DeepCopy()
+		if expireAt, ok := keyExpirations.FindExpiration(src); ok {
+			keyExpirations.PushItem(KeyExpiration{key: dst, expire_timestamp: expireAt})
+		}
+		ftReindexLocked(data, dst)
+		copied = true
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !copied {
+		return intReply(0), nil
+	}
+	keyReadyNotifier.Signal(dst)
+	return intReply(1), nil
+}
+
+// TOUCH key [key ...]
+// Returns how many of the keys exist. Like every command naming keys, it
+// updates their access statistics (see trackCommandKeys).
+func TOUCH(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("touch")
+	}
+	return intReply(countExistingKeys(argv)), nil
+}
+
+// UNLINK key [key ...]
+// Like DEL, but the removed values are released by a background goroutine,
+// so the command only pays for unlinking the keys, whatever the size of
+// their values.
+func UNLINK(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("unlink")
+	}
+
+	removed := removeKeys(argv)
+	go lazyFree(removed)
+	return intReply(int64(len(removed))), nil
+}
+
+// objectEncoding names the internal representation of a value, using the
+// Redis names where they apply: strings holding a canonical 64-bit integer
+// are "int", sorted sets are always a skiplist with a dict, and the types
+// Redis implements as modules are reported as "raw", like Redis does.
+func objectEncoding(value DataValue) string {
+	switch v := value.(type) {
+	case StringValue:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(v) {
+			return "int"
+		}
+		return "raw"
+	case *SortedSet:
+		return "skiplist"
+	case *Stream:
+		return "stream"
+	default:
+		return "raw"
+	}
+}
+
+// OBJECT ENCODING|FREQ|IDLETIME|REFCOUNT key
+// OBJECT HELP
+// Inspects a key without counting as an access to it. IDLETIME is the
+// number of seconds since the last read or write, FREQ the logarithmic
+// access counter (see keyAccessSpace.go). Values are never shared, so
+// REFCOUNT is always 1. Replies (nil) if the key does not exist.
+func OBJECT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("object")
+	}
+	sub := strings.ToUpper(argv[0])
+	if sub == "HELP" {
+		return arrayReply([]string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified <key>.",
+		}), nil
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("object|" + strings.ToLower(argv[0]))
+	}
+	key := argv[1]
+
+	nowMs := time.Now().UnixMilli()
+	var value DataValue
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		if keyAliveLocked(data, key, nowMs) {
+			value = data[key]
+		}
+		return nil
+	})
+
+	switch sub {
+	case "ENCODING", "FREQ", "IDLETIME", "REFCOUNT":
+	default:
+		return "NOT_OK", errors.New("unknown subcommand '" + argv[0] + "'. Try OBJECT HELP.")
+	}
+	if value == nil {
+		return NIL_REPLY, nil
+	}
+
+	access, ok := keyAccess.Get(key)
+	if !ok {
+		access = newKeyAccess(nowMs)
+	}
+	switch sub {
+	case "ENCODING":
+		return objectEncoding(value), nil
+	case "FREQ":
+		return intReply(int64(access.freq(nowMs))), nil
+	case "IDLETIME":
+		return intReply((nowMs - access.lastAccessMs) / 1000), nil
+	default:
+		return intReply(1), nil
+	}
+}
+
+// lazyFree releases values detached from the keyspace. Collections are
+// emptied piece by piece so that the garbage collector can reclaim their
+// parts incrementally instead of walking one huge object graph.
+func lazyFree(values []DataValue) {
+	for i, value := range values {
+		lazyFreeValue(value)
+		values[i] = nil
+	}
+}
+
+// lazyFreeKeyspace is lazyFree for a whole map detached by FLUSHDB ASYNC.
+func lazyFreeKeyspace(data map[string]DataValue) {
+	for key, value := range data {
+		lazyFreeValue(value)
+		delete(data, key)
+	}
+}
+
+func lazyFreeValue(value DataValue) {
+	switch v := value.(type) {
+	case *SortedSet:
+		clear(v.dict)
+		v.zsl = nil
+		v.scan = nil
+	case *Graph:
+		for _, n := range v.nodes {
+			n.in, n.out = nil, nil
+		}
+		clear(v.nodes)
+		clear(v.edges)
+	case *VectorSet:
+		for _, n := range v.nodes {
+			n.neighbors = nil
+		}
+		clear(v.nodes)
+		v.entry = nil
+	}
+}
+
+// DBSIZE
+// Returns the number of keys, including expired keys not removed yet.
+func DBSIZE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 0 {
+		return "NOT_OK", errWrongArgs("dbsize")
+	}
+	return intReply(int64(keyDataSpace.Length())), nil
+}
+
+// flushGeneric implements FLUSHDB and FLUSHALL [ASYNC|SYNC]. SYNC (the
+// default) releases the old keyspace before replying; ASYNC hands it to a
+// background goroutine, so the command returns in constant time.
+func flushGeneric(args, cmd string) error {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) > 1 {
+		return errWrongArgs(cmd)
+	}
+	async := false
+	if len(argv) == 1 {
+		switch strings.ToUpper(argv[0]) {
+		case "ASYNC":
+			async = true
+		case "SYNC":
+		default:
+			return ErrSyntax
+		}
+	}
+
+	old := keyDataSpace.Flush()
+	if async {
+		go lazyFreeKeyspace(old)
+	} else {
+		lazyFreeKeyspace(old)
+	}
+	return nil
+}
+
+// FLUSHDB [ASYNC|SYNC]
+// Removes every key. The next periodic snapshot persists the empty keyspace.
+func FLUSHDB(args string) (string, error) {
+	if err := flushGeneric(args, "flushdb"); err != nil {
+		return "NOT_OK", err
+	}
+	return "", nil
+}
+
+// FLUSHALL [ASYNC|SYNC]
+// Removes every key (there is a single database) and, like Redis, writes the
+// empty snapshot right away so that a restart cannot bring the data back.
+func FLUSHALL(args string) (string, error) {
+	if err := flushGeneric(args, "flushall"); err != nil {
+		return "NOT_OK", err
+	}
+	if err := saveRDBSnapshot(); err != nil {
+		return "NOT_OK", err
+	}
+	return "", nil
+}
+
+// RANDOMKEY
+// Returns a key chosen uniformly at random, or (nil) if there is none.
+// Reservoir sampling picks it in one pass over the map without copying the
+// keys: O(N) time, O(1) memory.
+func RANDOMKEY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 0 {
+		return "NOT_OK", errWrongArgs("randomkey")
+	}
+
+	nowMs := time.Now().UnixMilli()
+	picked, seen := "", 0
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for key := range data {
+			if !keyAliveLocked(data, key, nowMs) {
+				continue
+			}
+			seen++
+			if rand.Intn(seen) == 0 {
+				picked = key
+			}
+		}
+		return nil
+	})
+	if seen == 0 {
+		return NIL_REPLY, nil
+	}
+	return bulkReply(picked), nil
+}
+
+// DUMP key
+// Returns the serialized value of key (see encodeDump), quoted so that it can
+// be passed back to RESTORE as is, or (nil) if the key does not exist.
+func DUMP(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("dump")
+	}
+
+	nowMs := time.Now().UnixMilli()
+	var payload []byte
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		if !keyAliveLocked(data, argv[0], nowMs) {
+			return nil
+		}
+		payload, err = encodeDump(data[argv[0]])
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if payload == nil {
+		return NIL_REPLY, nil
+	}
+	return strconv.Quote(string(payload)), nil
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+// Creates key from a DUMP payload. ttl is in milliseconds, 0 meaning no
+// expiration; with ABSTTL it is a unix time in milliseconds. Fails with
+// BUSYKEY if the key exists, unless REPLACE is given. IDLETIME and FREQ set
+// the access statistics reported by OBJECT.
+func RESTORE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("restore")
+	}
+	key := argv[0]
+	ttl, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if ttl < 0 {
+		return "NOT_OK", errors.New("Invalid TTL value, must be >= 0")
+	}
+
+	nowMs := time.Now().UnixMilli()
+	access := newKeyAccess(nowMs)
+	replace, absttl := false, false
+	for i := 3; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absttl = true
+		case "IDLETIME":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			idle, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return "NOT_OK", err
+			}
+			if idle < 0 || idle > nowMs/1000 {
+				return "NOT_OK", errors.New("Invalid IDLETIME value, must be >= 0")
+			}
+			access.lastAccessMs = nowMs - idle*1000
+			i++
+		case "FREQ":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			freq, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return "NOT_OK", err
+			}
+			if freq < 0 || freq > 255 {
+				return "NOT_OK", errors.New("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			access.lfu = uint8(freq)
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	serialized := argv[2]
+	if strings.HasPrefix(serialized, `"`) {
+		if serialized, err = strconv.Unquote(serialized); err != nil {
+			return "NOT_OK", errors.New("DUMP payload version or checksum are wrong")
+		}
+	}
+	value, err := decodeDump([]byte(serialized))
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	expireAt := int64(NO_EXP_TS)
+	if ttl > 0 {
+		expireAt = ttl
+		if !absttl {
+			if ttl > math.MaxInt64-nowMs {
+				return "NOT_OK", errors.New("invalid expire time in 'restore' command")
+			}
+			expireAt += nowMs
+		}
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := data[key]; exists {
+			if keyAliveLocked(data, key, nowMs) && !replace {
+				return errors.New("BUSYKEY Target key name already exists.")
+			}
+			deleteKeyLocked(data, key)
+		}
+		// An absolute expiration in the past restores nothing.
+		if expireAt != NO_EXP_TS && expireAt <= nowMs {
+			return nil
+		}
+		data[key] = value
+		ftReindexLocked(data, key)
+		if expireAt != NO_EXP_TS {
+			keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: expireAt})
+		}
+		keyAccess.Set(key, access)
+		keyDataSpace.trackSizeLocked(key)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	keyReadyNotifier.Signal(key)
+	return "", nil
+}
@@ -0,0 +1,240 @@
+// File: memory.go
+//
+// Purpose:
+//   Approximate memory accounting:
+//     - usedMemory reports the bytes held by the heap, as seen by the Go
+//       runtime, garbage and snapshot copies included (MEMORY STATS)
+//     - entrySize estimates the bytes a key costs, from the sizes of Go
+//       headers, map entries and payloads. Collections are not walked
+//       entirely: as in Redis' MEMORY USAGE, up to `samples` elements are
+//       measured and their average is multiplied by the collection size
+//       (samples <= 0 measures every element).
+//
+// Asymptotic costs:
+//   - usedMemory: O(1)
+//   - entrySize: O(samples), O(size of the value) when samples <= 0
+//
+// Concurrency:
+//   - entrySize reads the value: call it under the KeyDataSpace lock.
+
+package main
+
+import (
+	"encoding/json"
+	"runtime/metrics"
+	"sync"
+)
+
+// Approximate sizes of Go runtime structures, on 64-bit platforms.
+const (
+	MEM_STRING_HEADER = 16 // pointer + length
+	MEM_SLICE_HEADER  = 24 // pointer + length + capacity
+	MEM_INTERFACE     = 16 // type + data pointers
+	MEM_POINTER       = 8
+	MEM_MAP_ENTRY     = 48 // key/value slots, tophash and bucket overhead, averaged
+	MEM_STRUCT        = 64 // small struct with a few fields, rounded to its size class
+)
+
+// MEMORY_SAMPLES is the default number of collection elements measured.
+const MEMORY_SAMPLES = 5
+
+var (
+	memMu      sync.Mutex
+	memMetrics = []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+	}
+	memPeak int64 // highest value returned by usedMemory
+)
+
+// usedMemory returns the bytes occupied by heap objects, including dead
+// objects the garbage collector has not freed yet.
+func usedMemory() int64 {
+	memMu.Lock()
+	defer memMu.Unlock()
+
+	metrics.Read(memMetrics)
+	used := int64(memMetrics[0].Value.Uint64())
+	memPeak = max(memPeak, used)
+	return used
+}
+
+// peakMemory returns the highest memory usage observed by usedMemory.
+func peakMemory() int64 {
+	memMu.Lock()
+	defer memMu.Unlock()
+
+	return memPeak
+}
+
+// entrySize estimates the bytes used by key and its value in the keyspace.
+func entrySize(key string, value DataValue, samples int) int64 {
+	return MEM_MAP_ENTRY + MEM_STRING_HEADER + int64(len(key)) + MEM_INTERFACE + valueSize(value, samples)
+}
+
+// sampledSize extrapolates the size of n elements from the first `samples`
+// ones, measured by size(i).
+func sampledSize(n, samples int, size func(i int) int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	measured := n
+	if samples > 0 && samples < n {
+		measured = samples
+	}
+	var total int64
+	for i := 0; i < measured; i++ {
+		total += size(i)
+	}
+	return total * int64(n) / int64(measured)
+}
+
+// valueSize estimates the bytes used by a value.
+func valueSize(value DataValue, samples int) int64 {
+	switch v := value.(type) {
+	case StringValue:
+		return MEM_STRING_HEADER + int64(len(v))
+
+	case *SortedSet:
+		// Each member is a skiplist node (score, member, backward pointer and
+		// on average 1.33 levels), a dict entry and a scan index node.
+		x := v.zsl.First()
+		return 2*MEM_STRUCT + sampledSize(v.Len(), samples, func(int) int64 {
+			size := 2*MEM_STRUCT + MEM_MAP_ENTRY + MEM_STRING_HEADER + int64(len(x.member)) + int64(len(x.level))*2*MEM_POINTER
+			x = x.level[0].forward
+			return size
+		})
+
+	case *Stream:
+		size := MEM_STRUCT + MEM_SLICE_HEADER + sampledSize(len(v.entries), samples, func(i int) int64 {
+			e := v.entries[i]
+			size := int64(16 + MEM_SLICE_HEADER)
+			for _, f := range e.fields {
+				size += MEM_STRING_HEADER + int64(len(f))
+			}
+			return size
+		})
+		for name, g := range v.groups {
+			size += MEM_MAP_ENTRY + int64(len(name)) + MEM_STRUCT
+			size += int64(len(g.pel)) * (MEM_MAP_ENTRY + MEM_STRUCT)
+			for cname, c := range g.consumers {
+				size += MEM_MAP_ENTRY + int64(len(cname)) + MEM_STRUCT + int64(len(c.pending))*MEM_MAP_ENTRY
+			}
+		}
+		return size
+
+	case *JSONValue:
+		return MEM_POINTER + jsonSize(v.root, samples)
+
+	case *BloomFilter:
+		size := int64(MEM_STRUCT)
+		for _, link := range v.links {
+			size += MEM_POINTER + MEM_STRUCT + int64(len(link.bits))
+		}
+		return size
+
+	case *CountMinSketch:
+		return MEM_STRUCT + int64(len(v.counters))*4
+
+	case *TopK:
+		return 2*MEM_STRUCT + int64(len(v.buckets))*8 + sampledSize(len(v.heap.entries), samples, func(i int) int64 {
+			// The item is referenced by the entry and by the index map.
+			return MEM_POINTER + MEM_STRUCT + MEM_MAP_ENTRY + 2*MEM_STRING_HEADER + int64(len(v.heap.entries[i].item))
+		})
+
+	case *TimeSeries:
+		size := int64(2*MEM_STRUCT) + int64(len(v.samples))*16 + int64(len(v.src))
+		for _, l := range v.labels {
+			size += 2*MEM_STRING_HEADER + int64(len(l[0])+len(l[1]))
+		}
+		for _, r := range v.rules {
+			size += MEM_POINTER + MEM_STRUCT + int64(len(r.dest))
+		}
+		return size
+
+	case *VectorSet:
+		var nodes []*vsetNode
+		for _, n := range v.nodes {
+			if samples > 0 && len(nodes) == samples {
+				break
+			}
+			nodes = append(nodes, n)
+		}
+		return MEM_STRUCT + sampledSize(len(v.nodes), len(nodes), func(i int) int64 {
+			n := nodes[i]
+			size := MEM_MAP_ENTRY + MEM_STRUCT + MEM_STRING_HEADER + int64(len(n.element)) + int64(len(n.vec))*4
+			for _, level := range n.neighbors {
+				size += MEM_SLICE_HEADER + int64(len(level))*MEM_POINTER
+			}
+			return size
+		})
+
+	case *Graph:
+		return MEM_STRUCT + graphMapSize(v.nodes, samples, func(n *graphNode) int64 {
+			size := MEM_STRUCT + graphPropsSize(n.props) + int64(len(n.in)+len(n.out))*MEM_POINTER
+			for _, l := range n.labels {
+				size += MEM_STRING_HEADER + int64(len(l))
+			}
+			return size
+		}) + graphMapSize(v.edges, samples, func(e *graphEdge) int64 {
+			return MEM_STRUCT + MEM_STRING_HEADER + int64(len(e.relType)) + graphPropsSize(e.props)
+		})
+
+	default:
+		return MEM_STRUCT
+	}
+}
+
+// graphMapSize extrapolates the size of the nodes or edges of a graph.
+func graphMapSize[T any](m map[uint64]T, samples int, size func(T) int64) int64 {
+	var total int64
+	measured := 0
+	for _, x := range m {
+		if samples > 0 && measured == samples {
+			break
+		}
+		total += MEM_MAP_ENTRY + size(x)
+		measured++
+	}
+	if measured == 0 {
+		return 0
+	}
+	return total * int64(len(m)) / int64(measured)
+}
+
+func graphPropsSize(props graphProps) int64 {
+	size := int64(MEM_SLICE_HEADER)
+	for _, p := range props {
+		size += MEM_STRING_HEADER + int64(len(p.key)) + MEM_INTERFACE
+		if s, ok := p.value.(string); ok {
+			size += MEM_STRING_HEADER + int64(len(s))
+		}
+	}
+	return size
+}
+
+// jsonSize estimates the bytes used by a parsed JSON node. Nested
+// containers of sampled children are measured from their first child only,
+// so that the cost does not grow exponentially with the depth.
+func jsonSize(v any, samples int) int64 {
+	nested := samples
+	if samples > 0 {
+		nested = 1
+	}
+	switch n := v.(type) {
+	case string:
+		return MEM_INTERFACE + MEM_STRING_HEADER + int64(len(n))
+	case json.Number:
+		return MEM_INTERFACE + MEM_STRING_HEADER + int64(len(n))
+	case *jsonArray:
+		return MEM_INTERFACE + MEM_SLICE_HEADER + sampledSize(len(n.items), samples, func(i int) int64 {
+			return jsonSize(n.items[i], nested)
+		})
+	case *jsonObject:
+		return MEM_INTERFACE + MEM_STRUCT + sampledSize(len(n.keys), samples, func(i int) int64 {
+			key := n.keys[i]
+			return 2*MEM_STRING_HEADER + int64(len(key)) + MEM_MAP_ENTRY + jsonSize(n.vals[key], nested)
+		})
+	default:
+		return MEM_INTERFACE // null, booleans
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MEMORY command handlers. Sizes are the approximations of memory.go: the
+// dataset is the sum of the sizes recorded for each entry, refreshed every
+// time a command touches it, and the total is the Go heap.
+
+// memoryStats is the breakdown reported by MEMORY STATS.
+type memoryStats struct {
+	peak, total      int64
+	dataset, expires int64
+	access, clients  int64
+	overhead, keys   int64
+}
+
+func readMemoryStats() memoryStats {
+	st := memoryStats{
+		total:   usedMemory(),
+		dataset: keyDataSpace.DatasetBytes(),
+		expires: keyExpirations.MemoryUsage(),
+		access:  keyAccess.MemoryUsage(),
+		clients: connectedClients.Load() * CLIENT_BUFFER_BYTES,
+		keys:    int64(keyDataSpace.Length()),
+	}
+	st.peak = peakMemory()
+	st.overhead = max(st.total-st.dataset, 0)
+	return st
+}
+
+// percentOf returns part as a percentage of whole.
+func percentOf(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(whole)
+}
+
+// MEMORY USAGE key [SAMPLES count]
+// Returns the approximate bytes used by key and its value, or (nil) if the
+// key does not exist. Collections are estimated from count elements
+// (default 5); SAMPLES 0 measures all of them.
+func memoryUsage(argv []string) (string, error) {
+	if len(argv) != 1 && len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("memory|usage")
+	}
+	samples := MEMORY_SAMPLES
+	if len(argv) == 3 {
+		if !strings.EqualFold(argv[1], "SAMPLES") {
+			return "NOT_OK", ErrSyntax
+		}
+		n, err := parseIntArg(argv[2])
+		if err != nil {
+			return "NOT_OK", err
+		}
+		if n < 0 {
+			return "NOT_OK", ErrSyntax
+		}
+		samples = int(n)
+	}
+
+	nowMs := time.Now().UnixMilli()
+	size := int64(-1)
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		if keyAliveLocked(data, argv[0], nowMs) {
+			size = entrySize(argv[0], data[argv[0]], samples)
+		}
+		return nil
+	})
+	if size < 0 {
+		return NIL_REPLY, nil
+	}
+	return intReply(size), nil
+}
+
+// MEMORY STATS
+// Returns a flat array of names and values: the heap in use and its peak,
+// the dataset (keys and values), the expiration index, the access
+// statistics, the client buffers, and the overhead, i.e. everything that is
+// not the dataset (the structures above, search indexes, the runtime).
+func memoryStatsReply() string {
+	st := readMemoryStats()
+	bytesPerKey := int64(0)
+	if st.keys > 0 {
+		bytesPerKey = st.dataset / st.keys
+	}
+	return arrayReply([]string{
+		"peak.allocated", intReply(st.peak),
+		"total.allocated", intReply(st.total),
+		"dataset.bytes", intReply(st.dataset),
+		"dataset.percentage", floatReply(percentOf(st.dataset, st.total)),
+		"expires.bytes", intReply(st.expires),
+		"keys.access.bytes", intReply(st.access),
+		"clients.normal", intReply(st.clients),
+		"overhead.total", intReply(st.overhead),
+		"keys.count", intReply(st.keys),
+		"keys.bytes-per-key", intReply(bytesPerKey),
+		"peak.percentage", floatReply(percentOf(st.total, st.peak)),
+	})
+}
+
+// MEMORY_DOCTOR_MIN_BYTES is the heap size under which MEMORY DOCTOR does not
+// look for issues: the runtime alone takes a few megabytes.
+const MEMORY_DOCTOR_MIN_BYTES = 5 << 20
+
+// MEMORY DOCTOR
+// Returns one hint per memory issue found.
+func memoryDoctor() string {
+	st := readMemoryStats()
+	if st.total < MEMORY_DOCTOR_MIN_BYTES {
+		return arrayReply([]string{"This instance uses very little memory: there is nothing to diagnose yet."})
+	}
+
+	var hints []string
+	if st.peak > st.total*3/2 {
+		hints = append(hints, fmt.Sprintf("Peak memory: in the past this instance used %d bytes, more than 150%% of the memory used now. "+
+			"The Go runtime returns freed memory to the OS gradually, so the process RSS can stay high.", st.peak))
+	}
+	limit, policy, _ := evictionSettings()
+	if limit > 0 && policy == EVICT_NOEVICTION && maxmemoryUsed() > limit/10*9 {
+		hints = append(hints, "Memory limit: the memory used is above 90% of maxmemory and maxmemory-policy is noeviction, "+
+			"so writes will soon fail with OOM errors. Raise maxmemory or choose an eviction policy.")
+	}
+	if st.keys > 0 && st.overhead > st.dataset {
+		hints = append(hints, fmt.Sprintf("High overhead: %d bytes are used besides the %d bytes of the dataset. "+
+			"With many small keys, consider grouping small values into larger ones, such as JSON documents.", st.overhead, st.dataset))
+	}
+	if st.dataset > 0 && st.expires > st.dataset/4 {
+		hints = append(hints, fmt.Sprintf("Expiration index: it takes %d bytes, %.0f%% of the dataset. "+
+			"Many small keys have an expiration; consider expiring groups of values together.", st.expires, percentOf(st.expires, st.dataset)))
+	}
+	if key, size := keyDataSpace.LargestEntry(); st.keys > 1 && size > st.dataset/2 {
+		hints = append(hints, fmt.Sprintf("Big key: %s takes about %d bytes, %.0f%% of the dataset. "+
+			"Consider splitting it, so that it can be read, deleted and evicted in smaller pieces.", key, size, percentOf(size, st.dataset)))
+	}
+	if st.clients > st.total/10 {
+		hints = append(hints, fmt.Sprintf("Clients: %d connections use %d bytes of buffers.", st.clients/CLIENT_BUFFER_BYTES, st.clients))
+	}
+
+	if len(hints) == 0 {
+		hints = append(hints, "I can't find any memory issue in this instance.")
+	}
+	return arrayReply(hints)
+}
+
+// MEMORY USAGE|STATS|DOCTOR|HELP
+func MEMORY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("memory")
+	}
+
+	sub := strings.ToUpper(argv[0])
+	switch sub {
+	case "USAGE":
+		return memoryUsage(argv[1:])
+	case "STATS", "DOCTOR", "HELP":
+		if len(argv) != 1 {
+			return "NOT_OK", errWrongArgs("memory|" + strings.ToLower(sub))
+		}
+	default:
+		return "NOT_OK", errors.New("unknown subcommand '" + argv[0] + "'. Try MEMORY HELP.")
+	}
+
+	switch sub {
+	case "STATS":
+		return memoryStatsReply(), nil
+	case "DOCTOR":
+		return memoryDoctor(), nil
+	default:
+		return arrayReply([]string{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+		}), nil
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc64"
 	"io"
 	"log"
+	"math"
 	"os"
 	"sync"
 	"time"
@@ -15,12 +18,65 @@ import (
 const RDB_FILE_PATH = "rdb.bin"
 const RDB_SNAPSHOT_INTERVAL = 3 * time.Second
 
+// RDB_SAVE_KEY_ACCESS enables saving the key access statistics (see
+// keyAccessSpace.go) next to each snapshot, in a file named after it with the
+// RDB_ACCESS_FILE_SUFFIX, so that restarts keep OBJECT IDLETIME and FREQ.
+const RDB_SAVE_KEY_ACCESS = true
+const RDB_ACCESS_FILE_SUFFIX = ".access"
+
+// Snapshots are written to a file with RDB_TEMP_SUFFIX appended, then renamed
+// over the previous one, so an interrupted save never leaves a truncated file.
+const RDB_TEMP_SUFFIX = ".tmp"
+
 var NATIVE_ENDIAN = binary.NativeEndian
+
+// VALUE_ENDIAN is the byte order of value payloads (see encodeDataValue),
+// which DUMP shares with the rdb file: it is fixed so that DUMP payloads can
+// be restored on any machine.
+var VALUE_ENDIAN = binary.LittleEndian
+
 var rdbFileMutex sync.RWMutex
 
-// An entry is: key_len(uint_32) key(string) data_len(uint_32) data (string) expiration_timestamp_ms(int64)
-// returns key and value and expiration_timestamp_ms error
-func readRdbEntry(f *os.File) (string, string, int64, error) {
+// The rdb file starts with a header: RDB_MAGIC then version(uint_16,
+// little-endian), followed by the entries.
+// Files written before the header existed (version 0) have no value_type
+// field: every value is a string. They are still loaded, while snapshots
+// are always written in the current version. Newer versions are refused.
+const RDB_MAGIC = "REDISGO"
+const RDB_VERSION uint16 = 1
+
+// writeRdbHeader writes the magic and the current version.
+func writeRdbHeader(w io.Writer) error {
+	if _, err := io.WriteString(w, RDB_MAGIC); err != nil {
+		return err
+	}
+	return binary.Write(w, VALUE_ENDIAN, RDB_VERSION)
+}
+
+// readRdbHeader returns the version of the file, leaving f at the first
+// entry. A file without the magic is a version 0 file: f is rewound.
+func readRdbHeader(f *os.File) (uint16, error) {
+	header := make([]byte, len(RDB_MAGIC)+2)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if n < len(header) || string(header[:len(RDB_MAGIC)]) != RDB_MAGIC {
+		_, err = f.Seek(0, io.SeekStart)
+		return 0, err
+	}
+	version := VALUE_ENDIAN.Uint16(header[len(RDB_MAGIC):])
+	if version > RDB_VERSION {
+		return 0, fmt.Errorf("rdb file version %d is newer than the supported version %d", version, RDB_VERSION)
+	}
+	return version, nil
+}
+
+// An entry is: key_len(uint_32) key(string) value_type(uint_8) data_len(uint_32) data(bytes) expiration_timestamp_ms(int64)
+// data is the value payload produced by encodeDataValue for the given value_type.
+// Version 0 entries have no value_type and their data is a string.
+// returns key, value, expiration_timestamp_ms and error
+func readRdbEntry(f *os.File, version uint16) (string, DataValue, int64, error) {
 
 	// READ KEY LEN
 	var keyLen uint32
@@ -29,43 +85,62 @@ func readRdbEntry(f *os.File) (string, string, int64, error) {
 	// err is io.ErrUnexpectedEOF if file ended before N bytes,
 	// or io.EOF if the file had 0 bytes left.
 	if err = binary.Read(f, NATIVE_ENDIAN, &keyLen); err != nil {
-		return "", "", -1, err
+		return "", nil, -1, err
 	}
 
 	// READ KEY
 	key_buf := make([]byte, keyLen)
 	if err = binary.Read(f, NATIVE_ENDIAN, &key_buf); err != nil {
-		return "", "", -1, err
+		return "", nil, -1, err
+	}
+
+	// READ VALUE TYPE
+	var value_type ValueType = STRING_VALUE
+	if version > 0 {
+		if err = binary.Read(f, NATIVE_ENDIAN, &value_type); err != nil {
+			return "", nil, -1, err
+		}
 	}
 
 	// READ DATA LEN
 	var data_len uint32
 	if err = binary.Read(f, NATIVE_ENDIAN, &data_len); err != nil {
-		return "", "", -1, err
+		return "", nil, -1, err
 	}
 
 	// READ DATA
 	data_buf := make([]byte, data_len)
 	if err = binary.Read(f, NATIVE_ENDIAN, data_buf); err != nil {
-		return "", "", -1, err
+		return "", nil, -1, err
 	}
 
 	// READ EXPIRATION
 	var expiration_timestamp_ms int64
 	if err = binary.Read(f, NATIVE_ENDIAN, &expiration_timestamp_ms); err != nil {
-		return "", "", -1, err
+		return "", nil, -1, err
+	}
+
+	// DECODE VALUE
+	value, err := decodeDataValue(value_type, data_buf)
+	if err != nil {
+		return "", nil, -1, fmt.Errorf("key %s: %w", string(key_buf), err)
 	}
 
 	//We always returns err, cause if it equals io.EOF file is finished
-	return string(key_buf), string(data_buf), expiration_timestamp_ms, err
+	return string(key_buf), value, expiration_timestamp_ms, err
 }
 
-// An entry is: key_len(uint_32) key(string) data_len(uint_32) data(string) expiration_timestamp_ms(int64)
+// An entry is: key_len(uint_32) key(string) value_type(uint_8) data_len(uint_32) data(bytes) expiration_timestamp_ms(int64)
 // writes a single entry to the given writer.
 // accepst an io.Writer (like *bufio.Writer) for performance.
-func writeRdbEntry(w io.Writer, key string, data string, exp_ts_ms int64) error {
+func writeRdbEntry(w io.Writer, key string, value DataValue, exp_ts_ms int64) error {
+	data, err := encodeDataValue(value)
+	if err != nil {
+		return err
+	}
+
 	// key_len(uint_32)
-	var err = binary.Write(w, NATIVE_ENDIAN, uint32(len(key)))
+	err = binary.Write(w, NATIVE_ENDIAN, uint32(len(key)))
 	if err != nil {
 		return err
 	}
@@ -76,14 +151,20 @@ func writeRdbEntry(w io.Writer, key string, data string, exp_ts_ms int64) error
 		return err
 	}
 
+	// value_type(uint_8)
+	err = binary.Write(w, NATIVE_ENDIAN, value.Type())
+	if err != nil {
+		return err
+	}
+
 	// data_len(uint_32)
 	err = binary.Write(w, NATIVE_ENDIAN, uint32(len(data)))
 	if err != nil {
 		return err
 	}
 
-	// data(string)
-	_, err = w.Write([]byte(data))
+	// data(bytes)
+	_, err = w.Write(data)
 	if err != nil {
 		return err
 	}
@@ -97,17 +178,262 @@ func writeRdbEntry(w io.Writer, key string, data string, exp_ts_ms int64) error
 	return nil
 }
 
+// writeRdbString writes a length-prefixed string: len(uint_32) bytes
+func writeRdbString(w io.Writer, s string) error {
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// errRdbTruncated reports a length or count larger than the data left.
+var errRdbTruncated = errors.New("length or count exceeds the payload size")
+
+// readRdbString reads a string written by writeRdbString.
+func readRdbString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, VALUE_ENDIAN, &n); err != nil {
+		return "", err
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", errRdbTruncated
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readRdbCount reads an element count(uint_32) and checks that the rest of
+// the payload can hold that many elements of at least minSize bytes, so that
+// a corrupt or crafted payload is rejected before anything is allocated.
+func readRdbCount(r *bytes.Reader, minSize int64) (int, error) {
+	var count uint32
+	if err := binary.Read(r, VALUE_ENDIAN, &count); err != nil {
+		return 0, err
+	}
+	if int64(count)*minSize > int64(r.Len()) {
+		return 0, errRdbTruncated
+	}
+	return int(count), nil
+}
+
+// encodeDataValue serializes a value into the data field of an rdb entry.
+// Payload layout per value type:
+//   - string: the raw bytes of the string
+//   - zset:   member_count(uint_32) then, in ascending order, member(len-prefixed string) score(float64)
+//   - stream: see encodeStream
+//   - json:   the compact JSON text of the document
+//   - bloom:  see encodeBloom
+//   - cms:    see encodeCMS
+//   - topk:   see encodeTopK
+//   - ts:     see encodeTimeSeries
+//   - vset:   see encodeVectorSet
+//   - graph:  see encodeGraph
+func encodeDataValue(value DataValue) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch v := value.(type) {
+	case StringValue:
+		buf.WriteString(string(v))
+
+	case *SortedSet:
+		if err := binary.Write(&buf, VALUE_ENDIAN, uint32(v.Len())); err != nil {
+			return nil, err
+		}
+		for x := v.zsl.First(); x != nil; x = x.level[0].forward {
+			if err := writeRdbString(&buf, x.member); err != nil {
+				return nil, err
+			}
+			if err := binary.Write(&buf, VALUE_ENDIAN, x.score); err != nil {
+				return nil, err
+			}
+		}
+
+	case *Stream:
+		if err := encodeStream(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *JSONValue:
+		buf.WriteString(serializeJSON(v.root))
+
+	case *BloomFilter:
+		if err := encodeBloom(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *CountMinSketch:
+		if err := encodeCMS(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *TopK:
+		if err := encodeTopK(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *TimeSeries:
+		if err := encodeTimeSeries(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *VectorSet:
+		if err := encodeVectorSet(&buf, v); err != nil {
+			return nil, err
+		}
+
+	case *Graph:
+		if err := encodeGraph(&buf, v); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("cannot encode value of type %s", valueTypeName(value.Type()))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeDataValue is the inverse of encodeDataValue.
+func decodeDataValue(value_type ValueType, payload []byte) (DataValue, error) {
+	r := bytes.NewReader(payload)
+
+	switch value_type {
+	case STRING_VALUE:
+		return StringValue(payload), nil
+
+	case ZSET_VALUE:
+		count, err := readRdbCount(r, 4+8)
+		if err != nil {
+			return nil, err
+		}
+		zset := NewSortedSet()
+		for i := 0; i < count; i++ {
+			member, err := readRdbString(r)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if err := binary.Read(r, VALUE_ENDIAN, &score); err != nil {
+				return nil, err
+			}
+			// A NaN score cannot be ordered in the skiplist.
+			if math.IsNaN(score) {
+				return nil, errors.New("invalid sorted set score")
+			}
+			if !zset.Add(score, member) {
+				return nil, errors.New("duplicate sorted set member")
+			}
+		}
+		return zset, nil
+
+	case STREAM_VALUE:
+		return decodeStream(r)
+
+	case JSON_VALUE:
+		root, err := parseJSON(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		return &JSONValue{root: root}, nil
+
+	case BLOOM_VALUE:
+		return decodeBloom(r)
+
+	case CMS_VALUE:
+		return decodeCMS(r)
+
+	case TOPK_VALUE:
+		return decodeTopK(r)
+
+	case TS_VALUE:
+		return decodeTimeSeries(r)
+
+	case VSET_VALUE:
+		return decodeVectorSet(r)
+
+	case GRAPH_VALUE:
+		return decodeGraph(r)
+
+	default:
+		return nil, fmt.Errorf("unknown value type %d", value_type)
+	}
+}
+
+// DUMP_VERSION is the version of the DUMP payload layout. RESTORE rejects
+// payloads written by a newer version.
+const DUMP_VERSION uint16 = 1
+
+var dumpCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// A DUMP payload is: value_type(uint_8) data(bytes) version(uint_16) crc64(uint_64)
+// data is the same payload written in rdb entries by encodeDataValue, so a
+// type added to the rdb file is dumpable as well. The checksum covers all the
+// preceding bytes. Numbers are little-endian (VALUE_ENDIAN), so payloads are
+// portable between machines.
+func encodeDump(value DataValue) ([]byte, error) {
+	data, err := encodeDataValue(value)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(byte(value.Type()))
+	buf.Write(data)
+	binary.Write(&buf, VALUE_ENDIAN, DUMP_VERSION)
+	binary.Write(&buf, VALUE_ENDIAN, crc64.Checksum(buf.Bytes(), dumpCRCTable))
+	return buf.Bytes(), nil
+}
+
+// decodeDump is the inverse of encodeDump.
+func decodeDump(payload []byte) (DataValue, error) {
+	errBadPayload := errors.New("DUMP payload version or checksum are wrong")
+	if len(payload) < 1+2+8 {
+		return nil, errBadPayload
+	}
+	body := payload[:len(payload)-8]
+	if VALUE_ENDIAN.Uint64(payload[len(body):]) != crc64.Checksum(body, dumpCRCTable) {
+		return nil, errBadPayload
+	}
+	if VALUE_ENDIAN.Uint16(body[len(body)-2:]) > DUMP_VERSION {
+		return nil, errBadPayload
+	}
+	value, err := decodeDataValue(ValueType(body[0]), body[1:len(body)-2])
+	if err != nil {
+		return nil, errors.New("Bad data format")
+	}
+	return value, nil
+}
+
+// saveRDBSnapshot copies the keyspace and the expirations and saves them to
+// RDB_FILE_PATH. The copy is taken under the rdbFileMutex write lock too, so
+// concurrent snapshots are written in the order they were taken and a later
+// state (e.g. the empty keyspace after FLUSHALL) is never overwritten by an
+// earlier one.
+func saveRDBSnapshot() error {
+	rdbFileMutex.Lock()
+	defer rdbFileMutex.Unlock()
+
+	if err := saveRDBFile(RDB_FILE_PATH, keyDataSpace.DeepCopy(), keyExpirations.DeepCopy()); err != nil {
+		return err
+	}
+	last_rdb_snapshot_ts.Store(time.Now().UnixMilli())
+	return nil
+}
+
 // saveRDBFile performs the complete, atomic, and safe persistence routine.
-// It opens the file, clears existing content, writes the snapshot, flushes, and syncs.
+// It writes the snapshot to a temporary file, flushes and syncs it, then
+// renames it over rdbFileName. The caller holds the rdbFileMutex write lock
+// (see saveRDBSnapshot).
 func saveRDBFile(rdbFileName string, dataSnapshot *KeyDataSpace, expSnapshot *KeyExpirationMinHeap) error {
-	rdbFileMutex.RLock()
-	defer rdbFileMutex.RUnlock()
-
-	// Open/Create/Truncate File
+	// Open/Create/Truncate the temporary file
 	// O_WRONLY: Write-only access
 	// O_CREATE: Create the file if it doesn't exist
-	// O_TRUNC: TRUNCATE (WIPE) existing content to ensure a clean start
-	file, err := os.OpenFile(rdbFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// O_TRUNC: TRUNCATE (WIPE) leftovers of an interrupted save
+	tmpName := rdbFileName + RDB_TEMP_SUFFIX
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("RDB Snapshot: critical error opening/creating file: %w", err)
 	}
@@ -117,6 +443,10 @@ func saveRDBFile(rdbFileName string, dataSnapshot *KeyDataSpace, expSnapshot *Ke
 	// This makes writes highly efficient by minimizing system calls.
 	writer := bufio.NewWriter(file)
 
+	if err := writeRdbHeader(writer); err != nil {
+		return fmt.Errorf("RDB Snapshot: error writing header: %w", err)
+	}
+
 	// Write Data Snapshot
 	log.Printf("RDB Snapshot: Writing %d entries\n", len(dataSnapshot.data))
 	for key, value := range dataSnapshot.data {
@@ -140,12 +470,101 @@ func saveRDBFile(rdbFileName string, dataSnapshot *KeyDataSpace, expSnapshot *Ke
 	if err := file.Sync(); err != nil {
 		return fmt.Errorf("RDB Snapshot: error during disk synchronization: %w", err)
 	}
+	if err := commitRdbTempFile(file, rdbFileName); err != nil {
+		return err
+	}
+
+	if RDB_SAVE_KEY_ACCESS {
+		if err := saveKeyAccessFile(rdbFileName+RDB_ACCESS_FILE_SUFFIX, dataSnapshot); err != nil {
+			return err
+		}
+	}
 
 	log.Println("RDB Snapshot: completed successfully")
 
 	return nil
 }
 
+// An access file entry is: key_len(uint_32) key(string) last_access_ms(int64) lfu_updated_ms(int64) lfu(uint_8)
+// saveKeyAccessFile writes the access statistics of the keys in the snapshot.
+func saveKeyAccessFile(path string, dataSnapshot *KeyDataSpace) error {
+	file, err := os.OpenFile(path+RDB_TEMP_SUFFIX, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("RDB Snapshot: error opening access file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for key := range dataSnapshot.data {
+		a, ok := keyAccess.Get(key)
+		if !ok {
+			continue
+		}
+		if err := writeRdbString(writer, key); err != nil {
+			return fmt.Errorf("RDB Snapshot: error writing access entry for key %s: %w", key, err)
+		}
+		if err := binary.Write(writer, VALUE_ENDIAN, [2]int64{a.lastAccessMs, a.lfuUpdatedMs}); err != nil {
+			return fmt.Errorf("RDB Snapshot: error writing access entry for key %s: %w", key, err)
+		}
+		if err := writer.WriteByte(a.lfu); err != nil {
+			return fmt.Errorf("RDB Snapshot: error writing access entry for key %s: %w", key, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("RDB Snapshot: error during access file flush: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("RDB Snapshot: error during access file synchronization: %w", err)
+	}
+	return commitRdbTempFile(file, path)
+}
+
+// commitRdbTempFile closes a fully written and synced temporary file and
+// renames it over path.
+func commitRdbTempFile(file *os.File, path string) error {
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("RDB Snapshot: error closing %s: %w", file.Name(), err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("RDB Snapshot: error replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadKeyAccessFile restores the statistics saved by saveKeyAccessFile for
+// the keys that were loaded. A missing file is not an error.
+func loadKeyAccessFile(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	r := bytes.NewReader(buf)
+	for {
+		key, err := readRdbString(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var times [2]int64
+		if err := binary.Read(r, VALUE_ENDIAN, &times); err != nil {
+			return err
+		}
+		a := KeyAccess{lastAccessMs: times[0], lfuUpdatedMs: times[1]}
+		if a.lfu, err = r.ReadByte(); err != nil {
+			return err
+		}
+		if keyDataSpace.Exists(key) {
+			keyAccess.Set(key, a)
+		}
+	}
+}
+
 // tryLoadRdbFile attempts to load an RDB file located at the given path.
 // Initializes keys expirations when exp_ts != NO_EXP_TS
 // Behavior:
@@ -183,8 +602,17 @@ func tryLoadRdbFile(path string) error {
 	}
 	defer f.Close()
 
+	version, err := readRdbHeader(f)
+	if err != nil {
+		return err
+	}
+	if version < RDB_VERSION {
+		log.Printf("RDB Load: %s has version %d, snapshots are written with version %d\n", path, version, RDB_VERSION)
+	}
+
+	loadedAtMs := time.Now().UnixMilli()
 	for {
-		key, value, key_exp_ts, err := readRdbEntry(f)
+		key, value, key_exp_ts, err := readRdbEntry(f, version)
 
 		if err != nil {
 			if err == io.EOF {
@@ -196,13 +624,843 @@ func tryLoadRdbFile(path string) error {
 			return err
 		}
 
-		keyDataSpace.Add(key, value)
+		keyDataSpace.SetValue(key, value)
+		keyAccess.Set(key, newKeyAccess(loadedAtMs))
 
 		//Aggiungi la chiave alla heap di scadenza solo se ha un timestamp valido
-		if key_exp_ts != NO_EXP_TS {
+		// (older files store math.MaxInt64 for keys without expiration)
+		if key_exp_ts != NO_EXP_TS && key_exp_ts != math.MaxInt64 {
 			keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: key_exp_ts})
 		}
 	}
 
+	return loadKeyAccessFile(path + RDB_ACCESS_FILE_SUFFIX)
+}
+
+// writeRdbStreamID writes a stream ID as ms(uint_64) seq(uint_64).
+func writeRdbStreamID(w io.Writer, id StreamID) error {
+	return binary.Write(w, VALUE_ENDIAN, [2]uint64{id.ms, id.seq})
+}
+
+func readRdbStreamID(r *bytes.Reader) (StreamID, error) {
+	var parts [2]uint64
+	err := binary.Read(r, VALUE_ENDIAN, &parts)
+	return StreamID{parts[0], parts[1]}, err
+}
+
+// encodeStream writes the stream payload:
+//
+//	last_id(stream id) entries_added(uint_64) entry_count(uint_32)
+//	  entry: id(stream id) field_count(uint_32) field|value(len-prefixed strings)...
+//	group_count(uint_32)
+//	  group: name(string) last_id(stream id) pel_count(uint_32) consumer_count(uint_32)
+//	    pel entry: id(stream id) consumer(string) delivery_time(int64) delivery_count(uint_64)
+//	    consumer:  name(string) seen_time(int64) active_time(int64)
+//
+// where a stream id is ms(uint_64) seq(uint_64). Consumers' pending sets are
+// rebuilt from the group PEL when loading.
+func encodeStream(w io.Writer, s *Stream) error {
+	if err := writeRdbStreamID(w, s.lastID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, s.entriesAdded); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(s.entries))); err != nil {
+		return err
+	}
+	for _, e := range s.entries {
+		if err := writeRdbStreamID(w, e.id); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, uint32(len(e.fields))); err != nil {
+			return err
+		}
+		for _, f := range e.fields {
+			if err := writeRdbString(w, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(s.groups))); err != nil {
+		return err
+	}
+	for name, g := range s.groups {
+		if err := writeRdbString(w, name); err != nil {
+			return err
+		}
+		if err := writeRdbStreamID(w, g.lastID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, [2]uint32{uint32(len(g.pel)), uint32(len(g.consumers))}); err != nil {
+			return err
+		}
+		for id, p := range g.pel {
+			if err := writeRdbStreamID(w, id); err != nil {
+				return err
+			}
+			if err := writeRdbString(w, p.consumer); err != nil {
+				return err
+			}
+			if err := binary.Write(w, VALUE_ENDIAN, p.deliveryTime); err != nil {
+				return err
+			}
+			if err := binary.Write(w, VALUE_ENDIAN, p.deliveryCount); err != nil {
+				return err
+			}
+		}
+		for _, c := range g.consumers {
+			if err := writeRdbString(w, c.name); err != nil {
+				return err
+			}
+			if err := binary.Write(w, VALUE_ENDIAN, [2]int64{c.seenTime, c.activeTime}); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// decodeStream is the inverse of encodeStream.
+func decodeStream(r *bytes.Reader) (*Stream, error) {
+	s := NewStream()
+	var err error
+	if s.lastID, err = readRdbStreamID(r); err != nil {
+		return nil, err
+	}
+	if err = binary.Read(r, VALUE_ENDIAN, &s.entriesAdded); err != nil {
+		return nil, err
+	}
+	entryCount, err := readRdbCount(r, 16+4)
+	if err != nil {
+		return nil, err
+	}
+	s.entries = make([]streamEntry, entryCount)
+	for i := range s.entries {
+		if s.entries[i].id, err = readRdbStreamID(r); err != nil {
+			return nil, err
+		}
+		fieldCount, err := readRdbCount(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		s.entries[i].fields = make([]string, fieldCount)
+		for j := range s.entries[i].fields {
+			if s.entries[i].fields[j], err = readRdbString(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	groupCount, err := readRdbCount(r, 4+16+8)
+	if err != nil {
+		return nil, err
+	}
+	for ; groupCount > 0; groupCount-- {
+		name, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := readRdbStreamID(r)
+		if err != nil {
+			return nil, err
+		}
+		g := newStreamGroup(lastID)
+		var counts [2]uint32 // pel_count, consumer_count
+		if err = binary.Read(r, VALUE_ENDIAN, &counts); err != nil {
+			return nil, err
+		}
+		if int64(counts[0])*(16+4+16)+int64(counts[1])*(4+16) > int64(r.Len()) {
+			return nil, errRdbTruncated
+		}
+		for i := uint32(0); i < counts[0]; i++ {
+			id, err := readRdbStreamID(r)
+			if err != nil {
+				return nil, err
+			}
+			p := &streamPending{}
+			if p.consumer, err = readRdbString(r); err != nil {
+				return nil, err
+			}
+			if err = binary.Read(r, VALUE_ENDIAN, &p.deliveryTime); err != nil {
+				return nil, err
+			}
+			if err = binary.Read(r, VALUE_ENDIAN, &p.deliveryCount); err != nil {
+				return nil, err
+			}
+			g.pel[id] = p
+		}
+		for i := uint32(0); i < counts[1]; i++ {
+			cname, err := readRdbString(r)
+			if err != nil {
+				return nil, err
+			}
+			var times [2]int64
+			if err = binary.Read(r, VALUE_ENDIAN, &times); err != nil {
+				return nil, err
+			}
+			g.consumers[cname] = &streamConsumer{name: cname, seenTime: times[0], activeTime: times[1], pending: make(map[StreamID]struct{})}
+		}
+		for id, p := range g.pel {
+			c, _ := g.consumer(p.consumer, p.deliveryTime)
+			c.pending[id] = struct{}{}
+		}
+		s.groups[name] = g
+	}
+	return s, nil
+}
+
+// encodeBloom writes a Bloom filter:
+//
+//	expansion(uint_32) non_scaling(uint_8) filter_count(uint_32)
+//	filter: capacity(uint_64) error_rate(float64) hashes(uint_32) items(uint_64) bits(uint_32 size + bytes)
+func encodeBloom(w io.Writer, bf *BloomFilter) error {
+	nonScaling := uint8(0)
+	if bf.nonScaling {
+		nonScaling = 1
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, bf.expansion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, nonScaling); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(bf.links))); err != nil {
+		return err
+	}
+	for _, l := range bf.links {
+		if err := binary.Write(w, VALUE_ENDIAN, l.capacity); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, l.errorRate); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, l.hashes); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, l.items); err != nil {
+			return err
+		}
+		if err := writeRdbString(w, string(l.bits)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeBloom is the inverse of encodeBloom.
+func decodeBloom(r *bytes.Reader) (*BloomFilter, error) {
+	bf := &BloomFilter{}
+	var nonScaling uint8
+	if err := binary.Read(r, VALUE_ENDIAN, &bf.expansion); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, VALUE_ENDIAN, &nonScaling); err != nil {
+		return nil, err
+	}
+	count, err := readRdbCount(r, 8+8+4+8+4)
+	if err != nil {
+		return nil, err
+	}
+	bf.nonScaling = nonScaling != 0
+	if count == 0 {
+		return nil, errors.New("bloom filter without sub-filters")
+	}
+	if bf.expansion == 0 {
+		return nil, errors.New("invalid bloom filter expansion")
+	}
+
+	for i := 0; i < count; i++ {
+		l := &bloomLink{}
+		if err := binary.Read(r, VALUE_ENDIAN, &l.capacity); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &l.errorRate); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &l.hashes); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &l.items); err != nil {
+			return nil, err
+		}
+		bits, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		l.bits = []byte(bits)
+		if !validBloomLink(l) {
+			return nil, errors.New("invalid bloom sub-filter")
+		}
+		bf.links = append(bf.links, l)
+	}
+	return bf, nil
+}
+
+// encodeCMS writes a count-min sketch:
+//
+//	width(uint_32) depth(uint_32) count(uint_64) counters(width*depth uint_32, row by row)
+func encodeCMS(w io.Writer, c *CountMinSketch) error {
+	if err := binary.Write(w, VALUE_ENDIAN, [2]uint32{c.width, c.depth}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, c.count); err != nil {
+		return err
+	}
+	return binary.Write(w, VALUE_ENDIAN, c.counters)
+}
+
+// decodeCMS is the inverse of encodeCMS.
+func decodeCMS(r *bytes.Reader) (*CountMinSketch, error) {
+	var dims [2]uint32
+	if err := binary.Read(r, VALUE_ENDIAN, &dims); err != nil {
+		return nil, err
+	}
+	if !cmsValidDims(uint64(dims[0]), uint64(dims[1])) {
+		return nil, errors.New("invalid count-min sketch dimensions")
+	}
+	var count uint64
+	if err := binary.Read(r, VALUE_ENDIAN, &count); err != nil {
+		return nil, err
+	}
+	if int64(dims[0])*int64(dims[1])*4 > int64(r.Len()) {
+		return nil, errRdbTruncated
+	}
+	c := NewCountMinSketch(dims[0], dims[1])
+	c.count = count
+	if err := binary.Read(r, VALUE_ENDIAN, c.counters); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// encodeTopK writes a Top-K:
+//
+//	k(uint_32) width(uint_32) depth(uint_32) decay(float64)
+//	buckets(width*depth times fingerprint(uint_32) count(uint_32))
+//	heap_count(uint_32) heap entries: item(uint_32 size + string) fingerprint(uint_32) count(uint_32)
+func encodeTopK(w io.Writer, t *TopK) error {
+	if err := binary.Write(w, VALUE_ENDIAN, [3]uint32{t.k, t.width, t.depth}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, t.decay); err != nil {
+		return err
+	}
+	for _, b := range t.buckets {
+		if err := binary.Write(w, VALUE_ENDIAN, [2]uint32{b.fp, b.count}); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(t.heap.entries))); err != nil {
+		return err
+	}
+	for _, e := range t.heap.entries {
+		if err := writeRdbString(w, e.item); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, [2]uint32{e.fp, e.count}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTopK is the inverse of encodeTopK. Heap entries are written in heap
+// order, so they are restored as they are.
+func decodeTopK(r *bytes.Reader) (*TopK, error) {
+	var dims [3]uint32
+	var decay float64
+	if err := binary.Read(r, VALUE_ENDIAN, &dims); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, VALUE_ENDIAN, &decay); err != nil {
+		return nil, err
+	}
+	if dims[0] == 0 || !topkValidDims(uint64(dims[1]), uint64(dims[2])) {
+		return nil, errors.New("invalid top-k dimensions")
+	}
+	if !(decay > 0 && decay <= 1) {
+		return nil, errors.New("invalid top-k decay")
+	}
+	if int64(dims[1])*int64(dims[2])*8 > int64(r.Len()) {
+		return nil, errRdbTruncated
+	}
+	t := NewTopK(dims[0], dims[1], dims[2], decay)
+	for i := range t.buckets {
+		var b [2]uint32
+		if err := binary.Read(r, VALUE_ENDIAN, &b); err != nil {
+			return nil, err
+		}
+		t.buckets[i] = topkBucket{fp: b[0], count: b[1]}
+	}
+
+	count, err := readRdbCount(r, 4+8)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(count) > uint64(t.k) {
+		return nil, errors.New("top-k heap larger than k")
+	}
+	for i := 0; i < count; i++ {
+		item, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		var e [2]uint32
+		if err := binary.Read(r, VALUE_ENDIAN, &e); err != nil {
+			return nil, err
+		}
+		t.heap.Push(&topkEntry{item: item, fp: e[0], count: e[1]})
+	}
+	return t, nil
+}
+
+// encodeTimeSeries writes a time series:
+//
+//	retention(int64) duplicate_policy(uint_8)
+//	label_count(uint_32) labels: name value (uint_32 size + string each)
+//	sample_count(uint_32) samples: timestamp(int64) value(float64)
+//	src(uint_32 size + string, empty if none)
+//	rule_count(uint_32) rules: dest(uint_32 size + string) aggregation(uint_8) bucket(int64) started(uint_8) current(int64)
+func encodeTimeSeries(w io.Writer, ts *TimeSeries) error {
+	if err := binary.Write(w, VALUE_ENDIAN, ts.retention); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint8(ts.policy)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(ts.labels))); err != nil {
+		return err
+	}
+	for _, l := range ts.labels {
+		if err := writeRdbString(w, l[0]); err != nil {
+			return err
+		}
+		if err := writeRdbString(w, l[1]); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(ts.samples))); err != nil {
+		return err
+	}
+	for _, s := range ts.samples {
+		if err := binary.Write(w, VALUE_ENDIAN, s.ts); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, s.value); err != nil {
+			return err
+		}
+	}
+	if err := writeRdbString(w, ts.src); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(ts.rules))); err != nil {
+		return err
+	}
+	for _, r := range ts.rules {
+		started := uint8(0)
+		if r.started {
+			started = 1
+		}
+		if err := writeRdbString(w, r.dest); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, uint8(r.agg)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, r.bucket); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, started); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, r.current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTimeSeries is the inverse of encodeTimeSeries.
+func decodeTimeSeries(r *bytes.Reader) (*TimeSeries, error) {
+	ts := &TimeSeries{}
+	var policy uint8
+	if err := binary.Read(r, VALUE_ENDIAN, &ts.retention); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, VALUE_ENDIAN, &policy); err != nil {
+		return nil, err
+	}
+	if int(policy) >= len(tsDuplicatePolicyNames) {
+		return nil, fmt.Errorf("unknown duplicate policy %d", policy)
+	}
+	ts.policy = tsDuplicatePolicy(policy)
+
+	count, err := readRdbCount(r, 4+4)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		name, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		ts.labels = append(ts.labels, [2]string{name, value})
+	}
+
+	if count, err = readRdbCount(r, 8+8); err != nil {
+		return nil, err
+	}
+	ts.samples = make([]tsSample, count)
+	for i := range ts.samples {
+		if err := binary.Read(r, VALUE_ENDIAN, &ts.samples[i].ts); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &ts.samples[i].value); err != nil {
+			return nil, err
+		}
+	}
+
+	if ts.src, err = readRdbString(r); err != nil {
+		return nil, err
+	}
+	if count, err = readRdbCount(r, 4+1+8+1+8); err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		rule := &tsRule{}
+		var agg, started uint8
+		if rule.dest, err = readRdbString(r); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &agg); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &rule.bucket); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &started); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, VALUE_ENDIAN, &rule.current); err != nil {
+			return nil, err
+		}
+		if int(agg) >= len(tsAggregationNames) || rule.bucket <= 0 {
+			return nil, errors.New("invalid compaction rule")
+		}
+		rule.agg, rule.started = tsAggregation(agg), started != 0
+		ts.rules = append(ts.rules, rule)
+	}
+	return ts, nil
+}
+
+// encodeVectorSet writes a vector set:
+//
+//	metric(uint_8) m(uint_32) ef_construction(uint_32) dim(uint_32)
+//	element_count(uint_32) elements: name(uint_32 size + string) vector(dim float32)
+//
+// The HNSW graph is not stored: decodeVectorSet rebuilds it.
+func encodeVectorSet(w io.Writer, vs *VectorSet) error {
+	if err := binary.Write(w, VALUE_ENDIAN, uint8(vs.metric)); err != nil {
+		return err
+	}
+	header := [4]uint32{uint32(vs.m), uint32(vs.efConstruction), uint32(vs.dim), uint32(vs.Len())}
+	if err := binary.Write(w, VALUE_ENDIAN, header); err != nil {
+		return err
+	}
+	for _, n := range vs.nodes {
+		if err := writeRdbString(w, n.element); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, n.vec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeVectorSet is the inverse of encodeVectorSet.
+func decodeVectorSet(r *bytes.Reader) (*VectorSet, error) {
+	var metric uint8
+	var header [4]uint32
+	if err := binary.Read(r, VALUE_ENDIAN, &metric); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, VALUE_ENDIAN, &header); err != nil {
+		return nil, err
+	}
+	if int(metric) >= len(vsetMetricNames) || header[0] < 2 || header[0] > 4096 ||
+		header[1] == 0 || header[1] > 1000000 || header[2] == 0 {
+		return nil, errors.New("invalid vector set header")
+	}
+	if int64(header[3])*(4+4*int64(header[2])) > int64(r.Len()) {
+		return nil, errRdbTruncated
+	}
+	vs := NewVectorSet(int(header[2]), vsetMetric(metric), int(header[0]), int(header[1]))
+	for i := uint32(0); i < header[3]; i++ {
+		element, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		vec := make([]float32, vs.dim)
+		if err := binary.Read(r, VALUE_ENDIAN, vec); err != nil {
+			return nil, err
+		}
+		vs.Add(element, vec)
+	}
+	return vs, nil
+}
+
+// encodeGraph writes a graph:
+//
+//	next_node_id(uint_64) next_edge_id(uint_64)
+//	node_count(uint_32) nodes: id(uint_64) label_count(uint_32) labels... props
+//	edge_count(uint_32) edges: id(uint_64) type src_id(uint_64) dst_id(uint_64) props
+//
+// Nodes and edges are written in id order; props are written by
+// writeGraphProps.
+func encodeGraph(w io.Writer, g *Graph) error {
+	header := [2]uint64{g.nextNodeID, g.nextEdgeID}
+	if err := binary.Write(w, VALUE_ENDIAN, header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(g.nodes))); err != nil {
+		return err
+	}
+	for _, n := range g.sortedNodes() {
+		if err := binary.Write(w, VALUE_ENDIAN, n.id); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, uint32(len(n.labels))); err != nil {
+			return err
+		}
+		for _, label := range n.labels {
+			if err := writeRdbString(w, label); err != nil {
+				return err
+			}
+		}
+		if err := writeGraphProps(w, n.props); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(g.edges))); err != nil {
+		return err
+	}
+	for _, e := range g.sortedEdges() {
+		if err := binary.Write(w, VALUE_ENDIAN, e.id); err != nil {
+			return err
+		}
+		if err := writeRdbString(w, e.relType); err != nil {
+			return err
+		}
+		if err := binary.Write(w, VALUE_ENDIAN, [2]uint64{e.src.id, e.dst.id}); err != nil {
+			return err
+		}
+		if err := writeGraphProps(w, e.props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeGraph is the inverse of encodeGraph.
+func decodeGraph(r *bytes.Reader) (*Graph, error) {
+	g := NewGraph()
+	var header [2]uint64
+	if err := binary.Read(r, VALUE_ENDIAN, &header); err != nil {
+		return nil, err
+	}
+	g.nextNodeID, g.nextEdgeID = header[0], header[1]
+
+	count, err := readRdbCount(r, 8+4+4)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		n := &graphNode{}
+		if err := binary.Read(r, VALUE_ENDIAN, &n.id); err != nil {
+			return nil, err
+		}
+		labelCount, err := readRdbCount(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < labelCount; j++ {
+			label, err := readRdbString(r)
+			if err != nil {
+				return nil, err
+			}
+			n.labels = append(n.labels, label)
+		}
+		props, err := readGraphProps(r)
+		if err != nil {
+			return nil, err
+		}
+		n.props = props
+		if _, dup := g.nodes[n.id]; dup || n.id >= g.nextNodeID {
+			return nil, errors.New("invalid graph node id")
+		}
+		g.nodes[n.id] = n
+	}
+
+	if count, err = readRdbCount(r, 8+4+16+4); err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		e := &graphEdge{}
+		if err := binary.Read(r, VALUE_ENDIAN, &e.id); err != nil {
+			return nil, err
+		}
+		relType, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		var ends [2]uint64
+		if err := binary.Read(r, VALUE_ENDIAN, &ends); err != nil {
+			return nil, err
+		}
+		props, err := readGraphProps(r)
+		if err != nil {
+			return nil, err
+		}
+		e.relType, e.src, e.dst, e.props = relType, g.nodes[ends[0]], g.nodes[ends[1]], props
+		if _, dup := g.edges[e.id]; dup || e.id >= g.nextEdgeID || e.src == nil || e.dst == nil {
+			return nil, errors.New("invalid graph edge")
+		}
+		g.linkEdge(e)
+	}
+	return g, nil
+}
+
+// Tags of graph property values.
+const (
+	GRAPH_VAL_NULL uint8 = iota
+	GRAPH_VAL_BOOL
+	GRAPH_VAL_INT
+	GRAPH_VAL_FLOAT
+	GRAPH_VAL_STRING
+	GRAPH_VAL_LIST
+)
+
+// writeGraphProps writes prop_count(uint_32) then name(uint_32 size + string)
+// and a tagged value for every property.
+func writeGraphProps(w io.Writer, props graphProps) error {
+	if err := binary.Write(w, VALUE_ENDIAN, uint32(len(props))); err != nil {
+		return err
+	}
+	for _, prop := range props {
+		if err := writeRdbString(w, prop.key); err != nil {
+			return err
+		}
+		if err := writeGraphValue(w, prop.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readGraphProps(r *bytes.Reader) (graphProps, error) {
+	count, err := readRdbCount(r, 4+1)
+	if err != nil {
+		return nil, err
+	}
+	var props graphProps
+	for i := 0; i < count; i++ {
+		key, err := readRdbString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readGraphValue(r)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, graphProp{key, value})
+	}
+	return props, nil
+}
+
+func writeGraphValue(w io.Writer, v any) error {
+	var err error
+	switch x := v.(type) {
+	case nil:
+		err = binary.Write(w, VALUE_ENDIAN, GRAPH_VAL_NULL)
+	case bool:
+		b := uint8(0)
+		if x {
+			b = 1
+		}
+		err = binary.Write(w, VALUE_ENDIAN, [2]uint8{GRAPH_VAL_BOOL, b})
+	case int64:
+		if err = binary.Write(w, VALUE_ENDIAN, GRAPH_VAL_INT); err == nil {
+			err = binary.Write(w, VALUE_ENDIAN, x)
+		}
+	case float64:
+		if err = binary.Write(w, VALUE_ENDIAN, GRAPH_VAL_FLOAT); err == nil {
+			err = binary.Write(w, VALUE_ENDIAN, x)
+		}
+	case string:
+		if err = binary.Write(w, VALUE_ENDIAN, GRAPH_VAL_STRING); err == nil {
+			err = writeRdbString(w, x)
+		}
+	case []any:
+		if err = binary.Write(w, VALUE_ENDIAN, GRAPH_VAL_LIST); err != nil {
+			return err
+		}
+		if err = binary.Write(w, VALUE_ENDIAN, uint32(len(x))); err != nil {
+			return err
+		}
+		for _, item := range x {
+			if err = writeGraphValue(w, item); err != nil {
+				return err
+			}
+		}
+	default:
+		err = fmt.Errorf("cannot encode graph value of type %T", v)
+	}
+	return err
+}
+
+func readGraphValue(r *bytes.Reader) (any, error) {
+	var tag uint8
+	if err := binary.Read(r, VALUE_ENDIAN, &tag); err != nil {
+		return nil, err
+	}
+	switch tag {
+	case GRAPH_VAL_NULL:
+		return nil, nil
+	case GRAPH_VAL_BOOL:
+		var b uint8
+		err := binary.Read(r, VALUE_ENDIAN, &b)
+		return b != 0, err
+	case GRAPH_VAL_INT:
+		var n int64
+		err := binary.Read(r, VALUE_ENDIAN, &n)
+		return n, err
+	case GRAPH_VAL_FLOAT:
+		var f float64
+		err := binary.Read(r, VALUE_ENDIAN, &f)
+		return f, err
+	case GRAPH_VAL_STRING:
+		return readRdbString(r)
+	case GRAPH_VAL_LIST:
+		count, err := readRdbCount(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readGraphValue(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown graph value tag %d", tag)
+}
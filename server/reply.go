@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The protocol answers every command with exactly one line, so replies that
+// carry more than one value are flattened with the helpers below:
+//   - a missing value is rendered as NIL_REPLY
+//   - an array is rendered as "[item item ...]"; nested arrays nest naturally
+//   - items that would not survive cutFirstTokenSmart as a single token are quoted
+//   - string values are sent as they are, unless they hold binary data
+//     (see stringReply)
+const NIL_REPLY = "(nil)"
+
+// stringReply renders a stored string value as a whole reply. Binary values,
+// such as bitmaps, zero-padded strings or HyperLogLogs, may hold line
+// terminators, other control bytes or invalid UTF-8: those are quoted, like
+// the empty string, which would otherwise read as OK.
+func stringReply(s string) string {
+	if s == "" || !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// bulkReply renders a single array item so that it can be read back as one token.
+func bulkReply(s string) string {
+	if s == "" {
+		return `""`
+	}
+	tok, rest, err := cutFirstTokenSmart(s)
+	if err == nil && tok == s && rest == "" {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// arrayReply renders items as a single-line array.
+// Items produced by arrayReply itself can be passed in to build nested arrays.
+func arrayReply(items []string) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, item := range items {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(bulkReply(item))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// intReply renders an integer reply.
+func intReply(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// floatReply renders a float using the shortest representation that round-trips,
+// with infinities spelled as Redis does.
+func floatReply(f float64) string {
+	if math.IsInf(f, 1) {
+		return "inf"
+	}
+	if math.IsInf(f, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
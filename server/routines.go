@@ -6,14 +6,25 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// CLIENT_BUFFER_BYTES is the memory reserved for each connection by its
+// buffered reader and writer (bufio default sizes).
+const CLIENT_BUFFER_BYTES = 2 * 4096
+
+// Number of open client connections
+var connectedClients atomic.Int64
+
 // handleClientServerRoutine processes one client connection using a simple line-based protocol.
 // Each client message is one line terminated by '\n'; the server replies with exactly one line.
 func handleClientServerRoutine(conn net.Conn) {
 	defer conn.Close()
 
+	connectedClients.Add(1)
+	defer connectedClients.Add(-1)
+
 	r := bufio.NewReader(conn) // line reader for the socket
 	w := bufio.NewWriter(conn) // buffered writer for replies
 
@@ -78,24 +89,38 @@ func handleClientServerRoutine(conn net.Conn) {
 	}
 }
 
+// KEY_EXPIRATION_MAX_SLEEP bounds how long the expiration routine sleeps, so
+// that expirations set meanwhile are honored with little delay.
+const KEY_EXPIRATION_MAX_SLEEP = 100 * time.Millisecond
+
 func handleKeysExpirationGoRoutine() {
 	for {
 		keyExp, has_elements := keyExpirations.Peek()
 
 		if !has_elements {
-			time.Sleep(3 * time.Second)
+			time.Sleep(KEY_EXPIRATION_MAX_SLEEP)
 			continue
 		}
-		log.Println("keysExpirationGoRoutine running...")
 
-		if time.Now().UnixMilli() >= keyExp.expire_timestamp {
-			log.Println("Removing expired key:", keyExp.key)
-			keyDataSpace.Remove(keyExp.key)
-			keyExpirations.PopMin()
-		} else {
-			time.Sleep(3 * time.Second)
+		nowMs := time.Now().UnixMilli()
+		if nowMs < keyExp.expire_timestamp {
+			wait := KEY_EXPIRATION_MAX_SLEEP
+			if remaining := keyExp.expire_timestamp - nowMs; remaining < wait.Milliseconds() {
+				wait = time.Duration(remaining) * time.Millisecond
+			}
+			time.Sleep(wait)
 			continue
 		}
+
+		// The expiration may have been changed since Peek: check it again
+		// under the lock before deleting.
+		keyDataSpace.Update(func(data map[string]DataValue) error {
+			if ts, ok := keyExpirations.FindExpiration(keyExp.key); ok && ts <= nowMs {
+				log.Println("Removing expired key:", keyExp.key)
+				deleteKeyLocked(data, keyExp.key)
+			}
+			return nil
+		})
 	}
 }
 
@@ -113,18 +138,11 @@ func rdbSnapshotGoRoutine() {
 	for range ticker.C {
 		log.Println("Starting RDB snaphsot execution..")
 
-		// Create consistent deep copies of the in-memory data structures.
-		// DeepCopy methods should acquire read locks (RLock) on the original structures
-		// to ensure a consistent, crash-safe snapshot of the data at that moment.
-		copyOfKeyDataSpace := keyDataSpace.DeepCopy()
-		copyOfKeyExpirationSpace := keyExpirations.DeepCopy()
-
-		// Save the copied data to the RDB file (this is the I/O operation).
-		// This function should handle serialization and file writing.
-		saveRDBFile(RDB_FILE_PATH, copyOfKeyDataSpace, copyOfKeyExpirationSpace)
-
-		// Record the time when the snapshot finished.
-		// This timestamp reflects the moment the persistent state was established.
-		last_rdb_snapshot_ts = time.Now().UnixMilli()
+		// Deep copy the in-memory data structures and save the copy to the
+		// RDB file (this is the I/O operation). On success the snapshot time
+		// is recorded in last_rdb_snapshot_ts.
+		if err := saveRDBSnapshot(); err != nil {
+			log.Println(err)
+		}
 	}
 }
@@ -0,0 +1,139 @@
+// File: scanIndex.go
+//
+// Purpose:
+//   Names ordered by scan hash (see scanHash), so that SCAN and ZSCAN can
+//   resume an iteration from its cursor without walking the whole
+//   collection. It is a skiplist ordered by (hash, name): the name breaks
+//   ties between colliding hashes.
+//
+// Asymptotic costs (n = number of names):
+//   - Insert / delete:        O(log n) expected
+//   - Scan of count names:    O(log n + count) expected
+//
+// Concurrency:
+//   Not thread-safe. The keyspace index is guarded by KeyDataSpace.trackMu,
+//   the index of a sorted set follows the sorted set itself.
+
+package main
+
+type scanIndexNode struct {
+	hash    uint64
+	name    string
+	forward []*scanIndexNode
+}
+
+// ScanIndex keeps names ordered by (scanHash(name), name).
+type ScanIndex struct {
+	header *scanIndexNode
+	length int
+	level  int
+}
+
+// NewScanIndex creates an empty index.
+func NewScanIndex() *ScanIndex {
+	return &ScanIndex{
+		header: &scanIndexNode{forward: make([]*scanIndexNode, SKIPLIST_MAX_LEVEL)},
+		level:  1,
+	}
+}
+
+func scanHash(name string) uint64 {
+	return murmurHash64A([]byte(name), SCAN_HASH_SEED)
+}
+
+// scanNodeLess reports whether node sorts before (hash, name).
+func scanNodeLess(node *scanIndexNode, hash uint64, name string) bool {
+	return node.hash < hash || (node.hash == hash && node.name < name)
+}
+
+// Len returns the number of names in the index.
+func (ix *ScanIndex) Len() int {
+	return ix.length
+}
+
+// Insert adds name. The caller must make sure name is not already present.
+func (ix *ScanIndex) Insert(name string) {
+	var update [SKIPLIST_MAX_LEVEL]*scanIndexNode
+	hash := scanHash(name)
+
+	x := ix.header
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && scanNodeLess(x.forward[i], hash, name) {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > ix.level {
+		for i := ix.level; i < level; i++ {
+			update[i] = ix.header
+		}
+		ix.level = level
+	}
+
+	x = &scanIndexNode{hash: hash, name: name, forward: make([]*scanIndexNode, level)}
+	for i := 0; i < level; i++ {
+		x.forward[i] = update[i].forward[i]
+		update[i].forward[i] = x
+	}
+	ix.length++
+}
+
+// Delete removes name. Returns true if it was present.
+func (ix *ScanIndex) Delete(name string) bool {
+	var update [SKIPLIST_MAX_LEVEL]*scanIndexNode
+	hash := scanHash(name)
+
+	x := ix.header
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && scanNodeLess(x.forward[i], hash, name) {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	x = x.forward[0]
+	if x == nil || x.hash != hash || x.name != name {
+		return false
+	}
+	for i := 0; i < ix.level; i++ {
+		if update[i].forward[i] == x {
+			update[i].forward[i] = x.forward[i]
+		}
+	}
+	for ix.level > 1 && ix.header.forward[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.length--
+	return true
+}
+
+// Scan returns the count names with the smallest hashes >= cursor, in hash
+// order, and the cursor to continue from (0 when the iteration is
+// complete). Names sharing the hash of the last one returned are all
+// included, since the next cursor skips past that hash.
+func (ix *ScanIndex) Scan(cursor uint64, count int) ([]string, uint64) {
+	x := ix.header
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && x.forward[i].hash < cursor {
+			x = x.forward[i]
+		}
+	}
+	x = x.forward[0]
+
+	var names []string
+	var last uint64
+	for ; x != nil && len(names) < count; x = x.forward[0] {
+		names = append(names, x.name)
+		last = x.hash
+	}
+	// Hash collision on the boundary: take the other names sharing it.
+	for ; x != nil && x.hash == last; x = x.forward[0] {
+		names = append(names, x.name)
+	}
+	if x == nil {
+		return names, 0
+	}
+	return names, last + 1
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Search command handlers. Indexes are *SearchIndex values kept in
+// searchIndexes (see searchIndex.go).
+
+var ErrFTUnknownIndex = errors.New("Unknown index name")
+
+// FT.CREATE index [ON JSON] [PREFIX count prefix [prefix ...]]
+//
+//	SCHEMA path [AS name] TEXT|TAG [SEPARATOR sep]|NUMERIC [SORTABLE] [path ...]
+//
+// Creates an index and fills it with the JSON documents already stored under
+// the prefixes (all keys when no prefix is given). Hash indexes are not
+// supported, since this server has no hash type.
+func FT_CREATE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 4 {
+		return "NOT_OK", errWrongArgs("ft.create")
+	}
+	name := argv[0]
+
+	var prefixes []string
+	i := 1
+	for i < len(argv) && strings.ToUpper(argv[i]) != "SCHEMA" {
+		switch strings.ToUpper(argv[i]) {
+		case "ON":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			switch strings.ToUpper(argv[i+1]) {
+			case "JSON":
+			case "HASH":
+				return "NOT_OK", errors.New("ON HASH is not supported, only JSON documents can be indexed")
+			default:
+				return "NOT_OK", ErrSyntax
+			}
+			i += 2
+		case "PREFIX":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			n, err := parseIntArg(argv[i+1])
+			if err != nil || n < 1 || n > int64(len(argv)-i-2) {
+				return "NOT_OK", errors.New("bad arguments for PREFIX")
+			}
+			prefixes = append(prefixes, argv[i+2:i+2+int(n)]...)
+			i += 2 + int(n)
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+	if i >= len(argv)-1 {
+		return "NOT_OK", errors.New("fields arguments are missing")
+	}
+
+	fields, err := parseFTSchema(argv[i+1:])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := searchIndexes[name]; exists {
+			return errors.New("Index already exists")
+		}
+		idx := NewSearchIndex(name, prefixes, fields)
+		for key, value := range data {
+			if doc, ok := value.(*JSONValue); ok && idx.covers(key) {
+				idx.add(key, doc)
+			}
+		}
+		searchIndexes[name] = idx
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// parseFTSchema parses the field definitions following SCHEMA.
+func parseFTSchema(argv []string) ([]*ftField, error) {
+	var fields []*ftField
+	for i := 0; i < len(argv); {
+		path, err := parseJSONPath(argv[i])
+		if err != nil {
+			return nil, err
+		}
+		f := &ftField{name: argv[i], path: path, separator: ","}
+		i++
+		if i+1 < len(argv) && strings.ToUpper(argv[i]) == "AS" {
+			f.name = argv[i+1]
+			i += 2
+		}
+		if i >= len(argv) {
+			return nil, errors.New("missing type for field " + f.name)
+		}
+		switch strings.ToUpper(argv[i]) {
+		case "TEXT":
+			f.kind = FT_TEXT
+		case "TAG":
+			f.kind = FT_TAG
+		case "NUMERIC":
+			f.kind = FT_NUMERIC
+		default:
+			return nil, errors.New("invalid field type for field " + f.name)
+		}
+		i++
+
+	options:
+		for i < len(argv) {
+			switch strings.ToUpper(argv[i]) {
+			case "SEPARATOR":
+				if f.kind != FT_TAG || i+1 >= len(argv) || len(argv[i+1]) != 1 {
+					return nil, errors.New("SEPARATOR takes a single character and applies to TAG fields")
+				}
+				f.separator = argv[i+1]
+				i += 2
+			case "SORTABLE":
+				// Every field can be sorted on already.
+				i++
+			default:
+				break options
+			}
+		}
+
+		for _, other := range fields {
+			if other.name == f.name {
+				return nil, errors.New("Duplicate field in schema - " + f.name)
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// FT.SEARCH index query [NOCONTENT] [RETURN count field [field ...]]
+//
+//	[SORTBY field [ASC|DESC]] [LIMIT offset num]
+//
+// Replies with the total number of matches followed by the keys in the LIMIT
+// window (default 0 10), each with its content: ["$" document] by default,
+// the field/value pairs listed by RETURN, or nothing with NOCONTENT. Keys are
+// ordered by name unless SORTBY is given.
+func FT_SEARCH(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("ft.search")
+	}
+	name, query := argv[0], argv[1]
+	// Queries with spaces arrive as a quoted token.
+	if strings.HasPrefix(query, `"`) {
+		if query, err = strconv.Unquote(query); err != nil {
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	noContent, desc := false, false
+	var returns []string
+	sortBy := ""
+	offset, num := int64(0), int64(10)
+	for i := 2; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "NOCONTENT":
+			noContent = true
+		case "RETURN":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			n, err := parseIntArg(argv[i+1])
+			if err != nil || n < 0 || n > int64(len(argv)-i-2) {
+				return "NOT_OK", errors.New("bad arguments for RETURN")
+			}
+			returns = argv[i+2 : i+2+int(n)]
+			i += 1 + int(n)
+		case "SORTBY":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			sortBy = argv[i+1]
+			i++
+			if i+1 < len(argv) {
+				switch strings.ToUpper(argv[i+1]) {
+				case "ASC":
+					i++
+				case "DESC":
+					desc = true
+					i++
+				}
+			}
+		case "LIMIT":
+			if i+2 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			if offset, err = parseIntArg(argv[i+1]); err != nil || offset < 0 {
+				return "NOT_OK", errors.New("bad arguments for LIMIT")
+			}
+			if num, err = parseIntArg(argv[i+2]); err != nil || num < 0 {
+				return "NOT_OK", errors.New("bad arguments for LIMIT")
+			}
+			i += 2
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	var items []string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		idx, ok := searchIndexes[name]
+		if !ok {
+			return ErrFTUnknownIndex
+		}
+		node, err := parseFTQuery(idx, query)
+		if err != nil {
+			return err
+		}
+		sortField := -1
+		if sortBy != "" {
+			if sortField = idx.fieldIndex(sortBy); sortField < 0 {
+				return errors.New("Property `" + sortBy + "` not loaded nor in schema")
+			}
+		}
+		returnFields := make([]*ftField, len(returns))
+		for i, r := range returns {
+			if j := idx.fieldIndex(r); j >= 0 {
+				returnFields[i] = idx.fields[j]
+				continue
+			}
+			path, err := parseJSONPath(r)
+			if err != nil {
+				return err
+			}
+			returnFields[i] = &ftField{name: r, path: path}
+		}
+
+		matches := node.eval(idx)
+		keys := make([]string, 0, len(matches))
+		for key := range matches {
+			keys = append(keys, key)
+		}
+		idx.sortKeys(keys, sortField, desc)
+
+		items = append(items, intReply(int64(len(keys))))
+		if offset >= int64(len(keys)) {
+			return nil
+		}
+		num = min(num, int64(len(keys))-offset) // offset+num may overflow
+		for _, key := range keys[offset : offset+num] {
+			// The index follows every write: skip rather than panic if a key
+			// somehow holds another type.
+			doc, ok := data[key].(*JSONValue)
+			if !ok {
+				continue
+			}
+			items = append(items, key)
+			if noContent {
+				continue
+			}
+			if len(returnFields) == 0 {
+				items = append(items, arrayReply([]string{"$", serializeJSON(doc.root)}))
+				continue
+			}
+			var content []string
+			for _, f := range returnFields {
+				if v, ok := ftFieldReply(doc, f); ok {
+					content = append(content, f.name, v)
+				}
+			}
+			items = append(items, arrayReply(content))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// FT.DROPINDEX index [DD]
+// Deletes the index; DD also deletes the documents it indexed.
+func FT_DROPINDEX(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("ft.dropindex")
+	}
+	deleteDocs := false
+	if len(argv) == 2 {
+		if strings.ToUpper(argv[1]) != "DD" {
+			return "NOT_OK", ErrSyntax
+		}
+		deleteDocs = true
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		idx, ok := searchIndexes[argv[0]]
+		if !ok {
+			return ErrFTUnknownIndex
+		}
+		delete(searchIndexes, argv[0])
+		if deleteDocs {
+			for key := range idx.docs {
+				deleteKeyLocked(data, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
@@ -0,0 +1,647 @@
+// File: searchIndex.go
+//
+// Purpose:
+//   Secondary indexes for the FT.* commands, modelled after RediSearch, over
+//   JSON documents whose key starts with one of the index prefixes.
+//
+//   An index has a schema of fields, each read from the documents with a
+//   JSONPath:
+//     TEXT     strings are split into lowercase words; an inverted index maps
+//              every word to the keys containing it
+//     TAG      strings are split on a separator (default ','), trimmed and
+//              lowercased; arrays of strings give one tag per element
+//     NUMERIC  the first number found; kept in a skip list (see sortedSet.go)
+//              so that ranges are found in O(log n)
+//
+//   Indexes are maintained incrementally: every write that can change a
+//   JSON document, replace it or delete it (including expiration) calls
+//   ftReindexLocked, which drops the key from every index and indexes it
+//   again if it still holds a matching document.
+//
+//   Queries (see parseFTQuery) are evaluated to the set of matching keys:
+//     word  w*  @field:word  @field:(expr)   text terms and prefixes
+//     @field:{tag | tag}                     tags
+//     @field:[min max]                       numeric range, '(' excludes a bound
+//     a b   a | b   -a   ( ... )   *         AND, OR, NOT, grouping, all
+//   AND binds tighter than OR.
+//
+// Asymptotic costs:
+//   - Indexing a document: O(words + tags + numeric fields * log n)
+//   - Term / tag lookup: O(matching keys); prefix: O(distinct words)
+//   - Numeric range: O(log n + matching keys)
+//
+// Concurrency:
+//   - searchIndexes and the indexes are guarded by the KeyDataSpace lock:
+//     they are modified under the write lock and read under the read lock.
+//   - Index definitions are not saved in the rdb file: indexes are rebuilt
+//     from the stored documents when they are created again.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchIndexes holds the FT indexes by name.
+var searchIndexes = map[string]*SearchIndex{}
+
+type ftFieldKind uint8
+
+const (
+	FT_TEXT ftFieldKind = iota
+	FT_TAG
+	FT_NUMERIC
+)
+
+type ftField struct {
+	name      string // alias, or the path when no alias is given
+	path      *jsonPath
+	kind      ftFieldKind
+	separator string // TAG only
+}
+
+// ftDocField holds the values indexed for one field of a document.
+type ftDocField struct {
+	has    bool
+	terms  []string // distinct words (TEXT) or tags (TAG)
+	num    float64  // NUMERIC
+	sortBy string   // first string value, used by SORTBY on TEXT and TAG fields
+}
+
+// SearchIndex is an index created by FT.CREATE.
+type SearchIndex struct {
+	name     string
+	prefixes []string
+	fields   []*ftField
+	docs     map[string][]ftDocField          // key -> one entry per field
+	postings []map[string]map[string]struct{} // per TEXT/TAG field: term -> keys
+	numbers  []*SortedSet                     // per NUMERIC field: key scored by value
+}
+
+// NewSearchIndex creates an empty index.
+func NewSearchIndex(name string, prefixes []string, fields []*ftField) *SearchIndex {
+	idx := &SearchIndex{
+		name:     name,
+		prefixes: prefixes,
+		fields:   fields,
+		docs:     make(map[string][]ftDocField),
+		postings: make([]map[string]map[string]struct{}, len(fields)),
+		numbers:  make([]*SortedSet, len(fields)),
+	}
+	for i, f := range fields {
+		if f.kind == FT_NUMERIC {
+			idx.numbers[i] = NewSortedSet()
+		} else {
+			idx.postings[i] = make(map[string]map[string]struct{})
+		}
+	}
+	return idx
+}
+
+// fieldIndex returns the position of the named field, or -1.
+func (idx *SearchIndex) fieldIndex(name string) int {
+	for i, f := range idx.fields {
+		if f.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// covers reports whether key falls under one of the index prefixes.
+func (idx *SearchIndex) covers(key string) bool {
+	if len(idx.prefixes) == 0 {
+		return true
+	}
+	for _, p := range idx.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ftTokenize splits text into lowercase words.
+func ftTokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ftStrings returns the strings at v: v itself, or the string elements of an array.
+func ftStrings(v any) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case *jsonArray:
+		var out []string
+		for _, item := range val.items {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// extract reads the value of field f from doc.
+func (f *ftField) extract(doc *JSONValue) ftDocField {
+	var df ftDocField
+	seen := make(map[string]bool)
+	for _, loc := range f.path.eval(doc, false) {
+		v, _ := loc.get()
+		if f.kind == FT_NUMERIC {
+			if n, ok := v.(json.Number); ok && !df.has {
+				if num, err := n.Float64(); err == nil {
+					df.has, df.num = true, num
+				}
+			}
+			continue
+		}
+
+		for _, s := range ftStrings(v) {
+			if !df.has {
+				df.has, df.sortBy = true, s
+			}
+			var terms []string
+			if f.kind == FT_TEXT {
+				terms = ftTokenize(s)
+			} else if _, isArray := v.(*jsonArray); isArray {
+				terms = []string{s}
+			} else {
+				terms = strings.Split(s, f.separator)
+			}
+			for _, t := range terms {
+				if f.kind == FT_TAG {
+					t = strings.ToLower(strings.TrimSpace(t))
+				}
+				if t != "" && !seen[t] {
+					seen[t] = true
+					df.terms = append(df.terms, t)
+				}
+			}
+		}
+	}
+	return df
+}
+
+// add indexes doc under key.
+func (idx *SearchIndex) add(key string, doc *JSONValue) {
+	fields := make([]ftDocField, len(idx.fields))
+	for i, f := range idx.fields {
+		fields[i] = f.extract(doc)
+		if !fields[i].has {
+			continue
+		}
+		if f.kind == FT_NUMERIC {
+			idx.numbers[i].Add(fields[i].num, key)
+			continue
+		}
+		for _, t := range fields[i].terms {
+			keys := idx.postings[i][t]
+			if keys == nil {
+				keys = make(map[string]struct{})
+				idx.postings[i][t] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+	idx.docs[key] = fields
+}
+
+// remove drops key from the index.
+func (idx *SearchIndex) remove(key string) {
+	fields, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	delete(idx.docs, key)
+	for i, df := range fields {
+		if !df.has {
+			continue
+		}
+		if idx.fields[i].kind == FT_NUMERIC {
+			idx.numbers[i].Remove(key)
+			continue
+		}
+		for _, t := range df.terms {
+			delete(idx.postings[i][t], key)
+			if len(idx.postings[i][t]) == 0 {
+				delete(idx.postings[i], t)
+			}
+		}
+	}
+}
+
+// ftReindexLocked updates every index after key was written or deleted.
+// It must be called while holding the KeyDataSpace write lock.
+func ftReindexLocked(data map[string]DataValue, key string) {
+	for _, idx := range searchIndexes {
+		idx.remove(key)
+		if doc, ok := data[key].(*JSONValue); ok && idx.covers(key) {
+			idx.add(key, doc)
+		}
+	}
+}
+
+// ftFlushLocked empties every index, keeping its definition.
+// It must be called while holding the KeyDataSpace write lock.
+func ftFlushLocked() {
+	for name, idx := range searchIndexes {
+		searchIndexes[name] = NewSearchIndex(idx.name, idx.prefixes, idx.fields)
+	}
+}
+
+// --- Queries ---
+
+// ftKeySet is the result of evaluating a query node.
+type ftKeySet map[string]struct{}
+
+type ftNode interface {
+	eval(idx *SearchIndex) ftKeySet
+}
+
+type (
+	ftAllNode  struct{}
+	ftTermNode struct {
+		field  int // -1 for every TEXT field
+		term   string
+		prefix bool
+	}
+	ftTagNode struct {
+		field int
+		tags  []string
+	}
+	ftRangeNode struct {
+		field int
+		r     *scoreRange
+	}
+	ftAndNode struct{ children []ftNode }
+	ftOrNode  struct{ children []ftNode }
+	ftNotNode struct{ child ftNode }
+)
+
+func (ftAllNode) eval(idx *SearchIndex) ftKeySet {
+	out := make(ftKeySet, len(idx.docs))
+	for key := range idx.docs {
+		out[key] = struct{}{}
+	}
+	return out
+}
+
+func (n ftTermNode) eval(idx *SearchIndex) ftKeySet {
+	out := make(ftKeySet)
+	for i, f := range idx.fields {
+		if f.kind != FT_TEXT || (n.field >= 0 && n.field != i) {
+			continue
+		}
+		if !n.prefix {
+			for key := range idx.postings[i][n.term] {
+				out[key] = struct{}{}
+			}
+			continue
+		}
+		for term, keys := range idx.postings[i] {
+			if strings.HasPrefix(term, n.term) {
+				for key := range keys {
+					out[key] = struct{}{}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (n ftTagNode) eval(idx *SearchIndex) ftKeySet {
+	out := make(ftKeySet)
+	for _, tag := range n.tags {
+		for key := range idx.postings[n.field][tag] {
+			out[key] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (n ftRangeNode) eval(idx *SearchIndex) ftKeySet {
+	out := make(ftKeySet)
+	zsl := idx.numbers[n.field].zsl
+	for x := zsl.FirstInScoreRange(n.r); x != nil && n.r.lteMax(x.score); x = x.level[0].forward {
+		out[x.member] = struct{}{}
+	}
+	return out
+}
+
+func (n ftAndNode) eval(idx *SearchIndex) ftKeySet {
+	out := n.children[0].eval(idx)
+	for _, child := range n.children[1:] {
+		if len(out) == 0 {
+			break
+		}
+		other := child.eval(idx)
+		for key := range out {
+			if _, ok := other[key]; !ok {
+				delete(out, key)
+			}
+		}
+	}
+	return out
+}
+
+func (n ftOrNode) eval(idx *SearchIndex) ftKeySet {
+	out := make(ftKeySet)
+	for _, child := range n.children {
+		for key := range child.eval(idx) {
+			out[key] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (n ftNotNode) eval(idx *SearchIndex) ftKeySet {
+	excluded := n.child.eval(idx)
+	out := make(ftKeySet)
+	for key := range idx.docs {
+		if _, ok := excluded[key]; !ok {
+			out[key] = struct{}{}
+		}
+	}
+	return out
+}
+
+// ftQueryParser is a recursive descent parser over the query string:
+//
+//	or    := and ('|' and)*
+//	and   := unary+
+//	unary := '-' unary | atom
+//	atom  := '(' or ')' | '*' | '@' field ':' value | word
+//	value := '[' min max ']' | '{' tag ('|' tag)* '}' | '(' or ')' | word
+//
+// Every nested group and negation goes through parseUnary, which bounds the
+// recursion to FT_QUERY_MAX_DEPTH levels.
+type ftQueryParser struct {
+	idx   *SearchIndex
+	s     string
+	pos   int
+	depth int
+}
+
+const FT_QUERY_MAX_DEPTH = 128
+
+func errFTQuery(msg string) error {
+	return errors.New("Syntax error in query: " + msg)
+}
+
+// parseFTQuery parses a query against the fields of idx.
+func parseFTQuery(idx *SearchIndex, query string) (ftNode, error) {
+	p := &ftQueryParser{idx: idx, s: query}
+	node, err := p.parseOr(-1)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos < len(p.s) {
+		return nil, errFTQuery("unexpected '" + p.s[p.pos:p.pos+1] + "'")
+	}
+	return node, nil
+}
+
+func (p *ftQueryParser) skipSpaces() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *ftQueryParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// parseOr and parseAnd take the text field that bare words refer to (-1 for all).
+func (p *ftQueryParser) parseOr(field int) (ftNode, error) {
+	var children []ftNode
+	for {
+		node, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return ftOrNode{children}, nil
+}
+
+func (p *ftQueryParser) parseAnd(field int) (ftNode, error) {
+	var children []ftNode
+	for {
+		if c := p.peek(); c == 0 || c == '|' || c == ')' {
+			break
+		}
+		node, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	switch len(children) {
+	case 0:
+		return nil, errFTQuery("empty expression")
+	case 1:
+		return children[0], nil
+	}
+	return ftAndNode{children}, nil
+}
+
+func (p *ftQueryParser) parseUnary(field int) (ftNode, error) {
+	if p.depth++; p.depth > FT_QUERY_MAX_DEPTH {
+		return nil, errFTQuery("query nested too deeply")
+	}
+	defer func() { p.depth-- }()
+
+	if p.peek() == '-' {
+		p.pos++
+		child, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		return ftNotNode{child}, nil
+	}
+	return p.parseAtom(field)
+}
+
+func (p *ftQueryParser) parseAtom(field int) (ftNode, error) {
+	switch p.peek() {
+	case '(':
+		return p.parseGroup(field)
+	case '*':
+		p.pos++
+		return ftAllNode{}, nil
+	case '@':
+		p.pos++
+		name := p.readWhile(func(r rune) bool { return r != ':' && !unicode.IsSpace(r) })
+		if p.pos >= len(p.s) || p.s[p.pos] != ':' {
+			return nil, errFTQuery("expected ':' after @" + name)
+		}
+		p.pos++
+		i := p.idx.fieldIndex(name)
+		if i < 0 {
+			return nil, errors.New("Unknown field '" + name + "'")
+		}
+		return p.parseFieldValue(i)
+	}
+	return p.parseWord(field)
+}
+
+func (p *ftQueryParser) parseGroup(field int) (ftNode, error) {
+	p.pos++
+	node, err := p.parseOr(field)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != ')' {
+		return nil, errFTQuery("missing ')'")
+	}
+	p.pos++
+	return node, nil
+}
+
+func (p *ftQueryParser) parseFieldValue(field int) (ftNode, error) {
+	kind := p.idx.fields[field].kind
+	c := p.peek()
+	switch {
+	case kind == FT_NUMERIC:
+		if c != '[' {
+			return nil, errFTQuery("numeric fields take a [min max] range")
+		}
+		body, err := p.readUntil(']')
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.Fields(body)
+		if len(bounds) != 2 {
+			return nil, errFTQuery("a numeric range needs a min and a max")
+		}
+		r, err := parseScoreRange(bounds[0], bounds[1])
+		if err != nil {
+			return nil, errFTQuery(err.Error())
+		}
+		return ftRangeNode{field, r}, nil
+
+	case kind == FT_TAG:
+		if c != '{' {
+			return nil, errFTQuery("tag fields take a {tag | tag} list")
+		}
+		body, err := p.readUntil('}')
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, t := range strings.Split(body, "|") {
+			if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+				tags = append(tags, t)
+			}
+		}
+		return ftTagNode{field, tags}, nil
+
+	case c == '(':
+		return p.parseGroup(field)
+	}
+	return p.parseWord(field)
+}
+
+func (p *ftQueryParser) parseWord(field int) (ftNode, error) {
+	p.skipSpaces()
+	word := p.readWhile(func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) })
+	if word == "" {
+		if p.pos < len(p.s) {
+			return nil, errFTQuery("unexpected '" + p.s[p.pos:p.pos+1] + "'")
+		}
+		return nil, errFTQuery("unexpected end of query")
+	}
+	node := ftTermNode{field: field, term: strings.ToLower(word)}
+	if p.pos < len(p.s) && p.s[p.pos] == '*' {
+		p.pos++
+		node.prefix = true
+	}
+	return node, nil
+}
+
+func (p *ftQueryParser) readWhile(ok func(r rune) bool) string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		if !ok(r) {
+			break
+		}
+		p.pos += size
+	}
+	return p.s[start:p.pos]
+}
+
+// readUntil consumes an opening delimiter and returns the text up to end.
+func (p *ftQueryParser) readUntil(end byte) (string, error) {
+	p.pos++
+	i := strings.IndexByte(p.s[p.pos:], end)
+	if i < 0 {
+		return "", errFTQuery("missing '" + string(end) + "'")
+	}
+	body := p.s[p.pos : p.pos+i]
+	p.pos += i + 1
+	return body, nil
+}
+
+// sortKeys orders the matching keys by the given field (or by key when field
+// is -1). Documents without the field come last.
+func (idx *SearchIndex) sortKeys(keys []string, field int, desc bool) {
+	less := func(a, b string) bool {
+		if field < 0 {
+			return a < b
+		}
+		fa, fb := idx.docs[a][field], idx.docs[b][field]
+		if fa.has != fb.has {
+			return fa.has
+		}
+		if !fa.has {
+			return a < b
+		}
+		var order int
+		if idx.fields[field].kind == FT_NUMERIC {
+			order = cmp.Compare(fa.num, fb.num)
+		} else {
+			order = strings.Compare(fa.sortBy, fb.sortBy)
+		}
+		if order == 0 {
+			return a < b
+		}
+		return (order < 0) != desc
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+}
+
+// ftFieldReply renders the value of a RETURN field: strings as they are,
+// other values as JSON.
+func ftFieldReply(doc *JSONValue, f *ftField) (string, bool) {
+	locs := f.path.eval(doc, false)
+	if len(locs) == 0 {
+		return "", false
+	}
+	v, _ := locs[0].get()
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	return serializeJSON(v), true
+}
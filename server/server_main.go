@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,7 +12,7 @@ const (
 	COMMAND_MAX_LEN = 2048             //max number of runes for each command (and args)
 )
 
-var last_rdb_snapshot_ts int64 // Last RDB snapshot timestamp in millis
+var last_rdb_snapshot_ts atomic.Int64 // Last RDB snapshot timestamp in millis
 
 func initDataStructures() {
 	log.Println("Initializing memorization data structures..")
@@ -19,8 +20,13 @@ func initDataStructures() {
 	log.Println("Initialized key expiration data structure")
 	initKeyDataSpace(&keyDataSpace)
 	log.Println("Initialized key data space")
-	tryLoadRdbFile(RDB_FILE_PATH)
-	last_rdb_snapshot_ts = time.Now().UnixMilli()
+	initKeyAccessSpace(&keyAccess)
+	log.Println("Initialized key access statistics")
+	// Refuse to start on an unreadable file: the next snapshot would overwrite it.
+	if err := tryLoadRdbFile(RDB_FILE_PATH); err != nil {
+		log.Fatalf("Could not load %s: %v", RDB_FILE_PATH, err)
+	}
+	last_rdb_snapshot_ts.Store(time.Now().UnixMilli())
 	log.Println("Loaded key-value data structure and keys expirations data structure")
 	log.Println("Completed data structures initializations")
 }
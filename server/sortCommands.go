@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SORT and SORT_RO handlers.
+//
+// The only collection that can be sorted is the sorted set: there are no list
+// or set types yet. Elements are sorted by their own value, not by score.
+// There is no hash type either, so the "key->field" references of BY and GET
+// read a top-level member of a JSON document instead. STORE saves the result
+// as a JSON array, the closest thing to a list the keyspace has, with nil
+// elements stored as null.
+
+// sortOptions holds the parsed arguments of SORT.
+type sortOptions struct {
+	by     string // BY pattern, "" to sort by the elements themselves
+	nosort bool   // BY pattern without '*': keep the collection order
+	gets   []string
+	offset int64
+	count  int64 // -1 for every element
+	desc   bool
+	alpha  bool
+	store  string
+}
+
+// parseSortOptions parses everything after the key.
+func parseSortOptions(argv []string, readOnly bool) (*sortOptions, error) {
+	opts := &sortOptions{count: -1}
+	for i := 0; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "ASC":
+			opts.desc = false
+		case "DESC":
+			opts.desc = true
+		case "ALPHA":
+			opts.alpha = true
+		case "LIMIT":
+			if i+2 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			offset, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			count, err := parseIntArg(argv[i+2])
+			if err != nil {
+				return nil, err
+			}
+			opts.offset, opts.count = offset, count
+			i += 2
+		case "BY":
+			if i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			opts.by = argv[i+1]
+			opts.nosort = !strings.Contains(opts.by, "*")
+			i++
+		case "GET":
+			if i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			opts.gets = append(opts.gets, argv[i+1])
+			i++
+		case "STORE":
+			if readOnly || i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			opts.store = argv[i+1]
+			i++
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// sortLookupLocked resolves a BY or GET pattern for elem: the first '*' is
+// replaced by elem and the resulting key is read; "key->field" reads a
+// top-level member of a JSON document. "#" is the element itself. Returns
+// false when there is nothing to read.
+func sortLookupLocked(data map[string]DataValue, pattern, elem string, nowMs int64) (string, bool) {
+	if pattern == "#" {
+		return elem, true
+	}
+	star := strings.IndexByte(pattern, '*')
+	key, field := pattern, ""
+	if arrow := strings.LastIndex(pattern, "->"); arrow > star && arrow+2 < len(pattern) {
+		key, field = pattern[:arrow], pattern[arrow+2:]
+	}
+	if star >= 0 {
+		key = key[:star] + elem + key[star+1:]
+	}
+	if !keyAliveLocked(data, key, nowMs) {
+		return "", false
+	}
+
+	switch v := data[key].(type) {
+	case StringValue:
+		if field == "" {
+			return string(v), true
+		}
+	case *JSONValue:
+		obj, ok := v.root.(*jsonObject)
+		if field == "" || !ok {
+			return "", false
+		}
+		switch m := obj.vals[field].(type) {
+		case string:
+			return m, true
+		case json.Number:
+			return string(m), true
+		case bool:
+			return strconv.FormatBool(m), true
+		}
+	}
+	return "", false
+}
+
+// sortItem is an element with the value it is sorted by.
+type sortItem struct {
+	elem   string
+	key    string // the BY value, or elem
+	hasKey bool
+	score  float64
+}
+
+// sortGeneric implements SORT and SORT_RO.
+func sortGeneric(args string, readOnly bool) (string, error) {
+	cmd := "sort"
+	if readOnly {
+		cmd = "sort_ro"
+	}
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	opts, err := parseSortOptions(argv[1:], readOnly)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	nowMs := time.Now().UnixMilli()
+	var result []string
+	var isNil []bool
+	run := func(data map[string]DataValue) error {
+		var elems []string
+		if keyAliveLocked(data, argv[0], nowMs) {
+			zset, ok := data[argv[0]].(*SortedSet)
+			if !ok {
+				return ErrWrongType
+			}
+			elems = make([]string, 0, zset.Len())
+			for x := zset.zsl.First(); x != nil; x = x.level[0].forward {
+				elems = append(elems, x.member)
+			}
+		}
+
+		items := make([]sortItem, len(elems))
+		for i, elem := range elems {
+			items[i] = sortItem{elem: elem, key: elem, hasKey: true}
+			if opts.nosort {
+				continue
+			}
+			if opts.by != "" {
+				items[i].key, items[i].hasKey = sortLookupLocked(data, opts.by, elem, nowMs)
+			}
+			if !opts.alpha && items[i].hasKey {
+				score, err := strconv.ParseFloat(items[i].key, 64)
+				if err != nil {
+					return errors.New("One or more scores can't be converted into double")
+				}
+				items[i].score = score
+			}
+		}
+
+		if opts.nosort {
+			// The collection order, reversed by DESC as Redis does for sorted sets.
+			if opts.desc {
+				for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+					items[i], items[j] = items[j], items[i]
+				}
+			}
+		} else {
+			sort.SliceStable(items, func(i, j int) bool {
+				a, b := items[i], items[j]
+				if opts.desc {
+					a, b = b, a
+				}
+				return sortItemLess(a, b, opts.alpha)
+			})
+		}
+
+		start, end := sortLimitRange(len(items), opts.offset, opts.count)
+		for _, item := range items[start:end] {
+			if len(opts.gets) == 0 {
+				result = append(result, item.elem)
+				isNil = append(isNil, false)
+				continue
+			}
+			for _, pattern := range opts.gets {
+				value, ok := sortLookupLocked(data, pattern, item.elem, nowMs)
+				result = append(result, value)
+				isNil = append(isNil, !ok)
+			}
+		}
+
+		if opts.store != "" {
+			sortStoreLocked(data, opts.store, result, isNil)
+		}
+		return nil
+	}
+
+	if opts.store != "" {
+		err = keyDataSpace.Update(run)
+	} else {
+		err = keyDataSpace.View(run)
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if opts.store != "" {
+		keyReadyNotifier.Signal(opts.store)
+		return intReply(int64(len(result))), nil
+	}
+	for i := range result {
+		if isNil[i] {
+			result[i] = NIL_REPLY
+		}
+	}
+	return arrayReply(result), nil
+}
+
+// sortItemLess orders items by score, or by their BY value with ALPHA.
+// Missing BY values sort first; ties are broken by the elements themselves.
+func sortItemLess(a, b sortItem, alpha bool) bool {
+	if a.hasKey != b.hasKey {
+		return !a.hasKey
+	}
+	if alpha {
+		if a.key != b.key {
+			return a.key < b.key
+		}
+	} else if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.elem < b.elem
+}
+
+// sortLimitRange clamps LIMIT offset count to [0, n].
+func sortLimitRange(n int, offset, count int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > int64(n) {
+		offset = int64(n)
+	}
+	end := int64(n)
+	if count >= 0 && count < end-offset {
+		end = offset + count
+	}
+	return int(offset), int(end)
+}
+
+// sortStoreLocked replaces dest with the result as a JSON array, or deletes
+// it when the result is empty.
+func sortStoreLocked(data map[string]DataValue, dest string, result []string, isNil []bool) {
+	deleteKeyLocked(data, dest)
+	if len(result) == 0 {
+		return
+	}
+	arr := &jsonArray{items: make([]any, len(result))}
+	for i, value := range result {
+		if !isNil[i] {
+			arr.items[i] = value
+		}
+	}
+	data[dest] = &JSONValue{root: arr}
+	ftReindexLocked(data, dest)
+}
+
+// SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA] [STORE destination]
+// Returns the elements of the sorted set at key sorted numerically, or
+// lexicographically with ALPHA. With STORE the result is saved at
+// destination and its length is returned.
+func SORT(args string) (string, error) {
+	return sortGeneric(args, false)
+}
+
+// SORT_RO key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA]
+// Read-only variant of SORT, without STORE.
+func SORT_RO(args string) (string, error) {
+	return sortGeneric(args, true)
+}
@@ -0,0 +1,475 @@
+// File: sortedSet.go
+//
+// Purpose:
+//   Sorted set value type (ZSET), modelled after the Redis implementation:
+//   a hash map member -> score for O(1) lookups plus a skiplist ordered by
+//   (score, member) for ordered and rank-based access, and a ScanIndex
+//   keeping the members in ZSCAN order.
+//
+//   Every skiplist link stores its "span" (how many nodes it jumps over),
+//   so that the rank of a node can be accumulated while descending the list.
+//
+// Asymptotic costs (n = number of members):
+//   - Score lookup:            O(1)
+//   - Insert / delete / update: O(log n) expected
+//   - Rank of a member:         O(log n) expected
+//   - Member by rank:           O(log n) expected
+//   - Range by score / lex:     O(log n + m) for m returned elements
+//
+// Concurrency:
+//   Not thread-safe. Sorted sets live inside the KeyDataSpace and must only be
+//   accessed through KeyDataSpace.View (reads) or KeyDataSpace.Update (writes).
+
+package main
+
+import (
+	"math/rand"
+)
+
+const (
+	SKIPLIST_MAX_LEVEL = 32   // Enough for 2^64 elements with P = 1/4
+	SKIPLIST_P         = 0.25 // Probability of promoting a node to the next level
+)
+
+type skipListLevel struct {
+	forward *skipListNode
+	span    int // Number of nodes between this node and forward
+}
+
+type skipListNode struct {
+	member   string
+	score    float64
+	backward *skipListNode
+	level    []skipListLevel
+}
+
+// SkipList keeps (score, member) pairs ordered by score, then by member.
+type SkipList struct {
+	header *skipListNode
+	tail   *skipListNode
+	length int
+	level  int
+}
+
+// NewSkipList creates an empty skiplist.
+func NewSkipList() *SkipList {
+	return &SkipList{
+		header: &skipListNode{level: make([]skipListLevel, SKIPLIST_MAX_LEVEL)},
+		level:  1,
+	}
+}
+
+// randomLevel returns a level in [1, SKIPLIST_MAX_LEVEL] with a power-law distribution.
+func randomLevel() int {
+	level := 1
+	for level < SKIPLIST_MAX_LEVEL && rand.Float64() < SKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// nodeLess reports whether (score, member) sorts before node.
+func nodeLess(node *skipListNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// Insert adds a new element. The caller must make sure member is not already present.
+func (zsl *SkipList) Insert(score float64, member string) *skipListNode {
+	var update [SKIPLIST_MAX_LEVEL]*skipListNode
+	var rank [SKIPLIST_MAX_LEVEL]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// rank[i] is the rank of the node where we stop on level i
+		if i == zsl.level-1 {
+			rank[i] = 0
+		} else {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skipListNode{member: member, score: score, level: make([]skipListLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		// update span covered by update[i] as x is inserted here
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// increment span for untouched levels
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// deleteNode unlinks x given the update vector computed by the caller.
+func (zsl *SkipList) deleteNode(x *skipListNode, update []*skipListNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// Delete removes the element with the given score and member.
+// Returns true if the element was found and removed.
+func (zsl *SkipList) Delete(score float64, member string) bool {
+	update := make([]*skipListNode, SKIPLIST_MAX_LEVEL)
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		zsl.deleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+// UpdateScore moves an existing element to newScore.
+// When the node keeps its position only the score is rewritten.
+func (zsl *SkipList) UpdateScore(curScore float64, member string, newScore float64) *skipListNode {
+	update := make([]*skipListNode, SKIPLIST_MAX_LEVEL)
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, curScore, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+
+	// Fast path: the node would stay in the same position.
+	if (x.backward == nil || nodeLess(x.backward, newScore, member)) &&
+		(x.level[0].forward == nil || !nodeLess(x.level[0].forward, newScore, member)) {
+		x.score = newScore
+		return x
+	}
+
+	zsl.deleteNode(x, update)
+	return zsl.Insert(newScore, member)
+}
+
+// Rank returns the 1-based rank of the element, or 0 if it is not present.
+func (zsl *SkipList) Rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(nodeLess(x.level[i].forward, score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// ByRank returns the node with the given 1-based rank, or nil if out of range.
+func (zsl *SkipList) ByRank(rank int) *skipListNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			if x == zsl.header {
+				return nil
+			}
+			return x
+		}
+	}
+	return nil
+}
+
+// First returns the lowest element, or nil if the list is empty.
+func (zsl *SkipList) First() *skipListNode {
+	return zsl.header.level[0].forward
+}
+
+// Last returns the highest element, or nil if the list is empty.
+func (zsl *SkipList) Last() *skipListNode {
+	return zsl.tail
+}
+
+// scoreRange is a [min, max] score interval; minex/maxex make the bounds exclusive.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r *scoreRange) gteMin(v float64) bool {
+	if r.minex {
+		return v > r.min
+	}
+	return v >= r.min
+}
+
+func (r *scoreRange) lteMax(v float64) bool {
+	if r.maxex {
+		return v < r.max
+	}
+	return v <= r.max
+}
+
+func (r *scoreRange) isEmpty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+// FirstInScoreRange returns the first node whose score is inside r, or nil.
+func (zsl *SkipList) FirstInScoreRange(r *scoreRange) *skipListNode {
+	if r.isEmpty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// LastInScoreRange returns the last node whose score is inside r, or nil.
+func (zsl *SkipList) LastInScoreRange(r *scoreRange) *skipListNode {
+	if r.isEmpty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lexRange is a member interval as used by BYLEX, where "-" and "+" are the
+// negative and positive infinite strings.
+type lexRange struct {
+	min, max         string
+	minex, maxex     bool
+	minInf, maxInf   bool // min is "-" / max is "+"
+	minPInf, maxNInf bool // min is "+" / max is "-" (always empty ranges)
+}
+
+func (r *lexRange) gteMin(v string) bool {
+	if r.minInf {
+		return true
+	}
+	if r.minPInf {
+		return false
+	}
+	if r.minex {
+		return v > r.min
+	}
+	return v >= r.min
+}
+
+func (r *lexRange) lteMax(v string) bool {
+	if r.maxInf {
+		return true
+	}
+	if r.maxNInf {
+		return false
+	}
+	if r.maxex {
+		return v < r.max
+	}
+	return v <= r.max
+}
+
+func (r *lexRange) isEmpty() bool {
+	if r.minPInf || r.maxNInf {
+		return true
+	}
+	if r.minInf || r.maxInf {
+		return false
+	}
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+// FirstInLexRange returns the first node whose member is inside r, or nil.
+// Lex ranges are only meaningful when all members share the same score.
+func (zsl *SkipList) FirstInLexRange(r *lexRange) *skipListNode {
+	if r.isEmpty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+// LastInLexRange returns the last node whose member is inside r, or nil.
+func (zsl *SkipList) LastInLexRange(r *lexRange) *skipListNode {
+	if r.isEmpty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+// SortedSet is the ZSET value type.
+type SortedSet struct {
+	dict map[string]float64 // member -> score
+	zsl  *SkipList          // members ordered by (score, member)
+	scan *ScanIndex         // members in ZSCAN order
+}
+
+// NewSortedSet creates an empty sorted set.
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		dict: make(map[string]float64),
+		zsl:  NewSkipList(),
+		scan: NewScanIndex(),
+	}
+}
+
+func (z *SortedSet) Type() ValueType { return ZSET_VALUE }
+
+// DeepCopy clones the sorted set, re-inserting members in order.
+func (z *SortedSet) DeepCopy() DataValue {
+	clone := NewSortedSet()
+	for x := z.zsl.First(); x != nil; x = x.level[0].forward {
+		clone.Add(x.score, x.member)
+	}
+	return clone
+}
+
+// Len returns the number of members.
+func (z *SortedSet) Len() int {
+	return len(z.dict)
+}
+
+// Score returns the score of member and whether it is present.
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Add inserts member or updates its score.
+// Returns true if the member was newly added.
+func (z *SortedSet) Add(score float64, member string) bool {
+	if cur, ok := z.dict[member]; ok {
+		if cur != score {
+			z.zsl.UpdateScore(cur, member, score)
+			z.dict[member] = score
+		}
+		return false
+	}
+	z.zsl.Insert(score, member)
+	z.scan.Insert(member)
+	z.dict[member] = score
+	return true
+}
+
+// Remove deletes member. Returns true if it was present.
+func (z *SortedSet) Remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.Delete(score, member)
+	z.scan.Delete(member)
+	delete(z.dict, member)
+	return true
+}
+
+// Rank returns the 0-based rank of member (descending when reverse is set).
+func (z *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	score, ok := z.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.Rank(score, member)
+	if reverse {
+		return z.zsl.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// CountInScoreRange returns how many members have a score inside r, using ranks
+// so that the cost does not depend on the size of the range.
+func (z *SortedSet) CountInScoreRange(r *scoreRange) int {
+	first := z.zsl.FirstInScoreRange(r)
+	if first == nil {
+		return 0
+	}
+	last := z.zsl.LastInScoreRange(r)
+	return z.zsl.Rank(last.score, last.member) - z.zsl.Rank(first.score, first.member) + 1
+}
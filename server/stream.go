@@ -0,0 +1,346 @@
+// File: stream.go
+//
+// Purpose:
+//   Stream value type: an append-only log of entries identified by
+//   monotonically increasing IDs ("<ms>-<seq>"), plus consumer groups that track
+//   which entries were delivered to which consumer and not yet acknowledged
+//   (the Pending Entries List, PEL).
+//
+//   Entries are kept in a slice ordered by ID, so lookups and range queries use
+//   binary search and trimming simply re-slices the head of the log.
+//
+// Asymptotic costs (n = number of entries):
+//   - Append:              O(1) amortized
+//   - Lookup by ID:        O(log n)
+//   - Range of m entries:  O(log n + m)
+//   - Trim k entries:      O(log n)
+//
+// Concurrency:
+//   Not thread-safe. Streams live inside the KeyDataSpace and must only be
+//   accessed through KeyDataSpace.View (reads) or KeyDataSpace.Update (writes).
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidStreamID = errors.New("Invalid stream ID specified as stream command argument")
+
+// StreamID identifies a stream entry: milliseconds time part and sequence number.
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var (
+	MIN_STREAM_ID = StreamID{0, 0}
+	MAX_STREAM_ID = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+// Less reports whether id sorts before other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// incr returns the ID that immediately follows id; ok is false on overflow.
+func (id StreamID) incr() (StreamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return StreamID{id.ms, id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return StreamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// decr returns the ID that immediately precedes id; ok is false on underflow.
+func (id StreamID) decr() (StreamID, bool) {
+	if id.seq > 0 {
+		return StreamID{id.ms, id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return StreamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses "<ms>-<seq>" or "<ms>"; in the latter form the sequence
+// part is set to missingSeq (0 for range starts, MaxUint64 for range ends).
+func parseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	return StreamID{ms, seq}, nil
+}
+
+// parseStreamRangeID parses an XRANGE bound: "-", "+", an ID, or "(" followed by
+// an ID for an exclusive bound. isStart selects how incomplete and exclusive IDs
+// are completed.
+func parseStreamRangeID(s string, isStart bool) (StreamID, error) {
+	switch s {
+	case "-":
+		return MIN_STREAM_ID, nil
+	case "+":
+		return MAX_STREAM_ID, nil
+	}
+
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+
+	if !strings.HasPrefix(s, "(") {
+		return parseStreamID(s, missingSeq)
+	}
+
+	id, err := parseStreamID(s[1:], missingSeq)
+	if err != nil {
+		return id, err
+	}
+	var ok bool
+	if isStart {
+		id, ok = id.incr()
+	} else {
+		id, ok = id.decr()
+	}
+	if !ok {
+		return id, errors.New("invalid start or end ID, overflow")
+	}
+	return id, nil
+}
+
+type streamEntry struct {
+	id     StreamID
+	fields []string // field, value, field, value, ...
+}
+
+// streamPending is a PEL entry: delivered to consumer but not yet acknowledged.
+type streamPending struct {
+	consumer      string
+	deliveryTime  int64 // unix millis of the last delivery
+	deliveryCount uint64
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // unix millis of the last interaction
+	activeTime int64 // unix millis of the last successful read/claim, -1 if never
+	pending    map[StreamID]struct{}
+}
+
+type streamGroup struct {
+	lastID    StreamID // last ID delivered to the group
+	pel       map[StreamID]*streamPending
+	consumers map[string]*streamConsumer
+}
+
+// Stream is the STREAM value type.
+type Stream struct {
+	entries      []streamEntry // ordered by id
+	lastID       StreamID      // greatest ID ever added, even if trimmed away
+	entriesAdded uint64        // number of entries ever added
+	groups       map[string]*streamGroup
+}
+
+// NewStream creates an empty stream.
+func NewStream() *Stream {
+	return &Stream{
+		groups: make(map[string]*streamGroup),
+	}
+}
+
+func (s *Stream) Type() ValueType { return STREAM_VALUE }
+
+// DeepCopy clones the stream. Entry field slices are immutable once added and
+// are therefore shared.
+func (s *Stream) DeepCopy() DataValue {
+	clone := &Stream{
+		entries:      append([]streamEntry(nil), s.entries...),
+		lastID:       s.lastID,
+		entriesAdded: s.entriesAdded,
+		groups:       make(map[string]*streamGroup, len(s.groups)),
+	}
+	for name, g := range s.groups {
+		cg := newStreamGroup(g.lastID)
+		for id, p := range g.pel {
+			cp := *p
+			cg.pel[id] = &cp
+		}
+		for cname, c := range g.consumers {
+			cc := &streamConsumer{name: c.name, seenTime: c.seenTime, activeTime: c.activeTime, pending: make(map[StreamID]struct{}, len(c.pending))}
+			for id := range c.pending {
+				cc.pending[id] = struct{}{}
+			}
+			cg.consumers[cname] = cc
+		}
+		clone.groups[name] = cg
+	}
+	return clone
+}
+
+// Len returns the number of entries currently in the stream.
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// nextAutoID returns the ID generated by "*" at time nowMs.
+func (s *Stream) nextAutoID(nowMs uint64) (StreamID, bool) {
+	if nowMs > s.lastID.ms {
+		return StreamID{nowMs, 0}, true
+	}
+	return s.lastID.incr()
+}
+
+// Append adds an entry; the caller guarantees id is greater than lastID.
+func (s *Stream) Append(id StreamID, fields []string) {
+	s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// search returns the index of the first entry with ID >= id.
+func (s *Stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.Less(id)
+	})
+}
+
+// Get returns the entry with the given ID.
+func (s *Stream) Get(id StreamID) (*streamEntry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return &s.entries[i], true
+	}
+	return nil, false
+}
+
+// Range returns up to count (count <= 0: all) entries with start <= ID <= end,
+// in descending order when rev is set.
+func (s *Stream) Range(start, end StreamID, count int, rev bool) []streamEntry {
+	if end.Less(start) {
+		return nil
+	}
+	lo := s.search(start)
+	hi := s.search(end)
+	if hi < len(s.entries) && s.entries[hi].id == end {
+		hi++
+	}
+	if lo >= hi {
+		return nil
+	}
+
+	n := hi - lo
+	if count > 0 && count < n {
+		n = count
+	}
+	out := make([]streamEntry, 0, n)
+	if rev {
+		for i := hi - 1; i >= lo && len(out) < n; i-- {
+			out = append(out, s.entries[i])
+		}
+	} else {
+		out = append(out, s.entries[lo:lo+n]...)
+	}
+	return out
+}
+
+// TrimMaxLen drops the oldest entries so that at most maxLen remain, evicting
+// no more than limit entries when limit > 0. Returns the number of evicted entries.
+func (s *Stream) TrimMaxLen(maxLen int, limit int) int {
+	n := len(s.entries) - maxLen
+	return s.trimHead(n, limit)
+}
+
+// TrimMinID drops every entry with an ID lower than minID, evicting no more
+// than limit entries when limit > 0. Returns the number of evicted entries.
+func (s *Stream) TrimMinID(minID StreamID, limit int) int {
+	return s.trimHead(s.search(minID), limit)
+}
+
+func (s *Stream) trimHead(n int, limit int) int {
+	if n <= 0 {
+		return 0
+	}
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	// Clear the evicted cells so that the GC can reclaim their fields.
+	for i := 0; i < n; i++ {
+		s.entries[i] = streamEntry{}
+	}
+	s.entries = s.entries[n:]
+	return n
+}
+
+func newStreamGroup(lastID StreamID) *streamGroup {
+	return &streamGroup{
+		lastID:    lastID,
+		pel:       make(map[StreamID]*streamPending),
+		consumers: make(map[string]*streamConsumer),
+	}
+}
+
+// consumer returns the named consumer, creating it when missing.
+// created reports whether a new consumer was made.
+func (g *streamGroup) consumer(name string, nowMs int64) (c *streamConsumer, created bool) {
+	c, ok := g.consumers[name]
+	if !ok {
+		c = &streamConsumer{name: name, seenTime: nowMs, activeTime: -1, pending: make(map[StreamID]struct{})}
+		g.consumers[name] = c
+		created = true
+	}
+	return c, created
+}
+
+// assign records id as delivered to consumer c, moving it from its previous
+// owner if it was already pending.
+func (g *streamGroup) assign(id StreamID, c *streamConsumer, deliveryTime int64, deliveryCount uint64) {
+	if p, ok := g.pel[id]; ok {
+		if owner, ok := g.consumers[p.consumer]; ok {
+			delete(owner.pending, id)
+		}
+	}
+	g.pel[id] = &streamPending{consumer: c.name, deliveryTime: deliveryTime, deliveryCount: deliveryCount}
+	c.pending[id] = struct{}{}
+}
+
+// ack removes id from the PEL. Returns true if it was pending.
+func (g *streamGroup) ack(id StreamID) bool {
+	p, ok := g.pel[id]
+	if !ok {
+		return false
+	}
+	if owner, ok := g.consumers[p.consumer]; ok {
+		delete(owner.pending, id)
+	}
+	delete(g.pel, id)
+	return true
+}
+
+// sortStreamIDs returns the keys of set in ascending order.
+func sortStreamIDs[V any](set map[StreamID]V) []StreamID {
+	ids := make([]StreamID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	return ids
+}
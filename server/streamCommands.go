@@ -0,0 +1,1129 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream command handlers. All of them operate on *Stream values through
+// KeyDataSpace.Update / KeyDataSpace.View so that every command is atomic.
+
+// lookupStream returns the stream stored at key, nil if the key does not exist,
+// or ErrWrongType if the key holds another kind of value.
+func lookupStream(data map[string]DataValue, key string) (*Stream, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	stream, ok := value.(*Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return stream, nil
+}
+
+// lookupStreamGroup returns the stream at key and its consumer group,
+// or a NOGROUP error when either is missing.
+func lookupStreamGroup(data map[string]DataValue, key, group, cmd string) (*Stream, *streamGroup, error) {
+	stream, err := lookupStream(data, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stream != nil {
+		if g, ok := stream.groups[group]; ok {
+			return stream, g, nil
+		}
+	}
+	return nil, nil, errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in " + cmd)
+}
+
+// streamEntryReply renders an entry as [id [field value ...]].
+func streamEntryReply(e streamEntry) string {
+	return arrayReply([]string{e.id.String(), arrayReply(e.fields)})
+}
+
+func streamEntriesReply(entries []streamEntry) string {
+	items := make([]string, len(entries))
+	for i, e := range entries {
+		items[i] = streamEntryReply(e)
+	}
+	return arrayReply(items)
+}
+
+// streamTrimSpec is the parsed MAXLEN/MINID clause of XADD and XTRIM.
+type streamTrimSpec struct {
+	enabled bool
+	byMinID bool
+	maxLen  int
+	minID   StreamID
+	limit   int // only with "~"; 0 means no limit
+}
+
+// parseStreamTrim parses "MAXLEN|MINID [=|~] threshold [LIMIT count]" starting at argv[i]
+// (argv[i] is MAXLEN or MINID). Returns the index of the first unparsed argument.
+func parseStreamTrim(argv []string, i int) (streamTrimSpec, int, error) {
+	spec := streamTrimSpec{enabled: true, byMinID: strings.EqualFold(argv[i], "MINID")}
+	i++
+	approx := false
+	if i < len(argv) && (argv[i] == "~" || argv[i] == "=") {
+		approx = argv[i] == "~"
+		i++
+	}
+	if i >= len(argv) {
+		return spec, i, ErrSyntax
+	}
+
+	if spec.byMinID {
+		id, err := parseStreamID(argv[i], 0)
+		if err != nil {
+			return spec, i, err
+		}
+		spec.minID = id
+	} else {
+		n, err := parseIntArg(argv[i])
+		if err != nil {
+			return spec, i, err
+		}
+		if n < 0 {
+			return spec, i, errors.New("The MAXLEN argument must be >= 0.")
+		}
+		spec.maxLen = int(n)
+	}
+	i++
+
+	if i < len(argv) && strings.EqualFold(argv[i], "LIMIT") {
+		if i+1 >= len(argv) {
+			return spec, i, ErrSyntax
+		}
+		n, err := parseIntArg(argv[i+1])
+		if err != nil {
+			return spec, i, err
+		}
+		if n < 0 {
+			return spec, i, errors.New("The LIMIT argument must be >= 0.")
+		}
+		if !approx {
+			return spec, i, errors.New("syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		spec.limit = int(n)
+		i += 2
+	}
+	return spec, i, nil
+}
+
+// apply trims the stream according to the spec and returns the evicted count.
+func (spec *streamTrimSpec) apply(stream *Stream) int {
+	if !spec.enabled {
+		return 0
+	}
+	if spec.byMinID {
+		return stream.TrimMinID(spec.minID, spec.limit)
+	}
+	return stream.TrimMaxLen(spec.maxLen, spec.limit)
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func XADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 4 {
+		return "NOT_OK", errWrongArgs("xadd")
+	}
+	key := argv[0]
+
+	noMkStream := false
+	var trim streamTrimSpec
+	i := 1
+options:
+	for i < len(argv) {
+		switch strings.ToUpper(argv[i]) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			i++
+		case "MAXLEN", "MINID":
+			if trim, i, err = parseStreamTrim(argv, i); err != nil {
+				return "NOT_OK", err
+			}
+		default:
+			break options
+		}
+	}
+
+	if i >= len(argv) {
+		return "NOT_OK", ErrSyntax
+	}
+	idArg, fields := argv[i], argv[i+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return "NOT_OK", errWrongArgs("xadd")
+	}
+
+	// Parse the requested ID: "*", "<ms>-*" or an explicit "<ms>-<seq>".
+	autoID, autoSeq := idArg == "*", false
+	var reqID StreamID
+	if !autoID {
+		if msPart, found := strings.CutSuffix(idArg, "-*"); found {
+			ms, err := strconv.ParseUint(msPart, 10, 64)
+			if err != nil {
+				return "NOT_OK", ErrInvalidStreamID
+			}
+			reqID, autoSeq = StreamID{ms, 0}, true
+		} else if reqID, err = parseStreamID(idArg, 0); err != nil {
+			return "NOT_OK", err
+		}
+		if !autoSeq && reqID == MIN_STREAM_ID {
+			return "NOT_OK", errors.New("The ID specified in XADD must be greater than 0-0")
+		}
+	}
+
+	errTooSmall := errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+	res := NIL_REPLY
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, key)
+		if err != nil {
+			return err
+		}
+		if stream == nil {
+			if noMkStream {
+				return nil
+			}
+			stream = NewStream()
+		}
+
+		var id StreamID
+		switch {
+		case autoID:
+			var ok bool
+			if id, ok = stream.nextAutoID(uint64(time.Now().UnixMilli())); !ok {
+				return errors.New("The stream has exhausted the last possible ID, unable to add more items")
+			}
+		case autoSeq:
+			// "<ms>-*": next sequence number within that millisecond.
+			switch {
+			case reqID.ms > stream.lastID.ms:
+				id = reqID
+			case reqID.ms == stream.lastID.ms:
+				var ok bool
+				if id, ok = stream.lastID.incr(); !ok || id.ms != reqID.ms {
+					return errTooSmall
+				}
+			default:
+				return errTooSmall
+			}
+		default:
+			if !stream.lastID.Less(reqID) {
+				return errTooSmall
+			}
+			id = reqID
+		}
+
+		stream.Append(id, append([]string(nil), fields...))
+		trim.apply(stream)
+		data[key] = stream
+		res = id.String()
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if res != NIL_REPLY {
+		keyReadyNotifier.Signal(key)
+	}
+	return res, nil
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func XTRIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("xtrim")
+	}
+	if !strings.EqualFold(argv[1], "MAXLEN") && !strings.EqualFold(argv[1], "MINID") {
+		return "NOT_OK", ErrSyntax
+	}
+	trim, next, err := parseStreamTrim(argv, 1)
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if next != len(argv) {
+		return "NOT_OK", ErrSyntax
+	}
+
+	var evicted int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, argv[0])
+		if err != nil || stream == nil {
+			return err
+		}
+		evicted = trim.apply(stream)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(evicted)), nil
+}
+
+// XLEN key
+func XLEN(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("xlen")
+	}
+
+	var length int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, argv[0])
+		if err != nil || stream == nil {
+			return err
+		}
+		length = stream.Len()
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(length)), nil
+}
+
+// XRANGE key start end [COUNT count]
+func XRANGE(args string) (string, error) {
+	return xrangeGeneric(args, "xrange", false)
+}
+
+// XREVRANGE key end start [COUNT count]
+func XREVRANGE(args string) (string, error) {
+	return xrangeGeneric(args, "xrevrange", true)
+}
+
+func xrangeGeneric(args string, cmd string, rev bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 && len(argv) != 5 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+
+	startArg, endArg := argv[1], argv[2]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, err := parseStreamRangeID(startArg, true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+	end, err := parseStreamRangeID(endArg, false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	count := 0
+	if len(argv) == 5 {
+		if !strings.EqualFold(argv[3], "COUNT") {
+			return "NOT_OK", ErrSyntax
+		}
+		n, err := parseIntArg(argv[4])
+		if err != nil {
+			return "NOT_OK", err
+		}
+		if n <= 0 {
+			return arrayReply(nil), nil
+		}
+		count = int(n)
+	}
+
+	var entries []streamEntry
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, argv[0])
+		if err != nil || stream == nil {
+			return err
+		}
+		entries = stream.Range(start, end, count, rev)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return streamEntriesReply(entries), nil
+}
+
+// xreadSpec holds the options shared by XREAD and XREADGROUP.
+type xreadSpec struct {
+	count   int
+	block   bool
+	timeout time.Duration
+	noAck   bool
+	group   string
+	member  string // consumer name
+	keys    []string
+	ids     []string
+}
+
+// parseXread parses [GROUP group consumer] [COUNT n] [BLOCK ms] [NOACK] STREAMS key... id...
+func parseXread(argv []string, cmd string, withGroup bool) (*xreadSpec, error) {
+	spec := &xreadSpec{}
+	i := 0
+	for ; i < len(argv); i++ {
+		opt := strings.ToUpper(argv[i])
+		if opt == "STREAMS" {
+			break
+		}
+		switch {
+		case opt == "COUNT" && i+1 < len(argv):
+			n, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				spec.count = int(n)
+			}
+			i++
+		case opt == "BLOCK" && i+1 < len(argv):
+			ms, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return nil, errors.New("timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, errors.New("timeout is negative")
+			}
+			spec.block, spec.timeout = true, time.Duration(ms)*time.Millisecond
+			i++
+		case opt == "GROUP" && withGroup && i+2 < len(argv):
+			spec.group, spec.member = argv[i+1], argv[i+2]
+			i += 2
+		case opt == "NOACK" && withGroup:
+			spec.noAck = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if withGroup && spec.group == "" {
+		return nil, errors.New("Missing GROUP option for XREADGROUP")
+	}
+
+	streams := argv[min(i+1, len(argv)):]
+	if i >= len(argv) || len(streams) == 0 || len(streams)%2 != 0 {
+		return nil, errors.New("Unbalanced '" + cmd + "' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	spec.keys, spec.ids = streams[:len(streams)/2], streams[len(streams)/2:]
+	return spec, nil
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func XREAD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	spec, err := parseXread(argv, "xread", false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	// Resolve IDs once: "$" means "only entries added after this call".
+	ids := make([]StreamID, len(spec.keys))
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		for i, key := range spec.keys {
+			stream, err := lookupStream(data, key)
+			if err != nil {
+				return err
+			}
+			if spec.ids[i] == "$" {
+				if stream != nil {
+					ids[i] = stream.lastID
+				}
+				continue
+			}
+			if ids[i], err = parseStreamID(spec.ids[i], 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	try := func() (string, bool, error) {
+		var results []string
+		err := keyDataSpace.View(func(data map[string]DataValue) error {
+			for i, key := range spec.keys {
+				stream, err := lookupStream(data, key)
+				if err != nil {
+					return err
+				}
+				if stream == nil {
+					continue
+				}
+				start, ok := ids[i].incr()
+				if !ok {
+					continue
+				}
+				if entries := stream.Range(start, MAX_STREAM_ID, spec.count, false); len(entries) > 0 {
+					results = append(results, arrayReply([]string{key, streamEntriesReply(entries)}))
+				}
+			}
+			return nil
+		})
+		return arrayReply(results), len(results) > 0, err
+	}
+
+	var res string
+	var done bool
+	if spec.block {
+		res, done, err = blockUntilReady(spec.keys, spec.timeout, try)
+	} else {
+		res, done, err = try()
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !done {
+		return NIL_REPLY, nil
+	}
+	return res, nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+//
+// The ID ">" delivers entries never delivered to the group and adds them to the PEL;
+// any other ID returns the history of entries pending for the consumer after that ID.
+func XREADGROUP(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	spec, err := parseXread(argv, "xreadgroup", true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	ids := make([]StreamID, len(spec.keys))
+	for i, idArg := range spec.ids {
+		if idArg == ">" {
+			continue
+		}
+		if ids[i], err = parseStreamID(idArg, 0); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	try := func() (string, bool, error) {
+		var results []string
+		err := keyDataSpace.Update(func(data map[string]DataValue) error {
+			now := time.Now().UnixMilli()
+			for i, key := range spec.keys {
+				stream, group, err := lookupStreamGroup(data, key, spec.group, "XREADGROUP with GROUP option")
+				if err != nil {
+					return err
+				}
+				consumer, _ := group.consumer(spec.member, now)
+				consumer.seenTime = now
+
+				if spec.ids[i] != ">" {
+					// History: entries already pending for this consumer.
+					results = append(results, arrayReply([]string{key, streamPendingHistory(stream, group, consumer, ids[i], spec.count, now)}))
+					continue
+				}
+
+				start, ok := group.lastID.incr()
+				if !ok {
+					continue
+				}
+				entries := stream.Range(start, MAX_STREAM_ID, spec.count, false)
+				if len(entries) == 0 {
+					continue
+				}
+				for _, e := range entries {
+					group.lastID = e.id
+					if !spec.noAck {
+						group.assign(e.id, consumer, now, 1)
+					}
+				}
+				consumer.activeTime = now
+				results = append(results, arrayReply([]string{key, streamEntriesReply(entries)}))
+			}
+			return nil
+		})
+		return arrayReply(results), len(results) > 0, err
+	}
+
+	var res string
+	var done bool
+	if spec.block {
+		res, done, err = blockUntilReady(spec.keys, spec.timeout, try)
+	} else {
+		res, done, err = try()
+	}
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !done {
+		return NIL_REPLY, nil
+	}
+	return res, nil
+}
+
+// streamPendingHistory renders the entries pending for consumer with an ID greater
+// than after, bumping their delivery counters. Entries trimmed away from the stream
+// are reported as [id (nil)].
+func streamPendingHistory(stream *Stream, group *streamGroup, consumer *streamConsumer, after StreamID, count int, now int64) string {
+	items := make([]string, 0)
+	for _, id := range sortStreamIDs(consumer.pending) {
+		if !after.Less(id) {
+			continue
+		}
+		if count > 0 && len(items) >= count {
+			break
+		}
+		p := group.pel[id]
+		p.deliveryTime = now
+		p.deliveryCount++
+		if e, ok := stream.Get(id); ok {
+			items = append(items, streamEntryReply(*e))
+		} else {
+			items = append(items, arrayReply([]string{id.String(), NIL_REPLY}))
+		}
+	}
+	return arrayReply(items)
+}
+
+// XACK key group id [id ...]
+func XACK(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("xack")
+	}
+	ids := make([]StreamID, len(argv)-2)
+	for i, idArg := range argv[2:] {
+		if ids[i], err = parseStreamID(idArg, 0); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var acked int64
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, argv[0])
+		if err != nil || stream == nil {
+			return err
+		}
+		group, ok := stream.groups[argv[1]]
+		if !ok {
+			return nil
+		}
+		for _, id := range ids {
+			if group.ack(id) {
+				acked++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(acked), nil
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n]
+// XGROUP SETID key group id|$ [ENTRIESREAD n]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func XGROUP(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("xgroup")
+	}
+	sub, key, groupName := strings.ToUpper(argv[0]), argv[1], argv[2]
+
+	// resolveID turns "$" or an explicit ID into the group's last delivered ID.
+	resolveID := func(stream *Stream, idArg string) (StreamID, error) {
+		if idArg == "$" {
+			return stream.lastID, nil
+		}
+		return parseStreamID(idArg, 0)
+	}
+	// checkOptions validates the trailing options, ENTRIESREAD being accepted and ignored.
+	checkOptions := func(opts []string, allowMkStream bool) (mkStream bool, err error) {
+		for i := 0; i < len(opts); i++ {
+			switch {
+			case strings.EqualFold(opts[i], "MKSTREAM") && allowMkStream:
+				mkStream = true
+			case strings.EqualFold(opts[i], "ENTRIESREAD") && i+1 < len(opts):
+				if _, err := parseIntArg(opts[i+1]); err != nil {
+					return false, err
+				}
+				i++
+			default:
+				return false, ErrSyntax
+			}
+		}
+		return mkStream, nil
+	}
+	errNoKey := errors.New("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+
+	res := "OK"
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, err := lookupStream(data, key)
+		if err != nil {
+			return err
+		}
+
+		switch sub {
+		case "CREATE":
+			if len(argv) < 4 {
+				return errWrongArgs("xgroup|create")
+			}
+			mkStream, err := checkOptions(argv[4:], true)
+			if err != nil {
+				return err
+			}
+			if stream == nil {
+				if !mkStream {
+					return errNoKey
+				}
+				stream = NewStream()
+				data[key] = stream
+			}
+			if _, exists := stream.groups[groupName]; exists {
+				return errors.New("BUSYGROUP Consumer Group name already exists")
+			}
+			id, err := resolveID(stream, argv[3])
+			if err != nil {
+				return err
+			}
+			stream.groups[groupName] = newStreamGroup(id)
+
+		case "SETID":
+			if len(argv) < 4 {
+				return errWrongArgs("xgroup|setid")
+			}
+			if _, err := checkOptions(argv[4:], false); err != nil {
+				return err
+			}
+			if stream == nil {
+				return errNoKey
+			}
+			group, ok := stream.groups[groupName]
+			if !ok {
+				return errors.New("NOGROUP No such consumer group '" + groupName + "' for key name '" + key + "'")
+			}
+			id, err := resolveID(stream, argv[3])
+			if err != nil {
+				return err
+			}
+			group.lastID = id
+
+		case "DESTROY":
+			if len(argv) != 3 {
+				return errWrongArgs("xgroup|destroy")
+			}
+			if stream == nil {
+				return errNoKey
+			}
+			if _, ok := stream.groups[groupName]; ok {
+				delete(stream.groups, groupName)
+				res = "1"
+			} else {
+				res = "0"
+			}
+
+		case "CREATECONSUMER", "DELCONSUMER":
+			if len(argv) != 4 {
+				return errWrongArgs("xgroup|" + strings.ToLower(sub))
+			}
+			if stream == nil {
+				return errNoKey
+			}
+			group, ok := stream.groups[groupName]
+			if !ok {
+				return errors.New("NOGROUP No such consumer group '" + groupName + "' for key name '" + key + "'")
+			}
+			if sub == "CREATECONSUMER" {
+				_, created := group.consumer(argv[3], time.Now().UnixMilli())
+				res = "0"
+				if created {
+					res = "1"
+				}
+				return nil
+			}
+			// DELCONSUMER replies with the number of messages the consumer still had pending.
+			consumer, ok := group.consumers[argv[3]]
+			if !ok {
+				res = "0"
+				return nil
+			}
+			res = intReply(int64(len(consumer.pending)))
+			for id := range consumer.pending {
+				delete(group.pel, id)
+			}
+			delete(group.consumers, argv[3])
+
+		default:
+			return errors.New("unknown subcommand '" + argv[0] + "'. Try XGROUP HELP.")
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if sub == "DESTROY" {
+		// Wake up XREADGROUP callers blocked on this group so they can fail.
+		keyReadyNotifier.Signal(key)
+	}
+	return res, nil
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+//
+// Without a range returns the summary [count min-id max-id [[consumer count] ...]];
+// with a range returns [[id consumer idle-ms delivery-count] ...].
+func XPENDING(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("xpending")
+	}
+	key, groupName := argv[0], argv[1]
+
+	extended := len(argv) > 2
+	var minIdle int64
+	var start, end StreamID
+	var count int64
+	consumerFilter := ""
+	if extended {
+		opts := argv[2:]
+		if strings.EqualFold(opts[0], "IDLE") {
+			if len(opts) < 2 {
+				return "NOT_OK", ErrSyntax
+			}
+			if minIdle, err = parseIntArg(opts[1]); err != nil {
+				return "NOT_OK", err
+			}
+			opts = opts[2:]
+		}
+		if len(opts) != 3 && len(opts) != 4 {
+			return "NOT_OK", ErrSyntax
+		}
+		if start, err = parseStreamRangeID(opts[0], true); err != nil {
+			return "NOT_OK", err
+		}
+		if end, err = parseStreamRangeID(opts[1], false); err != nil {
+			return "NOT_OK", err
+		}
+		if count, err = parseIntArg(opts[2]); err != nil {
+			return "NOT_OK", err
+		}
+		if len(opts) == 4 {
+			consumerFilter = opts[3]
+		}
+	}
+
+	var res string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		_, group, err := lookupStreamGroup(data, key, groupName, "XPENDING")
+		if err != nil {
+			return err
+		}
+		ids := sortStreamIDs(group.pel)
+
+		if !extended {
+			if len(ids) == 0 {
+				res = arrayReply([]string{"0", NIL_REPLY, NIL_REPLY, NIL_REPLY})
+				return nil
+			}
+			consumers := make([]string, 0)
+			for _, name := range sortedStreamConsumers(group) {
+				if n := len(group.consumers[name].pending); n > 0 {
+					consumers = append(consumers, arrayReply([]string{name, intReply(int64(n))}))
+				}
+			}
+			res = arrayReply([]string{
+				intReply(int64(len(ids))),
+				ids[0].String(),
+				ids[len(ids)-1].String(),
+				arrayReply(consumers),
+			})
+			return nil
+		}
+
+		now := time.Now().UnixMilli()
+		items := make([]string, 0)
+		for _, id := range ids {
+			if int64(len(items)) >= count {
+				break
+			}
+			if id.Less(start) || end.Less(id) {
+				continue
+			}
+			p := group.pel[id]
+			idle := now - p.deliveryTime
+			if idle < minIdle || (consumerFilter != "" && p.consumer != consumerFilter) {
+				continue
+			}
+			items = append(items, arrayReply([]string{
+				id.String(), p.consumer, intReply(idle), strconv.FormatUint(p.deliveryCount, 10),
+			}))
+		}
+		res = arrayReply(items)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// sortedStreamConsumers returns the consumer names of group in lexicographic order.
+func sortedStreamConsumers(group *streamGroup) []string {
+	names := make([]string, 0, len(group.consumers))
+	for name := range group.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func XCLAIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 5 {
+		return "NOT_OK", errWrongArgs("xclaim")
+	}
+	key, groupName, consumerName := argv[0], argv[1], argv[2]
+	minIdle, err := parseIntArg(argv[3])
+	if err != nil {
+		return "NOT_OK", errors.New("Invalid min-idle-time argument for XCLAIM")
+	}
+
+	// IDs come first, options follow.
+	var ids []StreamID
+	i := 4
+	for ; i < len(argv); i++ {
+		id, err := parseStreamID(argv[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return "NOT_OK", ErrInvalidStreamID
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := now
+	var retryCount int64 = -1
+	var force, justID bool
+	var lastID StreamID
+	hasLastID := false
+	for ; i < len(argv); i++ {
+		opt := strings.ToUpper(argv[i])
+		hasValue := i+1 < len(argv)
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case opt == "IDLE" && hasValue:
+			idle, err := parseIntArg(argv[i+1])
+			if err != nil {
+				return "NOT_OK", err
+			}
+			deliveryTime = now - idle
+			i++
+		case opt == "TIME" && hasValue:
+			if deliveryTime, err = parseIntArg(argv[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+			i++
+		case opt == "RETRYCOUNT" && hasValue:
+			if retryCount, err = parseIntArg(argv[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+			i++
+		case opt == "LASTID" && hasValue:
+			if lastID, err = parseStreamID(argv[i+1], 0); err != nil {
+				return "NOT_OK", err
+			}
+			hasLastID = true
+			i++
+		default:
+			return "NOT_OK", errors.New("Unrecognized XCLAIM option '" + argv[i] + "'")
+		}
+	}
+
+	items := make([]string, 0)
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, group, err := lookupStreamGroup(data, key, groupName, "XCLAIM")
+		if err != nil {
+			return err
+		}
+		if hasLastID && group.lastID.Less(lastID) {
+			group.lastID = lastID
+		}
+		consumer, _ := group.consumer(consumerName, now)
+		consumer.seenTime = now
+
+		for _, id := range ids {
+			entry, inStream := stream.Get(id)
+			p, pending := group.pel[id]
+			if !pending {
+				if !force || !inStream {
+					continue
+				}
+				p = &streamPending{deliveryTime: now}
+			}
+			if !inStream {
+				// The entry was trimmed away: drop it from the PEL.
+				group.ack(id)
+				continue
+			}
+			if minIdle > 0 && now-p.deliveryTime < minIdle {
+				continue
+			}
+
+			deliveryCount := p.deliveryCount
+			if retryCount >= 0 {
+				deliveryCount = uint64(retryCount)
+			} else if !justID {
+				deliveryCount++
+			}
+			group.assign(id, consumer, deliveryTime, deliveryCount)
+			consumer.activeTime = now
+
+			if justID {
+				items = append(items, id.String())
+			} else {
+				items = append(items, streamEntryReply(*entry))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+//
+// Replies with [next-start-id [claimed entries] [IDs trimmed away from the stream]].
+func XAUTOCLAIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 5 {
+		return "NOT_OK", errWrongArgs("xautoclaim")
+	}
+	key, groupName, consumerName := argv[0], argv[1], argv[2]
+	minIdle, err := parseIntArg(argv[3])
+	if err != nil {
+		return "NOT_OK", errors.New("Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, err := parseStreamRangeID(argv[4], true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var count int64 = 100
+	justID := false
+	for i := 5; i < len(argv); i++ {
+		switch {
+		case strings.EqualFold(argv[i], "JUSTID"):
+			justID = true
+		case strings.EqualFold(argv[i], "COUNT") && i+1 < len(argv):
+			if count, err = parseIntArg(argv[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+			if count < 1 {
+				return "NOT_OK", errors.New("COUNT must be > 0")
+			}
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	var res string
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		stream, group, err := lookupStreamGroup(data, key, groupName, "XAUTOCLAIM")
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		consumer, _ := group.consumer(consumerName, now)
+		consumer.seenTime = now
+
+		claimed := make([]string, 0)
+		deleted := make([]string, 0)
+		next := MIN_STREAM_ID
+		attempts := count * 10 // bound the scan like Redis does
+
+		for _, id := range sortStreamIDs(group.pel) {
+			if id.Less(start) {
+				continue
+			}
+			if int64(len(claimed)) >= count || attempts == 0 {
+				next = id
+				break
+			}
+			attempts--
+
+			p := group.pel[id]
+			entry, inStream := stream.Get(id)
+			if !inStream {
+				group.ack(id)
+				deleted = append(deleted, id.String())
+				continue
+			}
+			if minIdle > 0 && now-p.deliveryTime < minIdle {
+				continue
+			}
+
+			deliveryCount := p.deliveryCount
+			if !justID {
+				deliveryCount++
+			}
+			group.assign(id, consumer, now, deliveryCount)
+			consumer.activeTime = now
+
+			if justID {
+				claimed = append(claimed, id.String())
+			} else {
+				claimed = append(claimed, streamEntryReply(*entry))
+			}
+		}
+
+		res = arrayReply([]string{next.String(), arrayReply(claimed), arrayReply(deleted)})
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
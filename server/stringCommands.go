@@ -0,0 +1,701 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String command handlers beyond GET and SET. Read-modify-write commands run
+// entirely inside KeyDataSpace.Update, so concurrent clients cannot interleave
+// between the read and the write.
+
+// lookupString returns the string stored at key, found=false if the key does not
+// exist, or ErrWrongType if the key holds another kind of value.
+func lookupString(data map[string]DataValue, key string) (string, bool, error) {
+	value, ok := data[key]
+	if !ok {
+		return "", false, nil
+	}
+	str, ok := value.(StringValue)
+	if !ok {
+		return "", false, ErrWrongType
+	}
+	return string(str), true, nil
+}
+
+// storeStringLocked writes a string value. Existing keys keep their
+// expiration, new keys have none.
+// Must be called inside KeyDataSpace.Update.
+func storeStringLocked(data map[string]DataValue, key string, value string) {
+	data[key] = StringValue(value)
+}
+
+// parseStrictInt parses a stored value as a 64-bit integer, rejecting the
+// forms Redis does not consider integers (leading '+', spaces, empty string).
+func parseStrictInt(s string) (int64, bool) {
+	if s == "" || s[0] == '+' {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// incrDecrBy atomically adds delta to the integer stored at key (0 if missing).
+func incrDecrBy(key string, delta int64) (string, error) {
+	var result int64
+	err := keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		var cur int64
+		if found {
+			var ok bool
+			if cur, ok = parseStrictInt(str); !ok {
+				return ErrNotInteger
+			}
+		}
+		if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+			return errors.New("increment or decrement would overflow")
+		}
+		result = cur + delta
+		storeStringLocked(data, key, strconv.FormatInt(result, 10))
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(result), nil
+}
+
+// INCR key
+func INCR(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("incr")
+	}
+	return incrDecrBy(argv[0], 1)
+}
+
+// DECR key
+func DECR(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("decr")
+	}
+	return incrDecrBy(argv[0], -1)
+}
+
+// INCRBY key increment
+func INCRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("incrby")
+	}
+	delta, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return incrDecrBy(argv[0], delta)
+}
+
+// DECRBY key decrement
+func DECRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("decrby")
+	}
+	delta, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if delta == math.MinInt64 {
+		return "NOT_OK", errors.New("decrement would overflow")
+	}
+	return incrDecrBy(argv[0], -delta)
+}
+
+// INCRBYFLOAT key increment
+func INCRBYFLOAT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("incrbyfloat")
+	}
+	key := argv[0]
+	incr, err := strconv.ParseFloat(argv[1], 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		return "NOT_OK", ErrNotFloat
+	}
+
+	var result string
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		var cur float64
+		if found {
+			cur, err = strconv.ParseFloat(str, 64)
+			if err != nil || math.IsNaN(cur) || math.IsInf(cur, 0) || strings.TrimSpace(str) != str {
+				return ErrNotFloat
+			}
+		}
+		sum := cur + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			return errors.New("increment would produce NaN or Infinity")
+		}
+		// Plain decimal notation, as Redis stores it (e.g. 5.0e3 -> 5000).
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		storeStringLocked(data, key, result)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// STRING_MAX_SIZE is the largest string SETRANGE and APPEND may produce (512MB, like Redis).
+const STRING_MAX_SIZE = 512 * 1024 * 1024
+
+var ErrStringTooLong = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+
+// APPEND key value
+func APPEND(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("append")
+	}
+	key := argv[0]
+
+	var length int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		if len(str)+len(argv[1]) > STRING_MAX_SIZE {
+			return ErrStringTooLong
+		}
+		str += argv[1]
+		storeStringLocked(data, key, str)
+		length = len(str)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(length)), nil
+}
+
+// STRLEN key
+func STRLEN(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("strlen")
+	}
+
+	var length int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, argv[0])
+		length = len(str)
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(length)), nil
+}
+
+// GETRANGE key start end
+// Offsets are inclusive byte positions; negative offsets count from the end.
+func GETRANGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("getrange")
+	}
+	start, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	end, err := parseIntArg(argv[2])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	// An empty reply would be acknowledged as "OK" by the connection handler.
+	res := `""`
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, argv[0])
+		if err != nil {
+			return err
+		}
+		length := int64(len(str))
+		if start < 0 && end < 0 && start > end {
+			return nil
+		}
+		if start < 0 {
+			start += length
+		}
+		if end < 0 {
+			end += length
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end < 0 {
+			end = 0
+		}
+		if end >= length {
+			end = length - 1
+		}
+		if length == 0 || start > end {
+			return nil
+		}
+		res = stringReply(str[start : end+1])
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// SETRANGE key offset value
+// Overwrites part of the string starting at offset, padding with zero bytes
+// when the string is shorter than offset.
+func SETRANGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("setrange")
+	}
+	key, value := argv[0], argv[2]
+	offset, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if offset < 0 {
+		return "NOT_OK", errors.New("offset is out of range")
+	}
+	if offset > STRING_MAX_SIZE-int64(len(value)) {
+		return "NOT_OK", ErrStringTooLong
+	}
+
+	var length int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, _, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			// Nothing to write: do not create the key nor pad it.
+			length = len(str)
+			return nil
+		}
+
+		buf := []byte(str)
+		if need := int(offset) + len(value); need > len(buf) {
+			buf = append(buf, make([]byte, need-len(buf))...)
+		}
+		copy(buf[offset:], value)
+		storeStringLocked(data, key, string(buf))
+		length = len(buf)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(length)), nil
+}
+
+// GETDEL key
+func GETDEL(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("getdel")
+	}
+
+	res := NIL_REPLY
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, argv[0])
+		if err != nil || !found {
+			return err
+		}
+		res = stringReply(str)
+		deleteKeyLocked(data, argv[0])
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// GETSET key value
+// Sets the new value, discarding any expiration, and returns the old one.
+func GETSET(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("getset")
+	}
+	key := argv[0]
+
+	res := NIL_REPLY
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, key)
+		if err != nil {
+			return err
+		}
+		if found {
+			res = stringReply(str)
+		}
+		data[key] = StringValue(argv[1])
+		keyExpirations.Remove(key)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// parseExpireOption converts an EX/PX/EXAT/PXAT option and its argument into an
+// absolute unix timestamp in milliseconds. cmd is used in error messages.
+func parseExpireOption(opt string, arg string, nowMs int64, cmd string) (int64, error) {
+	n, err := parseIntArg(arg)
+	if err != nil {
+		return 0, err
+	}
+	errInvalid := errors.New("invalid expire time in '" + cmd + "' command")
+	if n <= 0 {
+		return 0, errInvalid
+	}
+
+	switch strings.ToUpper(opt) {
+	case "EX":
+		if n > (math.MaxInt64-nowMs)/1000 {
+			return 0, errInvalid
+		}
+		return nowMs + n*1000, nil
+	case "PX":
+		if n > math.MaxInt64-nowMs {
+			return 0, errInvalid
+		}
+		return nowMs + n, nil
+	case "EXAT":
+		if n > math.MaxInt64/1000 {
+			return 0, errInvalid
+		}
+		return n * 1000, nil
+	case "PXAT":
+		return n, nil
+	}
+	return 0, ErrSyntax
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// Returns the value and optionally changes the key expiration.
+func GETEX(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("getex")
+	}
+	key := argv[0]
+
+	nowMs := time.Now().UnixMilli()
+	var expireAt int64
+	setExpire, persist := false, false
+	switch {
+	case len(argv) == 1:
+	case len(argv) == 2 && strings.EqualFold(argv[1], "PERSIST"):
+		persist = true
+	case len(argv) == 3:
+		if expireAt, err = parseExpireOption(argv[1], argv[2], nowMs, "getex"); err != nil {
+			return "NOT_OK", err
+		}
+		setExpire = true
+	default:
+		return "NOT_OK", ErrSyntax
+	}
+
+	res := NIL_REPLY
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		str, found, err := lookupString(data, key)
+		if err != nil || !found {
+			return err
+		}
+		res = stringReply(str)
+		switch {
+		case setExpire && expireAt <= nowMs:
+			// An absolute time in the past deletes the key right away.
+			deleteKeyLocked(data, key)
+		case setExpire:
+			keyExpirations.PushItem(KeyExpiration{key: key, expire_timestamp: expireAt})
+		case persist:
+			keyExpirations.Remove(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// LCS_MAX_CELLS bounds the dynamic programming table of LCS, which holds
+// (len1+1)*(len2+1) counters: longer inputs are refused, as in Redis.
+const LCS_MAX_CELLS = math.MaxUint32 / 4
+
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len] [WITHMATCHLEN]
+// Longest common subsequence of two strings. By default returns the subsequence,
+// with LEN its length, with IDX the matching ranges as
+// [matches [[[start1 end1] [start2 end2] (len)] ...] len n].
+func LCS(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("lcs")
+	}
+
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 2; i < len(argv); i++ {
+		switch opt := strings.ToUpper(argv[i]); {
+		case opt == "LEN":
+			getLen = true
+		case opt == "IDX":
+			getIdx = true
+		case opt == "WITHMATCHLEN":
+			withMatchLen = true
+		case opt == "MINMATCHLEN" && i+1 < len(argv):
+			if minMatchLen, err = parseIntArg(argv[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+			if minMatchLen < 0 {
+				minMatchLen = 0
+			}
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+	if getLen && getIdx {
+		return "NOT_OK", errors.New("If you want both the length and indexes, please just use IDX.")
+	}
+
+	var a, b string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		var err error
+		if a, _, err = lookupString(data, argv[0]); err != nil {
+			return err
+		}
+		b, _, err = lookupString(data, argv[1])
+		return err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if uint64(len(a)+1)*uint64(len(b)+1) > LCS_MAX_CELLS {
+		return "NOT_OK", errors.New("Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// dp[i][j] = LCS length of a[:i] and b[:j], stored in a flat slice.
+	cols := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*cols)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*cols+j] = dp[(i-1)*cols+j-1] + 1
+			} else {
+				dp[i*cols+j] = max(dp[(i-1)*cols+j], dp[i*cols+j-1])
+			}
+		}
+	}
+	lcsLen := int(dp[len(a)*cols+len(b)])
+
+	if getLen {
+		return intReply(int64(lcsLen)), nil
+	}
+
+	// Walk back from the end collecting the subsequence and the matching ranges
+	// (ranges come out from the end of the strings, as in Redis).
+	seq := make([]byte, lcsLen)
+	idx := lcsLen
+	matches := make([]string, 0)
+	rangeLen := 0
+	var aEnd, bEnd int
+	flush := func(aStart, bStart int) {
+		if rangeLen > 0 && int64(rangeLen) >= minMatchLen {
+			m := []string{
+				arrayReply([]string{intReply(int64(aStart)), intReply(int64(aEnd))}),
+				arrayReply([]string{intReply(int64(bStart)), intReply(int64(bEnd))}),
+			}
+			if withMatchLen {
+				m = append(m, intReply(int64(rangeLen)))
+			}
+			matches = append(matches, arrayReply(m))
+		}
+		rangeLen = 0
+	}
+
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		if a[i-1] == b[j-1] {
+			idx--
+			seq[idx] = a[i-1]
+			if rangeLen == 0 {
+				aEnd, bEnd = i-1, j-1
+			} else if aEnd-rangeLen != i-1 || bEnd-rangeLen != j-1 {
+				// Not contiguous with the current range: emit it and start a new one.
+				flush(aEnd-rangeLen+1, bEnd-rangeLen+1)
+				aEnd, bEnd = i-1, j-1
+			}
+			rangeLen++
+			i--
+			j--
+		} else if dp[(i-1)*cols+j] >= dp[i*cols+j-1] {
+			i--
+		} else {
+			j--
+		}
+	}
+	flush(aEnd-rangeLen+1, bEnd-rangeLen+1)
+
+	if getIdx {
+		return arrayReply([]string{"matches", arrayReply(matches), "len", intReply(int64(lcsLen))}), nil
+	}
+	return bulkReply(string(seq)), nil
+}
+
+// MGET key [key ...]
+// Returns the values of the keys; missing keys and keys holding another type
+// are (nil). All keys are read under the same lock.
+func MGET(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 {
+		return "NOT_OK", errWrongArgs("mget")
+	}
+
+	nowMs := time.Now().UnixMilli()
+	items := make([]string, len(argv))
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		for i, key := range argv {
+			items[i] = NIL_REPLY
+			if str, ok := data[key].(StringValue); ok && keyAliveLocked(data, key, nowMs) {
+				items[i] = string(str)
+			}
+		}
+		return nil
+	})
+	return arrayReply(items), nil
+}
+
+// parseKeyValuePairs splits "key value [key value ...]" arguments.
+func parseKeyValuePairs(args, cmd string) ([]string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return nil, errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) == 0 || len(argv)%2 != 0 {
+		return nil, errWrongArgs(cmd)
+	}
+	return argv, nil
+}
+
+// msetLocked stores every pair like SET does: any previous value and
+// expiration are replaced. Must be called inside KeyDataSpace.Update.
+func msetLocked(data map[string]DataValue, pairs []string) {
+	for i := 0; i < len(pairs); i += 2 {
+		key := pairs[i]
+		data[key] = StringValue(pairs[i+1])
+		keyExpirations.Remove(key)
+		ftReindexLocked(data, key)
+	}
+}
+
+// MSET key value [key value ...]
+// Sets all the pairs atomically: other clients see either none or all of them.
+// When a key is repeated, the last value wins.
+func MSET(args string) (string, error) {
+	pairs, err := parseKeyValuePairs(args, "mset")
+	if err != nil {
+		return "NOT_OK", err
+	}
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		msetLocked(data, pairs)
+		return nil
+	})
+	return "OK", nil
+}
+
+// MSETNX key value [key value ...]
+// Sets all the pairs atomically only if none of the keys exists.
+// Returns 1 if they were set, 0 if nothing was set.
+func MSETNX(args string) (string, error) {
+	pairs, err := parseKeyValuePairs(args, "msetnx")
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	nowMs := time.Now().UnixMilli()
+	set := false
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		for i := 0; i < len(pairs); i += 2 {
+			if keyAliveLocked(data, pairs[i], nowMs) {
+				return nil
+			}
+		}
+		msetLocked(data, pairs)
+		set = true
+		return nil
+	})
+	if set {
+		return intReply(1), nil
+	}
+	return intReply(0), nil
+}
@@ -0,0 +1,297 @@
+// File: timeSeries.go
+//
+// Purpose:
+//   Time series value type for the TS.* commands, modelled after RedisTimeSeries.
+//
+//   A series is a list of (timestamp ms, float64) samples sorted by timestamp,
+//   plus:
+//     - a retention period: samples older than (newest timestamp - retention)
+//       are dropped as new samples arrive (0 keeps everything);
+//     - a duplicate policy deciding what happens when a timestamp is added twice;
+//     - labels (name=value pairs) used by TS.MRANGE to select series;
+//     - compaction rules that downsample the series into other series: each
+//       rule tracks the bucket currently being filled, and when a sample falls
+//       into a later bucket the previous one is aggregated and written to the
+//       destination. Samples arriving late for an already closed bucket cause
+//       that bucket to be recomputed.
+//
+//   Aggregated ranges use buckets aligned to the epoch: the bucket of t starts
+//   at t - t % bucketDuration.
+//
+// Asymptotic costs:
+//   - Add: O(1) amortized for in-order samples, O(n) for out-of-order ones
+//   - Range: O(log n + samples in range)
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; series live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrTSRetention = errors.New("TSDB: Timestamp is older than retention")
+	ErrTSBlocked   = errors.New("TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+)
+
+// tsDuplicatePolicy decides how a sample with an existing timestamp is handled.
+type tsDuplicatePolicy uint8
+
+const (
+	TS_DUP_BLOCK tsDuplicatePolicy = iota
+	TS_DUP_FIRST
+	TS_DUP_LAST
+	TS_DUP_MIN
+	TS_DUP_MAX
+	TS_DUP_SUM
+)
+
+var tsDuplicatePolicyNames = []string{"block", "first", "last", "min", "max", "sum"}
+
+func parseTSDuplicatePolicy(s string) (tsDuplicatePolicy, error) {
+	for i, name := range tsDuplicatePolicyNames {
+		if strings.EqualFold(s, name) {
+			return tsDuplicatePolicy(i), nil
+		}
+	}
+	return 0, errors.New("TSDB: Unknown DUPLICATE_POLICY")
+}
+
+// tsAggregation is an aggregation function over the samples of a bucket.
+type tsAggregation uint8
+
+const (
+	TS_AGG_AVG tsAggregation = iota
+	TS_AGG_MIN
+	TS_AGG_MAX
+	TS_AGG_SUM
+	TS_AGG_COUNT
+)
+
+var tsAggregationNames = []string{"avg", "min", "max", "sum", "count"}
+
+func parseTSAggregation(s string) (tsAggregation, error) {
+	for i, name := range tsAggregationNames {
+		if strings.EqualFold(s, name) {
+			return tsAggregation(i), nil
+		}
+	}
+	return 0, errors.New("TSDB: Unknown aggregation type")
+}
+
+// apply aggregates a non-empty list of samples.
+func (a tsAggregation) apply(samples []tsSample) float64 {
+	switch a {
+	case TS_AGG_COUNT:
+		return float64(len(samples))
+	case TS_AGG_MIN:
+		v := math.Inf(1)
+		for _, s := range samples {
+			v = math.Min(v, s.value)
+		}
+		return v
+	case TS_AGG_MAX:
+		v := math.Inf(-1)
+		for _, s := range samples {
+			v = math.Max(v, s.value)
+		}
+		return v
+	}
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.value
+	}
+	if a == TS_AGG_AVG {
+		return sum / float64(len(samples))
+	}
+	return sum
+}
+
+type tsSample struct {
+	ts    int64
+	value float64
+}
+
+// tsRule downsamples the series into the series stored at dest.
+type tsRule struct {
+	dest    string
+	agg     tsAggregation
+	bucket  int64
+	started bool  // whether current is set
+	current int64 // start of the bucket being filled
+}
+
+// TimeSeries is the time series value type.
+type TimeSeries struct {
+	samples   []tsSample
+	retention int64
+	policy    tsDuplicatePolicy
+	labels    [][2]string // name, value; in creation order
+	src       string      // key of the series compacted into this one, if any
+	rules     []*tsRule
+}
+
+// NewTimeSeries creates an empty series.
+func NewTimeSeries(retention int64, policy tsDuplicatePolicy, labels [][2]string) *TimeSeries {
+	return &TimeSeries{retention: retention, policy: policy, labels: labels}
+}
+
+func (ts *TimeSeries) Type() ValueType { return TS_VALUE }
+
+func (ts *TimeSeries) DeepCopy() DataValue {
+	clone := *ts
+	clone.samples = append([]tsSample(nil), ts.samples...)
+	clone.labels = append([][2]string(nil), ts.labels...)
+	clone.rules = make([]*tsRule, len(ts.rules))
+	for i, r := range ts.rules {
+		cp := *r
+		clone.rules[i] = &cp
+	}
+	return &clone
+}
+
+// Label returns the value of a label and whether it is set.
+func (ts *TimeSeries) Label(name string) (string, bool) {
+	for _, l := range ts.labels {
+		if l[0] == name {
+			return l[1], true
+		}
+	}
+	return "", false
+}
+
+// lastTimestamp returns the newest timestamp, or -1 for an empty series.
+func (ts *TimeSeries) lastTimestamp() int64 {
+	if len(ts.samples) == 0 {
+		return -1
+	}
+	return ts.samples[len(ts.samples)-1].ts
+}
+
+// search returns the index of the first sample with timestamp >= t.
+func (ts *TimeSeries) search(t int64) int {
+	return sort.Search(len(ts.samples), func(i int) bool { return ts.samples[i].ts >= t })
+}
+
+// upsert adds a sample, resolving duplicates with policy.
+func (ts *TimeSeries) upsert(t int64, value float64, policy tsDuplicatePolicy) error {
+	last := ts.lastTimestamp()
+	if ts.retention > 0 && last >= 0 && t < last-ts.retention {
+		return ErrTSRetention
+	}
+	if t > last {
+		ts.samples = append(ts.samples, tsSample{t, value})
+		ts.trim()
+		return nil
+	}
+
+	i := ts.search(t)
+	if i < len(ts.samples) && ts.samples[i].ts == t {
+		cur := &ts.samples[i].value
+		switch policy {
+		case TS_DUP_BLOCK:
+			return ErrTSBlocked
+		case TS_DUP_LAST:
+			*cur = value
+		case TS_DUP_MIN:
+			*cur = math.Min(*cur, value)
+		case TS_DUP_MAX:
+			*cur = math.Max(*cur, value)
+		case TS_DUP_SUM:
+			*cur += value
+		}
+		return nil
+	}
+	ts.samples = append(ts.samples, tsSample{})
+	copy(ts.samples[i+1:], ts.samples[i:])
+	ts.samples[i] = tsSample{t, value}
+	return nil
+}
+
+// trim drops the samples that fell out of the retention period.
+func (ts *TimeSeries) trim() {
+	if ts.retention <= 0 || len(ts.samples) == 0 {
+		return
+	}
+	if i := ts.search(ts.lastTimestamp() - ts.retention); i > 0 {
+		ts.samples = append(ts.samples[:0], ts.samples[i:]...)
+	}
+}
+
+// Range returns the samples with from <= timestamp <= to.
+func (ts *TimeSeries) Range(from, to int64) []tsSample {
+	if from > to {
+		return nil
+	}
+	i := ts.search(from)
+	j := ts.search(to)
+	if j < len(ts.samples) && ts.samples[j].ts == to {
+		j++
+	}
+	return ts.samples[i:j]
+}
+
+// tsBucketStart returns the start of the bucket containing t.
+func tsBucketStart(t, bucket int64) int64 {
+	start := t - t%bucket
+	if t < 0 && t%bucket != 0 {
+		start -= bucket
+	}
+	return start
+}
+
+// tsAggregate groups samples (sorted by timestamp) into buckets and
+// aggregates each of them; buckets without samples are omitted.
+func tsAggregate(samples []tsSample, agg tsAggregation, bucket int64) []tsSample {
+	var out []tsSample
+	for i := 0; i < len(samples); {
+		start := tsBucketStart(samples[i].ts, bucket)
+		j := i
+		// start+bucket may overflow for timestamps near math.MaxInt64.
+		for j < len(samples) && samples[j].ts-start < bucket {
+			j++
+		}
+		out = append(out, tsSample{start, agg.apply(samples[i:j])})
+		i = j
+	}
+	return out
+}
+
+// compactBucket writes the aggregate of the bucket starting at start into dest.
+func (ts *TimeSeries) compactBucket(rule *tsRule, dest *TimeSeries, start int64) {
+	end := start + min(rule.bucket-1, math.MaxInt64-start) // start >= 0: no overflow
+	samples := ts.Range(start, end)
+	if len(samples) == 0 {
+		return
+	}
+	// Compacted samples may legitimately fall out of the destination retention.
+	dest.upsert(start, rule.agg.apply(samples), TS_DUP_LAST)
+}
+
+// applyRules runs the compaction rules after a sample at t was added.
+// lookup resolves a destination key, returning nil when it is gone.
+func (ts *TimeSeries) applyRules(t int64, lookup func(key string) *TimeSeries) {
+	for _, rule := range ts.rules {
+		dest := lookup(rule.dest)
+		if dest == nil {
+			continue
+		}
+		start := tsBucketStart(t, rule.bucket)
+		switch {
+		case !rule.started:
+			rule.started, rule.current = true, start
+		case start > rule.current:
+			ts.compactBucket(rule, dest, rule.current)
+			rule.current = start
+		case start < rule.current:
+			// Late sample for a closed bucket.
+			ts.compactBucket(rule, dest, start)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"strings"
 )
 
 var (
@@ -41,6 +42,7 @@ func cutFirstTokenSpaceTab(s string) (string, string, error) {
 //  2. Quoted string: starts with '"' and ends at the matching non-escaped '"'.
 //  3. JSON-like block: starts with '{' or '[' and ends when braces/brackets are balanced,
 //     with strings inside handled correctly (quotes and escapes do not affect nesting).
+//     A block immediately followed by more bytes extends to the next separator.
 //
 // Separators are space ' ' and tab '\t'. Leading separators are skipped.
 // After extracting a token, any trailing separators are consumed, and the remainder is returned.
@@ -140,6 +142,10 @@ func cutFirstTokenSmart(s string) (string, string, error) {
 
 			// Token ends when both depths return to zero.
 			if braceDepth == 0 && bracketDepth == 0 {
+				// A block glued to more bytes (e.g. the glob "[ab]*") is a bare token.
+				for j < n && !isSpaceTab(s[j]) {
+					j++
+				}
 				// Consume trailing separators for rest.
 				k := j
 				for k < n && isSpaceTab(s[k]) {
@@ -169,3 +175,27 @@ func cutFirstTokenSmart(s string) (string, string, error) {
 func isSpaceTab(b byte) bool {
 	return b == ' ' || b == '\t'
 }
+
+// splitArgs splits the whole argument string into tokens using cutFirstTokenSmart,
+// so quoted strings and JSON-like blocks are kept as single arguments.
+// An unbalanced '[' or '{' is not an error here: the token falls back to a bare
+// token, since arguments like the BYLEX bound "[a" legitimately start with a bracket.
+func splitArgs(s string) ([]string, error) {
+	var tokens []string
+	for {
+		tok, rest, err := cutFirstTokenSmart(s)
+		if err == ErrNoToken {
+			return tokens, nil
+		}
+		if err == ErrMalformed {
+			if trimmed := strings.TrimLeft(s, " \t"); trimmed[0] == '[' || trimmed[0] == '{' {
+				tok, rest, err = cutFirstTokenSpaceTab(s)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		s = rest
+	}
+}
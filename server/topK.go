@@ -0,0 +1,203 @@
+// File: topK.go
+//
+// Purpose:
+//   Top-K value type for the TOPK.* commands, using the HeavyKeeper algorithm
+//   as RedisBloom does.
+//
+//   A depth x width matrix of buckets holds (fingerprint, count) pairs. Adding
+//   an item increments its bucket in every row when the fingerprint matches
+//   (or the bucket is empty); otherwise the bucket's count is decayed with
+//   probability decay^count, and the item takes the bucket over once the
+//   count reaches zero. Heavy hitters thus keep their buckets while rare
+//   items fade away.
+//
+//   The k heaviest items are kept in a min-heap ordered by count: an item
+//   whose estimate reaches the heap minimum replaces the lightest item, which
+//   is reported back to the caller as expelled.
+//
+// Asymptotic costs:
+//   - Add:   O(depth * increment) in the worst case, plus O(log k) on the heap
+//   - Query: O(1)
+//   - List:  O(k log k)
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; Top-K values live in the KeyDataSpace and
+//     are only touched under its lock.
+
+package main
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	TOPK_DEFAULT_WIDTH = 8
+	TOPK_DEFAULT_DEPTH = 7
+	TOPK_DEFAULT_DECAY = 0.9
+	TOPK_MAX_INCREMENT = 100000
+	TOPK_FP_SEED       = 1919
+)
+
+type topkBucket struct {
+	fp    uint32
+	count uint32
+}
+
+// topkEntry is an item tracked in the heap.
+type topkEntry struct {
+	item  string
+	fp    uint32
+	count uint32
+}
+
+// topkHeap is a min-heap of entries ordered by count, with an index by item.
+// Its heap.Interface methods are not intended for direct use.
+type topkHeap struct {
+	entries []*topkEntry
+	index   map[string]int
+}
+
+func (h *topkHeap) Len() int           { return len(h.entries) }
+func (h *topkHeap) Less(i, j int) bool { return h.entries[i].count < h.entries[j].count }
+func (h *topkHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].item] = i
+	h.index[h.entries[j].item] = j
+}
+func (h *topkHeap) Push(x any) {
+	e := x.(*topkEntry)
+	h.index[e.item] = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+func (h *topkHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, e.item)
+	return e
+}
+
+// TopK is the Top-K value type.
+type TopK struct {
+	k            uint32
+	width, depth uint32
+	decay        float64
+	buckets      []topkBucket
+	heap         *topkHeap
+}
+
+// TOPK_MAX_BUCKETS bounds width * depth: 256 MiB of buckets.
+const TOPK_MAX_BUCKETS = 1 << 25
+
+// topkValidDims reports whether a width x depth bucket matrix may be allocated.
+func topkValidDims(width, depth uint64) bool {
+	return width >= 1 && depth >= 1 &&
+		width <= TOPK_MAX_BUCKETS && depth <= TOPK_MAX_BUCKETS && width*depth <= TOPK_MAX_BUCKETS
+}
+
+// NewTopK creates an empty Top-K tracking the k heaviest items.
+func NewTopK(k, width, depth uint32, decay float64) *TopK {
+	return &TopK{
+		k:       k,
+		width:   width,
+		depth:   depth,
+		decay:   decay,
+		buckets: make([]topkBucket, uint64(width)*uint64(depth)),
+		heap:    &topkHeap{index: make(map[string]int)},
+	}
+}
+
+func (t *TopK) Type() ValueType { return TOPK_VALUE }
+
+func (t *TopK) DeepCopy() DataValue {
+	clone := *t
+	clone.buckets = append([]topkBucket(nil), t.buckets...)
+	clone.heap = &topkHeap{index: make(map[string]int, len(t.heap.entries))}
+	for i, e := range t.heap.entries {
+		cp := *e
+		clone.heap.entries = append(clone.heap.entries, &cp)
+		clone.heap.index[e.item] = i
+	}
+	return &clone
+}
+
+func topkFingerprint(item string) uint32 {
+	return uint32(murmurHash64A([]byte(item), TOPK_FP_SEED))
+}
+
+// Add counts incr occurrences of item. Returns the item expelled from the
+// top-k list, if any.
+func (t *TopK) Add(item string, incr uint32) (string, bool) {
+	fp := topkFingerprint(item)
+	var maxCount uint32
+
+	for row := uint32(0); row < t.depth; row++ {
+		loc := murmurHash64A([]byte(item), uint64(row)) % uint64(t.width)
+		b := &t.buckets[uint64(row)*uint64(t.width)+loc]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = fp, incr
+		case b.fp == fp:
+			b.count += incr
+		default:
+			// Each occurrence tries to decay the owner of the bucket.
+			for left := incr; left > 0; left-- {
+				if rand.Float64() < math.Pow(t.decay, float64(b.count)) {
+					b.count--
+					if b.count == 0 {
+						b.fp, b.count = fp, left
+						break
+					}
+				}
+			}
+		}
+		if b.fp == fp {
+			maxCount = max(maxCount, b.count)
+		}
+	}
+
+	// The heap minimum is 0 while there are free slots.
+	var heapMin uint32
+	if uint32(t.heap.Len()) == t.k {
+		heapMin = t.heap.entries[0].count
+	}
+	if maxCount == 0 || maxCount < heapMin {
+		return "", false
+	}
+
+	if i, ok := t.heap.index[item]; ok {
+		t.heap.entries[i].count = maxCount
+		heap.Fix(t.heap, i)
+		return "", false
+	}
+	if uint32(t.heap.Len()) < t.k {
+		heap.Push(t.heap, &topkEntry{item: item, fp: fp, count: maxCount})
+		return "", false
+	}
+	expelled := heap.Pop(t.heap).(*topkEntry)
+	heap.Push(t.heap, &topkEntry{item: item, fp: fp, count: maxCount})
+	return expelled.item, true
+}
+
+// Query reports whether item is currently in the top-k list.
+func (t *TopK) Query(item string) bool {
+	_, ok := t.heap.index[item]
+	return ok
+}
+
+// List returns the top-k entries, heaviest first.
+func (t *TopK) List() []topkEntry {
+	out := make([]topkEntry, len(t.heap.entries))
+	for i, e := range t.heap.entries {
+		out[i] = *e
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].count != out[j].count {
+			return out[i].count > out[j].count
+		}
+		return out[i].item < out[j].item
+	})
+	return out
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Top-K command handlers. Top-K values are *TopK values (see topK.go).
+
+// lookupTopK returns the Top-K stored at key, nil if the key does not exist,
+// or ErrWrongType if the key holds another kind of value.
+func lookupTopK(data map[string]DataValue, key string) (*TopK, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	topk, ok := value.(*TopK)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return topk, nil
+}
+
+// TOPK.RESERVE key topk [width depth decay]
+func TOPK_RESERVE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 && len(argv) != 5 {
+		return "NOT_OK", errWrongArgs("topk.reserve")
+	}
+	key := argv[0]
+
+	k, err := parseIntArg(argv[1])
+	if err != nil || k < 1 || k > math.MaxUint32 {
+		return "NOT_OK", errors.New("TopK: invalid k")
+	}
+	width, depth, decay := int64(TOPK_DEFAULT_WIDTH), int64(TOPK_DEFAULT_DEPTH), TOPK_DEFAULT_DECAY
+	if len(argv) == 5 {
+		if width, err = parseIntArg(argv[2]); err != nil || width < 1 || width > TOPK_MAX_BUCKETS {
+			return "NOT_OK", errors.New("TopK: invalid width")
+		}
+		if depth, err = parseIntArg(argv[3]); err != nil || !topkValidDims(uint64(width), uint64(max(depth, 0))) {
+			return "NOT_OK", errors.New("TopK: invalid depth")
+		}
+		if decay, err = parseFloatArg(argv[4]); err != nil || decay <= 0 || decay > 1 {
+			return "NOT_OK", errors.New("TopK: invalid decay value. must be '<= 1' & '> 0'")
+		}
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := data[key]; exists {
+			return errors.New("TopK: key already exists")
+		}
+		data[key] = NewTopK(uint32(k), uint32(width), uint32(depth), decay)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// topkAddGeneric adds items with their increments and replies, for each item,
+// with the item it expelled from the list or (nil).
+func topkAddGeneric(key string, items []string, incrs []uint32) (string, error) {
+	replies := make([]string, len(items))
+	err := keyDataSpace.Update(func(data map[string]DataValue) error {
+		topk, err := lookupTopK(data, key)
+		if err != nil {
+			return err
+		}
+		if topk == nil {
+			return errors.New("TopK: key does not exist")
+		}
+		for i, item := range items {
+			replies[i] = NIL_REPLY
+			if incrs[i] == 0 {
+				continue
+			}
+			if expelled, ok := topk.Add(item, incrs[i]); ok {
+				replies[i] = expelled
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(replies), nil
+}
+
+// TOPK.ADD key item [item ...]
+func TOPK_ADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("topk.add")
+	}
+	incrs := make([]uint32, len(argv)-1)
+	for i := range incrs {
+		incrs[i] = 1
+	}
+	return topkAddGeneric(argv[0], argv[1:], incrs)
+}
+
+// TOPK.INCRBY key item increment [item increment ...]
+func TOPK_INCRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 || len(argv)%2 != 1 {
+		return "NOT_OK", errWrongArgs("topk.incrby")
+	}
+	pairs := argv[1:]
+	items := make([]string, len(pairs)/2)
+	incrs := make([]uint32, len(pairs)/2)
+	for i := range items {
+		items[i] = pairs[2*i]
+		n, err := parseIntArg(pairs[2*i+1])
+		if err != nil || n < 0 || n > TOPK_MAX_INCREMENT {
+			return "NOT_OK", errors.New("TopK: increment must be an integer greater or equal to 0 and smaller or equal to 100000")
+		}
+		incrs[i] = uint32(n)
+	}
+	return topkAddGeneric(argv[0], items, incrs)
+}
+
+// TOPK.QUERY key item [item ...]
+// Returns 1 for each item currently in the top-k list, 0 otherwise.
+func TOPK_QUERY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("topk.query")
+	}
+
+	replies := make([]string, len(argv)-1)
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		topk, err := lookupTopK(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if topk == nil {
+			return errors.New("TopK: key does not exist")
+		}
+		for i, item := range argv[1:] {
+			replies[i] = "0"
+			if topk.Query(item) {
+				replies[i] = "1"
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(replies), nil
+}
+
+// TOPK.LIST key [WITHCOUNT]
+// Returns the top-k items, heaviest first, optionally followed by their counts.
+func TOPK_LIST(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("topk.list")
+	}
+	withCount := false
+	if len(argv) == 2 {
+		if strings.ToUpper(argv[1]) != "WITHCOUNT" {
+			return "NOT_OK", ErrSyntax
+		}
+		withCount = true
+	}
+
+	var replies []string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		topk, err := lookupTopK(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if topk == nil {
+			return errors.New("TopK: key does not exist")
+		}
+		for _, e := range topk.List() {
+			replies = append(replies, e.item)
+			if withCount {
+				replies = append(replies, intReply(int64(e.count)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(replies), nil
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time series command handlers. Series are *TimeSeries values (see timeSeries.go).
+
+var ErrTSKeyMissing = errors.New("TSDB: the key does not exist")
+
+// lookupTimeSeries returns the series stored at key, nil if the key does not
+// exist, or ErrWrongType if the key holds another kind of value.
+func lookupTimeSeries(data map[string]DataValue, key string) (*TimeSeries, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	ts, ok := value.(*TimeSeries)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return ts, nil
+}
+
+// tsAddLocked adds a sample to ts and runs its compaction rules.
+func tsAddLocked(data map[string]DataValue, ts *TimeSeries, t int64, value float64, policy tsDuplicatePolicy) error {
+	if err := ts.upsert(t, value, policy); err != nil {
+		return err
+	}
+	ts.applyRules(t, func(key string) *TimeSeries {
+		dest, _ := lookupTimeSeries(data, key)
+		return dest
+	})
+	return nil
+}
+
+// parseTSTimestamp parses a sample timestamp in ms; "*" is the current time.
+func parseTSTimestamp(s string) (int64, error) {
+	if s == "*" {
+		return time.Now().UnixMilli(), nil
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || t < 0 {
+		return 0, errors.New("TSDB: invalid timestamp")
+	}
+	return t, nil
+}
+
+// parseTSValue parses a sample value.
+func parseTSValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, errors.New("TSDB: invalid value")
+	}
+	return v, nil
+}
+
+// tsOptions holds the options shared by TS.CREATE and TS.ADD.
+type tsOptions struct {
+	retention   int64
+	policy      tsDuplicatePolicy
+	onDuplicate tsDuplicatePolicy
+	hasOnDup    bool
+	labels      [][2]string
+}
+
+// parseTSOptions parses RETENTION, DUPLICATE_POLICY, LABELS and, when
+// allowOnDup is set, ON_DUPLICATE. LABELS takes all the remaining arguments.
+func parseTSOptions(argv []string, allowOnDup bool) (*tsOptions, error) {
+	opts := &tsOptions{policy: TS_DUP_BLOCK}
+	for i := 0; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "RETENTION":
+			if i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			n, err := strconv.ParseInt(argv[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("TSDB: invalid RETENTION")
+			}
+			opts.retention = n
+			i++
+		case "DUPLICATE_POLICY":
+			if i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			p, err := parseTSDuplicatePolicy(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			opts.policy = p
+			i++
+		case "ON_DUPLICATE":
+			if !allowOnDup || i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			p, err := parseTSDuplicatePolicy(argv[i+1])
+			if err != nil {
+				return nil, err
+			}
+			opts.onDuplicate, opts.hasOnDup = p, true
+			i++
+		case "LABELS":
+			rest := argv[i+1:]
+			if len(rest)%2 != 0 {
+				return nil, errors.New("TSDB: invalid LABELS")
+			}
+			for j := 0; j < len(rest); j += 2 {
+				opts.labels = append(opts.labels, [2]string{rest[j], rest[j+1]})
+			}
+			return opts, nil
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// TS.CREATE key [RETENTION ms] [DUPLICATE_POLICY policy] [LABELS label value ...]
+func TS_CREATE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 1 {
+		return "NOT_OK", errWrongArgs("ts.create")
+	}
+	key := argv[0]
+	opts, err := parseTSOptions(argv[1:], false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		if _, exists := data[key]; exists {
+			return errors.New("TSDB: key already exists")
+		}
+		data[key] = NewTimeSeries(opts.retention, opts.policy, opts.labels)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// TS.ADD key timestamp|* value [RETENTION ms] [DUPLICATE_POLICY policy] [ON_DUPLICATE policy] [LABELS label value ...]
+// Creates the series with the given options when missing; ON_DUPLICATE
+// overrides the duplicate policy of the series for this sample.
+// Returns the timestamp of the sample.
+func TS_ADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("ts.add")
+	}
+	key := argv[0]
+	t, err := parseTSTimestamp(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	value, err := parseTSValue(argv[2])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	opts, err := parseTSOptions(argv[3:], true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		ts, err := lookupTimeSeries(data, key)
+		if err != nil {
+			return err
+		}
+		if ts == nil {
+			ts = NewTimeSeries(opts.retention, opts.policy, opts.labels)
+			data[key] = ts
+		}
+		policy := ts.policy
+		if opts.hasOnDup {
+			policy = opts.onDuplicate
+		}
+		return tsAddLocked(data, ts, t, value, policy)
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(t), nil
+}
+
+// TS.MADD key timestamp value [key timestamp value ...]
+// Adds samples to existing series. Returns the timestamp of each sample, or
+// the error that prevented adding it.
+func TS_MADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 || len(argv)%3 != 0 {
+		return "NOT_OK", errWrongArgs("ts.madd")
+	}
+
+	n := len(argv) / 3
+	timestamps := make([]int64, n)
+	values := make([]float64, n)
+	for i := 0; i < n; i++ {
+		if timestamps[i], err = parseTSTimestamp(argv[3*i+1]); err != nil {
+			return "NOT_OK", err
+		}
+		if values[i], err = parseTSValue(argv[3*i+2]); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	items := make([]string, n)
+	keyDataSpace.Update(func(data map[string]DataValue) error {
+		for i := 0; i < n; i++ {
+			ts, err := lookupTimeSeries(data, argv[3*i])
+			if err == nil && ts == nil {
+				err = ErrTSKeyMissing
+			}
+			if err == nil {
+				err = tsAddLocked(data, ts, timestamps[i], values[i], ts.policy)
+			}
+			if err != nil {
+				items[i] = "ERR: " + err.Error()
+			} else {
+				items[i] = intReply(timestamps[i])
+			}
+		}
+		return nil
+	})
+	return arrayReply(items), nil
+}
+
+// tsLabelFilter is a TS.MRANGE filter: label=value, label!=value, label=
+// (label not set), label!= (label set), label=(v1,v2), label!=(v1,v2).
+type tsLabelFilter struct {
+	label  string
+	values []string // empty for the "is set" / "is not set" forms
+	negate bool
+}
+
+func parseTSLabelFilter(s string) (*tsLabelFilter, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, errors.New("TSDB: failed parsing labels")
+	}
+	f := &tsLabelFilter{label: s[:i]}
+	if strings.HasSuffix(f.label, "!") {
+		f.label, f.negate = f.label[:len(f.label)-1], true
+		if f.label == "" {
+			return nil, errors.New("TSDB: failed parsing labels")
+		}
+	}
+	value := s[i+1:]
+	switch {
+	case value == "":
+	case strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")"):
+		f.values = strings.Split(value[1:len(value)-1], ",")
+	default:
+		f.values = []string{value}
+	}
+	return f, nil
+}
+
+func (f *tsLabelFilter) match(ts *TimeSeries) bool {
+	value, ok := ts.Label(f.label)
+	if len(f.values) == 0 {
+		// label= matches series without the label, label!= those with it.
+		return ok == f.negate
+	}
+	in := false
+	if ok {
+		for _, v := range f.values {
+			if v == value {
+				in = true
+				break
+			}
+		}
+	}
+	return in != f.negate
+}
+
+// tsRangeSpec holds the options of TS.RANGE, TS.REVRANGE and TS.MRANGE.
+type tsRangeSpec struct {
+	from, to   int64
+	reverse    bool
+	count      int64 // 0 means no limit
+	hasAgg     bool
+	agg        tsAggregation
+	bucket     int64
+	withLabels bool
+	filters    []*tsLabelFilter
+}
+
+// parseTSRangeBound parses a range bound: a timestamp, "-" (oldest) or "+" (newest).
+func parseTSRangeBound(s string) (int64, error) {
+	switch s {
+	case "-":
+		return 0, nil
+	case "+":
+		return math.MaxInt64, nil
+	}
+	return parseTSTimestamp(s)
+}
+
+// parseTSAggregationArgs parses "aggregator bucketDuration".
+func parseTSAggregationArgs(aggStr, bucketStr string) (tsAggregation, int64, error) {
+	agg, err := parseTSAggregation(aggStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	bucket, err := strconv.ParseInt(bucketStr, 10, 64)
+	if err != nil || bucket <= 0 {
+		return 0, 0, errors.New("TSDB: bucketDuration must be greater than zero")
+	}
+	return agg, bucket, nil
+}
+
+// parseTSRangeArgs parses "from to [options]"; multi enables WITHLABELS and
+// the mandatory FILTER of TS.MRANGE.
+func parseTSRangeArgs(argv []string, reverse bool, multi bool) (*tsRangeSpec, error) {
+	spec := &tsRangeSpec{reverse: reverse}
+	var err error
+	if spec.from, err = parseTSRangeBound(argv[0]); err != nil {
+		return nil, err
+	}
+	if spec.to, err = parseTSRangeBound(argv[1]); err != nil {
+		return nil, err
+	}
+
+	for i := 2; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "COUNT":
+			if i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			if spec.count, err = strconv.ParseInt(argv[i+1], 10, 64); err != nil || spec.count <= 0 {
+				return nil, errors.New("TSDB: Invalid COUNT value")
+			}
+			i++
+		case "AGGREGATION":
+			if i+2 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			if spec.agg, spec.bucket, err = parseTSAggregationArgs(argv[i+1], argv[i+2]); err != nil {
+				return nil, err
+			}
+			spec.hasAgg = true
+			i += 2
+		case "WITHLABELS":
+			if !multi {
+				return nil, ErrSyntax
+			}
+			spec.withLabels = true
+		case "FILTER":
+			if !multi || i+1 >= len(argv) {
+				return nil, ErrSyntax
+			}
+			// FILTER takes all the remaining arguments.
+			for _, raw := range argv[i+1:] {
+				f, err := parseTSLabelFilter(raw)
+				if err != nil {
+					return nil, err
+				}
+				spec.filters = append(spec.filters, f)
+			}
+			i = len(argv)
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if multi && len(spec.filters) == 0 {
+		return nil, errors.New("TSDB: missing FILTER argument")
+	}
+	return spec, nil
+}
+
+// tsRangeReply renders the samples of ts selected by spec.
+func tsRangeReply(ts *TimeSeries, spec *tsRangeSpec) string {
+	samples := ts.Range(spec.from, spec.to)
+	if spec.hasAgg {
+		samples = tsAggregate(samples, spec.agg, spec.bucket)
+	}
+
+	items := make([]string, 0, len(samples))
+	for i := range samples {
+		s := samples[i]
+		if spec.reverse {
+			s = samples[len(samples)-1-i]
+		}
+		if spec.count > 0 && int64(len(items)) == spec.count {
+			break
+		}
+		items = append(items, arrayReply([]string{intReply(s.ts), floatReply(s.value)}))
+	}
+	return arrayReply(items)
+}
+
+// TS.RANGE key from to [COUNT count] [AGGREGATION avg|min|max|sum|count bucketDuration]
+// from and to are timestamps in ms, or "-" and "+" for the oldest and newest samples.
+func TS_RANGE(args string) (string, error) {
+	return tsRangeGeneric(args, "ts.range", false)
+}
+
+// TS.REVRANGE key from to [COUNT count] [AGGREGATION avg|min|max|sum|count bucketDuration]
+func TS_REVRANGE(args string) (string, error) {
+	return tsRangeGeneric(args, "ts.revrange", true)
+}
+
+func tsRangeGeneric(args string, cmd string, reverse bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	spec, err := parseTSRangeArgs(argv[1:], reverse, false)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var result string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		ts, err := lookupTimeSeries(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if ts == nil {
+			return ErrTSKeyMissing
+		}
+		result = tsRangeReply(ts, spec)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return result, nil
+}
+
+// TS.MRANGE from to [COUNT count] [AGGREGATION agg bucketDuration] [WITHLABELS] FILTER filter ...
+// Runs TS.RANGE on every series matching all the filters. Each reply item is
+// [key labels samples], sorted by key; labels are only filled with WITHLABELS.
+func TS_MRANGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 4 {
+		return "NOT_OK", errWrongArgs("ts.mrange")
+	}
+	spec, err := parseTSRangeArgs(argv, false, true)
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var items []string
+	keyDataSpace.View(func(data map[string]DataValue) error {
+		var keys []string
+	series:
+		for key, value := range data {
+			ts, ok := value.(*TimeSeries)
+			if !ok {
+				continue
+			}
+			for _, f := range spec.filters {
+				if !f.match(ts) {
+					continue series
+				}
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			ts := data[key].(*TimeSeries)
+			var labels []string
+			if spec.withLabels {
+				for _, l := range ts.labels {
+					labels = append(labels, arrayReply([]string{l[0], l[1]}))
+				}
+			}
+			items = append(items, arrayReply([]string{key, arrayReply(labels), tsRangeReply(ts, spec)}))
+		}
+		return nil
+	})
+	return arrayReply(items), nil
+}
+
+// TS.CREATERULE sourceKey destKey AGGREGATION avg|min|max|sum|count bucketDuration
+// Downsamples every new sample of sourceKey into destKey. A series can be the
+// destination of a single rule, and compacted series cannot be compacted further.
+func TS_CREATERULE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 5 {
+		return "NOT_OK", errWrongArgs("ts.createrule")
+	}
+	srcKey, destKey := argv[0], argv[1]
+	if strings.ToUpper(argv[2]) != "AGGREGATION" {
+		return "NOT_OK", ErrSyntax
+	}
+	agg, bucket, err := parseTSAggregationArgs(argv[3], argv[4])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if srcKey == destKey {
+		return "NOT_OK", errors.New("TSDB: the source key and destination key should be different")
+	}
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		src, err := lookupTimeSeries(data, srcKey)
+		if err != nil {
+			return err
+		}
+		dest, err := lookupTimeSeries(data, destKey)
+		if err != nil {
+			return err
+		}
+		if src == nil || dest == nil {
+			return ErrTSKeyMissing
+		}
+		if src.src != "" || len(dest.rules) > 0 {
+			return errors.New("TSDB: the source key or destination key is part of another compaction chain")
+		}
+		if dest.src != "" {
+			return errors.New("TSDB: the destination key already has a src rule")
+		}
+		src.rules = append(src.rules, &tsRule{dest: destKey, agg: agg, bucket: bucket})
+		dest.src = srcKey
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
+
+// TS.DELETERULE sourceKey destKey
+func TS_DELETERULE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("ts.deleterule")
+	}
+	srcKey, destKey := argv[0], argv[1]
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		src, err := lookupTimeSeries(data, srcKey)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			return ErrTSKeyMissing
+		}
+		for i, rule := range src.rules {
+			if rule.dest == destKey {
+				src.rules = append(src.rules[:i], src.rules[i+1:]...)
+				if dest, _ := lookupTimeSeries(data, destKey); dest != nil {
+					dest.src = ""
+				}
+				return nil
+			}
+		}
+		return errors.New("TSDB: compaction rule does not exist")
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return "OK", nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Vector set command handlers. Vector sets are *VectorSet values
+// (see vectorSet.go).
+
+// lookupVectorSet returns the vector set stored at key, nil if the key does
+// not exist, or ErrWrongType if the key holds another kind of value.
+func lookupVectorSet(data map[string]DataValue, key string) (*VectorSet, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	vs, ok := value.(*VectorSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return vs, nil
+}
+
+// parseVectorValues parses "VALUES num v1 ... vnum" at the start of argv and
+// returns the vector and the number of arguments consumed.
+func parseVectorValues(argv []string) ([]float32, int, error) {
+	if len(argv) < 2 || strings.ToUpper(argv[0]) != "VALUES" {
+		return nil, 0, ErrSyntax
+	}
+	dim, err := parseIntArg(argv[1])
+	if err != nil || dim < 1 {
+		return nil, 0, errors.New("invalid vector dimension")
+	}
+	if dim > int64(len(argv)-2) {
+		return nil, 0, errors.New("vector has fewer values than its declared dimension")
+	}
+	vec := make([]float32, dim)
+	for i := range vec {
+		f, err := strconv.ParseFloat(argv[2+i], 32)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, 0, errors.New("invalid vector value: " + argv[2+i])
+		}
+		vec[i] = float32(f)
+	}
+	return vec, int(2 + dim), nil
+}
+
+func errVectorDim(got, want int) error {
+	return fmt.Errorf("Vector dimension mismatch - got %d but set has %d", got, want)
+}
+
+// VADD key VALUES num v1 ... vnum element [METRIC COSINE|L2|IP] [M links] [EF build-exploration-factor]
+// Adds element or replaces its vector. METRIC, M and EF only apply when the
+// set is created. Returns 1 if the element is new, 0 if it was updated.
+func VADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 4 {
+		return "NOT_OK", errWrongArgs("vadd")
+	}
+	key := argv[0]
+	vec, n, err := parseVectorValues(argv[1:])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if 1+n >= len(argv) {
+		return "NOT_OK", errWrongArgs("vadd")
+	}
+	element := argv[1+n]
+
+	metric, m, ef := VSET_METRIC_COSINE, int64(VSET_DEFAULT_M), int64(VSET_DEFAULT_EF_CONSTRUCTION)
+	opts := argv[2+n:]
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return "NOT_OK", ErrSyntax
+		}
+		switch strings.ToUpper(opts[i]) {
+		case "METRIC":
+			if metric, err = parseVsetMetric(opts[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+		case "M":
+			if m, err = parseIntArg(opts[i+1]); err != nil || m < 2 || m > 4096 {
+				return "NOT_OK", errors.New("invalid M, must be between 2 and 4096")
+			}
+		case "EF":
+			if ef, err = parseIntArg(opts[i+1]); err != nil || ef < 1 || ef > 1000000 {
+				return "NOT_OK", errors.New("invalid EF, must be between 1 and 1000000")
+			}
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	added := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, key)
+		if err != nil {
+			return err
+		}
+		if vs == nil {
+			vs = NewVectorSet(len(vec), metric, int(m), int(ef))
+			data[key] = vs
+		}
+		if len(vec) != vs.dim {
+			return errVectorDim(len(vec), vs.dim)
+		}
+		added = vs.Add(element, vec)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if added {
+		return intReply(1), nil
+	}
+	return intReply(0), nil
+}
+
+// VREM key element
+// Returns 1 if the element was removed, 0 if it did not exist. The key is
+// deleted with its last element.
+func VREM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("vrem")
+	}
+
+	removed := false
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, argv[0])
+		if err != nil || vs == nil {
+			return err
+		}
+		removed = vs.Remove(argv[1])
+		if vs.Len() == 0 {
+			deleteKeyLocked(data, argv[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if removed {
+		return intReply(1), nil
+	}
+	return intReply(0), nil
+}
+
+// VSIM key (ELE element | VALUES num v1 ... vnum) [WITHSCORES] [COUNT n] [EF search-exploration-factor] [TRUTH]
+// Returns the COUNT (default 10) elements most similar to the query, best
+// first. Sets larger than VSET_BRUTE_FORCE_MAX are searched through the HNSW
+// index; TRUTH forces an exact linear scan.
+func VSIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("vsim")
+	}
+	key := argv[0]
+
+	var query []float32
+	var queryElement string
+	var opts []string
+	if strings.ToUpper(argv[1]) == "ELE" {
+		queryElement = argv[2]
+		opts = argv[3:]
+	} else {
+		vec, n, err := parseVectorValues(argv[1:])
+		if err != nil {
+			return "NOT_OK", err
+		}
+		query = vec
+		opts = argv[1+n:]
+	}
+
+	withScores, exact := false, false
+	count, ef := int64(10), int64(VSET_DEFAULT_EF_SEARCH)
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "TRUTH":
+			exact = true
+		case "COUNT", "EF":
+			if i+1 >= len(opts) {
+				return "NOT_OK", ErrSyntax
+			}
+			n, err := parseIntArg(opts[i+1])
+			if err != nil || n < 1 {
+				return "NOT_OK", errors.New("invalid " + strings.ToUpper(opts[i]) + ", must be a positive integer")
+			}
+			if strings.ToUpper(opts[i]) == "COUNT" {
+				count = n
+			} else {
+				ef = min(n, 1000000)
+			}
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	var results []vsetResult
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, key)
+		if err != nil || vs == nil {
+			return err
+		}
+		if query == nil {
+			vec, ok := vs.Vector(queryElement)
+			if !ok {
+				return errors.New("element not found in set")
+			}
+			query = vec
+		}
+		if len(query) != vs.dim {
+			return errVectorDim(len(query), vs.dim)
+		}
+		results = vs.Search(query, int(min(count, int64(vs.Len()))), int(ef), exact)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	items := make([]string, 0, len(results))
+	for _, r := range results {
+		items = append(items, r.element)
+		if withScores {
+			items = append(items, floatReply(r.score))
+		}
+	}
+	return arrayReply(items), nil
+}
+
+// VCARD key
+func VCARD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("vcard")
+	}
+
+	var card int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, argv[0])
+		if err != nil || vs == nil {
+			return err
+		}
+		card = vs.Len()
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(card)), nil
+}
+
+// VDIM key
+func VDIM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("vdim")
+	}
+
+	var dim int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, argv[0])
+		if err != nil {
+			return err
+		}
+		if vs == nil {
+			return errors.New("key does not exist")
+		}
+		dim = vs.dim
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(dim)), nil
+}
+
+// VEMB key element
+// Returns the vector of element, or (nil) if it does not exist.
+func VEMB(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("vemb")
+	}
+
+	var items []string
+	found := false
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		vs, err := lookupVectorSet(data, argv[0])
+		if err != nil || vs == nil {
+			return err
+		}
+		vec, ok := vs.Vector(argv[1])
+		if !ok {
+			return nil
+		}
+		found = true
+		for _, x := range vec {
+			items = append(items, strconv.FormatFloat(float64(x), 'g', -1, 32))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !found {
+		return NIL_REPLY, nil
+	}
+	return arrayReply(items), nil
+}
@@ -0,0 +1,417 @@
+// File: vectorSet.go
+//
+// Purpose:
+//   Vector set value type for the V* commands: named elements with float32
+//   embeddings, searchable by similarity.
+//
+//   The metric is chosen when the set is created:
+//     COSINE  distance 1 - cos(a, b)     score (1 + cos) / 2, in [0, 1]
+//     L2      squared euclidean distance score: the euclidean distance
+//     IP      distance -dot(a, b)        score: the inner product
+//
+//   Elements are indexed in an HNSW graph (Hierarchical Navigable Small
+//   World, Malkov & Yashunin): every node lives on levels 0..L, with L drawn
+//   from an exponential distribution, and is linked to its closest nodes on
+//   each level (up to M, 2*M on level 0). A search greedily descends from the
+//   entry point on the sparse upper levels, then explores level 0 keeping the
+//   ef best candidates.
+//
+//   Small sets (up to VSET_BRUTE_FORCE_MAX elements) and TRUTH queries are
+//   answered by an exact linear scan instead.
+//
+//   Removing an element unlinks it and reconnects each of its former
+//   neighbours with the removed node's other neighbours, keeping the
+//   closest ones.
+//
+// Asymptotic costs:
+//   - Add:    O(log n) distance computations on average (HNSW)
+//   - Remove: O(n), dangling back references are swept from every node
+//   - Search: O(log n) for HNSW, O(n) for brute force
+//   - DeepCopy: O(n * links), the graph is cloned as it is
+//
+// Concurrency:
+//   - Not goroutine-safe by itself; sets live in the KeyDataSpace and are
+//     only touched under its lock.
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	VSET_DEFAULT_M               = 16
+	VSET_DEFAULT_EF_CONSTRUCTION = 200
+	VSET_DEFAULT_EF_SEARCH       = 100
+	VSET_MAX_LEVEL               = 16
+	VSET_BRUTE_FORCE_MAX         = 1000
+)
+
+type vsetMetric uint8
+
+const (
+	VSET_METRIC_COSINE vsetMetric = iota
+	VSET_METRIC_L2
+	VSET_METRIC_IP
+)
+
+var vsetMetricNames = []string{"COSINE", "L2", "IP"}
+
+func parseVsetMetric(s string) (vsetMetric, error) {
+	for i, name := range vsetMetricNames {
+		if strings.EqualFold(s, name) {
+			return vsetMetric(i), nil
+		}
+	}
+	return 0, errors.New("unknown metric, use COSINE, L2 or IP")
+}
+
+type vsetNode struct {
+	element   string
+	vec       []float32
+	norm      float64
+	neighbors [][]*vsetNode // one list per level
+}
+
+// VectorSet is the vector set value type.
+type VectorSet struct {
+	metric         vsetMetric
+	dim            int
+	m              int
+	efConstruction int
+	nodes          map[string]*vsetNode
+	entry          *vsetNode
+}
+
+// NewVectorSet creates an empty set for vectors of the given dimension.
+func NewVectorSet(dim int, metric vsetMetric, m, efConstruction int) *VectorSet {
+	return &VectorSet{
+		metric:         metric,
+		dim:            dim,
+		m:              m,
+		efConstruction: efConstruction,
+		nodes:          make(map[string]*vsetNode),
+	}
+}
+
+func (vs *VectorSet) Type() ValueType { return VSET_VALUE }
+
+// DeepCopy clones the nodes and relinks their neighbour lists to the
+// clones, in O(nodes * links): rebuilding the graph would cost as much as
+// inserting every vector again.
+func (vs *VectorSet) DeepCopy() DataValue {
+	clone := NewVectorSet(vs.dim, vs.metric, vs.m, vs.efConstruction)
+	clones := make(map[*vsetNode]*vsetNode, len(vs.nodes))
+	for element, n := range vs.nodes {
+		cp := &vsetNode{element: n.element, vec: append([]float32(nil), n.vec...), norm: n.norm}
+		clones[n] = cp
+		clone.nodes[element] = cp
+	}
+	for n, cp := range clones {
+		cp.neighbors = make([][]*vsetNode, len(n.neighbors))
+		for l, level := range n.neighbors {
+			cp.neighbors[l] = make([]*vsetNode, len(level), cap(level))
+			for i, nb := range level {
+				cp.neighbors[l][i] = clones[nb]
+			}
+		}
+	}
+	clone.entry = clones[vs.entry]
+	return clone
+}
+
+// Len returns the number of elements.
+func (vs *VectorSet) Len() int {
+	return len(vs.nodes)
+}
+
+// Vector returns the vector of element.
+func (vs *VectorSet) Vector(element string) ([]float32, bool) {
+	n, ok := vs.nodes[element]
+	if !ok {
+		return nil, false
+	}
+	return n.vec, true
+}
+
+func vsetNorm(v []float32) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	return math.Sqrt(sum)
+}
+
+// distance returns the metric distance between a query and a node: lower is closer.
+func (vs *VectorSet) distance(q []float32, qnorm float64, n *vsetNode) float64 {
+	switch vs.metric {
+	case VSET_METRIC_L2:
+		sum := 0.0
+		for i := range q {
+			d := float64(q[i]) - float64(n.vec[i])
+			sum += d * d
+		}
+		return sum
+	}
+
+	dot := 0.0
+	for i := range q {
+		dot += float64(q[i]) * float64(n.vec[i])
+	}
+	if vs.metric == VSET_METRIC_IP {
+		return -dot
+	}
+	if qnorm == 0 || n.norm == 0 {
+		return 1
+	}
+	return 1 - dot/(qnorm*n.norm)
+}
+
+// score converts a distance into the value reported by VSIM WITHSCORES.
+func (vs *VectorSet) score(distance float64) float64 {
+	switch vs.metric {
+	case VSET_METRIC_L2:
+		return math.Sqrt(distance)
+	case VSET_METRIC_IP:
+		return -distance
+	}
+	return 1 - distance/2
+}
+
+// vsetCandidate is a node with its distance from the query.
+type vsetCandidate struct {
+	node *vsetNode
+	dist float64
+}
+
+// vsetQueue is a heap of candidates: closest first, or farthest first when far is set.
+type vsetQueue struct {
+	items []vsetCandidate
+	far   bool
+}
+
+func (q *vsetQueue) Len() int { return len(q.items) }
+func (q *vsetQueue) Less(i, j int) bool {
+	if q.far {
+		return q.items[i].dist > q.items[j].dist
+	}
+	return q.items[i].dist < q.items[j].dist
+}
+func (q *vsetQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *vsetQueue) Push(x any)    { q.items = append(q.items, x.(vsetCandidate)) }
+func (q *vsetQueue) Pop() any {
+	x := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return x
+}
+
+// searchLayer returns up to ef nodes of the given level closest to q,
+// starting from the entry points, sorted by distance.
+func (vs *VectorSet) searchLayer(q []float32, qnorm float64, entries []vsetCandidate, ef int, level int) []vsetCandidate {
+	visited := make(map[*vsetNode]bool)
+	candidates := &vsetQueue{}
+	results := &vsetQueue{far: true}
+	for _, e := range entries {
+		visited[e.node] = true
+		heap.Push(candidates, e)
+		heap.Push(results, e)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(vsetCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		for _, n := range c.node.neighbors[level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			d := vs.distance(q, qnorm, n)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, vsetCandidate{n, d})
+				heap.Push(results, vsetCandidate{n, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sort.Slice(results.items, func(i, j int) bool { return results.items[i].dist < results.items[j].dist })
+	return results.items
+}
+
+// maxLinks returns how many neighbours a node may have on level.
+func (vs *VectorSet) maxLinks(level int) int {
+	if level == 0 {
+		return 2 * vs.m
+	}
+	return vs.m
+}
+
+// prune keeps the maxLinks closest neighbours of n on level.
+func (vs *VectorSet) prune(n *vsetNode, level int) {
+	links := n.neighbors[level]
+	if len(links) <= vs.maxLinks(level) {
+		return
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return vs.distance(n.vec, n.norm, links[i]) < vs.distance(n.vec, n.norm, links[j])
+	})
+	n.neighbors[level] = links[:vs.maxLinks(level)]
+}
+
+func (vs *VectorSet) randomLevel() int {
+	mL := 1 / math.Log(float64(vs.m))
+	level := int(-math.Log(1-rand.Float64()) * mL)
+	return min(level, VSET_MAX_LEVEL)
+}
+
+// Add inserts element or replaces its vector. Returns true if it is new.
+func (vs *VectorSet) Add(element string, vec []float32) bool {
+	_, exists := vs.nodes[element]
+	if exists {
+		vs.Remove(element)
+	}
+
+	node := &vsetNode{element: element, vec: vec, norm: vsetNorm(vec)}
+	level := vs.randomLevel()
+	node.neighbors = make([][]*vsetNode, level+1)
+	vs.nodes[element] = node
+
+	if vs.entry == nil {
+		vs.entry = node
+		return !exists
+	}
+
+	topLevel := len(vs.entry.neighbors) - 1
+	ep := []vsetCandidate{{vs.entry, vs.distance(vec, node.norm, vs.entry)}}
+	for l := topLevel; l > level; l-- {
+		ep = vs.searchLayer(vec, node.norm, ep, 1, l)[:1]
+	}
+	for l := min(level, topLevel); l >= 0; l-- {
+		found := vs.searchLayer(vec, node.norm, ep, vs.efConstruction, l)
+		for i := 0; i < len(found) && i < vs.m; i++ {
+			n := found[i].node
+			node.neighbors[l] = append(node.neighbors[l], n)
+			n.neighbors[l] = append(n.neighbors[l], node)
+			vs.prune(n, l)
+		}
+		ep = found
+	}
+	if level > topLevel {
+		vs.entry = node
+	}
+	return !exists
+}
+
+// Remove deletes element. Returns true if it was present.
+func (vs *VectorSet) Remove(element string) bool {
+	node, ok := vs.nodes[element]
+	if !ok {
+		return false
+	}
+	delete(vs.nodes, element)
+
+	for l, links := range node.neighbors {
+		for _, n := range links {
+			// Unlink node and offer n the other neighbours of node instead.
+			kept := n.neighbors[l][:0]
+			for _, x := range n.neighbors[l] {
+				if x != node {
+					kept = append(kept, x)
+				}
+			}
+			n.neighbors[l] = kept
+			for _, other := range links {
+				if other != n && !vsetLinked(n, other, l) {
+					n.neighbors[l] = append(n.neighbors[l], other)
+				}
+			}
+			vs.prune(n, l)
+		}
+	}
+	// Links are not always symmetric after pruning: drop remaining back references.
+	for _, n := range vs.nodes {
+		for l := range n.neighbors {
+			if vsetLinked(n, node, l) {
+				kept := n.neighbors[l][:0]
+				for _, x := range n.neighbors[l] {
+					if x != node {
+						kept = append(kept, x)
+					}
+				}
+				n.neighbors[l] = kept
+			}
+		}
+	}
+
+	if vs.entry == node {
+		vs.entry = nil
+		for _, n := range vs.nodes {
+			if vs.entry == nil || len(n.neighbors) > len(vs.entry.neighbors) {
+				vs.entry = n
+			}
+		}
+	}
+	return true
+}
+
+func vsetLinked(n, other *vsetNode, level int) bool {
+	for _, x := range n.neighbors[level] {
+		if x == other {
+			return true
+		}
+	}
+	return false
+}
+
+// vsetResult is an element returned by Search with its score.
+type vsetResult struct {
+	element string
+	score   float64
+}
+
+// Search returns the count elements most similar to q, best first. exact
+// forces a linear scan; ef is the HNSW exploration factor.
+func (vs *VectorSet) Search(q []float32, count int, ef int, exact bool) []vsetResult {
+	if vs.entry == nil {
+		return nil
+	}
+	qnorm := vsetNorm(q)
+
+	var found []vsetCandidate
+	if exact || len(vs.nodes) <= VSET_BRUTE_FORCE_MAX {
+		found = make([]vsetCandidate, 0, len(vs.nodes))
+		for _, n := range vs.nodes {
+			found = append(found, vsetCandidate{n, vs.distance(q, qnorm, n)})
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].dist != found[j].dist {
+				return found[i].dist < found[j].dist
+			}
+			return found[i].node.element < found[j].node.element
+		})
+	} else {
+		ep := []vsetCandidate{{vs.entry, vs.distance(q, qnorm, vs.entry)}}
+		for l := len(vs.entry.neighbors) - 1; l > 0; l-- {
+			ep = vs.searchLayer(q, qnorm, ep, 1, l)[:1]
+		}
+		found = vs.searchLayer(q, qnorm, ep, max(ef, count), 0)
+	}
+
+	if len(found) > count {
+		found = found[:count]
+	}
+	results := make([]vsetResult, len(found))
+	for i, c := range found {
+		results[i] = vsetResult{c.node.element, vs.score(c.dist)}
+	}
+	return results
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Sorted set command handlers. All of them operate on *SortedSet values through
+// KeyDataSpace.Update / KeyDataSpace.View so that every command is atomic.
+
+// lookupSortedSet returns the sorted set stored at key, nil if the key does not
+// exist, or ErrWrongType if the key holds another kind of value.
+func lookupSortedSet(data map[string]DataValue, key string) (*SortedSet, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	zset, ok := value.(*SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return zset, nil
+}
+
+// parseScoreBound parses a ZRANGE/ZCOUNT score bound: "1.5", "(1.5", "-inf", "+inf".
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := false
+	if strings.HasPrefix(s, "(") {
+		exclusive = true
+		s = s[1:]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false, errors.New("min or max is not a float")
+	}
+	return f, exclusive, nil
+}
+
+func parseScoreRange(minStr, maxStr string) (*scoreRange, error) {
+	var r scoreRange
+	var err error
+	if r.min, r.minex, err = parseScoreBound(minStr); err != nil {
+		return nil, err
+	}
+	if r.max, r.maxex, err = parseScoreBound(maxStr); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// parseLexRange parses BYLEX bounds: "[a" (inclusive), "(a" (exclusive), "-" and "+".
+func parseLexRange(minStr, maxStr string) (*lexRange, error) {
+	errLex := errors.New("min or max not valid string range item")
+	var r lexRange
+
+	switch {
+	case minStr == "-":
+		r.minInf = true
+	case minStr == "+":
+		r.minPInf = true
+	case strings.HasPrefix(minStr, "["):
+		r.min = minStr[1:]
+	case strings.HasPrefix(minStr, "("):
+		r.min, r.minex = minStr[1:], true
+	default:
+		return nil, errLex
+	}
+
+	switch {
+	case maxStr == "+":
+		r.maxInf = true
+	case maxStr == "-":
+		r.maxNInf = true
+	case strings.HasPrefix(maxStr, "["):
+		r.max = maxStr[1:]
+	case strings.HasPrefix(maxStr, "("):
+		r.max, r.maxex = maxStr[1:], true
+	default:
+		return nil, errLex
+	}
+	return &r, nil
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func ZADD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("zadd")
+	}
+	key := argv[0]
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+flags:
+	for ; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := argv[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return "NOT_OK", ErrSyntax
+	}
+	if nx && xx {
+		return "NOT_OK", errors.New("XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || ((gt || lt) && nx) {
+		return "NOT_OK", errors.New("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return "NOT_OK", errors.New("INCR option supports a single increment-element pair")
+	}
+
+	// Parse every score before touching the keyspace: ZADD is all or nothing.
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		if scores[j], err = parseFloatArg(pairs[2*j]); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var added, updated int64
+	var incrResult float64
+	incrApplied := false
+
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, key)
+		if err != nil {
+			return err
+		}
+		if zset == nil {
+			if xx {
+				return nil
+			}
+			zset = NewSortedSet()
+		}
+
+		for j, score := range scores {
+			member := pairs[2*j+1]
+			cur, exists := zset.Score(member)
+
+			if exists {
+				if nx {
+					continue
+				}
+				newScore := score
+				if incr {
+					newScore = cur + score
+					if math.IsNaN(newScore) {
+						return errors.New("resulting score is not a number (NaN)")
+					}
+				}
+				if (gt && newScore <= cur) || (lt && newScore >= cur) {
+					continue
+				}
+				if newScore != cur {
+					zset.Add(newScore, member)
+					updated++
+				}
+				incrResult, incrApplied = newScore, true
+			} else {
+				if xx {
+					continue
+				}
+				zset.Add(score, member)
+				added++
+				incrResult, incrApplied = score, true
+			}
+		}
+
+		if zset.Len() > 0 {
+			data[key] = zset
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if added > 0 || updated > 0 {
+		keyReadyNotifier.Signal(key)
+	}
+
+	if incr {
+		if !incrApplied {
+			return NIL_REPLY, nil
+		}
+		return floatReply(incrResult), nil
+	}
+	if ch {
+		return intReply(added + updated), nil
+	}
+	return intReply(added), nil
+}
+
+// ZINCRBY key increment member
+func ZINCRBY(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("zincrby")
+	}
+	key, member := argv[0], argv[2]
+	incr, err := parseFloatArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var newScore float64
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, key)
+		if err != nil {
+			return err
+		}
+		if zset == nil {
+			zset = NewSortedSet()
+		}
+		cur, _ := zset.Score(member)
+		newScore = cur + incr
+		if math.IsNaN(newScore) {
+			return errors.New("resulting score is not a number (NaN)")
+		}
+		zset.Add(newScore, member)
+		data[key] = zset
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	keyReadyNotifier.Signal(key)
+	return floatReply(newScore), nil
+}
+
+// ZREM key member [member ...]
+func ZREM(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs("zrem")
+	}
+	key := argv[0]
+
+	var removed int64
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		for _, member := range argv[1:] {
+			if zset.Remove(member) {
+				removed++
+			}
+		}
+		if zset.Len() == 0 {
+			deleteKeyLocked(data, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(removed), nil
+}
+
+// ZCARD key
+func ZCARD(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 {
+		return "NOT_OK", errWrongArgs("zcard")
+	}
+
+	var card int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		card = zset.Len()
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(card)), nil
+}
+
+// ZSCORE key member
+func ZSCORE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 {
+		return "NOT_OK", errWrongArgs("zscore")
+	}
+
+	res := NIL_REPLY
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		if score, ok := zset.Score(argv[1]); ok {
+			res = floatReply(score)
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// ZRANK key member [WITHSCORE]
+func ZRANK(args string) (string, error) {
+	return zrankGeneric(args, "zrank", false)
+}
+
+// ZREVRANK key member [WITHSCORE]
+func ZREVRANK(args string) (string, error) {
+	return zrankGeneric(args, "zrevrank", true)
+}
+
+func zrankGeneric(args string, cmd string, reverse bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 2 && len(argv) != 3 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	withScore := false
+	if len(argv) == 3 {
+		if !strings.EqualFold(argv[2], "WITHSCORE") {
+			return "NOT_OK", ErrSyntax
+		}
+		withScore = true
+	}
+
+	res := NIL_REPLY
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		rank, ok := zset.Rank(argv[1], reverse)
+		if !ok {
+			return nil
+		}
+		if withScore {
+			score, _ := zset.Score(argv[1])
+			res = arrayReply([]string{intReply(int64(rank)), floatReply(score)})
+		} else {
+			res = intReply(int64(rank))
+		}
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return res, nil
+}
+
+// ZCOUNT key min max
+func ZCOUNT(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 3 {
+		return "NOT_OK", errWrongArgs("zcount")
+	}
+	r, err := parseScoreRange(argv[1], argv[2])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	var count int
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		count = zset.CountInScoreRange(r)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return intReply(int64(count)), nil
+}
+
+// zrangeSpec describes a parsed ZRANGE request.
+type zrangeSpec struct {
+	byScore, byLex bool
+	reverse        bool
+	withScores     bool
+	start, stop    int64 // rank range (when neither byScore nor byLex)
+	scores         *scoreRange
+	lex            *lexRange
+	offset, count  int64 // LIMIT; count < 0 means "all"
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func ZRANGE(args string) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs("zrange")
+	}
+	spec := zrangeSpec{count: -1}
+	hasLimit := false
+
+	for i := 3; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "BYSCORE":
+			spec.byScore = true
+		case "BYLEX":
+			spec.byLex = true
+		case "REV":
+			spec.reverse = true
+		case "WITHSCORES":
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			if spec.offset, err = parseIntArg(argv[i+1]); err != nil {
+				return "NOT_OK", err
+			}
+			if spec.count, err = parseIntArg(argv[i+2]); err != nil {
+				return "NOT_OK", err
+			}
+			hasLimit = true
+			i += 2
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	if spec.byScore && spec.byLex {
+		return "NOT_OK", ErrSyntax
+	}
+	if hasLimit && !spec.byScore && !spec.byLex {
+		return "NOT_OK", errors.New("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.withScores && spec.byLex {
+		return "NOT_OK", errors.New("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// With REV the score/lex bounds are given as max, min.
+	minArg, maxArg := argv[1], argv[2]
+	if spec.reverse && (spec.byScore || spec.byLex) {
+		minArg, maxArg = maxArg, minArg
+	}
+	switch {
+	case spec.byScore:
+		if spec.scores, err = parseScoreRange(minArg, maxArg); err != nil {
+			return "NOT_OK", err
+		}
+	case spec.byLex:
+		if spec.lex, err = parseLexRange(minArg, maxArg); err != nil {
+			return "NOT_OK", err
+		}
+	default:
+		if spec.start, err = parseIntArg(argv[1]); err != nil {
+			return "NOT_OK", err
+		}
+		if spec.stop, err = parseIntArg(argv[2]); err != nil {
+			return "NOT_OK", err
+		}
+	}
+
+	var items []string
+	err = keyDataSpace.View(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		items = zrangeGeneric(zset, &spec)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// zrangeGeneric collects the members selected by spec, followed by their
+// scores when spec.withScores is set.
+func zrangeGeneric(zset *SortedSet, spec *zrangeSpec) []string {
+	zsl := zset.zsl
+	items := make([]string, 0)
+	emit := func(x *skipListNode) {
+		items = append(items, x.member)
+		if spec.withScores {
+			items = append(items, floatReply(x.score))
+		}
+	}
+	next := func(x *skipListNode) *skipListNode {
+		if spec.reverse {
+			return x.backward
+		}
+		return x.level[0].forward
+	}
+
+	if !spec.byScore && !spec.byLex {
+		length := int64(zsl.length)
+		start, stop := spec.start, spec.stop
+		if start < 0 {
+			start += length
+		}
+		if stop < 0 {
+			stop += length
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > stop || start >= length {
+			return items
+		}
+		if stop >= length {
+			stop = length - 1
+		}
+
+		var x *skipListNode
+		if spec.reverse {
+			x = zsl.ByRank(int(length - start))
+		} else {
+			x = zsl.ByRank(int(start + 1))
+		}
+		for n := stop - start + 1; n > 0 && x != nil; n-- {
+			emit(x)
+			x = next(x)
+		}
+		return items
+	}
+
+	if spec.offset < 0 {
+		return items
+	}
+
+	// Position on the first node of the range, then walk it honouring LIMIT.
+	var x *skipListNode
+	var inRange func(x *skipListNode) bool
+	if spec.byScore {
+		if spec.reverse {
+			x = zsl.LastInScoreRange(spec.scores)
+			inRange = func(x *skipListNode) bool { return spec.scores.gteMin(x.score) }
+		} else {
+			x = zsl.FirstInScoreRange(spec.scores)
+			inRange = func(x *skipListNode) bool { return spec.scores.lteMax(x.score) }
+		}
+	} else {
+		if spec.reverse {
+			x = zsl.LastInLexRange(spec.lex)
+			inRange = func(x *skipListNode) bool { return spec.lex.gteMin(x.member) }
+		} else {
+			x = zsl.FirstInLexRange(spec.lex)
+			inRange = func(x *skipListNode) bool { return spec.lex.lteMax(x.member) }
+		}
+	}
+
+	for offset := spec.offset; x != nil && offset > 0; offset-- {
+		x = next(x)
+	}
+	for count := spec.count; x != nil && count != 0 && inRange(x); count-- {
+		emit(x)
+		x = next(x)
+	}
+	return items
+}
+
+// ZPOPMIN key [count]
+func ZPOPMIN(args string) (string, error) {
+	return zpopGeneric(args, "zpopmin", false)
+}
+
+// ZPOPMAX key [count]
+func ZPOPMAX(args string) (string, error) {
+	return zpopGeneric(args, "zpopmax", true)
+}
+
+func zpopGeneric(args string, cmd string, max bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) != 1 && len(argv) != 2 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	var count int64 = 1
+	if len(argv) == 2 {
+		if count, err = parseIntArg(argv[1]); err != nil {
+			return "NOT_OK", err
+		}
+		if count < 0 {
+			return "NOT_OK", errors.New("value is out of range, must be positive")
+		}
+	}
+
+	items := make([]string, 0)
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		zset, err := lookupSortedSet(data, argv[0])
+		if err != nil || zset == nil {
+			return err
+		}
+		items = zpopLocked(data, argv[0], zset, count, max)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	return arrayReply(items), nil
+}
+
+// zpopLocked pops up to count members from the low (or high) end of zset and
+// returns them as member, score pairs. The key is deleted once the set is empty.
+// Must be called inside KeyDataSpace.Update.
+func zpopLocked(data map[string]DataValue, key string, zset *SortedSet, count int64, max bool) []string {
+	items := make([]string, 0)
+	for ; count > 0 && zset.Len() > 0; count-- {
+		var x *skipListNode
+		if max {
+			x = zset.zsl.Last()
+		} else {
+			x = zset.zsl.First()
+		}
+		member, score := x.member, x.score
+		zset.Remove(member)
+		items = append(items, member, floatReply(score))
+	}
+	if zset.Len() == 0 {
+		deleteKeyLocked(data, key)
+	}
+	return items
+}
+
+// BZPOPMIN key [key ...] timeout
+func BZPOPMIN(args string) (string, error) {
+	return bzpopGeneric(args, "bzpopmin", false)
+}
+
+// BZPOPMAX key [key ...] timeout
+func BZPOPMAX(args string) (string, error) {
+	return bzpopGeneric(args, "bzpopmax", true)
+}
+
+// bzpopGeneric pops from the first non-empty sorted set among keys, blocking
+// until one becomes available or the timeout elapses.
+// Replies with [key member score], or NIL_REPLY on timeout.
+func bzpopGeneric(args string, cmd string, max bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 2 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	keys := argv[:len(argv)-1]
+	timeout, err := parseTimeoutArg(argv[len(argv)-1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	res, done, err := blockUntilReady(keys, timeout, func() (string, bool, error) {
+		var res string
+		err := keyDataSpace.Update(func(data map[string]DataValue) error {
+			for _, key := range keys {
+				zset, err := lookupSortedSet(data, key)
+				if err != nil {
+					return err
+				}
+				if zset == nil {
+					continue
+				}
+				popped := zpopLocked(data, key, zset, 1, max)
+				res = arrayReply(append([]string{key}, popped...))
+				return nil
+			}
+			return nil
+		})
+		return res, res != "", err
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if !done {
+		return NIL_REPLY, nil
+	}
+	return res, nil
+}
+
+// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func ZUNIONSTORE(args string) (string, error) {
+	return zsetStoreGeneric(args, "zunionstore", false)
+}
+
+// ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func ZINTERSTORE(args string) (string, error) {
+	return zsetStoreGeneric(args, "zinterstore", true)
+}
+
+// zsetAggregate combines two weighted scores as selected by AGGREGATE.
+func zsetAggregate(mode string, acc, score float64) float64 {
+	switch mode {
+	case "MIN":
+		return math.Min(acc, score)
+	case "MAX":
+		return math.Max(acc, score)
+	default:
+		sum := acc + score
+		if math.IsNaN(sum) { // +inf + -inf
+			return 0
+		}
+		return sum
+	}
+}
+
+func zsetStoreGeneric(args string, cmd string, inter bool) (string, error) {
+	argv, err := splitArgs(args)
+	if err != nil {
+		return "NOT_OK", errors.New("command parsing error: " + err.Error())
+	}
+	if len(argv) < 3 {
+		return "NOT_OK", errWrongArgs(cmd)
+	}
+	dest := argv[0]
+	numKeys, err := parseIntArg(argv[1])
+	if err != nil {
+		return "NOT_OK", err
+	}
+	if numKeys < 1 {
+		return "NOT_OK", errors.New("at least 1 input key is needed for '" + cmd + "' command")
+	}
+	if numKeys > int64(len(argv)-2) {
+		return "NOT_OK", ErrSyntax
+	}
+	keys := argv[2 : 2+numKeys]
+
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	for i := 2 + int(numKeys); i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "WEIGHTS":
+			if i+int(numKeys) >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			for j := range weights {
+				if weights[j], err = strconv.ParseFloat(argv[i+1+j], 64); err != nil || math.IsNaN(weights[j]) {
+					return "NOT_OK", errors.New("weight value is not a float")
+				}
+			}
+			i += int(numKeys)
+		case "AGGREGATE":
+			if i+1 >= len(argv) {
+				return "NOT_OK", ErrSyntax
+			}
+			aggregate = strings.ToUpper(argv[i+1])
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return "NOT_OK", ErrSyntax
+			}
+			i++
+		default:
+			return "NOT_OK", ErrSyntax
+		}
+	}
+
+	var card int
+	err = keyDataSpace.Update(func(data map[string]DataValue) error {
+		sets := make([]*SortedSet, numKeys)
+		for i, key := range keys {
+			zset, err := lookupSortedSet(data, key)
+			if err != nil {
+				return err
+			}
+			sets[i] = zset
+		}
+
+		// weighted multiplies a score by its weight; inf * 0 is taken as 0.
+		weighted := func(score float64, i int) float64 {
+			v := score * weights[i]
+			if math.IsNaN(v) {
+				return 0
+			}
+			return v
+		}
+
+		result := make(map[string]float64)
+		if inter {
+			for _, zset := range sets {
+				if zset == nil {
+					sets = nil // any missing key makes the intersection empty
+					break
+				}
+			}
+			if sets != nil {
+				for member, score := range sets[0].dict {
+					acc := weighted(score, 0)
+					inAll := true
+					for i := 1; i < len(sets); i++ {
+						other, ok := sets[i].dict[member]
+						if !ok {
+							inAll = false
+							break
+						}
+						acc = zsetAggregate(aggregate, acc, weighted(other, i))
+					}
+					if inAll {
+						result[member] = acc
+					}
+				}
+			}
+		} else {
+			for i, zset := range sets {
+				if zset == nil {
+					continue
+				}
+				for member, score := range zset.dict {
+					if acc, ok := result[member]; ok {
+						result[member] = zsetAggregate(aggregate, acc, weighted(score, i))
+					} else {
+						result[member] = weighted(score, i)
+					}
+				}
+			}
+		}
+
+		// The destination is overwritten, losing any previous expiration.
+		deleteKeyLocked(data, dest)
+		if len(result) > 0 {
+			out := NewSortedSet()
+			for member, score := range result {
+				out.Add(score, member)
+			}
+			data[dest] = out
+		}
+		card = len(result)
+		return nil
+	})
+	if err != nil {
+		return "NOT_OK", err
+	}
+
+	if card > 0 {
+		keyReadyNotifier.Signal(dest)
+	}
+	return intReply(int64(card)), nil
+}